@@ -0,0 +1,174 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// JSON endpoints for SPA and mobile clients.
+// Login still sets the "u" cookie so the rest of the site works the same.
+//
+// Errors are JSONError bodies with one of these stable codes:
+//   bad_request     unparseable or incomplete request
+//   bad_credentials unknown username or wrong password
+//   second_factor_required  password was good, now send a totp code
+//   bad_second_factor       wrong or reused second factor code
+//   throttled       too many failures, wait retry_after seconds
+//   locked          account locked after many failures, wait retry_after seconds
+//   disabled        the account is disabled
+//   vetoed          refused by an OnLogin or OnUserCreatedTx hook
+//   not_logged_in   no valid login on the request
+//   missing_scope   api key doesn't grant what was asked for
+//   internal        server side failure
+
+type jsonLoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// Second factor code, if the user has one.
+	// Without it such a user gets second_factor_required and a
+	// "u2" cookie for SecondFactorHandler.
+	TOTP string `json:"totp,omitempty"`
+}
+
+type UserInfoEmail struct {
+	Email     string `json:"email"`
+	Validated bool   `json:"validated"`
+	Added     int64  `json:"added,omitempty"`
+}
+
+type UserInfoService struct {
+	Service string `json:"service"`
+	Id      string `json:"id"`
+}
+
+// Public view of a User for "who am I" responses.
+// Never includes password or other secrets.
+type UserInfo struct {
+	Guid        int64             `json:"guid"`
+	Username    string            `json:"username,omitempty"`
+	DisplayName string            `json:"display_name"`
+	Emails      []UserInfoEmail   `json:"emails"`
+	Services    []UserInfoService `json:"services"`
+}
+
+func NewUserInfo(u *User) UserInfo {
+	ui := UserInfo{
+		Guid:        u.Guid,
+		Username:    u.Username,
+		DisplayName: u.BestDisplayName(),
+		Emails:      make([]UserInfoEmail, len(u.Email)),
+		Services:    make([]UserInfoService, len(u.Social)),
+	}
+	for i, em := range u.Email {
+		ui.Emails[i] = UserInfoEmail{em.Email, em.Validated, em.Added}
+	}
+	for i, so := range u.Social {
+		ui.Services[i] = UserInfoService{so.Service, so.Id}
+	}
+	return ui
+}
+
+// Map a login error to http status and stable JSON error code
+func loginErrorCode(err error) (status int, code string) {
+	switch {
+	case errors.Is(err, BadUserError):
+		return http.StatusUnauthorized, "bad_credentials"
+	case errors.Is(err, ErrSecondFactorRequired):
+		return http.StatusUnauthorized, "second_factor_required"
+	case errors.Is(err, ErrBadSecondFactor):
+		return http.StatusUnauthorized, "bad_second_factor"
+	case errors.Is(err, ErrUserDisabled):
+		return http.StatusForbidden, "disabled"
+	case errors.Is(err, ErrVetoed):
+		return http.StatusForbidden, "vetoed"
+	case errors.Is(err, ErrThrottled):
+		var te *ThrottledError
+		if errors.As(err, &te) && te.Locked {
+			return http.StatusTooManyRequests, "locked"
+		}
+		return http.StatusTooManyRequests, "throttled"
+	default:
+		return http.StatusInternalServerError, "internal"
+	}
+}
+
+// JSON error response for err from a login check
+func writeLoginError(out http.ResponseWriter, err error, fields FieldErrors) {
+	status, code := loginErrorCode(err)
+	if status == http.StatusInternalServerError {
+		log.Print("login err ", err)
+	}
+	writeJSON(out, status, JSONError{
+		Code:       code,
+		Message:    err.Error(),
+		Fields:     fields,
+		RetryAfter: setRetryAfter(out, err),
+	})
+}
+
+// POST {"username":"", "password":""}
+// Responds with UserInfo and sets the "u" cookie.
+type JSONLoginHandler struct {
+	Udb UserDB
+}
+
+func (lh *JSONLoginHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, lh.Udb)
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "POST only", nil)
+		return
+	}
+	var lr jsonLoginRequest
+	err := json.NewDecoder(request.Body).Decode(&lr)
+	if err != nil || len(lr.Username) == 0 {
+		writeJSONError(out, http.StatusBadRequest, "bad_request", "need username and password", nil)
+		return
+	}
+	user, err := localLogin(request, udb, lr.Username, lr.Password, lr.TOTP)
+	if user != nil {
+		err = loginCookies(out, user, err)
+	}
+	if err != nil {
+		writeLoginError(out, err, nil)
+		return
+	}
+	writeJSON(out, http.StatusOK, NewUserInfo(user))
+}
+
+// GET current user's UserInfo, or 401 not_logged_in, or 403 disabled
+type JSONMeHandler struct {
+	Udb UserDB
+}
+
+func (mh *JSONMeHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, mh.Udb)
+	user, err := requestGetUser(request, udb)
+	if errors.Is(err, ErrUserDisabled) {
+		writeLoginError(out, err, nil)
+		return
+	}
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("json me err ", err)
+	}
+	if user == nil {
+		writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "not logged in", nil)
+		return
+	}
+	writeJSON(out, http.StatusOK, NewUserInfo(user))
+}
+
+// POST to clear the "u" cookie. Responds {"ok":true}
+func JSONLogoutHandler(out http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "POST only", nil)
+		return
+	}
+	recordLogout(request)
+	clearLoginCookie(out)
+	writeJSON(out, http.StatusOK, map[string]bool{"ok": true})
+}
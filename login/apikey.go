@@ -0,0 +1,83 @@
+package login
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/brianolson/login/login/sql"
+)
+
+type ctxKey int
+
+const (
+	userCtxKey ctxKey = iota
+	scopesCtxKey
+)
+
+// User put into request context by APIKeyMiddleware, or nil
+func UserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userCtxKey).(*User)
+	return u
+}
+
+// Scopes of the API key that authenticated the request, or nil
+func ScopesFromContext(ctx context.Context) []string {
+	s, _ := ctx.Value(scopesCtxKey).([]string)
+	return s
+}
+
+func HasScope(ctx context.Context, scope string) bool {
+	for _, s := range ScopesFromContext(ctx) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate "Authorization: Bearer lk_..." personal API keys.
+// On success the owning user and the key's scopes are in the request
+// context, see UserFromContext and ScopesFromContext.
+// Requests without an API key pass through untouched; a bad key gets 401.
+func APIKeyMiddleware(udb UserDB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		key := bearerToken(request)
+		if !sql.IsAPIKey(key) {
+			next.ServeHTTP(out, request)
+			return
+		}
+		udb := requestUserDB(request, udb)
+		user, ak, err := udb.GetAPIKeyUser(key)
+		if err != nil {
+			if !errors.Is(err, BadUserError) {
+				log.Print("api key lookup ", err)
+				writeJSONError(out, http.StatusInternalServerError, "internal", "error checking api key", nil)
+				return
+			}
+			writeJSONError(out, http.StatusUnauthorized, "bad_credentials", "bad api key", nil)
+			return
+		}
+		err = checkDisabled(udb, user)
+		if err != nil {
+			writeLoginError(out, err, nil)
+			return
+		}
+		ctx := context.WithValue(request.Context(), userCtxKey, user)
+		ctx = context.WithValue(ctx, scopesCtxKey, ak.Scopes)
+		next.ServeHTTP(out, request.WithContext(ctx))
+	})
+}
+
+// Respond 403 unless the request's API key has scope.
+// Goes inside APIKeyMiddleware.
+func RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		if !HasScope(request.Context(), scope) {
+			writeJSONError(out, http.StatusForbidden, "missing_scope", "api key lacks scope "+scope, nil)
+			return
+		}
+		next.ServeHTTP(out, request)
+	})
+}
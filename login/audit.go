@@ -0,0 +1,136 @@
+package login
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Logins, failures and logouts are recorded in the UserDB auth event
+// log by the handlers in this package. The UserDB records password,
+// email and social login changes itself, without the client's IP.
+
+// LogoutHandler and JSONLogoutHandler record logouts and run its
+// OnLogout hooks here if set.
+var LogoutUdb UserDB
+
+// Record an auth event for the client of request. Errors are logged,
+// the log is not worth failing a login over.
+func RecordAuthEvent(udb UserDB, request *http.Request, guid int64, etype, method, detail string) {
+	ev := &AuthEvent{
+		Time:      time.Now().Unix(),
+		Guid:      guid,
+		Type:      etype,
+		Method:    method,
+		IP:        requestIP(request),
+		UserAgent: truncate(request.UserAgent(), 300),
+		Detail:    truncate(detail, 300),
+	}
+	err := udb.LogAuthEvent(ev)
+	if err != nil {
+		log.Print("auth event log ", err)
+	}
+}
+
+// Credentials are good. Check the user isn't disabled, run OnLogin
+// hooks, which may veto, and record the result.
+func loginSucceeded(udb UserDB, request *http.Request, user *User, method string) error {
+	err := checkDisabled(udb, user)
+	if err == nil {
+		err = udb.Hooks().FireLogin(user, method)
+	}
+	if err != nil {
+		recordLoginFailure(udb, request, user.Guid, method, err.Error(), err)
+		return err
+	}
+	RecordAuthEvent(udb, request, user.Guid, EventLoginSuccess, method, "")
+	return nil
+}
+
+// Record a login failure and run OnLoginFailed hooks.
+// Throttled attempts are noted in the detail.
+func recordLoginFailure(udb UserDB, request *http.Request, guid int64, method, detail string, err error) {
+	udb.Hooks().FireLoginFailed(guid, method, detail, err)
+	if errors.Is(err, ErrThrottled) {
+		detail = "throttled " + detail
+	}
+	RecordAuthEvent(udb, request, guid, EventLoginFailure, method, detail)
+}
+
+// Same client address as LoginThrottle uses
+func requestIP(request *http.Request) string {
+	if LoginThrottle != nil {
+		return LoginThrottle.clientIP(request)
+	}
+	return remoteHost(request)
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// Record and run OnLogout hooks
+func recordLogout(request *http.Request) {
+	uid := cookieGuid(request)
+	if uid == 0 || LogoutUdb == nil {
+		return
+	}
+	LogoutUdb.Hooks().FireLogout(uid)
+	RecordAuthEvent(requestUserDB(request, LogoutUdb), request, uid, EventLogout, "", "")
+}
+
+type AuthEventInfo struct {
+	Time      int64  `json:"time"`
+	Type      string `json:"type"`
+	Method    string `json:"method,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+const defaultAuthEventLimit = 50
+
+// GET the logged in user's recent auth events, newest first.
+// Optional query params: since (unix time), limit (default 50, max 500).
+type AuthEventsHandler struct {
+	Udb UserDB
+}
+
+func (ah *AuthEventsHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, ah.Udb)
+	if request.Method != http.MethodGet {
+		out.Header().Set("Allow", http.MethodGet)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "GET only", nil)
+		return
+	}
+	user, err := requestGetUser(request, udb)
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("auth events user ", err)
+	}
+	if user == nil {
+		writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "not logged in", nil)
+		return
+	}
+	since, _ := strconv.ParseInt(request.FormValue("since"), 10, 64)
+	limit, _ := strconv.Atoi(request.FormValue("limit"))
+	if limit <= 0 {
+		limit = defaultAuthEventLimit
+	} else if limit > 500 {
+		limit = 500
+	}
+	events, err := udb.GetAuthEvents(user.Guid, since, 0, limit)
+	if err != nil {
+		log.Print("auth events ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error reading events", nil)
+		return
+	}
+	infos := make([]AuthEventInfo, len(events))
+	for i, ev := range events {
+		infos[i] = AuthEventInfo{ev.Time, ev.Type, ev.Method, ev.IP, ev.UserAgent}
+	}
+	writeJSON(out, http.StatusOK, infos)
+}
@@ -41,6 +41,8 @@ func GenerateCookieKey() []byte {
 
 var ErrKeyWrongLength = errors.New("key not 16 bytes")
 
+var ErrBadCookie = errors.New("bad login cookie")
+
 func SetCookieKey(key []byte) error {
 	if len(key) != CookieKeyByteLen {
 		return ErrKeyWrongLength
@@ -101,7 +103,10 @@ func MakeLoginCookie(uid int64) (string, error) {
 }
 
 func EncryptBytesToB64(rpad []byte) (string, error) {
-	key := getkey()
+	return encryptToB64(getkey(), rpad)
+}
+
+func encryptToB64(key, rpad []byte) (string, error) {
 	ac, err := aes.NewCipher(key)
 	bs := ac.BlockSize()
 	ciphertext := make([]byte, bs+len(rpad))
@@ -120,7 +125,10 @@ func EncryptBytesToB64(rpad []byte) (string, error) {
 }
 
 func B64Decrypt(ucookie string) ([]byte, error) {
-	key := getkey()
+	return b64Decrypt(getkey(), ucookie)
+}
+
+func b64Decrypt(key []byte, ucookie string) ([]byte, error) {
 	defer func() {
 		if failed := recover(); failed != nil {
 			log.Printf("panic parsing user cookie: %v", failed)
@@ -134,6 +142,9 @@ func B64Decrypt(ucookie string) ([]byte, error) {
 		log.Printf("cookie base64 decode fails %#v %s", ucookie, err)
 		return nil, err
 	}
+	if len(ciphertext) < bs {
+		return nil, ErrBadCookie
+	}
 	initialValue := ciphertext[:bs]
 	ct := ciphertext[bs:]
 	//log.Printf("parseUserCookie %d base64 into %d bytes, %d iv %v ct", len(ucookie), len(ciphertext), len(initialValue), len(ct))
@@ -142,23 +153,69 @@ func B64Decrypt(ucookie string) ([]byte, error) {
 	return ct, nil
 }
 
-func parseUserCookie(ucookie string) (*LoginCookieStruct, error) {
+// cborIntLen returns the encoded length of the CBOR integer starting
+// with b, or 0 if b does not start an integer.
+func cborIntLen(b byte) int {
+	if b>>5 > 1 {
+		return 0
+	}
+	switch aux := b & 0x1f; {
+	case aux < 24:
+		return 1
+	case aux == 24:
+		return 2
+	case aux == 25:
+		return 3
+	case aux == 26:
+		return 5
+	case aux == 27:
+		return 9
+	}
+	return 0
+}
+
+// cookieShape checks that b is exactly what MakeLoginCookie encodes,
+// {"t": int, "u": int}, before cbor gets to allocate on junk lengths.
+func cookieShape(b []byte) bool {
+	if len(b) < 5 || b[0] != 0xa2 || b[1] != 0x61 || b[2] != 't' {
+		return false
+	}
+	i := 3 + cborIntLen(b[3])
+	if i == 3 || i+3 > len(b) || b[i] != 0x61 || b[i+1] != 'u' {
+		return false
+	}
+	n := cborIntLen(b[i+2])
+	return n != 0 && i+2+n == len(b)
+}
+
+func parseUserCookie(ucookie string) (cs *LoginCookieStruct, err error) {
 	defer func() {
 		if failed := recover(); failed != nil {
 			log.Printf("panic parsing user cookie: %v", failed)
+			cs, err = nil, ErrBadCookie
 		}
 	}()
 
 	ct, err := B64Decrypt(ucookie)
+	if err != nil {
+		return nil, err
+	}
+	if len(ct) <= randomPadLength || !cookieShape(ct[randomPadLength:]) {
+		return nil, ErrBadCookie
+	}
 	//log.Printf("ct %#v", ct)
-	cs := LoginCookieStruct{}
-	err = cbor.Loads(ct[randomPadLength:], &cs)
+	cs = &LoginCookieStruct{}
+	err = cbor.Loads(ct[randomPadLength:], cs)
 	//log.Printf("cs %#v", cs)
 	if err != nil {
 		log.Printf("cbor loads err: %s", err)
 		return nil, err
 	}
-	return &cs, nil
+	// MakeLoginCookie always sets both, anything else decrypted to junk
+	if cs.Time == 0 || cs.Guid == 0 {
+		return nil, ErrBadCookie
+	}
+	return cs, nil
 }
 
 func ParseLogin(ucookie string) (int64, error) {
@@ -168,7 +225,7 @@ func ParseLogin(ucookie string) (int64, error) {
 		return 0, err
 	}
 	if cs == nil {
-		return 0, err
+		return 0, ErrBadCookie
 	}
 	// TODO: reject cookies older than [2 weeks?]
 	// TODO: reject cookies for a user older than a password change or other log-me-out-everywhere event
@@ -2,6 +2,7 @@ package crypto
 
 import cbor "github.com/brianolson/cbor_go"
 
+import "strings"
 import "testing"
 import "time"
 
@@ -52,3 +53,115 @@ func TestNonce(t *testing.T) {
 		t.Errorf("time drift %v %v", now, then)
 	}
 }
+
+func TestBearerToken(t *testing.T) {
+	cookieKey = testAesKey
+	var uid int64 = 4321
+	tok, err := MakeBearerToken(uid, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid, err := ParseBearerToken(tok)
+	if err != nil {
+		t.Error(err)
+	}
+	if guid != uid {
+		t.Errorf("uid mismatch want %#v got %#v", uid, guid)
+	}
+
+	// flip a bit in the encrypted part
+	bad := []byte(tok)
+	if bad[30] == 'A' {
+		bad[30] = 'B'
+	} else {
+		bad[30] = 'A'
+	}
+	_, err = ParseBearerToken(string(bad))
+	if err != ErrBadToken {
+		t.Errorf("tampered token want ErrBadToken got %v", err)
+	}
+
+	tok, err = MakeBearerToken(uid, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseBearerToken(tok)
+	if err != ErrTokenExpired {
+		t.Errorf("old token want ErrTokenExpired got %v", err)
+	}
+}
+
+func TestTokenIsNotLoginCookie(t *testing.T) {
+	cookieKey = testAesKey
+	var uid int64 = 42
+	makers := map[string]func() (string, error){
+		"bearer":         func() (string, error) { return MakeBearerToken(uid, time.Hour) },
+		"expired bearer": func() (string, error) { return MakeBearerToken(uid, -time.Hour) },
+		"second factor":  func() (string, error) { return MakeSecondFactorPendingToken(uid) },
+		"challenge":      func() (string, error) { return MakeChallenge("webauthn.get", uid) },
+	}
+	for name, make := range makers {
+		// the body is random under the cookie key, try a few
+		for i := 0; i < 100; i++ {
+			tok, err := make()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, part := range []string{tok, strings.Split(tok, ".")[0]} {
+				guid, err := ParseLogin(part)
+				if err == nil {
+					t.Fatalf("%s token %q parsed as login cookie for %d", name, part, guid)
+				}
+			}
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	vectors := []struct {
+		t    int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, v := range vectors {
+		code := TOTPCode(secret, time.Unix(v.t, 0))
+		if code != v.code {
+			t.Errorf("TOTP at %d want %s got %s", v.t, v.code, code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	prev := TOTPCode(secret, now.Add(-TOTPPeriod*time.Second))
+	step, ok := CheckTOTP(secret, prev, now)
+	if !ok || step != TOTPStep(now)-1 {
+		t.Errorf("previous step code not accepted %v %d", ok, step)
+	}
+	old := TOTPCode(secret, now.Add(-3*TOTPPeriod*time.Second))
+	_, ok = CheckTOTP(secret, old, now)
+	if ok {
+		t.Error("old code accepted")
+	}
+}
+
+func TestSealSecret(t *testing.T) {
+	cookieKey = testAesKey
+	sealed, err := SealSecret([]byte("shh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := OpenSecret(sealed)
+	if err != nil || string(plain) != "shh" {
+		t.Errorf("open got %#v %v", plain, err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	_, err = OpenSecret(sealed)
+	if err == nil {
+		t.Error("tampered secret opened")
+	}
+}
@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// Seal small secrets (e.g. TOTP keys) for storage in the database.
+// AES-GCM with a key derived from the cookie key, so SetCookieKey() must
+// be given the same key across restarts or sealed secrets are lost.
+
+var ErrSealedTooShort = errors.New("sealed data too short")
+
+func sealAEAD() (cipher.AEAD, error) {
+	ac, err := aes.NewCipher(deriveKey("login secret seal"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(ac)
+}
+
+func SealSecret(plain []byte) ([]byte, error) {
+	aead, err := sealAEAD()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func OpenSecret(sealed []byte) ([]byte, error) {
+	aead, err := sealAEAD()
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(sealed) < ns {
+		return nil, ErrSealedTooShort
+	}
+	return aead.Open(nil, sealed[:ns], sealed[ns:], nil)
+}
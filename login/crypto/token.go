@@ -0,0 +1,152 @@
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+)
+
+// Bearer tokens are for clients that can't manage cookies (CLI, mobile).
+// They are encrypted like login cookies but under a key derived for
+// tokens, so no token (or its body without the MAC) is ever a login
+// cookie, and additionally carry an expiration time, a kind, and an HMAC.
+
+var ErrBadToken = errors.New("bad bearer token")
+var ErrTokenExpired = errors.New("bearer token expired")
+
+type BearerTokenStruct struct {
+	Time    int64  `cbor:"t"`
+	Guid    int64  `cbor:"u"`
+	Expires int64  `cbor:"e"`
+	Kind    string `cbor:"k"`
+}
+
+// Kinds of signed token. A token of one kind is never accepted as another.
+const (
+	bearerKind       = "b"
+	secondFactorKind = "2"
+)
+
+const SecondFactorTTL = 5 * time.Minute
+
+// Keys for other purposes are derived from the cookie key so there's
+// still only one secret to manage.
+func deriveKey(label string) []byte {
+	h := sha256.New()
+	h.Write([]byte(label))
+	h.Write([]byte{0})
+	h.Write(getkey())
+	return h.Sum(nil)
+}
+
+// AES key for token bodies, never the cookie key
+func tokenKey() []byte {
+	return deriveKey("login bearer token enc")[:CookieKeyByteLen]
+}
+
+func tokenMac(body string) string {
+	mac := hmac.New(sha256.New, deriveKey("login bearer token mac"))
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Make a token good for ttl from now
+func MakeBearerToken(uid int64, ttl time.Duration) (string, error) {
+	return makeToken(bearerKind, uid, ttl)
+}
+
+// Returns the guid in a valid unexpired token
+func ParseBearerToken(token string) (int64, error) {
+	return parseToken(bearerKind, token)
+}
+
+// Token for a user who has passed their first login factor but not yet
+// their second. Good for SecondFactorTTL.
+func MakeSecondFactorPendingToken(uid int64) (string, error) {
+	return makeToken(secondFactorKind, uid, SecondFactorTTL)
+}
+
+func ParseSecondFactorPendingToken(token string) (int64, error) {
+	return parseToken(secondFactorKind, token)
+}
+
+// Challenge for a WebAuthn (or similar) ceremony, bound to purpose and
+// a user (0 for a not-yet-identified user). Good for SecondFactorTTL.
+// Stateless: the server checks it by signature, not by remembering it.
+func MakeChallenge(purpose string, uid int64) (string, error) {
+	return makeToken("c:"+purpose, uid, SecondFactorTTL)
+}
+
+func ParseChallenge(purpose string, challenge string) (int64, error) {
+	return parseToken("c:"+purpose, challenge)
+}
+
+func makeToken(kind string, uid int64, ttl time.Duration) (string, error) {
+	now := time.Now()
+	rpad := make([]byte, randomPadLength)
+	_, err := io.ReadFull(rand.Reader, rpad)
+	if err != nil {
+		return "", err
+	}
+	ts := BearerTokenStruct{
+		Time:    now.Unix(),
+		Guid:    uid,
+		Expires: now.Add(ttl).Unix(),
+		Kind:    kind,
+	}
+	tsbytes, err := cbor.Dumps(ts)
+	if err != nil {
+		return "", err
+	}
+	body, err := encryptToB64(tokenKey(), append(rpad, tsbytes...))
+	if err != nil {
+		return "", err
+	}
+	// StdEncoding has '+' and '/' which are fine in a header; '.' is not in the alphabet
+	return body + "." + tokenMac(body), nil
+}
+
+func decodeToken(token string) (*BearerTokenStruct, error) {
+	dot := strings.LastIndexByte(token, '.')
+	if dot < 0 {
+		return nil, ErrBadToken
+	}
+	body := token[:dot]
+	if !hmac.Equal([]byte(token[dot+1:]), []byte(tokenMac(body))) {
+		return nil, ErrBadToken
+	}
+	ct, err := b64Decrypt(tokenKey(), body)
+	if err != nil {
+		return nil, err
+	}
+	if len(ct) <= randomPadLength {
+		return nil, ErrBadToken
+	}
+	var ts BearerTokenStruct
+	err = cbor.Loads(ct[randomPadLength:], &ts)
+	if err != nil {
+		return nil, err
+	}
+	return &ts, nil
+}
+
+func parseToken(kind string, token string) (int64, error) {
+	ts, err := decodeToken(token)
+	if err != nil {
+		return 0, err
+	}
+	if ts.Kind != kind {
+		return 0, ErrBadToken
+	}
+	if time.Now().Unix() >= ts.Expires {
+		return 0, ErrTokenExpired
+	}
+	return ts.Guid, nil
+}
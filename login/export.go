@@ -0,0 +1,43 @@
+package login
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// GET the logged in user's UserExport as a JSON file download.
+// Disabled users can still export, the data is theirs.
+type ExportHandler struct {
+	Udb UserDB
+}
+
+func (eh *ExportHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, eh.Udb)
+	if request.Method != http.MethodGet {
+		out.Header().Set("Allow", http.MethodGet)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "GET only", nil)
+		return
+	}
+	user, err := requestGetUser(request, udb)
+	if errors.Is(err, ErrUserDisabled) {
+		user, err = udb.GetUser(requestGuid(request))
+	}
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("export user ", err)
+	}
+	if user == nil {
+		writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "not logged in", nil)
+		return
+	}
+	ex, err := udb.ExportUser(user.Guid)
+	if err != nil {
+		log.Print("export ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error exporting user", nil)
+		return
+	}
+	out.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"user-%d.json\"", user.Guid))
+	out.Header().Set("Cache-Control", "no-store")
+	writeJSON(out, http.StatusOK, ex)
+}
@@ -0,0 +1,122 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// POST feedback from the logged in user as JSON {"text":"..."} or form
+// field text. Each user may send PerUser messages per Window.
+type FeedbackHandler struct {
+	Udb UserDB
+
+	// characters, 0 for 5000
+	MaxLength int
+
+	// 0 for 5 per hour
+	PerUser int
+	Window  time.Duration
+}
+
+const (
+	defaultFeedbackMaxLength = 5000
+	defaultFeedbackPerUser   = 5
+	defaultFeedbackWindow    = time.Hour
+)
+
+type feedbackRequest struct {
+	Text string `json:"text"`
+}
+
+func (fh *FeedbackHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, fh.Udb)
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "POST only", nil)
+		return
+	}
+	user, err := requestGetUser(request, udb)
+	if err != nil && !errors.Is(err, BadUserError) && !errors.Is(err, ErrUserDisabled) {
+		log.Print("feedback user ", err)
+	}
+	if user == nil {
+		writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "not logged in", nil)
+		return
+	}
+	maxLength := fh.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultFeedbackMaxLength
+	}
+	// utf-8 is at most 4 bytes per character, plus JSON escaping
+	request.Body = http.MaxBytesReader(out, request.Body, int64(maxLength)*8+1024)
+	var fr feedbackRequest
+	if isJSONRequest(request) {
+		err = json.NewDecoder(request.Body).Decode(&fr)
+		if err != nil {
+			writeJSONError(out, http.StatusBadRequest, "bad_request", "could not parse JSON body", nil)
+			return
+		}
+	} else {
+		err = request.ParseForm()
+		if err != nil {
+			writeJSONError(out, http.StatusBadRequest, "bad_request", "bad form", nil)
+			return
+		}
+		fr.Text = request.PostForm.Get("text")
+	}
+	text := strings.TrimSpace(fr.Text)
+	tlen := utf8.RuneCountInString(text)
+	if tlen == 0 {
+		writeJSONError(out, http.StatusBadRequest, "invalid_fields", "feedback rejected", FieldErrors{"text": "text is required"})
+		return
+	} else if tlen > maxLength {
+		writeJSONError(out, http.StatusBadRequest, "invalid_fields", "feedback rejected", FieldErrors{"text": "text is too long"})
+		return
+	}
+
+	retry, err := fh.store(udb, user, time.Now(), text)
+	if err != nil {
+		log.Print("feedback ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error saving feedback", nil)
+		return
+	}
+	if retry > 0 {
+		out.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+		writeJSON(out, http.StatusTooManyRequests, JSONError{Code: "throttled", Message: "too much feedback, try again later", RetryAfter: retry})
+		return
+	}
+	writeJSON(out, http.StatusOK, map[string]bool{"ok": true})
+}
+
+// Store text unless user is over the limit. Returns seconds until user
+// may send feedback again, 0 if it was stored. UserDB.LimitedFeedback
+// counts what's already stored, so the limit holds across servers.
+func (fh *FeedbackHandler) store(udb UserDB, user *User, now time.Time, text string) (int64, error) {
+	perUser := fh.PerUser
+	if perUser <= 0 {
+		perUser = defaultFeedbackPerUser
+	}
+	window := fh.Window
+	if window <= 0 {
+		window = defaultFeedbackWindow
+	}
+	nowms := now.UnixNano() / int64(time.Millisecond)
+	windowms := int64(window / time.Millisecond)
+	stored, oldest, err := udb.LimitedFeedback(user, nowms, text, nowms-windowms, perUser)
+	if err != nil || stored {
+		return 0, err
+	}
+	// wait for the oldest of the last perUser to leave the window
+	untilms := oldest + windowms
+	retry := (untilms - nowms + 999) / 1000
+	if retry < 1 {
+		retry = 1
+	}
+	return retry, nil
+}
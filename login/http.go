@@ -1,8 +1,13 @@
 package login
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"strings"
 
 	"github.com/brianolson/login/login/crypto"
 )
@@ -21,7 +26,89 @@ func cookieGetUser(request *http.Request, udb UserDB) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
-	return udb.GetUser(uid)
+	return getEnabledUser(udb, uid)
+}
+
+// GetUser, or ErrUserDisabled
+func getEnabledUser(udb UserDB, uid int64) (*User, error) {
+	user, err := udb.GetUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	err = checkDisabled(udb, user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// nil, or ErrUserDisabled wrapped with the reason
+func checkDisabled(udb UserDB, user *User) error {
+	disabled, reason, err := udb.GetDisabled(user)
+	if err != nil {
+		return err
+	}
+	if disabled {
+		return fmt.Errorf("%w: %s", ErrUserDisabled, reason)
+	}
+	return nil
+}
+
+// guid from the "u" cookie without a db lookup, 0 if none or bad
+func cookieGuid(request *http.Request) int64 {
+	cx, err := request.Cookie("u")
+	if err != nil {
+		return 0
+	}
+	uid, err := crypto.ParseLogin(cx.Value)
+	if err != nil {
+		return 0
+	}
+	return uid
+}
+
+// guid from the "u" cookie, else the bearer token, without a db
+// lookup. 0 if neither is good.
+func requestGuid(request *http.Request) int64 {
+	uid := cookieGuid(request)
+	if uid != 0 {
+		return uid
+	}
+	uid, err := crypto.ParseBearerToken(bearerToken(request))
+	if err != nil {
+		return 0
+	}
+	return uid
+}
+
+// Returns the token from "Authorization: Bearer <token>" or ""
+func bearerToken(request *http.Request) string {
+	auth := request.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func bearerGetUser(request *http.Request, udb UserDB) (*User, error) {
+	token := bearerToken(request)
+	if token == "" {
+		return nil, nil
+	}
+	uid, err := crypto.ParseBearerToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return getEnabledUser(udb, uid)
+}
+
+// Cookie or bearer token, whichever is present
+func requestGetUser(request *http.Request, udb UserDB) (*User, error) {
+	user, err := cookieGetUser(request, udb)
+	if user != nil || errors.Is(err, ErrUserDisabled) {
+		return user, err
+	}
+	return bearerGetUser(request, udb)
 }
 
 func formGetUser(out http.ResponseWriter, request *http.Request, udb UserDB) (*User, error) {
@@ -37,6 +124,57 @@ func formGetUser(out http.ResponseWriter, request *http.Request, udb UserDB) (*U
 	}
 	password := request.Form.Get("password")
 
+	dbuser, err := localLogin(request, udb, username, password, request.Form.Get("totp"))
+	if dbuser == nil {
+		return nil, err
+	}
+	err = loginCookies(out, dbuser, err)
+	if err == ErrSecondFactorRequired {
+		return nil, err
+	}
+	if err != nil {
+		log.Print(err)
+	}
+	return dbuser, nil
+}
+
+// Username, password and second factor code (if needed) with LoginThrottle.
+// Shared by form, JSON and token login so they fail the same way.
+// Returns the user with ErrSecondFactorRequired if code was needed but
+// empty; the user is nil for all other errors.
+func localLogin(request *http.Request, udb UserDB, username, password, code string) (*User, error) {
+	var dbuser *User
+	err := throttled(request, username, func() error {
+		var err error
+		dbuser, err = passwordLogin(udb, username, password)
+		if err != nil {
+			return err
+		}
+		return loginSecondFactor(udb, dbuser, code)
+	})
+	if err == nil {
+		err = loginSucceeded(udb, request, dbuser, "password")
+		if err != nil {
+			return nil, err
+		}
+	} else if err != ErrSecondFactorRequired {
+		if errors.Is(err, BadUserError) || errors.Is(err, ErrBadSecondFactor) || errors.Is(err, ErrThrottled) || errors.Is(err, ErrUserDisabled) {
+			var guid int64
+			if dbuser != nil {
+				guid = dbuser.Guid
+			}
+			recordLoginFailure(udb, request, guid, "password", username, err)
+		}
+		return nil, err
+	}
+	return dbuser, err
+}
+
+// Check local username and password.
+// On a wrong password or disabled user the user is returned with the
+// error so the failure can be logged against them; don't treat it as
+// logged in.
+func passwordLogin(udb UserDB, username, password string) (*User, error) {
 	dbuser, err := udb.GetLocalUser(username)
 	if err != nil {
 		return nil, err
@@ -44,43 +182,104 @@ func formGetUser(out http.ResponseWriter, request *http.Request, udb UserDB) (*U
 	if dbuser == nil {
 		return nil, BadUserError
 	}
-	if dbuser.GoodPassword(password) {
-		xuc, err := crypto.MakeLoginCookie(dbuser.Guid)
-		if err == nil {
-			ucookie := MakeHttpCookie(xuc)
-			//log.Print("Set Cookie (form login) ", ucookie.String())
-			http.SetCookie(out, ucookie)
-		} else {
-			log.Print(err)
-		}
-		return dbuser, nil
-	} else {
+	if !dbuser.GoodPassword(password) {
 		//log.Printf("bad pass, wanted '%s' got '%s'", dbuser.Password, password)
-		return nil, BadUserError
+		return dbuser, BadUserError
+	}
+	err = checkDisabled(udb, dbuser)
+	if err != nil {
+		return dbuser, err
 	}
+	return dbuser, nil
 }
 
-// Checkes request for cookier or form login.
+// Checkes request for cookie, bearer token, or form login.
 // May set cookie in response if form login is successful.
+// Returns ErrSecondFactorRequired if the password was good but the user
+// must still POST a code to SecondFactorHandler, a *ThrottledError
+// if LoginThrottle says to wait, or ErrUserDisabled.
 func GetHttpUser(out http.ResponseWriter, request *http.Request, udb UserDB) (*User, error) {
-	user, err := cookieGetUser(request, udb)
-	if user != nil {
+	udb = requestUserDB(request, udb)
+	user, err := requestGetUser(request, udb)
+	if user != nil || errors.Is(err, ErrUserDisabled) {
 		return user, err
 	}
 	user, err = formGetUser(out, request, udb)
 	return user, err
 }
 
+// udb bound to request.Context(), so a client hanging up cancels its queries
+func requestUserDB(request *http.Request, udb UserDB) UserDB {
+	return BindUserDB(request.Context(), ContextUserDB(udb))
+}
+
+// Set the "u" login cookie for user on the response
+func setLoginCookie(out http.ResponseWriter, user *User) error {
+	xuc, err := crypto.MakeLoginCookie(user.Guid)
+	if err != nil {
+		return err
+	}
+	ucookie := MakeHttpCookie(xuc)
+	//log.Print("Set Cookie (form login) ", ucookie.String())
+	http.SetCookie(out, ucookie)
+	return nil
+}
+
+// Redirect after login to the "r" cookie destination if set, else home
+func loginRedirect(out http.ResponseWriter, request *http.Request, home string) {
+	redirCookie, err := request.Cookie("r")
+	if err == nil && redirCookie != nil && (len(redirCookie.Value) > 0) {
+		http.SetCookie(out, &http.Cookie{Name: "r", MaxAge: -1})
+		http.Redirect(out, request, redirCookie.Value, 303)
+		return
+	}
+	http.Redirect(out, request, home, 303)
+}
+
+func isJSONRequest(request *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return ct == "application/json"
+}
+
+func writeJSON(out http.ResponseWriter, code int, v interface{}) {
+	out.Header().Set("Content-Type", "application/json")
+	out.WriteHeader(code)
+	err := json.NewEncoder(out).Encode(v)
+	if err != nil {
+		log.Print("json response encode ", err)
+	}
+}
+
+// Body of all JSON error responses.
+// Code is stable for clients to switch on, Message is for humans.
+type JSONError struct {
+	Code    string      `json:"error"`
+	Message string      `json:"message,omitempty"`
+	Fields  FieldErrors `json:"fields,omitempty"`
+
+	// seconds, with throttled and locked errors
+	RetryAfter int64 `json:"retry_after,omitempty"`
+}
+
+func writeJSONError(out http.ResponseWriter, status int, code, message string, fields FieldErrors) {
+	writeJSON(out, status, JSONError{Code: code, Message: message, Fields: fields})
+}
+
 func MakeHttpCookie(xuc string) *http.Cookie {
 	return &http.Cookie{Name: "u", Value: xuc, MaxAge: 14 * 24 * 3600, Path: "/"}
 }
 
+func clearLoginCookie(out http.ResponseWriter) {
+	xcookie := &http.Cookie{Name: "u", MaxAge: -1, Path: "/"}
+	//log.Print("LOGOUT Cookie ", xcookie.String())
+	http.SetCookie(out, xcookie)
+}
+
 // Clear cookie. Redirect to /
 func LogoutHandler(out http.ResponseWriter, request *http.Request) {
 	// TODO: require nonce
 	// TODO: configurable redirect destination
-	xcookie := &http.Cookie{Name: "u", MaxAge: -1}
-	//log.Print("LOGOUT Cookie ", xcookie.String())
-	http.SetCookie(out, xcookie)
+	recordLogout(request)
+	clearLoginCookie(out)
 	http.Redirect(out, request, "/", 303)
 }
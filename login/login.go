@@ -9,11 +9,66 @@ type UserDB = sql.UserDB
 type User = sql.User
 type UserSocial = sql.UserSocial
 type EmailRecord = sql.EmailRecord
+type APIKey = sql.APIKey
+type TOTPRecord = sql.TOTPRecord
+type WebAuthnCredential = sql.WebAuthnCredential
+type AuthEvent = sql.AuthEvent
+type FeedbackRecord = sql.FeedbackRecord
+type UserExport = sql.UserExport
+type UserQuery = sql.UserQuery
+type UserSort = sql.UserSort
+type DisabledFilter = sql.DisabledFilter
+type HookRegistry = sql.HookRegistry
+type VetoError = sql.VetoError
+
+const (
+	SortByGuid     = sql.SortByGuid
+	SortByUsername = sql.SortByUsername
+	SortByCreated  = sql.SortByCreated
+
+	DisabledAny  = sql.DisabledAny
+	DisabledOnly = sql.DisabledOnly
+	EnabledOnly  = sql.EnabledOnly
+)
+
+const (
+	EventLoginSuccess    = sql.EventLoginSuccess
+	EventLoginFailure    = sql.EventLoginFailure
+	EventLogout          = sql.EventLogout
+	EventPasswordChanged = sql.EventPasswordChanged
+	EventEmailAdded      = sql.EventEmailAdded
+	EventEmailDeleted    = sql.EventEmailDeleted
+	EventSocialLinked    = sql.EventSocialLinked
+)
 
 var NewEmail = sql.NewEmail
+var NormalizeEmail = sql.NormalizeEmail
+
+type EmailNormalization = sql.EmailNormalization
 
 var BadUserError = sql.BadUserError
+var ErrUsernameTaken = sql.ErrUsernameTaken
+var ErrSocialTaken = sql.ErrSocialTaken
+var ErrEmailTaken = sql.ErrEmailTaken
+var ErrVetoed = sql.ErrVetoed
+var ErrUserDisabled = sql.ErrUserDisabled
+var ErrBadCursor = sql.ErrBadCursor
 var NewSqlUserDB = sql.NewSqlUserDB
 
+type UserDBContext = sql.UserDBContext
+
+var NewSqlUserDBContext = sql.NewSqlUserDBContext
+var ContextUserDB = sql.ContextUserDB
+var BindUserDB = sql.BindUserDB
+var BackgroundUserDB = sql.BackgroundUserDB
+
+type MemoryUserDB = sql.MemoryUserDB
+
+var NewMemoryUserDB = sql.NewMemoryUserDB
+
+type CachedUserDB = sql.CachedUserDB
+
+var NewCachedUserDB = sql.NewCachedUserDB
+
 var GenerateCookieKey = crypto.GenerateCookieKey
 var SetCookieKey = crypto.SetCookieKey
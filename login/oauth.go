@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -37,6 +38,10 @@ type OauthCallbackHandler struct {
 	Udb       sql.UserDB
 	HomePath  string
 	ErrorPath string
+
+	// Where to send users who must enter a second factor code.
+	// That page should POST to a SecondFactorHandler.
+	SecondFactorPath string
 }
 
 // local path which this Handler should register for
@@ -66,7 +71,8 @@ func (cb *OauthCallbackHandler) ServeHTTP(out http.ResponseWriter, request *http
 		http.Error(out, "err", 400)
 		return
 	}
-	tok, err := cb.Config.Exchange(oauth.NoContext, request.FormValue("code"))
+	udb := requestUserDB(request, cb.Udb)
+	tok, err := cb.Config.Exchange(request.Context(), request.FormValue("code"))
 	if err != nil {
 		log.Print("oauth callback exchange ", err)
 	}
@@ -78,7 +84,7 @@ func (cb *OauthCallbackHandler) ServeHTTP(out http.ResponseWriter, request *http
 	if cb.Name == "google" {
 		id_tokenp := tok.Extra("id_token")
 		if id_tokenp != nil {
-			if cb.maybeDecodeExtraToken(out, request, id_tokenp) {
+			if cb.maybeDecodeExtraToken(out, request, udb, id_tokenp) {
 				// was handled. done.
 				return
 			}
@@ -86,7 +92,7 @@ func (cb *OauthCallbackHandler) ServeHTTP(out http.ResponseWriter, request *http
 		log.Print("google without id_token")
 	} else if cb.Name == "facebook" {
 		// TODO: make this asynchronous? return logged in immediately and fill in extra data into user profile later?
-		if cb.facebookGetMoreInfo(out, request, cb.Udb, tok) {
+		if cb.facebookGetMoreInfo(out, request, udb, tok) {
 			return
 		}
 	}
@@ -96,7 +102,7 @@ func (cb *OauthCallbackHandler) ServeHTTP(out http.ResponseWriter, request *http
 	http.Redirect(out, request, cb.ErrorPath, 303)
 }
 
-func (cb *OauthCallbackHandler) maybeDecodeExtraToken(out http.ResponseWriter, request *http.Request, id_tokenp interface{}) (done bool) {
+func (cb *OauthCallbackHandler) maybeDecodeExtraToken(out http.ResponseWriter, request *http.Request, udb UserDB, id_tokenp interface{}) (done bool) {
 	id_token, ok := id_tokenp.(string)
 	if !ok {
 		return false
@@ -116,31 +122,21 @@ func (cb *OauthCallbackHandler) maybeDecodeExtraToken(out http.ResponseWriter, r
 		log.Print("decoding google id token got nil tsoc")
 		return false
 	}
-	xu, err := cb.Udb.GetSocialUser(tsocuser.Service, tsocuser.Id)
+	xu, err := udb.GetSocialUser(tsocuser.Service, tsocuser.Id)
 	if xu == nil {
 		log.Printf("creating db user for social %s:%s", tsocuser.Service, tsocuser.Id)
 		xu = &User{}
 		xu.Social = make([]UserSocial, 1)
 		xu.Social[0] = *tsocuser
-		xu, err = cb.Udb.PutNewUser(xu)
+		xu, err = udb.PutNewUser(xu)
 	}
 	if (err == nil) && (xu != nil) {
-		xuc, err := crypto.MakeLoginCookie(xu.Guid)
-		if err != nil {
-			log.Printf("error making cookie: %s", err)
-			http.Error(out, "error logging in 110", 500)
-			return true
-		}
-		ucookie := MakeHttpCookie(xuc)
-		//log.Print("Set Cookie (social login) ", ucookie.String())
-		http.SetCookie(out, ucookie)
-		redirCookie, err := request.Cookie("r")
-		if err == nil && redirCookie != nil && (len(redirCookie.Value) > 0) {
-			http.SetCookie(out, &http.Cookie{Name: "r", MaxAge: -1})
-			http.Redirect(out, request, redirCookie.Value, 303)
-			return true
-		}
-		http.Redirect(out, request, cb.HomePath, 303)
+		cb.finishLogin(out, request, udb, xu)
+		return true
+	}
+	if errors.Is(err, ErrVetoed) {
+		log.Print("social login ", err)
+		http.Redirect(out, request, cb.ErrorPath, 303)
 		return true
 	}
 	if err != nil {
@@ -152,6 +148,39 @@ func (cb *OauthCallbackHandler) maybeDecodeExtraToken(out http.ResponseWriter, r
 	return false
 }
 
+// Social login succeeded for xu. Set cookie and redirect.
+// Users with a second factor are sent to SecondFactorPath instead.
+func (cb *OauthCallbackHandler) finishLogin(out http.ResponseWriter, request *http.Request, udb UserDB, xu *User) {
+	err := checkDisabled(udb, xu)
+	if err == nil {
+		err = loginSecondFactor(udb, xu, "")
+	}
+	if err == nil {
+		err = loginSucceeded(udb, request, xu, cb.Name)
+	}
+	err = loginCookies(out, xu, err)
+	if errors.Is(err, ErrVetoed) || errors.Is(err, ErrUserDisabled) {
+		log.Printf("social login %d: %s", xu.Guid, err)
+		http.Redirect(out, request, cb.ErrorPath, 303)
+		return
+	}
+	if err == ErrSecondFactorRequired {
+		if cb.SecondFactorPath == "" {
+			log.Print("social login needs second factor but no SecondFactorPath set")
+			http.Redirect(out, request, cb.ErrorPath, 303)
+			return
+		}
+		http.Redirect(out, request, cb.SecondFactorPath, 303)
+		return
+	}
+	if err != nil {
+		log.Printf("error making cookie: %s", err)
+		http.Error(out, "error logging in 110", 500)
+		return
+	}
+	loginRedirect(out, request, cb.HomePath)
+}
+
 /*
 // expected data in facebookGetMoreInfo below
 type FbInfo struct {
@@ -179,7 +208,7 @@ func dgets(d map[string]interface{}, k string) string {
 }
 
 func (cb *OauthCallbackHandler) facebookGetMoreInfo(out http.ResponseWriter, request *http.Request, udb UserDB, tok *oauth.Token) bool {
-	client := cb.Config.Client(oauth.NoContext, tok)
+	client := cb.Config.Client(request.Context(), tok)
 	resp, err := client.Get("https://graph.facebook.com/v2.6/me?fields=email,name,id,gender,timezone")
 	if err != nil {
 		log.Print("failed getting fb me ", err)
@@ -200,7 +229,7 @@ func (cb *OauthCallbackHandler) facebookGetMoreInfo(out http.ResponseWriter, req
 		Data:    info,
 	}
 
-	xu, err := cb.Udb.GetSocialUser(tsoc.Service, tsoc.Id)
+	xu, err := udb.GetSocialUser(tsoc.Service, tsoc.Id)
 	if xu == nil {
 		log.Printf("creating db social user %s:%s", tsoc.Service, tsoc.Id)
 		xu = &User{}
@@ -215,25 +244,15 @@ func (cb *OauthCallbackHandler) facebookGetMoreInfo(out http.ResponseWriter, req
 		if len(name) > 0 {
 			xu.DisplayName = name
 		}
-		xu, err = cb.Udb.PutNewUser(xu)
+		xu, err = udb.PutNewUser(xu)
 	}
 	if (err == nil) && (xu != nil) {
-		xuc, err := crypto.MakeLoginCookie(xu.Guid)
-		if err != nil {
-			log.Printf("error making cookie: %s", err)
-			http.Error(out, "error logging in 110", 500)
-			return true
-		}
-		ucookie := MakeHttpCookie(xuc)
-		log.Print("Set Cookie (social login) ", ucookie.String())
-		http.SetCookie(out, ucookie)
-		redirCookie, err := request.Cookie("r")
-		if err == nil && redirCookie != nil {
-			http.SetCookie(out, &http.Cookie{Name: "r", MaxAge: -1})
-			http.Redirect(out, request, redirCookie.Value, 303)
-			return true
-		}
-		http.Redirect(out, request, cb.HomePath, 303)
+		cb.finishLogin(out, request, udb, xu)
+		return true
+	}
+	if errors.Is(err, ErrVetoed) {
+		log.Print("facebook login ", err)
+		http.Redirect(out, request, cb.ErrorPath, 303)
 		return true
 	}
 	if err != nil {
@@ -253,11 +272,21 @@ func (cb *OauthCallbackHandler) String() string {
 // e.g.
 // {"google":{"ClientID":"123-ABC.apps.googleusercontent.com", "ClientSecret":"12345", "Scopes": ["openid", "email"], "Endpoint":{"AuthURL":"https://accounts.google.com/o/oauth2/auth", "TokenURL":"https://accounts.google.com/o/oauth2/token"}, "RedirectURL":"https://myapp.com/login/google/callback"}}
 //
+// secondFactorPath is the OauthCallbackHandler.SecondFactorPath for all
+// of them, users with a second factor can't log in socially without it.
+//
 // See ParseConfigJSON
-func BuildOauthMods(configs map[string]OauthConfig, udb UserDB, homePath string, errPath string) ([]*OauthCallbackHandler, error) {
+func BuildOauthMods(configs map[string]OauthConfig, udb UserDB, homePath, errPath, secondFactorPath string) ([]*OauthCallbackHandler, error) {
 	authmods := make([]*OauthCallbackHandler, 0)
 	for serviceName, conf := range configs {
-		cb := &OauthCallbackHandler{serviceName, conf, udb, homePath, errPath}
+		cb := &OauthCallbackHandler{
+			Name:             serviceName,
+			Config:           conf,
+			Udb:              udb,
+			HomePath:         homePath,
+			ErrorPath:        errPath,
+			SecondFactorPath: secondFactorPath,
+		}
 		authmods = append(authmods, cb)
 	}
 	for _, cb := range authmods {
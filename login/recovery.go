@@ -0,0 +1,168 @@
+package login
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// One-time recovery codes for users who lose their second factor device.
+// A set is generated when a user first enrolls a second factor and can be
+// regenerated at any time, which invalidates the old set.
+
+const RecoveryCodeCount = 10
+
+const recoveryCodeBytes = 5 // 8 base32 chars
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Users type these in, be forgiving about case, spaces and dashes
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	code = strings.Replace(code, "-", "", -1)
+	code = strings.Replace(code, " ", "", -1)
+	return code
+}
+
+// Make and store a new set of recovery codes for user, replacing any
+// old ones. Returns the codes to show the user, this is the only time
+// they are available.
+func GenerateRecoveryCodes(udb UserDB, user *User) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	raw := make([]byte, recoveryCodeBytes)
+	for i := range codes {
+		_, err := io.ReadFull(rand.Reader, raw)
+		if err != nil {
+			return nil, err
+		}
+		code := recoveryEncoding.EncodeToString(raw)
+		hashes[i], err = bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = strings.ToLower(code[:4] + "-" + code[4:])
+	}
+	err := udb.SetRecoveryCodes(user, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Number of unused recovery codes, for account settings
+func RecoveryCodesRemaining(udb UserDB, user *User) (int, error) {
+	hashes, err := udb.GetRecoveryCodes(user)
+	if err != nil {
+		return 0, err
+	}
+	return len(hashes), nil
+}
+
+// Use up code if it is one of user's recovery codes.
+// nil on success, ErrBadSecondFactor if not.
+func checkRecoveryCode(udb UserDB, user *User, code string) error {
+	code = normalizeRecoveryCode(code)
+	if len(code) == 0 {
+		return ErrBadSecondFactor
+	}
+	hashes, err := udb.GetRecoveryCodes(user)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword(hash, []byte(code)) == nil {
+			ok, err := udb.DelRecoveryCode(user, hash)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				// used concurrently
+				return ErrBadSecondFactor
+			}
+			return nil
+		}
+	}
+	return ErrBadSecondFactor
+}
+
+// Generate recovery codes if user has none, as at first second factor
+// enrollment. Returns nil if they already had some.
+func ensureRecoveryCodes(udb UserDB, user *User) ([]string, error) {
+	n, err := RecoveryCodesRemaining(udb, user)
+	if err != nil || n > 0 {
+		return nil, err
+	}
+	return GenerateRecoveryCodes(udb, user)
+}
+
+type RecoveryCodesResponse struct {
+	Remaining int `json:"remaining"`
+	// only when newly generated
+	Codes []string `json:"codes,omitempty"`
+}
+
+// For the logged in user, JSON responses.
+// GET: how many recovery codes are left.
+// POST: generate a new set, invalidating the old ones. Needs "code", a
+// current TOTP code or an unused recovery code, as a form field or JSON.
+type RecoveryCodesHandler struct {
+	Udb UserDB
+}
+
+func (rh *RecoveryCodesHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, rh.Udb)
+	user, err := requestGetUser(request, udb)
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("recovery codes user ", err)
+	}
+	if user == nil {
+		writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "not logged in", nil)
+		return
+	}
+	switch request.Method {
+	case http.MethodGet:
+		n, err := RecoveryCodesRemaining(udb, user)
+		if err != nil {
+			log.Print("recovery codes count ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error reading recovery codes", nil)
+			return
+		}
+		writeJSON(out, http.StatusOK, RecoveryCodesResponse{Remaining: n})
+	case http.MethodPost:
+		var sr secondFactorRequest
+		if isJSONRequest(request) {
+			err = json.NewDecoder(request.Body).Decode(&sr)
+			if err != nil {
+				writeJSONError(out, http.StatusBadRequest, "bad_request", "could not parse JSON body", nil)
+				return
+			}
+		} else {
+			sr.Code = request.PostFormValue("code")
+		}
+		err = throttled(request, throttleName(user), func() error {
+			return checkSecondFactor(udb, user, strings.TrimSpace(sr.Code))
+		})
+		if err != nil {
+			writeLoginError(out, err, FieldErrors{"code": "wrong code"})
+			return
+		}
+		codes, err := GenerateRecoveryCodes(udb, user)
+		if err != nil {
+			log.Print("recovery codes generate ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error making recovery codes", nil)
+			return
+		}
+		writeJSON(out, http.StatusOK, RecoveryCodesResponse{Remaining: len(codes), Codes: codes})
+	default:
+		out.Header().Set("Allow", "GET, POST")
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "GET or POST", nil)
+	}
+}
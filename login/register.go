@@ -0,0 +1,235 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Rules applied to self-service registration of local accounts
+type RegistrationPolicy struct {
+	MinUsernameLen int
+	MaxUsernameLen int
+
+	// If not nil, usernames must match this
+	UsernamePattern *regexp.Regexp
+
+	MinPasswordLen int
+	// bcrypt ignores everything past 72 bytes
+	MaxPasswordLen int
+
+	RequireEmail bool
+}
+
+var DefaultRegistrationPolicy = RegistrationPolicy{
+	MinUsernameLen:  3,
+	MaxUsernameLen:  100, // guser.username varchar(100)
+	UsernamePattern: regexp.MustCompile(`^[A-Za-z0-9_.-]+$`),
+	MinPasswordLen:  8,
+	MaxPasswordLen:  72,
+	RequireEmail:    false,
+}
+
+// map from form field name to human readable problem with it
+type FieldErrors map[string]string
+
+// Check returns nil if everything is ok
+func (p *RegistrationPolicy) Check(username, password, email string) FieldErrors {
+	errs := make(FieldErrors)
+	ulen := utf8.RuneCountInString(username)
+	if ulen == 0 {
+		errs["username"] = "username is required"
+	} else if ulen < p.MinUsernameLen {
+		errs["username"] = "username is too short"
+	} else if p.MaxUsernameLen > 0 && ulen > p.MaxUsernameLen {
+		errs["username"] = "username is too long"
+	} else if p.UsernamePattern != nil && !p.UsernamePattern.MatchString(username) {
+		errs["username"] = "username contains characters that are not allowed"
+	}
+	if len(password) == 0 {
+		errs["password"] = "password is required"
+	} else if utf8.RuneCountInString(password) < p.MinPasswordLen {
+		errs["password"] = "password is too short"
+	} else if p.MaxPasswordLen > 0 && len(password) > p.MaxPasswordLen {
+		errs["password"] = "password is too long"
+	}
+	if len(email) == 0 {
+		if p.RequireEmail {
+			errs["email"] = "email is required"
+		}
+	} else if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		errs["email"] = "email address is not valid"
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+type registerRequest struct {
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+}
+
+type registerResponse struct {
+	Guid        int64  `json:"guid"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
+
+// Create a new local username/password user and log them in.
+// Accepts a POST of either form fields or a JSON object with
+// username, password, email (optional unless Policy.RequireEmail),
+// display_name (optional).
+type RegisterHandler struct {
+	Udb UserDB
+
+	// nil uses DefaultRegistrationPolicy
+	Policy *RegistrationPolicy
+
+	// Where to send a form-post user after registering.
+	// An "r" cookie redirect takes precedence, as with oauth login.
+	HomePath string
+
+	// Called to re-display the form after a failed form post.
+	// If nil, a plain text 400 response is sent.
+	FormError func(out http.ResponseWriter, request *http.Request, errs FieldErrors)
+}
+
+func (rh *RegisterHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, rh.Udb)
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		http.Error(out, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	isJson := isJSONRequest(request)
+	var rr registerRequest
+	if isJson {
+		err := json.NewDecoder(request.Body).Decode(&rr)
+		if err != nil {
+			writeJSONError(out, http.StatusBadRequest, "bad_request", "could not parse JSON body", nil)
+			return
+		}
+	} else {
+		err := request.ParseForm()
+		if err != nil {
+			http.Error(out, "bad form", http.StatusBadRequest)
+			return
+		}
+		rr.Username = request.PostForm.Get("username")
+		rr.Password = request.PostForm.Get("password")
+		rr.Email = request.PostForm.Get("email")
+		rr.DisplayName = request.PostForm.Get("display_name")
+	}
+	rr.Username = strings.TrimSpace(rr.Username)
+	rr.Email = strings.TrimSpace(rr.Email)
+	rr.DisplayName = strings.TrimSpace(rr.DisplayName)
+
+	user, errs, err := rh.register(udb, &rr)
+	if errors.Is(err, ErrVetoed) {
+		if isJson {
+			writeJSONError(out, http.StatusForbidden, "vetoed", err.Error(), nil)
+		} else {
+			http.Error(out, err.Error(), http.StatusForbidden)
+		}
+		return
+	}
+	if err != nil {
+		log.Print("register err ", err)
+		if isJson {
+			writeJSONError(out, http.StatusInternalServerError, "internal", "could not create user", nil)
+		} else {
+			http.Error(out, "could not create user", http.StatusInternalServerError)
+		}
+		return
+	}
+	if errs != nil {
+		if isJson {
+			writeJSONError(out, http.StatusBadRequest, "invalid_fields", "registration rejected", errs)
+		} else if rh.FormError != nil {
+			rh.FormError(out, request, errs)
+		} else {
+			msgs := make([]string, 0, len(errs))
+			for _, msg := range errs {
+				msgs = append(msgs, msg)
+			}
+			http.Error(out, strings.Join(msgs, "\n"), http.StatusBadRequest)
+		}
+		return
+	}
+
+	err = loginSucceeded(udb, request, user, "register")
+	if err != nil {
+		// vetoed or disabled, as for any other login
+		if isJson {
+			writeLoginError(out, err, nil)
+		} else {
+			status, _ := loginErrorCode(err)
+			http.Error(out, err.Error(), status)
+		}
+		return
+	}
+	err = setLoginCookie(out, user)
+	if err != nil {
+		// the user exists now, they can log in normally
+		log.Printf("register login: %s", err)
+	}
+	if isJson {
+		writeJSON(out, http.StatusOK, registerResponse{
+			Guid:        user.Guid,
+			Username:    user.Username,
+			DisplayName: user.BestDisplayName(),
+		})
+		return
+	}
+	loginRedirect(out, request, rh.HomePath)
+}
+
+// Returns the new user, or field errors for the requester to fix, or
+// an internal error.
+func (rh *RegisterHandler) register(udb UserDB, rr *registerRequest) (*User, FieldErrors, error) {
+	policy := rh.Policy
+	if policy == nil {
+		policy = &DefaultRegistrationPolicy
+	}
+	errs := policy.Check(rr.Username, rr.Password, rr.Email)
+	if errs != nil {
+		return nil, errs, nil
+	}
+	nu := &User{
+		Username:    rr.Username,
+		DisplayName: rr.DisplayName,
+	}
+	err := nu.SetPassword(rr.Password)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rr.Email) > 0 {
+		nu.Email = []EmailRecord{NewEmail(rr.Email)}
+	}
+	xu, err := udb.PutNewUser(nu)
+	if errors.Is(err, ErrUsernameTaken) {
+		return nil, FieldErrors{"username": "username is already taken"}, nil
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		return nil, FieldErrors{"email": "email is already in use by another account"}, nil
+	}
+	if err != nil {
+		// maybe lost a race with another registration on the
+		// unique index
+		ou, _ := udb.GetLocalUser(rr.Username)
+		if ou != nil {
+			return nil, FieldErrors{"username": "username is already taken"}, nil
+		}
+		return nil, nil, err
+	}
+	return xu, nil, nil
+}
@@ -0,0 +1,242 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brianolson/login/login/crypto"
+)
+
+// Users with a second factor enrolled don't get the "u" cookie from a
+// password or social login. They get a short lived "u2" cookie instead
+// and must POST a code to SecondFactorHandler, or complete a
+// WebAuthnHandler login, to finish logging in.
+
+var ErrSecondFactorRequired = errors.New("second factor required")
+var ErrBadSecondFactor = errors.New("bad second factor code")
+
+const pendingCookieName = "u2"
+
+// true if user has a confirmed second factor
+func secondFactorRequired(udb UserDB, user *User) (bool, error) {
+	rec, err := udb.GetTOTP(user)
+	if err != nil {
+		return false, err
+	}
+	if rec != nil && rec.Enabled {
+		return true, nil
+	}
+	creds, err := udb.ListWebAuthnCredentials(user)
+	if err != nil {
+		return false, err
+	}
+	return len(creds) > 0, nil
+}
+
+// Check code against user's second factors: TOTP, then recovery codes.
+// nil on success, ErrBadSecondFactor on a wrong or replayed code.
+func checkSecondFactor(udb UserDB, user *User, code string) error {
+	rec, err := udb.GetTOTP(user)
+	if err != nil {
+		return err
+	}
+	if rec != nil && rec.Enabled {
+		err = checkTOTP(udb, user, rec, code)
+		if err != ErrBadSecondFactor {
+			return err
+		}
+	}
+	return checkRecoveryCode(udb, user, code)
+}
+
+func checkTOTP(udb UserDB, user *User, rec *TOTPRecord, code string) error {
+	secret, err := crypto.OpenSecret(rec.Secret)
+	if err != nil {
+		return err
+	}
+	step, ok := crypto.CheckTOTP(secret, code, time.Now())
+	if !ok {
+		return ErrBadSecondFactor
+	}
+	ok, err = udb.UseTOTPStep(user, step)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		// replay
+		return ErrBadSecondFactor
+	}
+	return nil
+}
+
+// After the first factor (password, social) has passed.
+// nil if no second factor is needed or code is good for it,
+// ErrSecondFactorRequired if code is empty but one is needed.
+func loginSecondFactor(udb UserDB, user *User, code string) error {
+	required, err := secondFactorRequired(udb, user)
+	if err != nil {
+		return err
+	}
+	if !required {
+		return nil
+	}
+	if len(code) == 0 {
+		return ErrSecondFactorRequired
+	}
+	return checkSecondFactor(udb, user, code)
+}
+
+// Set the "u" cookie if user is fully logged in, or the "u2" pending
+// cookie and return ErrSecondFactorRequired.
+// code may be "" if the second factor wasn't sent with the first.
+func finishLogin(out http.ResponseWriter, udb UserDB, user *User, code string) error {
+	return loginCookies(out, user, loginSecondFactor(udb, user, code))
+}
+
+// Set cookies for the result of loginSecondFactor or localLogin
+func loginCookies(out http.ResponseWriter, user *User, err error) error {
+	if err == ErrSecondFactorRequired {
+		perr := setPendingCookie(out, user)
+		if perr != nil {
+			return perr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return setLoginCookie(out, user)
+}
+
+func setPendingCookie(out http.ResponseWriter, user *User) error {
+	token, err := crypto.MakeSecondFactorPendingToken(user.Guid)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(out, &http.Cookie{
+		Name:     pendingCookieName,
+		Value:    token,
+		MaxAge:   int(crypto.SecondFactorTTL / time.Second),
+		Path:     "/",
+		HttpOnly: true,
+	})
+	return nil
+}
+
+func clearPendingCookie(out http.ResponseWriter) {
+	http.SetCookie(out, &http.Cookie{Name: pendingCookieName, MaxAge: -1, Path: "/"})
+}
+
+// User who has passed a first factor and is waiting on the second
+func pendingGetUser(request *http.Request, udb UserDB) (*User, error) {
+	cx, err := request.Cookie(pendingCookieName)
+	if err == http.ErrNoCookie {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	uid, err := crypto.ParseSecondFactorPendingToken(cx.Value)
+	if err != nil {
+		return nil, err
+	}
+	return getEnabledUser(udb, uid)
+}
+
+type secondFactorRequest struct {
+	Code string `json:"code"`
+}
+
+// Finish a login that returned ErrSecondFactorRequired.
+// POST "code" (TOTP or recovery code) as a form field or JSON {"code":""}.
+// Form posts are redirected like oauth login, JSON gets UserInfo.
+type SecondFactorHandler struct {
+	Udb UserDB
+
+	HomePath string
+
+	// Called to re-display the code form after a failed form post.
+	// If nil, a plain text 401 response is sent.
+	FormError func(out http.ResponseWriter, request *http.Request, errs FieldErrors)
+}
+
+func (sh *SecondFactorHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, sh.Udb)
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		http.Error(out, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	isJson := isJSONRequest(request)
+	fail := func(status int, code, msg string) {
+		if isJson {
+			writeJSONError(out, status, code, msg, FieldErrors{"code": msg})
+		} else if sh.FormError != nil {
+			sh.FormError(out, request, FieldErrors{"code": msg})
+		} else {
+			http.Error(out, msg, status)
+		}
+	}
+	var sr secondFactorRequest
+	if isJson {
+		err := json.NewDecoder(request.Body).Decode(&sr)
+		if err != nil {
+			writeJSONError(out, http.StatusBadRequest, "bad_request", "could not parse JSON body", nil)
+			return
+		}
+	} else {
+		sr.Code = request.PostFormValue("code")
+	}
+	user, err := pendingGetUser(request, udb)
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("second factor pending cookie ", err)
+	}
+	if user == nil {
+		fail(http.StatusUnauthorized, "not_logged_in", "login expired, please log in again")
+		return
+	}
+	err = throttled(request, throttleName(user), func() error {
+		return checkSecondFactor(udb, user, strings.TrimSpace(sr.Code))
+	})
+	if err != nil {
+		if errors.Is(err, ErrBadSecondFactor) || errors.Is(err, ErrThrottled) {
+			recordLoginFailure(udb, request, user.Guid, "second_factor", "", err)
+		}
+		if isJson {
+			writeLoginError(out, err, FieldErrors{"code": err.Error()})
+			return
+		}
+		status, code := loginErrorCode(err)
+		if status == http.StatusInternalServerError {
+			log.Print("second factor err ", err)
+		}
+		setRetryAfter(out, err)
+		fail(status, code, err.Error())
+		return
+	}
+	err = loginSucceeded(udb, request, user, "second_factor")
+	if err != nil {
+		if isJson {
+			writeLoginError(out, err, nil)
+		} else {
+			fail(http.StatusForbidden, "vetoed", err.Error())
+		}
+		return
+	}
+	clearPendingCookie(out)
+	err = setLoginCookie(out, user)
+	if err != nil {
+		log.Printf("error making cookie: %s", err)
+		fail(http.StatusInternalServerError, "internal", "error logging in")
+		return
+	}
+	if isJson {
+		writeJSON(out, http.StatusOK, NewUserInfo(user))
+		return
+	}
+	loginRedirect(out, request, sh.HomePath)
+}
@@ -0,0 +1,203 @@
+package sql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// Personal API keys.
+// The key itself is only returned once from CreateAPIKey, the database
+// holds sha256(key). Keys are long random strings so a fast hash is fine.
+//
+// A key looks like "lk_" + 8 char prefix + "_" + secret.
+// The prefix is stored in the clear and identifies the key to its owner.
+
+const APIKeyMarker = "lk_"
+
+const apiKeyPrefixBytes = 6  // 8 chars of base64
+const apiKeySecretBytes = 24 // 32 chars of base64
+
+// Don't write last used time more often than this
+const APIKeyLastUsedResolution = 60
+
+type APIKey struct {
+	Prefix   string
+	Name     string
+	Scopes   []string
+	Created  int64 // unix timestamp
+	LastUsed int64 // unix timestamp, 0 if never
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	return strInStrs(k.Scopes, scope)
+}
+
+const (
+	createUserAPIKey = `CREATE TABLE IF NOT EXISTS user_apikey (
+keyhash bytea PRIMARY KEY, -- sha256(key)
+id bigint, -- foreign key guser.id
+prefix varchar(20),
+name varchar(100),
+scopes varchar(1000), -- space separated
+created bigint, -- unix timestamp
+lastused bigint -- unix timestamp
+)`
+	createUserAPIKeyIdIndex = `CREATE INDEX IF NOT EXISTS user_apikey_id ON user_apikey ( id )`
+)
+
+func IsAPIKey(key string) bool {
+	return strings.HasPrefix(key, APIKeyMarker)
+}
+
+// What a UserDB stores and looks keys up by
+func APIKeyHash(key string) []byte {
+	h := sha256.Sum256([]byte(key))
+	return h[:]
+}
+
+func randB64(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(rand.Reader, b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Make a new key, for a UserDB to store the hash of
+func NewAPIKey(name string, scopes []string) (string, *APIKey, error) {
+	prefix, err := randB64(apiKeyPrefixBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	secret, err := randB64(apiKeySecretBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	prefix = APIKeyMarker + prefix
+	key := prefix + "_" + secret
+	ak := &APIKey{
+		Prefix:  prefix,
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().Unix(),
+	}
+	return key, ak, nil
+}
+
+func CreateAPIKey(db *sql.DB, user *User, name string, scopes []string) (string, *APIKey, error) {
+	return CreateAPIKeyContext(context.Background(), db, user, name, scopes)
+}
+
+func CreateAPIKeyContext(ctx context.Context, db *sql.DB, user *User, name string, scopes []string) (string, *APIKey, error) {
+	return createAPIKey(ctx, detectDB(db), user, name, scopes)
+}
+
+func createAPIKey(ctx context.Context, db dialectDB, user *User, name string, scopes []string) (string, *APIKey, error) {
+	key, ak, err := NewAPIKey(name, scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = dbExecContext(ctx, db, `INSERT INTO user_apikey (keyhash, id, prefix, name, scopes, created, lastused) VALUES ($1, $2, $3, $4, $5, $6, 0)`, APIKeyHash(key), user.Guid, ak.Prefix, ak.Name, strings.Join(scopes, " "), ak.Created)
+	if err != nil {
+		return "", nil, err
+	}
+	return key, ak, nil
+}
+
+func readAPIKey(rows *sql.Rows) (*APIKey, error) {
+	var ak APIKey
+	var scopes string
+	err := rows.Scan(&ak.Prefix, &ak.Name, &scopes, &ak.Created, &ak.LastUsed)
+	if err != nil {
+		return nil, err
+	}
+	ak.Scopes = strings.Fields(scopes)
+	return &ak, nil
+}
+
+func ListAPIKeys(db *sql.DB, user *User) ([]APIKey, error) {
+	return ListAPIKeysContext(context.Background(), db, user)
+}
+
+func ListAPIKeysContext(ctx context.Context, db *sql.DB, user *User) ([]APIKey, error) {
+	return listAPIKeys(ctx, detectDB(db), user)
+}
+
+func listAPIKeys(ctx context.Context, db dialectDB, user *User) ([]APIKey, error) {
+	rows, err := dbQueryContext(ctx, db, `SELECT prefix, name, scopes, created, lastused FROM user_apikey WHERE id = $1 ORDER BY created`, user.Guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]APIKey, 0)
+	for rows.Next() {
+		ak, err := readAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *ak)
+	}
+	return out, rows.Err()
+}
+
+func RevokeAPIKey(db *sql.DB, user *User, prefix string) error {
+	return RevokeAPIKeyContext(context.Background(), db, user, prefix)
+}
+
+func RevokeAPIKeyContext(ctx context.Context, db *sql.DB, user *User, prefix string) error {
+	return revokeAPIKey(ctx, detectDB(db), user, prefix)
+}
+
+func revokeAPIKey(ctx context.Context, db dialectDB, user *User, prefix string) error {
+	_, err := dbExecContext(ctx, db, `DELETE FROM user_apikey WHERE id = $1 AND prefix = $2`, user.Guid, prefix)
+	return err
+}
+
+// Returns BadUserError if the key isn't known
+func commonGetAPIKeyUser(ctx context.Context, xd innerDriver, key string) (*User, *APIKey, error) {
+	if !IsAPIKey(key) {
+		return nil, nil, BadUserError
+	}
+	db := xd.DB()
+	keyhash := APIKeyHash(key)
+	rows, err := dbQueryContext(ctx, db, `SELECT prefix, name, scopes, created, lastused, id FROM user_apikey WHERE keyhash = $1`, keyhash)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ak APIKey
+	var scopes string
+	var guid int64
+	found := rows.Next()
+	if found {
+		err = rows.Scan(&ak.Prefix, &ak.Name, &scopes, &ak.Created, &ak.LastUsed, &guid)
+	}
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, BadUserError
+	}
+	ak.Scopes = strings.Fields(scopes)
+	now := time.Now().Unix()
+	if now-ak.LastUsed > APIKeyLastUsedResolution {
+		_, err = dbExecContext(ctx, db, `UPDATE user_apikey SET lastused = $1 WHERE keyhash = $2`, now, keyhash)
+		if err != nil {
+			log.Print("apikey lastused update ", err)
+		}
+		ak.LastUsed = now
+	}
+	user, err := xd.GetUser(ctx, guid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &ak, nil
+}
@@ -0,0 +1,127 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+// Auth event types for AuthEvent.Type. Every UserDB records the
+// password, email and social login ones itself, along with the change.
+const (
+	EventLoginSuccess    = "login"
+	EventLoginFailure    = "login_failed"
+	EventLogout          = "logout"
+	EventPasswordChanged = "password_changed"
+	EventEmailAdded      = "email_added"
+	EventEmailDeleted    = "email_deleted"
+	EventSocialLinked    = "social_linked"
+)
+
+// One row of the auth event log
+type AuthEvent struct {
+	Time int64 // unix timestamp
+
+	// 0 if the user is unknown, e.g. login failure for a bad username
+	Guid int64
+
+	// Event* constant
+	Type string
+
+	// "password", "webauthn", oauth service name, etc.
+	Method string
+
+	IP        string
+	UserAgent string
+
+	// Event specific, e.g. the username tried or the email added
+	Detail string
+}
+
+const (
+	createAuthEvent = `CREATE TABLE IF NOT EXISTS auth_event (
+t bigint, -- unix timestamp
+id bigint, -- guser.id, 0 if unknown
+etype varchar(30),
+method varchar(100),
+ip varchar(100),
+useragent varchar(300),
+detail varchar(300)
+)`
+	createAuthEventIdIndex   = `CREATE INDEX IF NOT EXISTS auth_event_id ON auth_event ( id, t )`
+	createAuthEventTimeIndex = `CREATE INDEX IF NOT EXISTS auth_event_t ON auth_event ( t )`
+)
+
+const insertAuthEvent = `INSERT INTO auth_event (t, id, etype, method, ip, useragent, detail) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+
+func LogAuthEvent(db *sql.DB, ev *AuthEvent) error {
+	return LogAuthEventContext(context.Background(), db, ev)
+}
+
+func LogAuthEventContext(ctx context.Context, db *sql.DB, ev *AuthEvent) error {
+	return logAuthEvent(ctx, detectDB(db), ev)
+}
+
+func logAuthEvent(ctx context.Context, db dialectDB, ev *AuthEvent) error {
+	_, err := dbExecContext(ctx, db, insertAuthEvent, ev.Time, ev.Guid, ev.Type, ev.Method, ev.IP, ev.UserAgent, ev.Detail)
+	return err
+}
+
+func txLogAuthEvent(ctx context.Context, db dialectDB, tx *sql.Tx, ev *AuthEvent) error {
+	_, err := txExecContext(ctx, db, tx, insertAuthEvent, ev.Time, ev.Guid, ev.Type, ev.Method, ev.IP, ev.UserAgent, ev.Detail)
+	return err
+}
+
+// An event a UserDB records with the change it is about. The UserDB
+// doesn't know the client, so there's no IP or UserAgent.
+func changeEvent(guid int64, etype, method, detail string) *AuthEvent {
+	return &AuthEvent{Time: time.Now().Unix(), Guid: guid, Type: etype, Method: method, Detail: detail}
+}
+
+func socialLinkedEvent(guid int64, si UserSocial) *AuthEvent {
+	return changeEvent(guid, EventSocialLinked, si.Service, si.Id)
+}
+
+// Events newest first with start <= Time < end.
+// guid 0 for all users. end 0 for no upper bound, limit 0 for no limit.
+func GetAuthEvents(db *sql.DB, guid, start, end int64, limit int) ([]AuthEvent, error) {
+	return GetAuthEventsContext(context.Background(), db, guid, start, end, limit)
+}
+
+func GetAuthEventsContext(ctx context.Context, db *sql.DB, guid, start, end int64, limit int) ([]AuthEvent, error) {
+	return getAuthEvents(ctx, detectDB(db), guid, start, end, limit)
+}
+
+func getAuthEvents(ctx context.Context, db dialectDB, guid, start, end int64, limit int) ([]AuthEvent, error) {
+	cmd := `SELECT t, id, etype, method, ip, useragent, detail FROM auth_event WHERE t >= $1`
+	args := []interface{}{start}
+	if end != 0 {
+		args = append(args, end)
+		cmd += ` AND t < $2`
+	}
+	if guid != 0 {
+		args = append(args, guid)
+		cmd += ` AND id = $` + strconv.Itoa(len(args))
+	}
+	cmd += ` ORDER BY t DESC`
+	if limit > 0 {
+		args = append(args, limit)
+		cmd += ` LIMIT $` + strconv.Itoa(len(args))
+	}
+	rows, err := dbQueryContext(ctx, db, cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]AuthEvent, 0)
+	for rows.Next() {
+		var ev AuthEvent
+		err = rows.Scan(&ev.Time, &ev.Guid, &ev.Type, &ev.Method, &ev.IP, &ev.UserAgent, &ev.Detail)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, ev)
+	}
+	return out, rows.Err()
+}
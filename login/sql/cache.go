@@ -0,0 +1,378 @@
+package sql
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+)
+
+// UserDB with an LRU of users in front of GetUser, GetLocalUser and
+// GetSocialUser. Entries are found by guid, username or social login and
+// expire after ttl (0 for never). Methods that change a user drop it from
+// the cache; everything else goes straight to the wrapped UserDB.
+//
+// With several servers on one database, set Changed to publish the guids
+// changed here, and feed what the other servers publish to Listen or
+// Invalidate.
+type CachedUserDB struct {
+	UserDB
+
+	// If not nil, gets the guid of every user changed through this
+	// CachedUserDB. Sends don't block: when the channel is full the guid
+	// is dropped (and logged), so buffer it and keep reading, or other
+	// servers will serve that user stale until ttl.
+	Changed chan<- int64
+
+	size int
+	ttl  time.Duration
+
+	l        sync.Mutex
+	lru      *list.List // of *cachedUser, most recently used first
+	byGuid   map[int64]*list.Element
+	byName   map[string]int64
+	bySocial map[string]int64
+
+	// bumped by every invalidation, so a read that raced one isn't cached
+	gen uint64
+}
+
+type cachedUser struct {
+	guid     int64
+	username string
+	social   []string // SocialKey()
+	blob     []byte   // cbor User, decoded fresh for every caller
+	expires  time.Time
+}
+
+// Cache up to size users from udb for ttl.
+func NewCachedUserDB(udb UserDB, size int, ttl time.Duration) *CachedUserDB {
+	if size < 1 {
+		size = 1
+	}
+	return &CachedUserDB{
+		UserDB:   udb,
+		size:     size,
+		ttl:      ttl,
+		lru:      list.New(),
+		byGuid:   make(map[int64]*list.Element),
+		byName:   make(map[string]int64),
+		bySocial: make(map[string]int64),
+	}
+}
+
+// Drop guid from the cache, e.g. because another server changed it.
+// Not sent to Changed.
+func (cdb *CachedUserDB) Invalidate(guid int64) {
+	cdb.l.Lock()
+	defer cdb.l.Unlock()
+	cdb.gen++
+	if el, ok := cdb.byGuid[guid]; ok {
+		cdb.remove(el)
+	}
+}
+
+// Invalidate every guid from ch until it is closed. Run in a goroutine.
+func (cdb *CachedUserDB) Listen(ch <-chan int64) {
+	for guid := range ch {
+		cdb.Invalidate(guid)
+	}
+}
+
+// Drop everything.
+func (cdb *CachedUserDB) Purge() {
+	cdb.l.Lock()
+	defer cdb.l.Unlock()
+	cdb.gen++
+	cdb.lru.Init()
+	cdb.byGuid = make(map[int64]*list.Element)
+	cdb.byName = make(map[string]int64)
+	cdb.bySocial = make(map[string]int64)
+}
+
+// Local change to guid
+func (cdb *CachedUserDB) changed(guid int64) {
+	cdb.Invalidate(guid)
+	if cdb.Changed != nil {
+		select {
+		case cdb.Changed <- guid:
+		default:
+			log.Printf("cache Changed full, dropped guid %d", guid)
+		}
+	}
+}
+
+// must hold lock
+func (cdb *CachedUserDB) remove(el *list.Element) {
+	cu := cdb.lru.Remove(el).(*cachedUser)
+	delete(cdb.byGuid, cu.guid)
+	if cu.username != "" && cdb.byName[cu.username] == cu.guid {
+		delete(cdb.byName, cu.username)
+	}
+	for _, skey := range cu.social {
+		if cdb.bySocial[skey] == cu.guid {
+			delete(cdb.bySocial, skey)
+		}
+	}
+}
+
+// must hold lock. Cached cbor for guid, or nil.
+func (cdb *CachedUserDB) lookup(guid int64) []byte {
+	el, ok := cdb.byGuid[guid]
+	if !ok {
+		return nil
+	}
+	cu := el.Value.(*cachedUser)
+	if cdb.ttl > 0 && time.Now().After(cu.expires) {
+		cdb.remove(el)
+		return nil
+	}
+	cdb.lru.MoveToFront(el)
+	return cu.blob
+}
+
+// cbor gives back empty slices for nil ones, and a nil Password matters
+func decodeCachedUser(blob []byte) (*User, error) {
+	u := &User{}
+	err := cbor.Loads(blob, u)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Password) == 0 {
+		u.Password = nil
+	}
+	for i, si := range u.Social {
+		if b, ok := si.Data.([]byte); ok && len(b) == 0 {
+			u.Social[i].Data = nil
+		}
+	}
+	return u, nil
+}
+
+// Decode a lookup() result, or read through to the wrapped UserDB with
+// get and store() that.
+func (cdb *CachedUserDB) readThrough(blob []byte, gen uint64, get func() (*User, error)) (*User, error) {
+	if blob != nil {
+		u, err := decodeCachedUser(blob)
+		if err == nil {
+			return u, nil
+		}
+	}
+	u, err := get()
+	if err != nil || u == nil {
+		return u, err
+	}
+	cdb.store(u, gen)
+	return u, nil
+}
+
+// Cache u as read from the wrapped UserDB, unless something was
+// invalidated since gen.
+func (cdb *CachedUserDB) store(u *User, gen uint64) {
+	blob, err := cbor.Dumps(u)
+	if err != nil {
+		return
+	}
+	cu := &cachedUser{
+		guid:     u.Guid,
+		username: u.Username,
+		social:   make([]string, len(u.Social)),
+		blob:     blob,
+		expires:  time.Now().Add(cdb.ttl),
+	}
+	for i, si := range u.Social {
+		cu.social[i] = SocialKey(si.Service, si.Id)
+	}
+	cdb.l.Lock()
+	defer cdb.l.Unlock()
+	if cdb.gen != gen {
+		return
+	}
+	if el, ok := cdb.byGuid[u.Guid]; ok {
+		cdb.remove(el)
+	}
+	cdb.byGuid[u.Guid] = cdb.lru.PushFront(cu)
+	if cu.username != "" {
+		cdb.byName[cu.username] = cu.guid
+	}
+	for _, skey := range cu.social {
+		cdb.bySocial[skey] = cu.guid
+	}
+	for cdb.lru.Len() > cdb.size {
+		cdb.remove(cdb.lru.Back())
+	}
+}
+
+func (cdb *CachedUserDB) withContext() *cachedUserDBContext {
+	return &cachedUserDBContext{ContextUserDB(cdb.UserDB), cdb}
+}
+
+func (cdb *CachedUserDB) GetUser(guid int64) (*User, error) {
+	return cdb.withContext().GetUser(context.Background(), guid)
+}
+
+func (cdb *CachedUserDB) GetLocalUser(username string) (*User, error) {
+	return cdb.withContext().GetLocalUser(context.Background(), username)
+}
+
+func (cdb *CachedUserDB) GetSocialUser(service, id string) (*User, error) {
+	return cdb.withContext().GetSocialUser(context.Background(), service, id)
+}
+
+func (cdb *CachedUserDB) GetUsers(guids []int64) ([]*User, error) {
+	return cdb.withContext().GetUsers(context.Background(), guids)
+}
+
+func (cdb *CachedUserDB) DeleteUser(user *User) error {
+	return cdb.withContext().DeleteUser(context.Background(), user)
+}
+
+func (cdb *CachedUserDB) SetUserPrefs(user *User) error {
+	return cdb.withContext().SetUserPrefs(context.Background(), user)
+}
+
+func (cdb *CachedUserDB) SetUserPassword(user *User) error {
+	return cdb.withContext().SetUserPassword(context.Background(), user)
+}
+
+func (cdb *CachedUserDB) SetLogin(user *User, username, password string) error {
+	return cdb.withContext().SetLogin(context.Background(), user, username, password)
+}
+
+func (cdb *CachedUserDB) AddEmail(user *User, email EmailRecord) error {
+	return cdb.withContext().AddEmail(context.Background(), user, email)
+}
+
+func (cdb *CachedUserDB) DelEmail(user *User, email string) error {
+	return cdb.withContext().DelEmail(context.Background(), user, email)
+}
+
+// ContextUserDB of a CachedUserDB: its cache in front of ContextUserDB of
+// the wrapped UserDB, so ctx reaches the database on a miss
+type cachedUserDBContext struct {
+	UserDBContext
+	cdb *CachedUserDB
+}
+
+func (c *cachedUserDBContext) GetUser(ctx context.Context, guid int64) (*User, error) {
+	cdb := c.cdb
+	cdb.l.Lock()
+	blob := cdb.lookup(guid)
+	gen := cdb.gen
+	cdb.l.Unlock()
+	return cdb.readThrough(blob, gen, func() (*User, error) {
+		return c.UserDBContext.GetUser(ctx, guid)
+	})
+}
+
+func (c *cachedUserDBContext) GetLocalUser(ctx context.Context, username string) (*User, error) {
+	cdb := c.cdb
+	var blob []byte
+	cdb.l.Lock()
+	if guid, ok := cdb.byName[username]; ok {
+		blob = cdb.lookup(guid)
+	}
+	gen := cdb.gen
+	cdb.l.Unlock()
+	return cdb.readThrough(blob, gen, func() (*User, error) {
+		return c.UserDBContext.GetLocalUser(ctx, username)
+	})
+}
+
+func (c *cachedUserDBContext) GetSocialUser(ctx context.Context, service, id string) (*User, error) {
+	cdb := c.cdb
+	var blob []byte
+	cdb.l.Lock()
+	if guid, ok := cdb.bySocial[SocialKey(service, id)]; ok {
+		blob = cdb.lookup(guid)
+	}
+	gen := cdb.gen
+	cdb.l.Unlock()
+	return cdb.readThrough(blob, gen, func() (*User, error) {
+		return c.UserDBContext.GetSocialUser(ctx, service, id)
+	})
+}
+
+// Cached users, then the rest in one GetUsers from the wrapped UserDB
+func (c *cachedUserDBContext) GetUsers(ctx context.Context, guids []int64) ([]*User, error) {
+	cdb := c.cdb
+	out := make([]*User, len(guids))
+	blobs := make([][]byte, len(guids))
+	cdb.l.Lock()
+	for i, guid := range guids {
+		blobs[i] = cdb.lookup(guid)
+	}
+	gen := cdb.gen
+	cdb.l.Unlock()
+	var missing []int64
+	for i, blob := range blobs {
+		var err error
+		if blob != nil {
+			out[i], err = decodeCachedUser(blob)
+		}
+		if blob == nil || err != nil {
+			missing = append(missing, guids[i])
+		}
+	}
+	if len(missing) == 0 {
+		return out, nil
+	}
+	users, err := c.UserDBContext.GetUsers(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[int64]*User, len(users))
+	for _, u := range users {
+		if u != nil {
+			found[u.Guid] = u
+			cdb.store(u, gen)
+		}
+	}
+	for i, guid := range guids {
+		if out[i] == nil {
+			out[i] = found[guid]
+		}
+	}
+	return out, nil
+}
+
+// Changes to users, which invalidate them
+
+func (c *cachedUserDBContext) DeleteUser(ctx context.Context, user *User) error {
+	err := c.UserDBContext.DeleteUser(ctx, user)
+	c.cdb.changed(user.Guid)
+	return err
+}
+
+func (c *cachedUserDBContext) SetUserPrefs(ctx context.Context, user *User) error {
+	err := c.UserDBContext.SetUserPrefs(ctx, user)
+	c.cdb.changed(user.Guid)
+	return err
+}
+
+func (c *cachedUserDBContext) SetUserPassword(ctx context.Context, user *User) error {
+	err := c.UserDBContext.SetUserPassword(ctx, user)
+	c.cdb.changed(user.Guid)
+	return err
+}
+
+func (c *cachedUserDBContext) SetLogin(ctx context.Context, user *User, username, password string) error {
+	err := c.UserDBContext.SetLogin(ctx, user, username, password)
+	c.cdb.changed(user.Guid)
+	return err
+}
+
+func (c *cachedUserDBContext) AddEmail(ctx context.Context, user *User, email EmailRecord) error {
+	err := c.UserDBContext.AddEmail(ctx, user, email)
+	c.cdb.changed(user.Guid)
+	return err
+}
+
+func (c *cachedUserDBContext) DelEmail(ctx context.Context, user *User, email string) error {
+	err := c.UserDBContext.DelEmail(ctx, user, email)
+	c.cdb.changed(user.Guid)
+	return err
+}
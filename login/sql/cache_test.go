@@ -0,0 +1,233 @@
+package sql_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ls "github.com/brianolson/login/login/sql"
+	tu "github.com/brianolson/login/login/sql/testutil"
+)
+
+// counts reads that got past the cache
+type countingUserDB struct {
+	ls.UserDB
+	reads int
+}
+
+func (c *countingUserDB) GetUser(guid int64) (*ls.User, error) {
+	c.reads++
+	return c.UserDB.GetUser(guid)
+}
+
+func (c *countingUserDB) GetLocalUser(username string) (*ls.User, error) {
+	c.reads++
+	return c.UserDB.GetLocalUser(username)
+}
+
+func (c *countingUserDB) GetSocialUser(service, id string) (*ls.User, error) {
+	c.reads++
+	return c.UserDB.GetSocialUser(service, id)
+}
+
+func (c *countingUserDB) GetUsers(guids []int64) ([]*ls.User, error) {
+	c.reads++
+	return c.UserDB.GetUsers(guids)
+}
+
+func TestCachedUserDBConformance(t *testing.T) {
+	tu.RunUserDBConformance(t, func(t *testing.T) ls.UserDB {
+		return ls.NewCachedUserDB(ls.NewMemoryUserDB(), 100, time.Minute)
+	})
+}
+
+func TestCachedUserDB(t *testing.T) {
+	cnt := &countingUserDB{UserDB: ls.NewMemoryUserDB()}
+	cdb := ls.NewCachedUserDB(cnt, 2, time.Minute)
+	nu := &ls.User{Username: "cached", DisplayName: "Cached", Social: []ls.UserSocial{{Service: "z", Id: "cached"}}}
+	_, err := cdb.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	xu, err := cdb.GetUser(nu.Guid)
+	if err != nil || xu.DisplayName != "Cached" {
+		t.Fatalf("get user %#v %v", xu, err)
+	}
+	// callers get their own copy
+	xu.DisplayName = "Scribbled"
+	for _, get := range []func() (*ls.User, error){
+		func() (*ls.User, error) { return cdb.GetUser(nu.Guid) },
+		func() (*ls.User, error) { return cdb.GetLocalUser("cached") },
+		func() (*ls.User, error) { return cdb.GetSocialUser("z", "cached") },
+	} {
+		xu, err = get()
+		if err != nil || xu.Guid != nu.Guid || xu.DisplayName != "Cached" {
+			t.Errorf("cached user %#v %v", xu, err)
+		}
+	}
+	if cnt.reads != 1 {
+		t.Errorf("%d reads through cache, wanted 1", cnt.reads)
+	}
+	if xu.HasLocalUser() {
+		t.Errorf("cached user without password HasLocalUser")
+	}
+
+	nu.DisplayName = "Changed"
+	err = cdb.SetUserPrefs(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xu, err = cdb.GetLocalUser("cached")
+	if err != nil || xu.DisplayName != "Changed" || cnt.reads != 2 {
+		t.Errorf("not invalidated %#v %v, %d reads", xu, err, cnt.reads)
+	}
+
+	// invalidation from another server
+	cdb.Invalidate(nu.Guid)
+	cdb.GetUser(nu.Guid)
+	if cnt.reads != 3 {
+		t.Errorf("Invalidate kept user, %d reads", cnt.reads)
+	}
+
+	// LRU of 2
+	for _, name := range []string{"second", "third"} {
+		_, err = cdb.PutNewUser(&ls.User{Username: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cdb.GetLocalUser(name)
+	}
+	cnt.reads = 0
+	cdb.GetUser(nu.Guid)
+	if cnt.reads != 1 {
+		t.Errorf("least recently used user not evicted, %d reads", cnt.reads)
+	}
+
+	// hits from the cache, misses in one batch
+	third, _ := cdb.GetLocalUser("third")
+	second, _ := cdb.GetLocalUser("second")
+	cnt.reads = 0
+	got, err := cdb.GetUsers([]int64{third.Guid, second.Guid, nu.Guid, 1 << 60})
+	if err != nil || got[0].Username != "third" || got[1].Username != "second" || got[2].Guid != nu.Guid || got[3] != nil {
+		t.Errorf("GetUsers %#v %v", got, err)
+	}
+	if cnt.reads != 1 {
+		t.Errorf("GetUsers made %d reads, wanted 1", cnt.reads)
+	}
+}
+
+func TestCachedUserDBExpiry(t *testing.T) {
+	cnt := &countingUserDB{UserDB: ls.NewMemoryUserDB()}
+	cdb := ls.NewCachedUserDB(cnt, 10, 20*time.Millisecond)
+	nu := &ls.User{Username: "brief"}
+	_, err := cdb.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cdb.GetUser(nu.Guid)
+	cdb.GetUser(nu.Guid)
+	if cnt.reads != 1 {
+		t.Errorf("%d reads before ttl", cnt.reads)
+	}
+	time.Sleep(40 * time.Millisecond)
+	cdb.GetUser(nu.Guid)
+	if cnt.reads != 2 {
+		t.Errorf("%d reads after ttl", cnt.reads)
+	}
+}
+
+func TestCachedUserDBChanged(t *testing.T) {
+	// two servers sharing a database
+	mdb := ls.NewMemoryUserDB()
+	a := ls.NewCachedUserDB(mdb, 10, time.Minute)
+	b := ls.NewCachedUserDB(mdb, 10, time.Minute)
+	ch := make(chan int64, 10)
+	a.Changed = ch
+	done := make(chan bool)
+	go func() {
+		b.Listen(ch)
+		done <- true
+	}()
+
+	nu := &ls.User{Username: "shared"}
+	_, err := a.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.GetUser(nu.Guid)
+	err = a.AddEmail(nu, ls.NewEmail("shared@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(ch)
+	<-done
+	xu, err := b.GetUser(nu.Guid)
+	if err != nil || !xu.HasEmail("shared@example.com") {
+		t.Errorf("b kept stale user %#v %v", xu, err)
+	}
+}
+
+func TestCachedUserDBChangedFull(t *testing.T) {
+	cdb := ls.NewCachedUserDB(ls.NewMemoryUserDB(), 10, time.Minute)
+	ch := make(chan int64, 1)
+	cdb.Changed = ch
+
+	nu := &ls.User{Username: "nobody reading"}
+	_, err := cdb.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nu.DisplayName = "Nobody"
+	err = cdb.SetUserPrefs(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// channel is full now, these must not block
+	err = cdb.AddEmail(nu, ls.NewEmail("full@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cdb.DelEmail(nu, "full@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ch) != 1 || <-ch != nu.Guid {
+		t.Errorf("expected the first change only")
+	}
+}
+
+type ctxKey struct{}
+
+// remembers the ctx value of the last GetUser
+type ctxUserDB struct {
+	ls.UserDBContext
+	saw interface{}
+}
+
+func (c *ctxUserDB) GetUser(ctx context.Context, guid int64) (*ls.User, error) {
+	c.saw = ctx.Value(ctxKey{})
+	return c.UserDBContext.GetUser(ctx, guid)
+}
+
+func TestCachedUserDBContext(t *testing.T) {
+	mdb := ls.NewMemoryUserDB()
+	inner := &ctxUserDB{UserDBContext: ls.ContextUserDB(mdb)}
+	cdb := ls.NewCachedUserDB(ls.BackgroundUserDB(inner), 10, time.Minute)
+	nu := &ls.User{Username: "ctx"}
+	_, err := cdb.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	_, err = ls.ContextUserDB(cdb).GetUser(ctx, nu.Guid)
+	if err != nil || inner.saw != "request" {
+		t.Errorf("ctx not passed through the cache, saw %v, %v", inner.saw, err)
+	}
+	inner.saw = nil
+	_, err = ls.BindUserDB(ctx, ls.ContextUserDB(cdb)).GetUser(nu.Guid)
+	if err != nil || inner.saw != nil {
+		t.Errorf("cache hit went to the wrapped UserDB, saw %v, %v", inner.saw, err)
+	}
+}
@@ -0,0 +1,607 @@
+package sql
+
+import (
+	"context"
+)
+
+// UserDBContext is UserDB with a ctx on every method, for cancellation,
+// deadlines and tracing. The SQL one passes ctx to QueryContext and
+// ExecContext.
+//
+// ContextUserDB and BackgroundUserDB convert between the two.
+type UserDBContext interface {
+	// Setup will create or migrate tables.
+	// ErrSchemaTooNew if the database is from newer code.
+	Setup(ctx context.Context) error
+
+	// Where to register hooks on this UserDB's events, never nil
+	Hooks() *HookRegistry
+	// How this UserDB normalizes email addresses, never nil. Set its
+	// options before use.
+	EmailNormalization() *EmailNormalization
+
+	PutNewUser(ctx context.Context, nu *User) (*User, error)
+
+	GetUser(ctx context.Context, guid int64) (*User, error)
+	GetLocalUser(ctx context.Context, username string) (*User, error)
+	GetSocialUser(ctx context.Context, service, id string) (*User, error)
+	// Many users at once, in the order of guids, nil where there is no
+	// such user. For SQL it's three queries per 500 guids.
+	GetUsers(ctx context.Context, guids []int64) ([]*User, error)
+	// User with email, after EmailNormalization(). If several users have it,
+	// a validated one, then the oldest. BadUserError if there is none, or
+	// if validatedOnly and nobody has validated it.
+	GetEmailUser(ctx context.Context, email string, validatedOnly bool) (*User, error)
+	// Page of users matching q, and the Cursor for the next page or ""
+	// after the last. ErrBadCursor if q.Cursor isn't from this query.
+	ListUsers(ctx context.Context, q UserQuery) ([]*User, string, error)
+
+	// Disabled users keep their data but can't log in.
+	DisableUser(ctx context.Context, user *User, reason string) error
+	EnableUser(ctx context.Context, user *User) error
+	GetDisabled(ctx context.Context, user *User) (disabled bool, reason string, err error)
+	// Remove user with their logins, emails and credentials.
+	// BadUserError if there was no such user.
+	DeleteUser(ctx context.Context, user *User) error
+
+	// Everything stored about a user, without secrets
+	ExportUser(ctx context.Context, guid int64) (*UserExport, error)
+
+	// copy misc data out of User struct into preferences
+	SetUserPrefs(ctx context.Context, user *User) error
+	SetUserPassword(ctx context.Context, user *User) error
+
+	// Set local login for a social-login user
+	SetLogin(ctx context.Context, user *User, username, password string) error
+
+	AddEmail(ctx context.Context, user *User, email EmailRecord) error
+	DelEmail(ctx context.Context, user *User, email string) error
+
+	// now is unix milliseconds. ListFeedback returns newest first with
+	// start <= Millis < end; guid 0 for all users, end 0 for no upper
+	// bound, limit 0 for no limit.
+	Feedback(ctx context.Context, user *User, now int64, text string) error
+	ListFeedback(ctx context.Context, guid, start, end int64, offset, limit int) ([]FeedbackRecord, error)
+	LimitedFeedback(ctx context.Context, user *User, now int64, text string, start int64, max int) (stored bool, oldest int64, err error)
+
+	// CreateAPIKey returns the new key, which is not stored and
+	// can't be recovered later.
+	CreateAPIKey(ctx context.Context, user *User, name string, scopes []string) (string, *APIKey, error)
+	ListAPIKeys(ctx context.Context, user *User) ([]APIKey, error)
+	RevokeAPIKey(ctx context.Context, user *User, prefix string) error
+	// Returns BadUserError for unknown or revoked keys
+	GetAPIKeyUser(ctx context.Context, key string) (*User, *APIKey, error)
+
+	// TOTP second factor. GetTOTP returns nil, nil if not enrolled.
+	PutTOTP(ctx context.Context, user *User, rec *TOTPRecord) error
+	GetTOTP(ctx context.Context, user *User) (*TOTPRecord, error)
+	// false if step is not after the last step used (replay)
+	UseTOTPStep(ctx context.Context, user *User, step int64) (bool, error)
+	DelTOTP(ctx context.Context, user *User) error
+
+	// WebAuthn credentials (passkeys).
+	// GetWebAuthnCredential returns BadUserError if credID is unknown.
+	AddWebAuthnCredential(ctx context.Context, user *User, cred *WebAuthnCredential) error
+	ListWebAuthnCredentials(ctx context.Context, user *User) ([]WebAuthnCredential, error)
+	GetWebAuthnCredential(ctx context.Context, credID []byte) (*User, *WebAuthnCredential, error)
+	UseWebAuthnCredential(ctx context.Context, credID []byte, signCount int64) (bool, error)
+	DelWebAuthnCredential(ctx context.Context, user *User, credID []byte) error
+
+	// WebAuthn challenges, see UserDB.
+	PutWebAuthnChallenge(ctx context.Context, challenge []byte, expires int64) error
+	TakeWebAuthnChallenge(ctx context.Context, challenge []byte) (bool, error)
+
+	// Recovery codes, as bcrypt hashes.
+	// SetRecoveryCodes replaces any previous set.
+	// DelRecoveryCode returns false if hash was already used.
+	SetRecoveryCodes(ctx context.Context, user *User, hashes [][]byte) error
+	GetRecoveryCodes(ctx context.Context, user *User) ([][]byte, error)
+	DelRecoveryCode(ctx context.Context, user *User, hash []byte) (bool, error)
+
+	// Auth event log. GetAuthEvents returns newest first with
+	// start <= Time < end; guid 0 for all users, end 0 for no upper
+	// bound, limit 0 for no limit.
+	LogAuthEvent(ctx context.Context, ev *AuthEvent) error
+	GetAuthEvents(ctx context.Context, guid, start, end int64, limit int) ([]AuthEvent, error)
+}
+
+// UserDB calling udbc with context.Background()
+func BackgroundUserDB(udbc UserDBContext) UserDB {
+	return BindUserDB(context.Background(), udbc)
+}
+
+// UserDB calling udbc with ctx, e.g. a request's context for the
+// duration of handling it
+func BindUserDB(ctx context.Context, udbc UserDBContext) UserDB {
+	return &boundUserDB{ctx, udbc}
+}
+
+// The UserDBContext behind a UserDB from BindUserDB, a CachedUserDB
+// passing ctx on to the UserDB it wraps, or else udb with ctx checked
+// before each call. MemoryUserDB and bolt have no I/O to cancel, so the
+// check is all they need.
+func ContextUserDB(udb UserDB) UserDBContext {
+	switch u := udb.(type) {
+	case *boundUserDB:
+		return u.udbc
+	case *CachedUserDB:
+		return u.withContext()
+	}
+	return &contextUserDB{udb}
+}
+
+type boundUserDB struct {
+	ctx  context.Context
+	udbc UserDBContext
+}
+
+func (b *boundUserDB) Setup() error {
+	return b.udbc.Setup(b.ctx)
+}
+
+func (b *boundUserDB) Hooks() *HookRegistry {
+	return b.udbc.Hooks()
+}
+
+func (b *boundUserDB) EmailNormalization() *EmailNormalization {
+	return b.udbc.EmailNormalization()
+}
+
+func (b *boundUserDB) PutNewUser(nu *User) (*User, error) {
+	return b.udbc.PutNewUser(b.ctx, nu)
+}
+
+func (b *boundUserDB) GetUser(guid int64) (*User, error) {
+	return b.udbc.GetUser(b.ctx, guid)
+}
+
+func (b *boundUserDB) GetLocalUser(username string) (*User, error) {
+	return b.udbc.GetLocalUser(b.ctx, username)
+}
+
+func (b *boundUserDB) GetSocialUser(service, id string) (*User, error) {
+	return b.udbc.GetSocialUser(b.ctx, service, id)
+}
+
+func (b *boundUserDB) GetUsers(guids []int64) ([]*User, error) {
+	return b.udbc.GetUsers(b.ctx, guids)
+}
+
+func (b *boundUserDB) GetEmailUser(email string, validatedOnly bool) (*User, error) {
+	return b.udbc.GetEmailUser(b.ctx, email, validatedOnly)
+}
+
+func (b *boundUserDB) ListUsers(q UserQuery) ([]*User, string, error) {
+	return b.udbc.ListUsers(b.ctx, q)
+}
+
+func (b *boundUserDB) DisableUser(user *User, reason string) error {
+	return b.udbc.DisableUser(b.ctx, user, reason)
+}
+
+func (b *boundUserDB) EnableUser(user *User) error {
+	return b.udbc.EnableUser(b.ctx, user)
+}
+
+func (b *boundUserDB) GetDisabled(user *User) (disabled bool, reason string, err error) {
+	return b.udbc.GetDisabled(b.ctx, user)
+}
+
+func (b *boundUserDB) DeleteUser(user *User) error {
+	return b.udbc.DeleteUser(b.ctx, user)
+}
+
+func (b *boundUserDB) ExportUser(guid int64) (*UserExport, error) {
+	return b.udbc.ExportUser(b.ctx, guid)
+}
+
+func (b *boundUserDB) SetUserPrefs(user *User) error {
+	return b.udbc.SetUserPrefs(b.ctx, user)
+}
+
+func (b *boundUserDB) SetUserPassword(user *User) error {
+	return b.udbc.SetUserPassword(b.ctx, user)
+}
+
+func (b *boundUserDB) SetLogin(user *User, username, password string) error {
+	return b.udbc.SetLogin(b.ctx, user, username, password)
+}
+
+func (b *boundUserDB) AddEmail(user *User, email EmailRecord) error {
+	return b.udbc.AddEmail(b.ctx, user, email)
+}
+
+func (b *boundUserDB) DelEmail(user *User, email string) error {
+	return b.udbc.DelEmail(b.ctx, user, email)
+}
+
+func (b *boundUserDB) Feedback(user *User, now int64, text string) error {
+	return b.udbc.Feedback(b.ctx, user, now, text)
+}
+
+func (b *boundUserDB) ListFeedback(guid, start, end int64, offset, limit int) ([]FeedbackRecord, error) {
+	return b.udbc.ListFeedback(b.ctx, guid, start, end, offset, limit)
+}
+
+func (b *boundUserDB) LimitedFeedback(user *User, now int64, text string, start int64, max int) (bool, int64, error) {
+	return b.udbc.LimitedFeedback(b.ctx, user, now, text, start, max)
+}
+
+func (b *boundUserDB) CreateAPIKey(user *User, name string, scopes []string) (string, *APIKey, error) {
+	return b.udbc.CreateAPIKey(b.ctx, user, name, scopes)
+}
+
+func (b *boundUserDB) ListAPIKeys(user *User) ([]APIKey, error) {
+	return b.udbc.ListAPIKeys(b.ctx, user)
+}
+
+func (b *boundUserDB) RevokeAPIKey(user *User, prefix string) error {
+	return b.udbc.RevokeAPIKey(b.ctx, user, prefix)
+}
+
+func (b *boundUserDB) GetAPIKeyUser(key string) (*User, *APIKey, error) {
+	return b.udbc.GetAPIKeyUser(b.ctx, key)
+}
+
+func (b *boundUserDB) PutTOTP(user *User, rec *TOTPRecord) error {
+	return b.udbc.PutTOTP(b.ctx, user, rec)
+}
+
+func (b *boundUserDB) GetTOTP(user *User) (*TOTPRecord, error) {
+	return b.udbc.GetTOTP(b.ctx, user)
+}
+
+func (b *boundUserDB) UseTOTPStep(user *User, step int64) (bool, error) {
+	return b.udbc.UseTOTPStep(b.ctx, user, step)
+}
+
+func (b *boundUserDB) DelTOTP(user *User) error {
+	return b.udbc.DelTOTP(b.ctx, user)
+}
+
+func (b *boundUserDB) AddWebAuthnCredential(user *User, cred *WebAuthnCredential) error {
+	return b.udbc.AddWebAuthnCredential(b.ctx, user, cred)
+}
+
+func (b *boundUserDB) ListWebAuthnCredentials(user *User) ([]WebAuthnCredential, error) {
+	return b.udbc.ListWebAuthnCredentials(b.ctx, user)
+}
+
+func (b *boundUserDB) GetWebAuthnCredential(credID []byte) (*User, *WebAuthnCredential, error) {
+	return b.udbc.GetWebAuthnCredential(b.ctx, credID)
+}
+
+func (b *boundUserDB) UseWebAuthnCredential(credID []byte, signCount int64) (bool, error) {
+	return b.udbc.UseWebAuthnCredential(b.ctx, credID, signCount)
+}
+
+func (b *boundUserDB) DelWebAuthnCredential(user *User, credID []byte) error {
+	return b.udbc.DelWebAuthnCredential(b.ctx, user, credID)
+}
+
+func (b *boundUserDB) PutWebAuthnChallenge(challenge []byte, expires int64) error {
+	return b.udbc.PutWebAuthnChallenge(b.ctx, challenge, expires)
+}
+
+func (b *boundUserDB) TakeWebAuthnChallenge(challenge []byte) (bool, error) {
+	return b.udbc.TakeWebAuthnChallenge(b.ctx, challenge)
+}
+
+func (b *boundUserDB) SetRecoveryCodes(user *User, hashes [][]byte) error {
+	return b.udbc.SetRecoveryCodes(b.ctx, user, hashes)
+}
+
+func (b *boundUserDB) GetRecoveryCodes(user *User) ([][]byte, error) {
+	return b.udbc.GetRecoveryCodes(b.ctx, user)
+}
+
+func (b *boundUserDB) DelRecoveryCode(user *User, hash []byte) (bool, error) {
+	return b.udbc.DelRecoveryCode(b.ctx, user, hash)
+}
+
+func (b *boundUserDB) LogAuthEvent(ev *AuthEvent) error {
+	return b.udbc.LogAuthEvent(b.ctx, ev)
+}
+
+func (b *boundUserDB) GetAuthEvents(guid, start, end int64, limit int) ([]AuthEvent, error) {
+	return b.udbc.GetAuthEvents(b.ctx, guid, start, end, limit)
+}
+
+type contextUserDB struct {
+	udb UserDB
+}
+
+func (c *contextUserDB) Setup(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.Setup()
+}
+
+func (c *contextUserDB) Hooks() *HookRegistry {
+	return c.udb.Hooks()
+}
+
+func (c *contextUserDB) EmailNormalization() *EmailNormalization {
+	return c.udb.EmailNormalization()
+}
+
+func (c *contextUserDB) PutNewUser(ctx context.Context, nu *User) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.PutNewUser(nu)
+}
+
+func (c *contextUserDB) GetUser(ctx context.Context, guid int64) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetUser(guid)
+}
+
+func (c *contextUserDB) GetLocalUser(ctx context.Context, username string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetLocalUser(username)
+}
+
+func (c *contextUserDB) GetSocialUser(ctx context.Context, service, id string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetSocialUser(service, id)
+}
+
+func (c *contextUserDB) GetUsers(ctx context.Context, guids []int64) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetUsers(guids)
+}
+
+func (c *contextUserDB) GetEmailUser(ctx context.Context, email string, validatedOnly bool) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetEmailUser(email, validatedOnly)
+}
+
+func (c *contextUserDB) ListUsers(ctx context.Context, q UserQuery) ([]*User, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", err
+	}
+	return c.udb.ListUsers(q)
+}
+
+func (c *contextUserDB) DisableUser(ctx context.Context, user *User, reason string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.DisableUser(user, reason)
+}
+
+func (c *contextUserDB) EnableUser(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.EnableUser(user)
+}
+
+func (c *contextUserDB) GetDisabled(ctx context.Context, user *User) (disabled bool, reason string, err error) {
+	if err := ctx.Err(); err != nil {
+		return false, "", err
+	}
+	return c.udb.GetDisabled(user)
+}
+
+func (c *contextUserDB) DeleteUser(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.DeleteUser(user)
+}
+
+func (c *contextUserDB) ExportUser(ctx context.Context, guid int64) (*UserExport, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.ExportUser(guid)
+}
+
+func (c *contextUserDB) SetUserPrefs(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.SetUserPrefs(user)
+}
+
+func (c *contextUserDB) SetUserPassword(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.SetUserPassword(user)
+}
+
+func (c *contextUserDB) SetLogin(ctx context.Context, user *User, username, password string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.SetLogin(user, username, password)
+}
+
+func (c *contextUserDB) AddEmail(ctx context.Context, user *User, email EmailRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.AddEmail(user, email)
+}
+
+func (c *contextUserDB) DelEmail(ctx context.Context, user *User, email string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.DelEmail(user, email)
+}
+
+func (c *contextUserDB) Feedback(ctx context.Context, user *User, now int64, text string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.Feedback(user, now, text)
+}
+
+func (c *contextUserDB) ListFeedback(ctx context.Context, guid, start, end int64, offset, limit int) ([]FeedbackRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.ListFeedback(guid, start, end, offset, limit)
+}
+
+func (c *contextUserDB) LimitedFeedback(ctx context.Context, user *User, now int64, text string, start int64, max int) (bool, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return false, 0, err
+	}
+	return c.udb.LimitedFeedback(user, now, text, start, max)
+}
+
+func (c *contextUserDB) CreateAPIKey(ctx context.Context, user *User, name string, scopes []string) (string, *APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	return c.udb.CreateAPIKey(user, name, scopes)
+}
+
+func (c *contextUserDB) ListAPIKeys(ctx context.Context, user *User) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.ListAPIKeys(user)
+}
+
+func (c *contextUserDB) RevokeAPIKey(ctx context.Context, user *User, prefix string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.RevokeAPIKey(user, prefix)
+}
+
+func (c *contextUserDB) GetAPIKeyUser(ctx context.Context, key string) (*User, *APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.udb.GetAPIKeyUser(key)
+}
+
+func (c *contextUserDB) PutTOTP(ctx context.Context, user *User, rec *TOTPRecord) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.PutTOTP(user, rec)
+}
+
+func (c *contextUserDB) GetTOTP(ctx context.Context, user *User) (*TOTPRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetTOTP(user)
+}
+
+func (c *contextUserDB) UseTOTPStep(ctx context.Context, user *User, step int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.udb.UseTOTPStep(user, step)
+}
+
+func (c *contextUserDB) DelTOTP(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.DelTOTP(user)
+}
+
+func (c *contextUserDB) AddWebAuthnCredential(ctx context.Context, user *User, cred *WebAuthnCredential) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.AddWebAuthnCredential(user, cred)
+}
+
+func (c *contextUserDB) ListWebAuthnCredentials(ctx context.Context, user *User) ([]WebAuthnCredential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.ListWebAuthnCredentials(user)
+}
+
+func (c *contextUserDB) GetWebAuthnCredential(ctx context.Context, credID []byte) (*User, *WebAuthnCredential, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return c.udb.GetWebAuthnCredential(credID)
+}
+
+func (c *contextUserDB) UseWebAuthnCredential(ctx context.Context, credID []byte, signCount int64) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.udb.UseWebAuthnCredential(credID, signCount)
+}
+
+func (c *contextUserDB) DelWebAuthnCredential(ctx context.Context, user *User, credID []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.DelWebAuthnCredential(user, credID)
+}
+
+func (c *contextUserDB) PutWebAuthnChallenge(ctx context.Context, challenge []byte, expires int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.PutWebAuthnChallenge(challenge, expires)
+}
+
+func (c *contextUserDB) TakeWebAuthnChallenge(ctx context.Context, challenge []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.udb.TakeWebAuthnChallenge(challenge)
+}
+
+func (c *contextUserDB) SetRecoveryCodes(ctx context.Context, user *User, hashes [][]byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.SetRecoveryCodes(user, hashes)
+}
+
+func (c *contextUserDB) GetRecoveryCodes(ctx context.Context, user *User) ([][]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetRecoveryCodes(user)
+}
+
+func (c *contextUserDB) DelRecoveryCode(ctx context.Context, user *User, hash []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return c.udb.DelRecoveryCode(user, hash)
+}
+
+func (c *contextUserDB) LogAuthEvent(ctx context.Context, ev *AuthEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.udb.LogAuthEvent(ev)
+}
+
+func (c *contextUserDB) GetAuthEvents(ctx context.Context, guid, start, end int64, limit int) ([]AuthEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.udb.GetAuthEvents(guid, start, end, limit)
+}
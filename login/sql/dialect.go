@@ -0,0 +1,174 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"reflect"
+)
+
+// Dialect holds the SQL that differs between databases. Queries
+// elsewhere in this package are written for postgres with $N
+// placeholders and go through Rebind.
+type Dialect interface {
+	// "postgres", "sqlite3", "mysql"
+	Name() string
+
+	// Rewrite $N placeholders for the driver, with args to match
+	Rebind(cmd string, args []interface{}) (string, []interface{})
+
+	// guser primary key column
+	GuserId() string
+
+	// Insert a guser row, return its id
+	InsertGuser(ctx context.Context, tx *sql.Tx, username sql.NullString, password, prefs []byte, created int64) (int64, error)
+
+	// Schema versions, see migrate.go
+	Migrations() [][]string
+}
+
+var (
+	PostgresDialect Dialect = postgresDialect{}
+	Sqlite3Dialect  Dialect = sqlite3Dialect{}
+	MysqlDialect    Dialect = mysqlDialect{}
+)
+
+// Package path of a database/sql driver type to its Dialect
+var driverDialects = map[string]Dialect{
+	"github.com/lib/pq":              PostgresDialect,
+	"github.com/jackc/pgx/stdlib":    PostgresDialect,
+	"github.com/jackc/pgx/v4/stdlib": PostgresDialect,
+	"github.com/jackc/pgx/v5/stdlib": PostgresDialect,
+	"github.com/mattn/go-sqlite3":    Sqlite3Dialect,
+	"modernc.org/sqlite":             Sqlite3Dialect,
+	"github.com/glebarez/go-sqlite":  Sqlite3Dialect,
+	"github.com/go-sql-driver/mysql": MysqlDialect,
+}
+
+// Dialect for db's driver. Unknown drivers get PostgresDialect.
+func DetectDialect(db *sql.DB) Dialect {
+	dialect, ok := detectDialect(db)
+	if !ok {
+		log.Printf("unknown sql driver %T, assuming postgres", db.Driver())
+	}
+	return dialect
+}
+
+func detectDialect(db *sql.DB) (Dialect, bool) {
+	t := reflect.TypeOf(db.Driver())
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	dialect, ok := driverDialects[t.PkgPath()]
+	if !ok {
+		return PostgresDialect, false
+	}
+	return dialect, true
+}
+
+// A *sql.DB and the Dialect to run queries on it with
+type dialectDB struct {
+	*sql.DB
+	dialect Dialect
+}
+
+// For the standalone functions taking a *sql.DB. Use a UserDB from
+// NewSqlUserDBWithDialect for drivers DetectDialect doesn't know.
+func detectDB(db *sql.DB) dialectDB {
+	dialect, _ := detectDialect(db)
+	return dialectDB{db, dialect}
+}
+
+// Run queries through these to rewrite them for db's dialect
+
+func dbExec(db dialectDB, cmd string, args ...interface{}) (sql.Result, error) {
+	return dbExecContext(context.Background(), db, cmd, args...)
+}
+
+func dbExecContext(ctx context.Context, db dialectDB, cmd string, args ...interface{}) (sql.Result, error) {
+	cmd, args = db.dialect.Rebind(cmd, args)
+	return db.ExecContext(ctx, cmd, args...)
+}
+
+func dbQuery(db dialectDB, cmd string, args ...interface{}) (*sql.Rows, error) {
+	return dbQueryContext(context.Background(), db, cmd, args...)
+}
+
+func dbQueryContext(ctx context.Context, db dialectDB, cmd string, args ...interface{}) (*sql.Rows, error) {
+	cmd, args = db.dialect.Rebind(cmd, args)
+	return db.QueryContext(ctx, cmd, args...)
+}
+
+// tx must be from db
+func txQueryContext(ctx context.Context, db dialectDB, tx *sql.Tx, cmd string, args ...interface{}) (*sql.Rows, error) {
+	cmd, args = db.dialect.Rebind(cmd, args)
+	return tx.QueryContext(ctx, cmd, args...)
+}
+
+// tx must be from db
+func txExec(db dialectDB, tx *sql.Tx, cmd string, args ...interface{}) (sql.Result, error) {
+	return txExecContext(context.Background(), db, tx, cmd, args...)
+}
+
+func txExecContext(ctx context.Context, db dialectDB, tx *sql.Tx, cmd string, args ...interface{}) (sql.Result, error) {
+	cmd, args = db.dialect.Rebind(cmd, args)
+	return tx.ExecContext(ctx, cmd, args...)
+}
+
+// postgres is the baseline, others deviate from it
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+func (postgresDialect) Rebind(cmd string, args []interface{}) (string, []interface{}) {
+	return cmd, args
+}
+
+func (postgresDialect) GuserId() string {
+	return "id"
+}
+
+func (postgresDialect) InsertGuser(ctx context.Context, tx *sql.Tx, username sql.NullString, password, prefs []byte, created int64) (int64, error) {
+	idrows, err := tx.QueryContext(ctx, `INSERT INTO guser (username, password, prefs, created) VALUES ($1, $2, $3, $4) RETURNING id`, username, password, prefs, created)
+	if err != nil {
+		err = fmt.Errorf("error inserting new user: %s", err)
+		return 0, err
+	}
+	defer idrows.Close()
+	var newGuid int64 = 0
+	if idrows.Next() {
+		err = idrows.Scan(&newGuid)
+		if err != nil {
+			err = fmt.Errorf("could not get new guid: %s", err)
+			return 0, err
+		}
+	}
+	// This call to Next which doesn't do anything but return
+	// false is necssary due to lib/pq driver oddities!
+	for idrows.Next() {
+		log.Print("bogus extra rows of return from INSERT!")
+	}
+	return newGuid, err
+}
+
+func (postgresDialect) Migrations() [][]string {
+	return postgresMigrations
+}
+
+// INSERT and return LastInsertId, for sqlite3 and mysql
+func insertGuserLastId(ctx context.Context, dialect Dialect, tx *sql.Tx, username sql.NullString, password, prefs []byte, created int64) (int64, error) {
+	cmd, args := dialect.Rebind(`INSERT INTO guser (username, password, prefs, created) VALUES ($1, $2, $3, $4)`, []interface{}{username, password, prefs, created})
+	result, err := tx.ExecContext(ctx, cmd, args...)
+	if err != nil {
+		err = fmt.Errorf("error inserting new user: %s", err)
+		return 0, err
+	}
+	newGuid, err := result.LastInsertId()
+	if err != nil {
+		err = fmt.Errorf("could not get user insert id, %v", err)
+	}
+	return newGuid, err
+}
@@ -0,0 +1,127 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Login is refused for disabled users, wrapped with the reason.
+// Test with errors.Is()
+var ErrUserDisabled = errors.New("user disabled")
+
+// A row here disables the user. Their other data is untouched.
+const createUserDisabled = `CREATE TABLE IF NOT EXISTS user_disabled (
+id bigint PRIMARY KEY, -- foreign key guser.id
+reason varchar(300),
+since bigint -- unix timestamp
+)`
+
+func DisableUser(db *sql.DB, user *User, reason string) error {
+	return DisableUserContext(context.Background(), db, user, reason)
+}
+
+func DisableUserContext(ctx context.Context, db *sql.DB, user *User, reason string) error {
+	return disableUser(ctx, detectDB(db), user, reason)
+}
+
+func disableUser(ctx context.Context, db dialectDB, user *User, reason string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	_, err = txExecContext(ctx, db, tx, `DELETE FROM user_disabled WHERE id = $1`, user.Guid)
+	if err != nil {
+		return err
+	}
+	_, err = txExecContext(ctx, db, tx, `INSERT INTO user_disabled (id, reason, since) VALUES ($1, $2, $3)`, user.Guid, reason, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func EnableUser(db *sql.DB, user *User) error {
+	return EnableUserContext(context.Background(), db, user)
+}
+
+func EnableUserContext(ctx context.Context, db *sql.DB, user *User) error {
+	return enableUser(ctx, detectDB(db), user)
+}
+
+func enableUser(ctx context.Context, db dialectDB, user *User) error {
+	_, err := dbExecContext(ctx, db, `DELETE FROM user_disabled WHERE id = $1`, user.Guid)
+	return err
+}
+
+func GetDisabled(db *sql.DB, user *User) (disabled bool, reason string, err error) {
+	return GetDisabledContext(context.Background(), db, user)
+}
+
+func GetDisabledContext(ctx context.Context, db *sql.DB, user *User) (disabled bool, reason string, err error) {
+	return getDisabled(ctx, detectDB(db), user)
+}
+
+func getDisabled(ctx context.Context, db dialectDB, user *User) (disabled bool, reason string, err error) {
+	rows, err := dbQueryContext(ctx, db, `SELECT reason FROM user_disabled WHERE id = $1`, user.Guid)
+	if err != nil {
+		return false, "", err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		var nreason sql.NullString
+		err = rows.Scan(&nreason)
+		return err == nil, nreason.String, err
+	}
+	return false, "", rows.Err()
+}
+
+// Tables with one or more rows per user, keyed by id
+var userTables = []string{
+	"user_social",
+	"user_email",
+	"user_apikey",
+	"user_totp",
+	"user_webauthn",
+	"user_recovery",
+	"user_disabled",
+}
+
+// Delete user and their logins, emails and credentials.
+// The auth event log is kept. guserId is the guser primary key column.
+func commonDeleteUser(ctx context.Context, db dialectDB, guserId string, hr *HookRegistry, user *User) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	result, err := txExecContext(ctx, db, tx, `DELETE FROM guser WHERE `+guserId+` = $1`, user.Guid)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return BadUserError
+	}
+	for _, table := range userTables {
+		_, err = txExecContext(ctx, db, tx, `DELETE FROM `+table+` WHERE id = $1`, user.Guid)
+		if err != nil {
+			return err
+		}
+	}
+	err = hr.FireUserDeletedTx(tx, user)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	hr.FireUserDeleted(user)
+	return nil
+}
@@ -0,0 +1,123 @@
+package sql
+
+import (
+	"strings"
+)
+
+// How a UserDB normalizes addresses, see UserDB.EmailNormalization().
+// Set before using the UserDB; addresses already stored keep the form
+// they were stored in, and lookups also match them.
+type EmailNormalization struct {
+	// a.b.c@gmail.com is abc@gmail.com, as Gmail delivers them alike.
+	// Also googlemail.com.
+	GmailDots bool
+
+	// a+tag@example.com is a@example.com
+	PlusTags bool
+}
+
+// Trimmed and lower case. What every UserDB stores at least, and what
+// the standalone functions taking a *sql.DB use.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// NormalizeEmail, then en's options. A nil en has none.
+func (en *EmailNormalization) Normalize(email string) string {
+	email = NormalizeEmail(email)
+	if en == nil {
+		return email
+	}
+	at := strings.LastIndexByte(email, '@')
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at+1:]
+	if en.PlusTags {
+		if plus := strings.IndexByte(local, '+'); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	if en.GmailDots && (domain == "gmail.com" || domain == "googlemail.com") {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain
+}
+
+// The forms of email to look up: en.Normalize(email), and
+// NormalizeEmail(email) for addresses stored before en's options were
+// set. One string if they're the same.
+func (en *EmailNormalization) LookupForms(email string) []string {
+	norm := en.Normalize(email)
+	lower := NormalizeEmail(email)
+	if norm == lower {
+		return []string{norm}
+	}
+	return []string{norm, lower}
+}
+
+// en.Normalize nu's addresses before storing it, dropping any that
+// become the same.
+func (en *EmailNormalization) NormalizeUserEmails(nu *User) {
+	if len(nu.Email) == 0 {
+		return
+	}
+	emails := make([]EmailRecord, 0, len(nu.Email))
+	for _, em := range nu.Email {
+		em.Email = en.Normalize(em.Email)
+		dup := false
+		for _, xe := range emails {
+			if xe.Email == em.Email {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			emails = append(emails, em)
+		}
+	}
+	nu.Email = emails
+}
+
+// Migration 6: NormalizeEmail the stored addresses, which older code
+// kept as given. Where one user has an address in several cases the
+// row already lower case is kept, else the first by byte order.
+var lowerStoredEmails = []string{
+	`DELETE FROM user_email WHERE email <> LOWER(TRIM(email)) AND EXISTS (SELECT 1 FROM user_email o WHERE o.id = user_email.id AND o.email = LOWER(TRIM(user_email.email)))`,
+	`DELETE FROM user_email WHERE email <> LOWER(TRIM(email)) AND EXISTS (SELECT 1 FROM user_email o WHERE o.id = user_email.id AND LOWER(TRIM(o.email)) = LOWER(TRIM(user_email.email)) AND o.email < user_email.email)`,
+	`UPDATE user_email SET email = LOWER(TRIM(email)) WHERE email <> LOWER(TRIM(email))`,
+}
+
+// MySQL can't DELETE with a subquery on the same table, and compares
+// case insensitively unless BINARY
+var mysqlLowerStoredEmails = []string{
+	`DELETE e FROM user_email e JOIN user_email o ON o.id = e.id AND BINARY o.email = BINARY LOWER(TRIM(e.email)) WHERE BINARY e.email <> BINARY LOWER(TRIM(e.email))`,
+	`DELETE e FROM user_email e JOIN user_email o ON o.id = e.id AND LOWER(TRIM(o.email)) = LOWER(TRIM(e.email)) AND BINARY o.email < BINARY e.email WHERE BINARY e.email <> BINARY LOWER(TRIM(e.email))`,
+	`UPDATE user_email SET email = LOWER(TRIM(email)) WHERE BINARY email <> BINARY LOWER(TRIM(email))`,
+}
+
+// Which of the users having an address GetEmailUser returns: a validated
+// one first, then the lowest guid. Offer each in any order.
+type EmailUserChoice struct {
+	ValidatedOnly bool
+
+	found     bool
+	guid      int64
+	validated bool
+}
+
+func (ec *EmailUserChoice) Offer(guid int64, validated bool) {
+	if ec.ValidatedOnly && !validated {
+		return
+	}
+	if !ec.found || (validated && !ec.validated) || (validated == ec.validated && guid < ec.guid) {
+		ec.found = true
+		ec.guid = guid
+		ec.validated = validated
+	}
+}
+
+// The chosen guid, ok false if none was offered
+func (ec *EmailUserChoice) Chosen() (guid int64, ok bool) {
+	return ec.guid, ec.found
+}
@@ -0,0 +1,48 @@
+package sql_test
+
+import (
+	"testing"
+
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		opts  ls.EmailNormalization
+		email string
+		want  string
+	}{
+		{ls.EmailNormalization{}, " Jo.Doe+news@GMail.com ", "jo.doe+news@gmail.com"},
+		{ls.EmailNormalization{}, "not an address", "not an address"},
+		{ls.EmailNormalization{PlusTags: true}, "Jo.Doe+news@GMail.com", "jo.doe@gmail.com"},
+		{ls.EmailNormalization{PlusTags: true}, "+news@example.com", "+news@example.com"},
+		{ls.EmailNormalization{GmailDots: true}, "Jo.Doe+news@GMail.com", "jodoe+news@gmail.com"},
+		{ls.EmailNormalization{GmailDots: true}, "jo.doe@googlemail.com", "jodoe@googlemail.com"},
+		{ls.EmailNormalization{GmailDots: true}, "jo.doe@example.com", "jo.doe@example.com"},
+		{ls.EmailNormalization{GmailDots: true, PlusTags: true}, "Jo.Doe+news@gmail.com", "jodoe@gmail.com"},
+	}
+	for _, tc := range cases {
+		if got := tc.opts.Normalize(tc.email); got != tc.want {
+			t.Errorf("%#v Normalize(%q) = %q, wanted %q", tc.opts, tc.email, got, tc.want)
+		}
+	}
+	var nilen *ls.EmailNormalization
+	if got := nilen.Normalize(" A@B.com"); got != "a@b.com" {
+		t.Errorf("nil Normalize gave %q", got)
+	}
+
+	mdb := ls.NewMemoryUserDB()
+	*mdb.EmailNormalization() = ls.EmailNormalization{GmailDots: true, PlusTags: true}
+	nu := &ls.User{Username: "dotted", Email: []ls.EmailRecord{ls.NewEmail("Jo.Doe@gmail.com"), ls.NewEmail("jodoe+dup@gmail.com")}}
+	_, err := mdb.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nu.Email) != 1 || nu.Email[0].Email != "jodoe@gmail.com" {
+		t.Errorf("stored emails %#v", nu.Email)
+	}
+	xu, err := mdb.GetEmailUser("j.o.d.o.e+login@GMAIL.com", false)
+	if err != nil || xu.Guid != nu.Guid {
+		t.Errorf("get email user %#v, %v", xu, err)
+	}
+}
@@ -0,0 +1,206 @@
+package sql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+)
+
+// Everything stored about a user, for giving to them on request.
+// Marshals to the export JSON document. Password hashes, TOTP secrets,
+// API key hashes, passkey public keys and recovery code hashes are left
+// out.
+type UserExport struct {
+	Exported int64 `json:"exported"` // unix timestamp
+
+	Guid        int64                  `json:"guid"`
+	Username    string                 `json:"username,omitempty"`
+	DisplayName string                 `json:"display_name,omitempty"`
+	Data        map[string]interface{} `json:"data,omitempty"`
+	HasPassword bool                   `json:"has_password"`
+	Created     int64                  `json:"created,omitempty"` // unix timestamp
+
+	Emails []ExportEmail  `json:"emails"`
+	Social []ExportSocial `json:"social"`
+
+	Sessions ExportSessions `json:"sessions"`
+
+	Disabled       bool   `json:"disabled,omitempty"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+
+	Events []ExportEvent `json:"events"`
+}
+
+type ExportEmail struct {
+	Email     string                 `json:"email"`
+	Validated bool                   `json:"validated"`
+	Added     int64                  `json:"added,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
+
+type ExportSocial struct {
+	Service string      `json:"service"`
+	Id      string      `json:"id"`
+	Profile interface{} `json:"profile,omitempty"`
+}
+
+// Login cookies and bearer tokens are signed, not stored, so there is
+// no list of them. These are the stored credentials.
+type ExportSessions struct {
+	Note                   string          `json:"note"`
+	APIKeys                []ExportAPIKey  `json:"api_keys"`
+	Passkeys               []ExportPasskey `json:"passkeys"`
+	TOTPEnabled            bool            `json:"totp_enabled"`
+	RecoveryCodesRemaining int             `json:"recovery_codes_remaining"`
+}
+
+type ExportAPIKey struct {
+	Prefix   string   `json:"prefix"`
+	Name     string   `json:"name"`
+	Scopes   []string `json:"scopes"`
+	Created  int64    `json:"created"`
+	LastUsed int64    `json:"lastused,omitempty"`
+}
+
+type ExportPasskey struct {
+	Name     string `json:"name"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastused,omitempty"`
+}
+
+type ExportEvent struct {
+	Time      int64  `json:"time"`
+	Type      string `json:"type"`
+	Method    string `json:"method,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+const exportSessionsNote = "Logins are signed cookies and tokens which are not stored. Logging out, or waiting for them to expire, ends them."
+
+// ExportUser for any UserDB, through its other methods
+func ExportUserFrom(ctx context.Context, udb UserDBContext, guid int64) (*UserExport, error) {
+	user, err := udb.GetUser(ctx, guid)
+	if err != nil {
+		return nil, err
+	}
+	ex := &UserExport{
+		Exported:    time.Now().Unix(),
+		Guid:        user.Guid,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
+		Data:        jsonSafeMap(user.Data),
+		HasPassword: len(user.Password) > 0,
+		Created:     user.Created,
+		Emails:      make([]ExportEmail, len(user.Email)),
+		Social:      make([]ExportSocial, len(user.Social)),
+	}
+	for i, em := range user.Email {
+		ex.Emails[i] = ExportEmail{em.Email, em.Validated, em.Added, jsonSafeMap(em.Data)}
+	}
+	for i, so := range user.Social {
+		ex.Social[i] = ExportSocial{so.Service, so.Id, socialProfile(so.Data)}
+	}
+	err = exportSessions(ctx, udb, user, &ex.Sessions)
+	if err != nil {
+		return nil, err
+	}
+	ex.Disabled, ex.DisabledReason, err = udb.GetDisabled(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	events, err := udb.GetAuthEvents(ctx, user.Guid, 0, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	ex.Events = make([]ExportEvent, len(events))
+	for i, ev := range events {
+		ex.Events[i] = ExportEvent{ev.Time, ev.Type, ev.Method, ev.IP, ev.UserAgent, ev.Detail}
+	}
+	return ex, nil
+}
+
+func exportSessions(ctx context.Context, udb UserDBContext, user *User, es *ExportSessions) error {
+	es.Note = exportSessionsNote
+	keys, err := udb.ListAPIKeys(ctx, user)
+	if err != nil {
+		return err
+	}
+	es.APIKeys = make([]ExportAPIKey, len(keys))
+	for i, k := range keys {
+		es.APIKeys[i] = ExportAPIKey{k.Prefix, k.Name, k.Scopes, k.Created, k.LastUsed}
+	}
+	creds, err := udb.ListWebAuthnCredentials(ctx, user)
+	if err != nil {
+		return err
+	}
+	es.Passkeys = make([]ExportPasskey, len(creds))
+	for i, c := range creds {
+		es.Passkeys[i] = ExportPasskey{c.Name, c.Created, c.LastUsed}
+	}
+	totp, err := udb.GetTOTP(ctx, user)
+	if err != nil {
+		return err
+	}
+	es.TOTPEnabled = totp != nil && totp.Enabled
+	codes, err := udb.GetRecoveryCodes(ctx, user)
+	if err != nil {
+		return err
+	}
+	es.RecoveryCodesRemaining = len(codes)
+	return nil
+}
+
+// Stored social data is cbor, decode it if we can
+func socialProfile(data interface{}) interface{} {
+	blob, ok := data.([]byte)
+	if !ok {
+		return jsonSafe(data)
+	}
+	if len(blob) == 0 {
+		return nil
+	}
+	var v interface{}
+	err := cbor.Loads(blob, &v)
+	if err != nil {
+		return blob
+	}
+	return jsonSafe(v)
+}
+
+func jsonSafeMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	return jsonSafe(m).(map[string]interface{})
+}
+
+// cbor decodes maps as map[interface{}]interface{}, which encoding/json
+// can't handle. Convert them to map[string]interface{}.
+func jsonSafe(v interface{}) interface{} {
+	switch xv := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(xv))
+		for k, mv := range xv {
+			out[fmt.Sprint(k)] = jsonSafe(mv)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(xv))
+		for k, mv := range xv {
+			out[k] = jsonSafe(mv)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(xv))
+		for i, iv := range xv {
+			out[i] = jsonSafe(iv)
+		}
+		return out
+	default:
+		return v
+	}
+}
@@ -0,0 +1,140 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+)
+
+// One message sent with UserDB.Feedback
+type FeedbackRecord struct {
+	Guid   int64
+	Millis int64 // unix milliseconds
+	Msg    string
+}
+
+const (
+	createFeedback = `CREATE TABLE IF NOT EXISTS feedback (
+guid bigint, -- guser.id
+millis bigint, -- unix milliseconds
+msg text
+)`
+	createFeedbackGuidIndex = `CREATE INDEX IF NOT EXISTS feedback_guid ON feedback ( guid, millis )`
+	createFeedbackTimeIndex = `CREATE INDEX IF NOT EXISTS feedback_millis ON feedback ( millis )`
+)
+
+func Feedback(db *sql.DB, user *User, now int64, text string) error {
+	return FeedbackContext(context.Background(), db, user, now, text)
+}
+
+func FeedbackContext(ctx context.Context, db *sql.DB, user *User, now int64, text string) error {
+	return feedback(ctx, detectDB(db), user, now, text)
+}
+
+func feedback(ctx context.Context, db dialectDB, user *User, now int64, text string) error {
+	_, err := dbExecContext(ctx, db, `INSERT INTO feedback (guid, millis, msg) VALUES ($1, $2, $3)`, user.Guid, now, text)
+	return err
+}
+
+// Feedback unless user already sent max since start, see UserDB
+func LimitedFeedback(db *sql.DB, user *User, now int64, text string, start int64, max int) (bool, int64, error) {
+	return LimitedFeedbackContext(context.Background(), db, user, now, text, start, max)
+}
+
+func LimitedFeedbackContext(ctx context.Context, db *sql.DB, user *User, now int64, text string, start int64, max int) (bool, int64, error) {
+	return limitedFeedback(ctx, detectDB(db), user, now, text, start, max)
+}
+
+func limitedFeedback(ctx context.Context, db dialectDB, user *User, now int64, text string, start int64, max int) (bool, int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, 0, err
+	}
+	defer tx.Rollback() // nop if committed
+	// Lock the user's guser row first, so their submissions count and
+	// insert one at a time, and each counts what the one before stored.
+	_, err = txExecContext(ctx, db, tx, `UPDATE guser SET created = created WHERE `+db.dialect.GuserId()+` = $1`, user.Guid)
+	if err != nil {
+		return false, 0, err
+	}
+	rows, err := txQueryContext(ctx, db, tx, `SELECT millis FROM feedback WHERE guid = $1 AND millis >= $2 ORDER BY millis DESC LIMIT $3`, user.Guid, start, max)
+	if err != nil {
+		return false, 0, err
+	}
+	count := 0
+	var oldest int64
+	for rows.Next() {
+		err = rows.Scan(&oldest)
+		if err != nil {
+			rows.Close()
+			return false, 0, err
+		}
+		count++
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return false, 0, err
+	}
+	if count >= max {
+		return false, oldest, nil
+	}
+	_, err = txExecContext(ctx, db, tx, `INSERT INTO feedback (guid, millis, msg) VALUES ($1, $2, $3)`, user.Guid, now, text)
+	if err != nil {
+		return false, 0, err
+	}
+	return true, 0, tx.Commit()
+}
+
+// Feedback newest first with start <= Millis < end, skipping the first
+// offset. guid 0 for all users. end 0 for no upper bound, limit 0 for
+// no limit.
+func ListFeedback(db *sql.DB, guid, start, end int64, offset, limit int) ([]FeedbackRecord, error) {
+	return ListFeedbackContext(context.Background(), db, guid, start, end, offset, limit)
+}
+
+func ListFeedbackContext(ctx context.Context, db *sql.DB, guid, start, end int64, offset, limit int) ([]FeedbackRecord, error) {
+	return listFeedback(ctx, detectDB(db), guid, start, end, offset, limit)
+}
+
+func listFeedback(ctx context.Context, db dialectDB, guid, start, end int64, offset, limit int) ([]FeedbackRecord, error) {
+	cmd := `SELECT guid, millis, msg FROM feedback WHERE millis >= $1`
+	args := []interface{}{start}
+	if end != 0 {
+		args = append(args, end)
+		cmd += ` AND millis < $2`
+	}
+	if guid != 0 {
+		args = append(args, guid)
+		cmd += ` AND guid = $` + strconv.Itoa(len(args))
+	}
+	cmd += ` ORDER BY millis DESC`
+	if limit > 0 {
+		args = append(args, limit)
+		cmd += ` LIMIT $` + strconv.Itoa(len(args))
+		if offset > 0 {
+			args = append(args, offset)
+			cmd += ` OFFSET $` + strconv.Itoa(len(args))
+			offset = 0
+		}
+	}
+	rows, err := dbQueryContext(ctx, db, cmd, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]FeedbackRecord, 0)
+	for rows.Next() {
+		// without a LIMIT, OFFSET syntax differs between databases
+		if offset > 0 {
+			offset--
+			continue
+		}
+		var fr FeedbackRecord
+		err = rows.Scan(&fr.Guid, &fr.Millis, &fr.Msg)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, fr)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,337 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+)
+
+// Callbacks on auth lifecycle events, e.g. to provision app data on
+// first login or send a welcome email. Each UserDB has its own
+// registry; register at startup on udb.Hooks(). The standalone
+// functions taking a *sql.DB run no hooks.
+//
+// The On*Tx hooks run inside the transaction making the change and
+// OnLogin hooks run before the login cookie is set; an error from any
+// of them vetoes the action. The rest are notifications run after the
+// change commits.
+//
+// Hooks are called without the registry locked, so a hook may register
+// more hooks; those run from the next event on.
+
+var ErrVetoed = errors.New("vetoed by hook")
+
+// Returned when a hook vetoes an action. errors.Is(err, ErrVetoed) is
+// true, and Unwrap gives the hook's error.
+type VetoError struct {
+	Event string
+	Err   error
+}
+
+func (ve *VetoError) Error() string {
+	return ve.Event + " vetoed: " + ve.Err.Error()
+}
+
+func (ve *VetoError) Unwrap() error {
+	return ve.Err
+}
+
+func (ve *VetoError) Is(target error) bool {
+	return target == ErrVetoed
+}
+
+type HookRegistry struct {
+	l sync.RWMutex
+
+	userCreatedTx   []func(tx *sql.Tx, user *User) error
+	userCreated     []func(user *User)
+	login           []func(user *User, method string) error
+	loginFailed     []func(guid int64, method, detail string, err error)
+	logout          []func(guid int64)
+	passwordChanged []func(user *User)
+	emailAddedTx    []func(tx *sql.Tx, user *User, email string) error
+	emailAdded      []func(user *User, email string)
+	emailDeletedTx  []func(tx *sql.Tx, user *User, email string) error
+	emailDeleted    []func(user *User, email string)
+	socialLinked    []func(user *User, social UserSocial)
+	userDeletedTx   []func(tx *sql.Tx, user *User) error
+	userDeleted     []func(user *User)
+}
+
+// After PutNewUser commits. To veto a new user use OnUserCreatedTx.
+func (hr *HookRegistry) OnUserCreated(f func(user *User)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.userCreated = append(hr.userCreated, f)
+}
+
+// Runs in the PutNewUser transaction, after user.Guid is set, for rows
+// that should commit or roll back with the new user. Returning an error
+// rolls back the new user. tx is nil for non-SQL UserDBs, which run it
+// after storing the user and delete the user again on a veto.
+func (hr *HookRegistry) OnUserCreatedTx(f func(tx *sql.Tx, user *User) error) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.userCreatedTx = append(hr.userCreatedTx, f)
+}
+
+// Runs after credentials check out, before the login cookie or token
+// is issued. Returning an error refuses the login.
+// method is "password", "webauthn", an oauth service name, etc.
+func (hr *HookRegistry) OnLogin(f func(user *User, method string) error) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.login = append(hr.login, f)
+}
+
+// guid is 0 if the user is unknown. detail is e.g. the username tried.
+func (hr *HookRegistry) OnLoginFailed(f func(guid int64, method, detail string, err error)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.loginFailed = append(hr.loginFailed, f)
+}
+
+func (hr *HookRegistry) OnLogout(f func(guid int64)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.logout = append(hr.logout, f)
+}
+
+// Also called when SetLogin gives a social user a password
+func (hr *HookRegistry) OnPasswordChanged(f func(user *User)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.passwordChanged = append(hr.passwordChanged, f)
+}
+
+func (hr *HookRegistry) OnEmailAdded(f func(user *User, email string)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.emailAdded = append(hr.emailAdded, f)
+}
+
+// Runs in the AddEmail transaction, for rows that should commit or
+// roll back with the email. Returning an error rolls back the email.
+// tx is nil for non-SQL UserDBs, which run it after the change and
+// only log the error.
+func (hr *HookRegistry) OnEmailAddedTx(f func(tx *sql.Tx, user *User, email string) error) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.emailAddedTx = append(hr.emailAddedTx, f)
+}
+
+// Like OnEmailAddedTx, for DelEmail
+func (hr *HookRegistry) OnEmailDeletedTx(f func(tx *sql.Tx, user *User, email string) error) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.emailDeletedTx = append(hr.emailDeletedTx, f)
+}
+
+func (hr *HookRegistry) OnEmailDeleted(f func(user *User, email string)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.emailDeleted = append(hr.emailDeleted, f)
+}
+
+// Called when a social login is attached to a user, including a new
+// user created by social login.
+func (hr *HookRegistry) OnSocialLinked(f func(user *User, social UserSocial)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.socialLinked = append(hr.socialLinked, f)
+}
+
+// Like OnEmailAddedTx, for DeleteUser
+func (hr *HookRegistry) OnUserDeletedTx(f func(tx *sql.Tx, user *User) error) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.userDeletedTx = append(hr.userDeletedTx, f)
+}
+
+// After DeleteUser commits
+func (hr *HookRegistry) OnUserDeleted(f func(user *User)) {
+	hr.l.Lock()
+	defer hr.l.Unlock()
+	hr.userDeleted = append(hr.userDeleted, f)
+}
+
+// Fire* run the registered hooks in order. The vetoable ones stop at
+// the first error and return it as a *VetoError. A nil *HookRegistry
+// has no hooks. Registration only appends, so the slice read under the
+// lock is a stable snapshot to run after unlocking.
+
+func (hr *HookRegistry) FireUserCreatedTx(tx *sql.Tx, user *User) error {
+	if hr == nil {
+		return nil
+	}
+	hr.l.RLock()
+	hooks := hr.userCreatedTx
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		err := f(tx, user)
+		if err != nil {
+			return &VetoError{"user created", err}
+		}
+	}
+	return nil
+}
+
+func (hr *HookRegistry) FireUserCreated(user *User) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.userCreated
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(user)
+	}
+}
+
+func (hr *HookRegistry) FireLogin(user *User, method string) error {
+	if hr == nil {
+		return nil
+	}
+	hr.l.RLock()
+	hooks := hr.login
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		err := f(user, method)
+		if err != nil {
+			return &VetoError{"login", err}
+		}
+	}
+	return nil
+}
+
+func (hr *HookRegistry) FireLoginFailed(guid int64, method, detail string, err error) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.loginFailed
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(guid, method, detail, err)
+	}
+}
+
+func (hr *HookRegistry) FireLogout(guid int64) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.logout
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(guid)
+	}
+}
+
+func (hr *HookRegistry) FirePasswordChanged(user *User) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.passwordChanged
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(user)
+	}
+}
+
+func (hr *HookRegistry) FireEmailAdded(user *User, email string) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.emailAdded
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(user, email)
+	}
+}
+
+func (hr *HookRegistry) FireEmailAddedTx(tx *sql.Tx, user *User, email string) error {
+	if hr == nil {
+		return nil
+	}
+	hr.l.RLock()
+	hooks := hr.emailAddedTx
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		err := f(tx, user, email)
+		if err != nil {
+			return &VetoError{"email added", err}
+		}
+	}
+	return nil
+}
+
+func (hr *HookRegistry) FireEmailDeletedTx(tx *sql.Tx, user *User, email string) error {
+	if hr == nil {
+		return nil
+	}
+	hr.l.RLock()
+	hooks := hr.emailDeletedTx
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		err := f(tx, user, email)
+		if err != nil {
+			return &VetoError{"email deleted", err}
+		}
+	}
+	return nil
+}
+
+func (hr *HookRegistry) FireEmailDeleted(user *User, email string) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.emailDeleted
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(user, email)
+	}
+}
+
+func (hr *HookRegistry) FireSocialLinked(user *User, social UserSocial) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.socialLinked
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(user, social)
+	}
+}
+
+func (hr *HookRegistry) FireUserDeletedTx(tx *sql.Tx, user *User) error {
+	if hr == nil {
+		return nil
+	}
+	hr.l.RLock()
+	hooks := hr.userDeletedTx
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		err := f(tx, user)
+		if err != nil {
+			return &VetoError{"user deleted", err}
+		}
+	}
+	return nil
+}
+
+func (hr *HookRegistry) FireUserDeleted(user *User) {
+	if hr == nil {
+		return
+	}
+	hr.l.RLock()
+	hooks := hr.userDeleted
+	hr.l.RUnlock()
+	for _, f := range hooks {
+		f(user)
+	}
+}
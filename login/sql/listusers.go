@@ -0,0 +1,334 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	cbor "github.com/brianolson/cbor_go"
+)
+
+// Which users ListUsers returns, and in what order. Zero values match
+// everyone.
+type UserQuery struct {
+	// Usernames starting with this, ignoring case
+	UsernamePrefix string
+	// Users with an email address containing this, case-insensitive
+	Email string
+	// Users with a social login from this service
+	Service  string
+	Disabled DisabledFilter
+	// unix timestamps, CreatedStart <= Created < CreatedEnd, 0 for no
+	// bound. With either bound, users with no Created don't match.
+	CreatedStart int64
+	CreatedEnd   int64
+
+	Sort       UserSort
+	Descending bool
+
+	// Next from the previous page of the same query, "" for the first
+	Cursor string
+	// 0 for no limit
+	Limit int
+}
+
+// Whether ListUsers wants disabled users, enabled users or both
+type DisabledFilter int
+
+const (
+	DisabledAny DisabledFilter = iota
+	DisabledOnly
+	EnabledOnly
+)
+
+// Usernames sort by their lower case bytes, so the same on every
+// database. sqlite3 lower cases only ASCII. Users with the same Username
+// or Created are ordered by guid.
+type UserSort int
+
+const (
+	SortByGuid UserSort = iota
+	SortByUsername
+	SortByCreated
+)
+
+var ErrBadCursor = errors.New("bad ListUsers cursor")
+
+// Where the last page ended, base64 cbor in UserQuery.Cursor
+type userCursor struct {
+	Sort UserSort
+	Desc bool
+	Name string
+	Time int64
+	Guid int64
+}
+
+func (q *UserQuery) cursorFor(u *User) string {
+	blob, err := cbor.Dumps(userCursor{q.Sort, q.Descending, u.Username, u.Created, u.Guid})
+	if err != nil {
+		log.Print("user cursor cbor ", err)
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(blob)
+}
+
+// nil for the first page
+func (q *UserQuery) cursor() (*userCursor, error) {
+	if q.Cursor == "" {
+		return nil, nil
+	}
+	blob, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var uc userCursor
+	err = cbor.Loads(blob, &uc)
+	if err != nil || uc.Sort != q.Sort || uc.Desc != q.Descending {
+		return nil, ErrBadCursor
+	}
+	return &uc, nil
+}
+
+// Sort order of a before b, ascending
+func (q *UserQuery) less(a, b *User) bool {
+	switch q.Sort {
+	case SortByUsername:
+		an, bn := strings.ToLower(a.Username), strings.ToLower(b.Username)
+		if an != bn {
+			return an < bn
+		}
+	case SortByCreated:
+		if a.Created != b.Created {
+			return a.Created < b.Created
+		}
+	}
+	return a.Guid < b.Guid
+}
+
+// For UserDBs without SQL: filter, sort and page all the users.
+// disabled reports whether a guid is disabled.
+func ListUsersFrom(q UserQuery, all []*User, disabled func(guid int64) bool) ([]*User, string, error) {
+	uc, err := q.cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	var after *User
+	if uc != nil {
+		after = &User{Guid: uc.Guid, Username: uc.Name, Created: uc.Time}
+	}
+	before := func(a, b *User) bool {
+		if q.Descending {
+			return q.less(b, a)
+		}
+		return q.less(a, b)
+	}
+	prefix := strings.ToLower(q.UsernamePrefix)
+	email := strings.ToLower(q.Email)
+	out := make([]*User, 0)
+	for _, u := range all {
+		if after != nil && !before(after, u) {
+			continue
+		}
+		if !strings.HasPrefix(strings.ToLower(u.Username), prefix) {
+			continue
+		}
+		if email != "" && !userEmailContains(u, email) {
+			continue
+		}
+		if q.Service != "" && !userHasService(u, q.Service) {
+			continue
+		}
+		if (q.CreatedStart != 0 || q.CreatedEnd != 0) && u.Created == 0 {
+			continue
+		}
+		if u.Created < q.CreatedStart || (q.CreatedEnd != 0 && u.Created >= q.CreatedEnd) {
+			continue
+		}
+		if q.Disabled != DisabledAny && disabled(u.Guid) != (q.Disabled == DisabledOnly) {
+			continue
+		}
+		out = append(out, u)
+	}
+	sort.Slice(out, func(i, j int) bool { return before(out[i], out[j]) })
+	if q.Limit > 0 && len(out) > q.Limit {
+		return out[:q.Limit], q.cursorFor(out[q.Limit-1]), nil
+	}
+	return out, "", nil
+}
+
+func userEmailContains(u *User, part string) bool {
+	for _, em := range u.Email {
+		if strings.Contains(strings.ToLower(em.Email), part) {
+			return true
+		}
+	}
+	return false
+}
+
+func userHasService(u *User, service string) bool {
+	for _, si := range u.Social {
+		if si.Service == service {
+			return true
+		}
+	}
+	return false
+}
+
+// For LIKE ... ESCAPE '!', which every database takes the same way
+func likeEscape(s string) string {
+	return strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(s)
+}
+
+// As sqlite3's LOWER()
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// LOWER(expr) compared and sorted by bytes, matching guser_lower_name
+func lowerKey(dialect Dialect, expr string) string {
+	switch dialect.Name() {
+	case "postgres":
+		return `LOWER(` + expr + `) COLLATE "C"`
+	case "mysql":
+		return `BINARY LOWER(` + expr + `)`
+	}
+	return `LOWER(` + expr + `)`
+}
+
+// Least string greater than every string starting with prefix,
+// "" if there is none
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// Users matching q, and the Cursor for the next page or "" if this is
+// the last. See UserQuery.
+func ListUsers(db *sql.DB, q UserQuery) ([]*User, string, error) {
+	return ListUsersContext(context.Background(), db, q)
+}
+
+func ListUsersContext(ctx context.Context, db *sql.DB, q UserQuery) ([]*User, string, error) {
+	return listUsers(ctx, detectDB(db), q)
+}
+
+func listUsers(ctx context.Context, db dialectDB, q UserQuery) ([]*User, string, error) {
+	uc, err := q.cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	dialect := db.dialect
+	id := `g.` + dialect.GuserId()
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return `$` + strconv.Itoa(len(args))
+	}
+
+	if q.UsernamePrefix != "" {
+		name := lowerKey(dialect, `g.username`)
+		if dialect.Name() == "sqlite3" {
+			// sqlite LIKE doesn't use the index, but < compares
+			// bytes so a range is the same thing
+			prefix := asciiLower(q.UsernamePrefix)
+			where = append(where, name+` >= `+arg(prefix))
+			if end := prefixEnd(prefix); end != "" {
+				where = append(where, name+` < `+arg(end))
+			}
+		} else {
+			where = append(where, name+` LIKE LOWER(`+arg(likeEscape(q.UsernamePrefix)+"%")+`) ESCAPE '!'`)
+		}
+	}
+	if q.Email != "" {
+		where = append(where, `EXISTS (SELECT 1 FROM user_email e WHERE e.id = `+id+` AND LOWER(e.email) LIKE `+arg("%"+likeEscape(strings.ToLower(q.Email))+"%")+` ESCAPE '!')`)
+	}
+	if q.Service != "" {
+		// socialkey is service\0id, and \1 comes right after \0
+		where = append(where, `EXISTS (SELECT 1 FROM user_social s WHERE s.id = `+id+` AND s.socialkey >= `+arg(q.Service+"\x00")+` AND s.socialkey < `+arg(q.Service+"\x01")+`)`)
+	}
+	switch q.Disabled {
+	case DisabledOnly:
+		where = append(where, `EXISTS (SELECT 1 FROM user_disabled d WHERE d.id = `+id+`)`)
+	case EnabledOnly:
+		where = append(where, `NOT EXISTS (SELECT 1 FROM user_disabled d WHERE d.id = `+id+`)`)
+	}
+	if q.CreatedStart != 0 || q.CreatedEnd != 0 {
+		where = append(where, `g.created >= `+arg(q.CreatedStart))
+	}
+	if q.CreatedEnd != 0 {
+		where = append(where, `g.created < `+arg(q.CreatedEnd))
+	}
+
+	// NULL username or created sorts as "" or 0, the same everywhere
+	var key string
+	switch q.Sort {
+	case SortByUsername:
+		key = lowerKey(dialect, `COALESCE(g.username, '')`)
+	case SortByCreated:
+		key = `COALESCE(g.created, 0)`
+	}
+	cmp, desc := `>`, ``
+	if q.Descending {
+		cmp, desc = `<`, ` DESC`
+	}
+	if uc != nil {
+		// args in the order they appear, for sqlite's $N
+		var after string
+		switch q.Sort {
+		case SortByUsername:
+			after = `(` + key + ` ` + cmp + ` LOWER(` + arg(uc.Name) + `) OR (` + key + ` = LOWER(` + arg(uc.Name) + `) AND `
+		case SortByCreated:
+			after = `(` + key + ` ` + cmp + ` ` + arg(uc.Time) + ` OR (` + key + ` = ` + arg(uc.Time) + ` AND `
+		}
+		after += id + ` ` + cmp + ` ` + arg(uc.Guid)
+		if key != "" {
+			after += `))`
+		}
+		where = append(where, after)
+	}
+
+	cmd := userSelect(dialect.GuserId())
+	if len(where) > 0 {
+		cmd += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	cmd += ` ORDER BY `
+	if key != "" {
+		cmd += key + desc + `, `
+	}
+	cmd += id + desc
+	if q.Limit > 0 {
+		// one more to know if there's a next page
+		cmd += ` LIMIT ` + arg(q.Limit+1)
+	}
+	rows, err := dbQueryContext(ctx, db, cmd, args...)
+	if err != nil {
+		log.Printf("sql err on %#v: %s", cmd, err)
+		return nil, "", err
+	}
+	users, err := readUsers(ctx, db, rows)
+	if err != nil {
+		return nil, "", err
+	}
+	if q.Limit > 0 && len(users) > q.Limit {
+		return users[:q.Limit], q.cursorFor(users[q.Limit-1]), nil
+	}
+	return users, "", nil
+}
@@ -0,0 +1,976 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+)
+
+// UserDB kept in memory, for tests and small deployments. Behaves like
+// the SQL backends: usernames and social logins are unique, PutNewUser
+// checks emails, users not found are BadUserError. Snapshot/Restore or
+// SaveFile/LoadFile to keep it across restarts.
+//
+// Hooks fire as for SQL, with a nil tx for OnUserCreatedTx. They run
+// without the lock held, so they may call back into the MemoryUserDB.
+type MemoryUserDB struct {
+	hooks *HookRegistry
+	en    *EmailNormalization
+
+	l sync.RWMutex
+
+	lastGuid int64
+	users    map[int64]*storedUser
+
+	// created but not yet past OnUserCreatedTx hooks
+	pending map[int64]*storedUser
+
+	byName   map[string]int64
+	bySocial map[string]int64
+
+	apiKeys  []storedAPIKey
+	totp     map[int64]*TOTPRecord
+	webauthn []storedWebAuthn
+	// sha256(challenge) to expiry, not in snapshots
+	challenges map[string]int64
+	recovery   map[int64][][]byte
+	disabled   map[int64]string
+	events     []AuthEvent
+	feedback   []FeedbackRecord
+}
+
+// A guser row with its user_social and user_email rows. Prefs and email
+// data are cbor as in the SQL tables, so every User read out is a fresh
+// copy.
+type storedUser struct {
+	Guid     int64
+	Username string
+	Password []byte
+	Prefs    []byte   // PrefsBlob
+	Social   []string // SocialKey()
+	Email    []storedEmail
+	Created  int64
+}
+
+type storedEmail struct {
+	Email string
+	Data  []byte // EmailMetadata
+}
+
+type storedAPIKey struct {
+	Hash []byte // APIKeyHash()
+	Guid int64
+	Key  APIKey
+}
+
+type storedWebAuthn struct {
+	Guid int64
+	Cred WebAuthnCredential
+}
+
+func NewMemoryUserDB() *MemoryUserDB {
+	mdb := &MemoryUserDB{hooks: &HookRegistry{}, en: &EmailNormalization{}}
+	mdb.reset()
+	return mdb
+}
+
+// must hold write lock
+func (mdb *MemoryUserDB) reset() {
+	mdb.lastGuid = 0
+	mdb.users = make(map[int64]*storedUser)
+	mdb.pending = make(map[int64]*storedUser)
+	mdb.byName = make(map[string]int64)
+	mdb.bySocial = make(map[string]int64)
+	mdb.apiKeys = nil
+	mdb.totp = make(map[int64]*TOTPRecord)
+	mdb.webauthn = nil
+	mdb.challenges = make(map[string]int64)
+	mdb.recovery = make(map[int64][][]byte)
+	mdb.disabled = make(map[int64]string)
+	mdb.events = nil
+	mdb.feedback = nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func (mu *storedUser) user() *User {
+	u := &User{
+		Guid:     mu.Guid,
+		Username: mu.Username,
+		Password: copyBytes(mu.Password),
+		Created:  mu.Created,
+		Email:    make([]EmailRecord, 0, len(mu.Email)),
+		Social:   make([]UserSocial, 0, len(mu.Social)),
+	}
+	for _, em := range mu.Email {
+		ne := EmailRecord{Email: em.Email}
+		if len(em.Data) > 0 {
+			cbor.Loads(em.Data, &ne.EmailMetadata)
+		}
+		u.Email = append(u.Email, ne)
+	}
+	for _, skey := range mu.Social {
+		service, sid := ParseSocialKey([]byte(skey))
+		u.Social = append(u.Social, UserSocial{Service: service, Id: sid})
+	}
+	if len(mu.Prefs) > 0 {
+		unpackPrefsBlob(u, mu.Prefs)
+	}
+	return u
+}
+
+func (mu *storedUser) hasEmail(email string) bool {
+	for _, em := range mu.Email {
+		if em.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold lock
+func (mdb *MemoryUserDB) getUser(guid int64) (*User, error) {
+	mu, ok := mdb.users[guid]
+	if !ok {
+		return nil, BadUserError
+	}
+	return mu.user(), nil
+}
+
+// Stored address matching one of EmailNormalization.LookupForms, as the
+// SQL UserDB matches rows lower cased by migration 6
+func emailIsForm(stored string, forms []string) bool {
+	return strInStrs(forms, NormalizeEmail(stored))
+}
+
+func (mu *storedUser) hasEmailForm(forms []string) bool {
+	for _, em := range mu.Email {
+		if emailIsForm(em.Email, forms) {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold lock. Includes pending users, as a unique index would.
+func (mdb *MemoryUserDB) emailTaken(forms []string) bool {
+	for _, mu := range mdb.users {
+		if mu.hasEmailForm(forms) {
+			return true
+		}
+	}
+	for _, mu := range mdb.pending {
+		if mu.hasEmailForm(forms) {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold write lock
+func (mdb *MemoryUserDB) unindex(mu *storedUser) {
+	if mu.Username != "" && mdb.byName[mu.Username] == mu.Guid {
+		delete(mdb.byName, mu.Username)
+	}
+	for _, skey := range mu.Social {
+		if mdb.bySocial[skey] == mu.Guid {
+			delete(mdb.bySocial, skey)
+		}
+	}
+}
+
+func (mdb *MemoryUserDB) Setup() error {
+	return nil
+}
+
+func (mdb *MemoryUserDB) Hooks() *HookRegistry {
+	return mdb.hooks
+}
+
+func (mdb *MemoryUserDB) EmailNormalization() *EmailNormalization {
+	return mdb.en
+}
+
+func (mdb *MemoryUserDB) PutNewUser(nu *User) (*User, error) {
+	forms := make([][]string, len(nu.Email))
+	for i, em := range nu.Email {
+		forms[i] = mdb.en.LookupForms(em.Email)
+	}
+	mdb.en.NormalizeUserEmails(nu)
+	pblob, err := prefsBlob(nu)
+	if err != nil {
+		log.Print("nu prefs cbor fail", err)
+		return nil, err
+	}
+	if nu.Created == 0 {
+		nu.Created = time.Now().Unix()
+	}
+	mu := &storedUser{
+		Username: nu.Username,
+		Password: copyBytes(nu.Password),
+		Prefs:    pblob,
+		Created:  nu.Created,
+	}
+	for _, si := range nu.Social {
+		mu.Social = append(mu.Social, SocialKey(si.Service, si.Id))
+	}
+	for _, em := range nu.Email {
+		edblob, err := cbor.Dumps(em.EmailMetadata)
+		if err != nil {
+			err = fmt.Errorf("could not cbor encode email metadata for %s, %v", em.Email, err)
+			return nil, err
+		}
+		mu.Email = append(mu.Email, storedEmail{em.Email, edblob})
+	}
+
+	mdb.l.Lock()
+	if mu.Username != "" {
+		if _, taken := mdb.byName[mu.Username]; taken {
+			mdb.l.Unlock()
+			return nil, fmt.Errorf("%w: %#v", ErrUsernameTaken, nu.Username)
+		}
+	}
+	for i, skey := range mu.Social {
+		if _, taken := mdb.bySocial[skey]; taken {
+			mdb.l.Unlock()
+			si := nu.Social[i]
+			return nil, fmt.Errorf("%w: \"%s %s\"", ErrSocialTaken, si.Service, si.Id)
+		}
+	}
+	for _, ef := range forms {
+		if mdb.emailTaken(ef) {
+			mdb.l.Unlock()
+			return nil, fmt.Errorf("%w: %#v", ErrEmailTaken, ef[0])
+		}
+	}
+	mdb.lastGuid++
+	mu.Guid = mdb.lastGuid
+	if mu.Username != "" {
+		mdb.byName[mu.Username] = mu.Guid
+	}
+	for _, skey := range mu.Social {
+		mdb.bySocial[skey] = mu.Guid
+	}
+	mdb.pending[mu.Guid] = mu
+	mdb.l.Unlock()
+
+	nu.Guid = mu.Guid
+	err = mdb.hooks.FireUserCreatedTx(nil, nu)
+
+	mdb.l.Lock()
+	delete(mdb.pending, mu.Guid)
+	if err != nil {
+		mdb.unindex(mu)
+	} else {
+		mdb.users[mu.Guid] = mu
+		for _, si := range nu.Social {
+			mdb.events = append(mdb.events, *socialLinkedEvent(nu.Guid, si))
+		}
+	}
+	mdb.l.Unlock()
+	if err != nil {
+		nu.Guid = 0
+		return nil, err
+	}
+
+	mdb.hooks.FireUserCreated(nu)
+	for _, si := range nu.Social {
+		mdb.hooks.FireSocialLinked(nu, si)
+	}
+	return nu, nil
+}
+
+func (mdb *MemoryUserDB) GetUser(guid int64) (*User, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	return mdb.getUser(guid)
+}
+
+func (mdb *MemoryUserDB) GetLocalUser(username string) (*User, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	guid, ok := mdb.byName[username]
+	if !ok {
+		return nil, BadUserError
+	}
+	return mdb.getUser(guid)
+}
+
+func (mdb *MemoryUserDB) GetSocialUser(service, id string) (*User, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	guid, ok := mdb.bySocial[SocialKey(service, id)]
+	if !ok {
+		return nil, BadUserError
+	}
+	return mdb.getUser(guid)
+}
+
+func (mdb *MemoryUserDB) GetUsers(guids []int64) ([]*User, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	out := make([]*User, len(guids))
+	for i, guid := range guids {
+		if mu, ok := mdb.users[guid]; ok {
+			out[i] = mu.user()
+		}
+	}
+	return out, nil
+}
+
+func (mdb *MemoryUserDB) GetEmailUser(email string, validatedOnly bool) (*User, error) {
+	forms := mdb.en.LookupForms(email)
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	choice := EmailUserChoice{ValidatedOnly: validatedOnly}
+	for _, mu := range mdb.users {
+		for _, em := range mu.Email {
+			if emailIsForm(em.Email, forms) {
+				var meta EmailMetadata
+				if len(em.Data) > 0 {
+					cbor.Loads(em.Data, &meta)
+				}
+				choice.Offer(mu.Guid, meta.Validated)
+			}
+		}
+	}
+	guid, ok := choice.Chosen()
+	if !ok {
+		return nil, BadUserError
+	}
+	return mdb.getUser(guid)
+}
+
+func (mdb *MemoryUserDB) ListUsers(q UserQuery) ([]*User, string, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	all := make([]*User, 0, len(mdb.users))
+	for _, mu := range mdb.users {
+		all = append(all, mu.user())
+	}
+	return ListUsersFrom(q, all, func(guid int64) bool {
+		_, disabled := mdb.disabled[guid]
+		return disabled
+	})
+}
+
+func (mdb *MemoryUserDB) DisableUser(user *User, reason string) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	mdb.disabled[user.Guid] = reason
+	return nil
+}
+
+func (mdb *MemoryUserDB) EnableUser(user *User) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	delete(mdb.disabled, user.Guid)
+	return nil
+}
+
+func (mdb *MemoryUserDB) GetDisabled(user *User) (bool, string, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	reason, disabled := mdb.disabled[user.Guid]
+	return disabled, reason, nil
+}
+
+// The auth event log and feedback are kept, as in SQL
+func (mdb *MemoryUserDB) DeleteUser(user *User) error {
+	mdb.l.Lock()
+	mu, ok := mdb.users[user.Guid]
+	if !ok {
+		mdb.l.Unlock()
+		return BadUserError
+	}
+	mdb.unindex(mu)
+	delete(mdb.users, user.Guid)
+	keys := mdb.apiKeys[:0]
+	for _, mk := range mdb.apiKeys {
+		if mk.Guid != user.Guid {
+			keys = append(keys, mk)
+		}
+	}
+	mdb.apiKeys = keys
+	creds := mdb.webauthn[:0]
+	for _, mw := range mdb.webauthn {
+		if mw.Guid != user.Guid {
+			creds = append(creds, mw)
+		}
+	}
+	mdb.webauthn = creds
+	delete(mdb.totp, user.Guid)
+	delete(mdb.recovery, user.Guid)
+	delete(mdb.disabled, user.Guid)
+	mdb.l.Unlock()
+	err := mdb.hooks.FireUserDeletedTx(nil, user)
+	if err != nil {
+		log.Print("user deleted hook ", err)
+	}
+	mdb.hooks.FireUserDeleted(user)
+	return nil
+}
+
+func (mdb *MemoryUserDB) ExportUser(guid int64) (*UserExport, error) {
+	return ExportUserFrom(context.Background(), ContextUserDB(mdb), guid)
+}
+
+func (mdb *MemoryUserDB) SetUserPrefs(user *User) error {
+	pblob, err := prefsBlob(user)
+	if err != nil {
+		log.Print("set prefs cbor fail", err)
+		return err
+	}
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	if mu, ok := mdb.users[user.Guid]; ok {
+		mu.Prefs = pblob
+	}
+	return nil
+}
+
+func (mdb *MemoryUserDB) SetUserPassword(user *User) error {
+	mdb.l.Lock()
+	if mu, ok := mdb.users[user.Guid]; ok {
+		mu.Password = copyBytes(user.Password)
+	}
+	mdb.events = append(mdb.events, *changeEvent(user.Guid, EventPasswordChanged, "password", ""))
+	mdb.l.Unlock()
+	mdb.hooks.FirePasswordChanged(user)
+	return nil
+}
+
+// Set local login for a social-login user
+func (mdb *MemoryUserDB) SetLogin(user *User, username, password string) error {
+	mdb.l.Lock()
+	if guid, taken := mdb.byName[username]; taken && guid != user.Guid {
+		mdb.l.Unlock()
+		return fmt.Errorf("%w: %#v", ErrUsernameTaken, username)
+	}
+	if mu, ok := mdb.users[user.Guid]; ok {
+		if mu.Username != "" {
+			delete(mdb.byName, mu.Username)
+		}
+		mu.Username = username
+		mu.Password = []byte(password)
+		if username != "" {
+			mdb.byName[username] = mu.Guid
+		}
+	}
+	mdb.events = append(mdb.events, *changeEvent(user.Guid, EventPasswordChanged, "password", username))
+	mdb.l.Unlock()
+	mdb.hooks.FirePasswordChanged(user)
+	return nil
+}
+
+func (mdb *MemoryUserDB) AddEmail(user *User, email EmailRecord) error {
+	email.Email = mdb.en.Normalize(email.Email)
+	metablob, err := cbor.Dumps(email.EmailMetadata)
+	if err != nil {
+		log.Print("failed to encode email metadata cbor ", err)
+		metablob = make([]byte, 0)
+	}
+	mdb.l.Lock()
+	if mu, ok := mdb.users[user.Guid]; ok {
+		if mu.hasEmail(email.Email) {
+			mdb.l.Unlock()
+			return fmt.Errorf("email %#v already added", email.Email)
+		}
+		mu.Email = append(mu.Email, storedEmail{email.Email, metablob})
+	}
+	mdb.events = append(mdb.events, *changeEvent(user.Guid, EventEmailAdded, "", email.Email))
+	mdb.l.Unlock()
+	err = mdb.hooks.FireEmailAddedTx(nil, user, email.Email)
+	if err != nil {
+		log.Print("email added hook ", err)
+	}
+	mdb.hooks.FireEmailAdded(user, email.Email)
+	return nil
+}
+
+func (mdb *MemoryUserDB) DelEmail(user *User, email string) error {
+	forms := mdb.en.LookupForms(email)
+	norm := forms[0]
+	mdb.l.Lock()
+	if mu, ok := mdb.users[user.Guid]; ok {
+		emails := mu.Email[:0]
+		for _, em := range mu.Email {
+			if !emailIsForm(em.Email, forms) {
+				emails = append(emails, em)
+			}
+		}
+		mu.Email = emails
+	}
+	mdb.events = append(mdb.events, *changeEvent(user.Guid, EventEmailDeleted, "", norm))
+	mdb.l.Unlock()
+	err := mdb.hooks.FireEmailDeletedTx(nil, user, norm)
+	if err != nil {
+		log.Print("email deleted hook ", err)
+	}
+	mdb.hooks.FireEmailDeleted(user, norm)
+	return nil
+}
+
+func (mdb *MemoryUserDB) Feedback(user *User, now int64, text string) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	mdb.feedback = append(mdb.feedback, FeedbackRecord{user.Guid, now, text})
+	return nil
+}
+
+func (mdb *MemoryUserDB) LimitedFeedback(user *User, now int64, text string, start int64, max int) (bool, int64, error) {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	var recent []int64
+	for _, fr := range mdb.feedback {
+		if fr.Guid == user.Guid && fr.Millis >= start {
+			recent = append(recent, fr.Millis)
+		}
+	}
+	if len(recent) >= max {
+		sort.Slice(recent, func(i, j int) bool { return recent[i] > recent[j] })
+		return false, recent[max-1], nil
+	}
+	mdb.feedback = append(mdb.feedback, FeedbackRecord{user.Guid, now, text})
+	return true, 0, nil
+}
+
+func (mdb *MemoryUserDB) ListFeedback(guid, start, end int64, offset, limit int) ([]FeedbackRecord, error) {
+	mdb.l.RLock()
+	out := make([]FeedbackRecord, 0)
+	for _, fr := range mdb.feedback {
+		if fr.Millis < start || (end != 0 && fr.Millis >= end) || (guid != 0 && fr.Guid != guid) {
+			continue
+		}
+		out = append(out, fr)
+	}
+	mdb.l.RUnlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Millis > out[j].Millis })
+	if offset >= len(out) {
+		return out[:0], nil
+	}
+	out = out[offset:]
+	if limit > 0 && limit < len(out) {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func copyAPIKey(ak APIKey) *APIKey {
+	ak.Scopes = append([]string{}, ak.Scopes...)
+	return &ak
+}
+
+// ORDER BY created, for UserDBs without it
+func sortAPIKeys(keys []APIKey) {
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+}
+
+func sortWebAuthnCredentials(creds []WebAuthnCredential) {
+	sort.SliceStable(creds, func(i, j int) bool { return creds[i].Created < creds[j].Created })
+}
+
+func (mdb *MemoryUserDB) CreateAPIKey(user *User, name string, scopes []string) (string, *APIKey, error) {
+	key, ak, err := NewAPIKey(name, scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	mdb.apiKeys = append(mdb.apiKeys, storedAPIKey{APIKeyHash(key), user.Guid, *copyAPIKey(*ak)})
+	return key, ak, nil
+}
+
+func (mdb *MemoryUserDB) ListAPIKeys(user *User) ([]APIKey, error) {
+	mdb.l.RLock()
+	out := make([]APIKey, 0)
+	for _, mk := range mdb.apiKeys {
+		if mk.Guid == user.Guid {
+			out = append(out, *copyAPIKey(mk.Key))
+		}
+	}
+	mdb.l.RUnlock()
+	sortAPIKeys(out)
+	return out, nil
+}
+
+func (mdb *MemoryUserDB) RevokeAPIKey(user *User, prefix string) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	keys := mdb.apiKeys[:0]
+	for _, mk := range mdb.apiKeys {
+		if mk.Guid != user.Guid || mk.Key.Prefix != prefix {
+			keys = append(keys, mk)
+		}
+	}
+	mdb.apiKeys = keys
+	return nil
+}
+
+func (mdb *MemoryUserDB) GetAPIKeyUser(key string) (*User, *APIKey, error) {
+	if !IsAPIKey(key) {
+		return nil, nil, BadUserError
+	}
+	keyhash := APIKeyHash(key)
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	for i := range mdb.apiKeys {
+		mk := &mdb.apiKeys[i]
+		if !bytes.Equal(mk.Hash, keyhash) {
+			continue
+		}
+		now := time.Now().Unix()
+		if now-mk.Key.LastUsed > APIKeyLastUsedResolution {
+			mk.Key.LastUsed = now
+		}
+		user, err := mdb.getUser(mk.Guid)
+		if err != nil {
+			return nil, nil, err
+		}
+		return user, copyAPIKey(mk.Key), nil
+	}
+	return nil, nil, BadUserError
+}
+
+// Replace any TOTP state for user
+func (mdb *MemoryUserDB) PutTOTP(user *User, rec *TOTPRecord) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	mdb.totp[user.Guid] = &TOTPRecord{copyBytes(rec.Secret), rec.Enabled, rec.LastStep}
+	return nil
+}
+
+func (mdb *MemoryUserDB) GetTOTP(user *User) (*TOTPRecord, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	rec, ok := mdb.totp[user.Guid]
+	if !ok {
+		return nil, nil
+	}
+	return &TOTPRecord{copyBytes(rec.Secret), rec.Enabled, rec.LastStep}, nil
+}
+
+func (mdb *MemoryUserDB) UseTOTPStep(user *User, step int64) (bool, error) {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	rec, ok := mdb.totp[user.Guid]
+	if !ok || rec.LastStep >= step {
+		return false, nil
+	}
+	rec.LastStep = step
+	return true, nil
+}
+
+func (mdb *MemoryUserDB) DelTOTP(user *User) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	delete(mdb.totp, user.Guid)
+	return nil
+}
+
+func copyWebAuthn(cred WebAuthnCredential) *WebAuthnCredential {
+	cred.ID = copyBytes(cred.ID)
+	cred.PublicKey = copyBytes(cred.PublicKey)
+	return &cred
+}
+
+func (mdb *MemoryUserDB) AddWebAuthnCredential(user *User, cred *WebAuthnCredential) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	for _, mw := range mdb.webauthn {
+		if bytes.Equal(mw.Cred.ID, cred.ID) {
+			return fmt.Errorf("webauthn credential %x already added", cred.ID)
+		}
+	}
+	mdb.webauthn = append(mdb.webauthn, storedWebAuthn{user.Guid, *copyWebAuthn(*cred)})
+	return nil
+}
+
+func (mdb *MemoryUserDB) ListWebAuthnCredentials(user *User) ([]WebAuthnCredential, error) {
+	mdb.l.RLock()
+	out := make([]WebAuthnCredential, 0)
+	for _, mw := range mdb.webauthn {
+		if mw.Guid == user.Guid {
+			out = append(out, *copyWebAuthn(mw.Cred))
+		}
+	}
+	mdb.l.RUnlock()
+	sortWebAuthnCredentials(out)
+	return out, nil
+}
+
+func (mdb *MemoryUserDB) GetWebAuthnCredential(credID []byte) (*User, *WebAuthnCredential, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	for _, mw := range mdb.webauthn {
+		if !bytes.Equal(mw.Cred.ID, credID) {
+			continue
+		}
+		user, err := mdb.getUser(mw.Guid)
+		if err != nil {
+			return nil, nil, err
+		}
+		return user, copyWebAuthn(mw.Cred), nil
+	}
+	return nil, nil, BadUserError
+}
+
+// Record a successful assertion
+func (mdb *MemoryUserDB) UseWebAuthnCredential(credID []byte, signCount int64) (bool, error) {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	for i := range mdb.webauthn {
+		mw := &mdb.webauthn[i]
+		if bytes.Equal(mw.Cred.ID, credID) {
+			if !signCountAfter(mw.Cred.SignCount, signCount) {
+				return false, nil
+			}
+			mw.Cred.SignCount = signCount
+			mw.Cred.LastUsed = time.Now().Unix()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// As UseWebAuthnCredential's SQL: counters go up, or stay 0 on
+// authenticators without one
+func signCountAfter(old, next int64) bool {
+	return old < next || (old == 0 && next == 0)
+}
+
+func (mdb *MemoryUserDB) DelWebAuthnCredential(user *User, credID []byte) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	creds := mdb.webauthn[:0]
+	for _, mw := range mdb.webauthn {
+		if mw.Guid != user.Guid || !bytes.Equal(mw.Cred.ID, credID) {
+			creds = append(creds, mw)
+		}
+	}
+	mdb.webauthn = creds
+	return nil
+}
+
+func (mdb *MemoryUserDB) PutWebAuthnChallenge(challenge []byte, expires int64) error {
+	now := time.Now().Unix()
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	for k, exp := range mdb.challenges {
+		if exp < now {
+			delete(mdb.challenges, k)
+		}
+	}
+	mdb.challenges[string(challenge)] = expires
+	return nil
+}
+
+func (mdb *MemoryUserDB) TakeWebAuthnChallenge(challenge []byte) (bool, error) {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	exp, ok := mdb.challenges[string(challenge)]
+	delete(mdb.challenges, string(challenge))
+	return ok && exp >= time.Now().Unix(), nil
+}
+
+// Replace all of user's recovery codes
+func (mdb *MemoryUserDB) SetRecoveryCodes(user *User, hashes [][]byte) error {
+	codes := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		if !baInBas(codes, hash) {
+			codes = append(codes, copyBytes(hash))
+		}
+	}
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	mdb.recovery[user.Guid] = codes
+	return nil
+}
+
+func (mdb *MemoryUserDB) GetRecoveryCodes(user *User) ([][]byte, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	out := make([][]byte, 0)
+	for _, hash := range mdb.recovery[user.Guid] {
+		out = append(out, copyBytes(hash))
+	}
+	return out, nil
+}
+
+// Use up a code. false if it was already used.
+func (mdb *MemoryUserDB) DelRecoveryCode(user *User, hash []byte) (bool, error) {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	codes := mdb.recovery[user.Guid]
+	for i, code := range codes {
+		if bytes.Equal(code, hash) {
+			mdb.recovery[user.Guid] = append(codes[:i], codes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (mdb *MemoryUserDB) LogAuthEvent(ev *AuthEvent) error {
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	mdb.events = append(mdb.events, *ev)
+	return nil
+}
+
+func (mdb *MemoryUserDB) GetAuthEvents(guid, start, end int64, limit int) ([]AuthEvent, error) {
+	mdb.l.RLock()
+	out := make([]AuthEvent, 0)
+	for _, ev := range mdb.events {
+		if ev.Time < start || (end != 0 && ev.Time >= end) || (guid != 0 && ev.Guid != guid) {
+			continue
+		}
+		out = append(out, ev)
+	}
+	mdb.l.RUnlock()
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time > out[j].Time })
+	if limit > 0 && limit < len(out) {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// Everything in a MemoryUserDB, cbor encoded by Snapshot
+type memorySnapshot struct {
+	LastGuid int64
+	Users    []storedUser
+	APIKeys  []storedAPIKey
+	TOTP     []memTOTP
+	WebAuthn []storedWebAuthn
+	Recovery []memRecovery
+	Disabled []memDisabled
+	Events   []AuthEvent
+	Feedback []FeedbackRecord
+}
+
+type memTOTP struct {
+	Guid int64
+	TOTP TOTPRecord
+}
+
+type memRecovery struct {
+	Guid  int64
+	Codes [][]byte
+}
+
+type memDisabled struct {
+	Guid   int64
+	Reason string
+}
+
+// Everything, as bytes for Restore
+func (mdb *MemoryUserDB) Snapshot() ([]byte, error) {
+	mdb.l.RLock()
+	defer mdb.l.RUnlock()
+	snap := memorySnapshot{
+		LastGuid: mdb.lastGuid,
+		APIKeys:  mdb.apiKeys,
+		WebAuthn: mdb.webauthn,
+		Events:   mdb.events,
+		Feedback: mdb.feedback,
+	}
+	for _, mu := range mdb.users {
+		snap.Users = append(snap.Users, *mu)
+	}
+	sort.Slice(snap.Users, func(i, j int) bool { return snap.Users[i].Guid < snap.Users[j].Guid })
+	for guid, rec := range mdb.totp {
+		snap.TOTP = append(snap.TOTP, memTOTP{guid, *rec})
+	}
+	for guid, codes := range mdb.recovery {
+		snap.Recovery = append(snap.Recovery, memRecovery{guid, codes})
+	}
+	for guid, reason := range mdb.disabled {
+		snap.Disabled = append(snap.Disabled, memDisabled{guid, reason})
+	}
+	return cbor.Dumps(snap)
+}
+
+// Replace everything with a Snapshot
+func (mdb *MemoryUserDB) Restore(blob []byte) error {
+	var snap memorySnapshot
+	err := cbor.Loads(blob, &snap)
+	if err != nil {
+		return fmt.Errorf("bad memory user db snapshot, %v", err)
+	}
+	mdb.l.Lock()
+	defer mdb.l.Unlock()
+	mdb.reset()
+	mdb.lastGuid = snap.LastGuid
+	for i := range snap.Users {
+		mu := &snap.Users[i]
+		mdb.users[mu.Guid] = mu
+		if mu.Username != "" {
+			mdb.byName[mu.Username] = mu.Guid
+		}
+		for _, skey := range mu.Social {
+			mdb.bySocial[skey] = mu.Guid
+		}
+	}
+	mdb.apiKeys = snap.APIKeys
+	for _, mt := range snap.TOTP {
+		rec := mt.TOTP
+		mdb.totp[mt.Guid] = &rec
+	}
+	mdb.webauthn = snap.WebAuthn
+	for _, mr := range snap.Recovery {
+		mdb.recovery[mr.Guid] = mr.Codes
+	}
+	for _, md := range snap.Disabled {
+		mdb.disabled[md.Guid] = md.Reason
+	}
+	mdb.events = snap.Events
+	mdb.feedback = snap.Feedback
+	return nil
+}
+
+// Snapshot to path, replacing it all at once
+func (mdb *MemoryUserDB) SaveFile(path string) error {
+	blob, err := mdb.Snapshot()
+	if err != nil {
+		return err
+	}
+	fout, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fout.Write(blob)
+	if err == nil {
+		err = fout.Close()
+	} else {
+		fout.Close()
+	}
+	if err == nil {
+		err = os.Rename(fout.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fout.Name())
+	}
+	return err
+}
+
+// Restore from a SaveFile
+func (mdb *MemoryUserDB) LoadFile(path string) error {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return mdb.Restore(blob)
+}
@@ -0,0 +1,85 @@
+package sql_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	ls "github.com/brianolson/login/login/sql"
+	tu "github.com/brianolson/login/login/sql/testutil"
+)
+
+func TestMemoryUserDBConformance(t *testing.T) {
+	tu.RunUserDBConformance(t, func(t *testing.T) ls.UserDB {
+		return ls.NewMemoryUserDB()
+	})
+}
+
+func TestMemoryUserDBSnapshot(t *testing.T) {
+	mdb := ls.NewMemoryUserDB()
+	nu := &ls.User{Username: "saved", DisplayName: "Saved", Social: []ls.UserSocial{{Service: "z", Id: "saved"}}, Email: []ls.EmailRecord{ls.NewEmail("saved@example.com")}}
+	_, err := mdb.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := mdb.CreateAPIKey(nu, "laptop", []string{"read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mdb.PutTOTP(nu, &ls.TOTPRecord{Secret: []byte("sealed"), Enabled: true, LastStep: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mdb.SetRecoveryCodes(nu, [][]byte{[]byte("a"), []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mdb.DisableUser(nu, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mdb.Feedback(nu, 1000, "hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "users.cbor")
+	err = mdb.SaveFile(path)
+	if err != nil {
+		t.Fatalf("save, %v", err)
+	}
+	rdb := ls.NewMemoryUserDB()
+	err = rdb.LoadFile(path)
+	if err != nil {
+		t.Fatalf("load, %v", err)
+	}
+
+	xu, err := rdb.GetSocialUser("z", "saved")
+	if err != nil || xu.Guid != nu.Guid || xu.Username != "saved" || xu.DisplayName != "Saved" || !xu.HasEmail("saved@example.com") {
+		t.Errorf("bad restored user %#v %v", xu, err)
+	}
+	ku, ak, err := rdb.GetAPIKeyUser(key)
+	if err != nil || ku.Guid != nu.Guid || !ak.HasScope("read") {
+		t.Errorf("bad restored api key %#v %v", ak, err)
+	}
+	ok, err := rdb.UseTOTPStep(nu, 7)
+	if err != nil || ok {
+		t.Errorf("restored TOTP step replayed %v %v", ok, err)
+	}
+	codes, err := rdb.GetRecoveryCodes(nu)
+	if err != nil || len(codes) != 2 {
+		t.Errorf("bad restored recovery codes %#v %v", codes, err)
+	}
+	disabled, reason, err := rdb.GetDisabled(nu)
+	if err != nil || !disabled || reason != "testing" {
+		t.Errorf("bad restored disabled %v %q %v", disabled, reason, err)
+	}
+	fb, err := rdb.ListFeedback(0, 0, 0, 0, 0)
+	if err != nil || len(fb) != 1 || fb[0].Msg != "hi" {
+		t.Errorf("bad restored feedback %#v %v", fb, err)
+	}
+	next := &ls.User{Username: "next"}
+	_, err = rdb.PutNewUser(next)
+	if err != nil || next.Guid <= nu.Guid {
+		t.Errorf("restored guid sequence gave %d after %d, %v", next.Guid, nu.Guid, err)
+	}
+}
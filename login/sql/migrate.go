@@ -0,0 +1,123 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schema migrations. Each dialect has an ordered list of up-steps, one
+// per schema version, and both lists always have the same length.
+// Version N is steps[N-1]. Setup() applies whatever the database hasn't
+// had yet, each step in its own transaction with its schema_version row.
+//
+// Version 1 is the schema from before migrations existed. Its CREATE ...
+// IF NOT EXISTS statements adopt a database made by an older Setup().
+//
+// MySQL commits DDL as it runs, so there a step isn't atomic: if it
+// fails part way, what it already did stays without the schema_version
+// row, and the next Setup() runs the whole step again. MySQL steps must
+// be safe to repeat: CREATE TABLE IF NOT EXISTS, DML that finds nothing
+// left to do, and ALTER TABLE ADD COLUMN or ADD KEY, whose "duplicate"
+// or "already exists" errors migrateStep takes as already applied.
+//
+// To change the schema append a step to postgresMigrations,
+// sqlite3Migrations and mysqlMigrations. Never edit a step that has shipped.
+
+var ErrSchemaTooNew = errors.New("database schema is newer than this code")
+
+const createSchemaVersion = `CREATE TABLE IF NOT EXISTS schema_version (
+version int PRIMARY KEY,
+applied bigint -- unix timestamp
+)`
+
+func init() {
+	if len(postgresMigrations) != len(sqlite3Migrations) || len(postgresMigrations) != len(mysqlMigrations) {
+		panic("schema versions differ between databases")
+	}
+}
+
+// Highest version applied to db, 0 for a new database
+func SchemaVersion(db *sql.DB) (int, error) {
+	return schemaVersion(context.Background(), detectDB(db))
+}
+
+func schemaVersion(ctx context.Context, db dialectDB) (int, error) {
+	_, err := db.ExecContext(ctx, createSchemaVersion)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT MAX(version) FROM schema_version`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var version sql.NullInt64
+	if rows.Next() {
+		err = rows.Scan(&version)
+	}
+	return int(version.Int64), err
+}
+
+// Bring db up to the last of steps
+func migrate(ctx context.Context, db dialectDB, steps [][]string) error {
+	current, err := schemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current > len(steps) {
+		return fmt.Errorf("%w: database version %d, code version %d", ErrSchemaTooNew, current, len(steps))
+	}
+	for version := current + 1; version <= len(steps); version++ {
+		err = migrateStep(ctx, db, version, steps[version-1])
+		if err != nil {
+			// Maybe another server applied it first
+			now, verr := schemaVersion(ctx, db)
+			if verr == nil && now >= version {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func migrateStep(ctx context.Context, db dialectDB, version int, cmds []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	for _, cmd := range cmds {
+		_, err := tx.ExecContext(ctx, cmd)
+		if err != nil && alreadyApplied(db.dialect, err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("schema version %d: sql failed %#v, %v", version, cmd, err)
+		}
+	}
+	_, err = txExecContext(ctx, db, tx, `INSERT INTO schema_version (version, applied) VALUES ($1, $2)`, version, time.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("schema version %d: %v", version, err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("schema version %d: commit failed, %v", version, err)
+	}
+	return nil
+}
+
+// A MySQL statement that failed because an earlier try at its step
+// already did it, see above
+func alreadyApplied(dialect Dialect, err error) bool {
+	if dialect.Name() != "mysql" {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	// "already exists" from go-mysql-server
+	return strings.Contains(msg, "duplicate column name") || strings.Contains(msg, "duplicate key name") || strings.Contains(msg, "already exists")
+}
@@ -0,0 +1,194 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// MySQL 8 or MariaDB 10.2 and later, with github.com/go-sql-driver/mysql.
+// Queries are the postgres ones with placeholders rewritten, only the
+// schema and getting a new guser id differ.
+type mysqlDialect struct{}
+
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (mysqlDialect) Rebind(cmd string, args []interface{}) (string, []interface{}) {
+	return mysqlRebind(cmd, args)
+}
+
+func (mysqlDialect) GuserId() string {
+	return "id"
+}
+
+func (d mysqlDialect) InsertGuser(ctx context.Context, tx *sql.Tx, username sql.NullString, password, prefs []byte, created int64) (int64, error) {
+	return insertGuserLastId(ctx, d, tx, username, password, prefs, created)
+}
+
+func (mysqlDialect) Migrations() [][]string {
+	return mysqlMigrations
+}
+
+// $N placeholders to ?, with args reordered to match. $N may repeat.
+func mysqlRebind(cmd string, args []interface{}) (string, []interface{}) {
+	if strings.IndexByte(cmd, '$') < 0 {
+		return cmd, args
+	}
+	var out strings.Builder
+	nargs := make([]interface{}, 0, len(args))
+	quoted := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		if c == '\'' {
+			quoted = !quoted
+		}
+		if c != '$' || quoted {
+			out.WriteByte(c)
+			continue
+		}
+		j := i + 1
+		for j < len(cmd) && cmd[j] >= '0' && cmd[j] <= '9' {
+			j++
+		}
+		n, err := strconv.Atoi(cmd[i+1 : j])
+		if err != nil || n < 1 || n > len(args) {
+			out.WriteByte(c)
+			continue
+		}
+		out.WriteByte('?')
+		nargs = append(nargs, args[n-1])
+		i = j - 1
+	}
+	return out.String(), nargs
+}
+
+// MySQL can't CREATE INDEX IF NOT EXISTS, so indexes are declared with
+// their tables. Names match the postgres ones.
+const (
+	mysqlCreateGuser = `CREATE TABLE IF NOT EXISTS guser (
+id bigint AUTO_INCREMENT PRIMARY KEY,
+username varchar(100), -- may be NULL
+password BLOB, -- may be NULL
+prefs BLOB, -- cbor encoded UserSqlPrefs{}
+UNIQUE KEY guser_name (username)
+)`
+	mysqlCreateUserSocial = `CREATE TABLE IF NOT EXISTS user_social (
+id bigint, -- foreign key guser.id
+socialkey varbinary(500), -- service\0id
+socialdata BLOB, -- cbor, unpack into specific struct per service in app
+PRIMARY KEY (id, socialkey),
+UNIQUE KEY social_key (socialkey)
+)`
+	mysqlCreateUserEmail = `CREATE TABLE IF NOT EXISTS user_email (
+id bigint, -- foreign key guser.id
+email varchar(100),
+data BLOB, -- cbor {'valid':bool, ...}
+PRIMARY KEY (id, email),
+KEY user_email_email (email)
+)`
+	mysqlCreateUserAPIKey = `CREATE TABLE IF NOT EXISTS user_apikey (
+keyhash varbinary(64) PRIMARY KEY, -- sha256(key)
+id bigint, -- foreign key guser.id
+prefix varchar(20),
+name varchar(100),
+scopes varchar(1000), -- space separated
+created bigint, -- unix timestamp
+lastused bigint, -- unix timestamp
+KEY user_apikey_id (id)
+)`
+	mysqlCreateUserTOTP = `CREATE TABLE IF NOT EXISTS user_totp (
+id bigint PRIMARY KEY, -- foreign key guser.id
+secret BLOB, -- sealed
+enabled boolean,
+laststep bigint
+)`
+	mysqlCreateUserWebAuthn = `CREATE TABLE IF NOT EXISTS user_webauthn (
+credid varbinary(1023) PRIMARY KEY,
+id bigint, -- foreign key guser.id
+pubkey BLOB, -- COSE_Key
+signcount bigint,
+name varchar(100),
+created bigint, -- unix timestamp
+lastused bigint, -- unix timestamp
+KEY user_webauthn_id (id)
+)`
+	mysqlCreateWebAuthnChallenge = `CREATE TABLE IF NOT EXISTS webauthn_challenge (
+challenge varbinary(64) PRIMARY KEY, -- sha256(challenge)
+expires bigint, -- unix timestamp
+KEY webauthn_challenge_expires (expires)
+)`
+	mysqlCreateUserRecovery = `CREATE TABLE IF NOT EXISTS user_recovery (
+id bigint, -- foreign key guser.id
+codehash varbinary(100), -- bcrypt
+PRIMARY KEY (id, codehash)
+)`
+	mysqlCreateAuthEvent = `CREATE TABLE IF NOT EXISTS auth_event (
+t bigint, -- unix timestamp
+id bigint, -- guser.id, 0 if unknown
+etype varchar(30),
+method varchar(100),
+ip varchar(100),
+useragent varchar(300),
+detail varchar(300),
+KEY auth_event_id (id, t),
+KEY auth_event_t (t)
+)`
+	mysqlCreateWebhookOutbox = `CREATE TABLE IF NOT EXISTS webhook_outbox (
+id bigint AUTO_INCREMENT PRIMARY KEY,
+url varchar(500),
+event varchar(100),
+body BLOB, -- JSON
+attempts int,
+nextattempt bigint, -- unix timestamp, -1 when given up
+created bigint, -- unix timestamp
+lasterror varchar(300),
+KEY webhook_outbox_next (nextattempt)
+)`
+	mysqlCreateFeedback = `CREATE TABLE IF NOT EXISTS feedback (
+guid bigint, -- guser.id
+millis bigint, -- unix milliseconds
+msg text,
+KEY feedback_guid (guid, millis),
+KEY feedback_millis (millis)
+)`
+)
+
+// Schema versions for mysql, see migrate.go
+var mysqlMigrations = [][]string{
+	// 1: baseline
+	{
+		mysqlCreateGuser,
+		mysqlCreateUserSocial,
+		mysqlCreateUserEmail,
+		mysqlCreateUserAPIKey,
+		mysqlCreateUserTOTP,
+		mysqlCreateUserWebAuthn,
+		mysqlCreateUserRecovery,
+		createLoginThrottle,
+		mysqlCreateAuthEvent,
+		mysqlCreateWebhookOutbox,
+		createUserDisabled,
+	},
+	// 2: postgres password to bytea, already a BLOB here
+	{},
+	// 3: UserDB.Feedback's table
+	{
+		mysqlCreateFeedback,
+	},
+	// 4: guser.created for ListUsers
+	{
+		`ALTER TABLE guser ADD COLUMN created bigint, ADD KEY guser_created (created)`,
+	},
+	// 5: single-use WebAuthn challenges
+	{
+		mysqlCreateWebAuthnChallenge,
+	},
+	// 6: lower case stored emails
+	mysqlLowerStoredEmails,
+	// 7: ListUsers matches and sorts usernames by LOWER(). Functional
+	// indexes need MySQL 8.0.13, so no guser_lower_name here.
+	{},
+}
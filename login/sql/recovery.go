@@ -0,0 +1,92 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+)
+
+// One-time second factor recovery codes, stored bcrypt hashed like
+// User.Password. Each row is one unused code.
+
+const (
+	createUserRecovery = `CREATE TABLE IF NOT EXISTS user_recovery (
+id bigint, -- foreign key guser.id
+codehash bytea, -- bcrypt
+PRIMARY KEY (id, codehash)
+)`
+)
+
+// Replace all of user's recovery codes
+func SetRecoveryCodes(db *sql.DB, user *User, hashes [][]byte) error {
+	return SetRecoveryCodesContext(context.Background(), db, user, hashes)
+}
+
+func SetRecoveryCodesContext(ctx context.Context, db *sql.DB, user *User, hashes [][]byte) error {
+	return setRecoveryCodes(ctx, detectDB(db), user, hashes)
+}
+
+func setRecoveryCodes(ctx context.Context, db dialectDB, user *User, hashes [][]byte) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	_, err = txExecContext(ctx, db, tx, `DELETE FROM user_recovery WHERE id = $1`, user.Guid)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		_, err = txExecContext(ctx, db, tx, `INSERT INTO user_recovery (id, codehash) VALUES ($1, $2)`, user.Guid, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func GetRecoveryCodes(db *sql.DB, user *User) ([][]byte, error) {
+	return GetRecoveryCodesContext(context.Background(), db, user)
+}
+
+func GetRecoveryCodesContext(ctx context.Context, db *sql.DB, user *User) ([][]byte, error) {
+	return getRecoveryCodes(ctx, detectDB(db), user)
+}
+
+func getRecoveryCodes(ctx context.Context, db dialectDB, user *User) ([][]byte, error) {
+	rows, err := dbQueryContext(ctx, db, `SELECT codehash FROM user_recovery WHERE id = $1`, user.Guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([][]byte, 0)
+	for rows.Next() {
+		var hash []byte
+		err = rows.Scan(&hash)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, hash)
+	}
+	return out, rows.Err()
+}
+
+// Use up a code. false if it was already used (lost a race).
+func DelRecoveryCode(db *sql.DB, user *User, hash []byte) (bool, error) {
+	return DelRecoveryCodeContext(context.Background(), db, user, hash)
+}
+
+func DelRecoveryCodeContext(ctx context.Context, db *sql.DB, user *User, hash []byte) (bool, error) {
+	return delRecoveryCode(ctx, detectDB(db), user, hash)
+}
+
+func delRecoveryCode(ctx context.Context, db dialectDB, user *User, hash []byte) (bool, error) {
+	result, err := dbExecContext(ctx, db, `DELETE FROM user_recovery WHERE id = $1 AND codehash = $2`, user.Guid, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
@@ -2,10 +2,12 @@ package sql
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
-	"reflect"
+	"strings"
+	"time"
 
 	cbor "github.com/brianolson/cbor_go"
 )
@@ -25,14 +27,42 @@ import (
 // add/del social login to user
 // set metadata for social
 type UserDB interface {
-	// Setup will create or mirgate tables
+	// Setup will create or migrate tables.
+	// ErrSchemaTooNew if the database is from newer code.
 	Setup() error
 
+	// Where to register hooks on this UserDB's events, never nil
+	Hooks() *HookRegistry
+	// How this UserDB normalizes email addresses, never nil. Set its
+	// options before use.
+	EmailNormalization() *EmailNormalization
+
 	PutNewUser(nu *User) (*User, error)
 
 	GetUser(guid int64) (*User, error)
 	GetLocalUser(username string) (*User, error)
 	GetSocialUser(service, id string) (*User, error)
+	// Many users at once, in the order of guids, nil where there is no
+	// such user. For SQL it's three queries per 500 guids.
+	GetUsers(guids []int64) ([]*User, error)
+	// User with email, after EmailNormalization(). If several users have it,
+	// a validated one, then the oldest. BadUserError if there is none, or
+	// if validatedOnly and nobody has validated it.
+	GetEmailUser(email string, validatedOnly bool) (*User, error)
+	// Page of users matching q, and the Cursor for the next page or ""
+	// after the last. ErrBadCursor if q.Cursor isn't from this query.
+	ListUsers(q UserQuery) ([]*User, string, error)
+
+	// Disabled users keep their data but can't log in.
+	DisableUser(user *User, reason string) error
+	EnableUser(user *User) error
+	GetDisabled(user *User) (disabled bool, reason string, err error)
+	// Remove user with their logins, emails and credentials.
+	// BadUserError if there was no such user.
+	DeleteUser(user *User) error
+
+	// Everything stored about a user, without secrets
+	ExportUser(guid int64) (*UserExport, error)
 
 	// copy misc data out of User struct into preferences
 	SetUserPrefs(user *User) error
@@ -44,7 +74,60 @@ type UserDB interface {
 	AddEmail(user *User, email EmailRecord) error
 	DelEmail(user *User, email string) error
 
+	// now is unix milliseconds. ListFeedback returns newest first with
+	// start <= Millis < end; guid 0 for all users, end 0 for no upper
+	// bound, limit 0 for no limit.
 	Feedback(user *User, now int64, text string) error
+	ListFeedback(guid, start, end int64, offset, limit int) ([]FeedbackRecord, error)
+	// LimitedFeedback is Feedback unless user already sent max with
+	// Millis >= start; then nothing is stored and it returns false with
+	// the Millis of the oldest of those max. Concurrent calls for one
+	// user can't both get under the limit.
+	LimitedFeedback(user *User, now int64, text string, start int64, max int) (stored bool, oldest int64, err error)
+
+	// CreateAPIKey returns the new key, which is not stored and
+	// can't be recovered later.
+	CreateAPIKey(user *User, name string, scopes []string) (string, *APIKey, error)
+	ListAPIKeys(user *User) ([]APIKey, error)
+	RevokeAPIKey(user *User, prefix string) error
+	// Returns BadUserError for unknown or revoked keys
+	GetAPIKeyUser(key string) (*User, *APIKey, error)
+
+	// TOTP second factor. GetTOTP returns nil, nil if not enrolled.
+	PutTOTP(user *User, rec *TOTPRecord) error
+	GetTOTP(user *User) (*TOTPRecord, error)
+	// false if step is not after the last step used (replay)
+	UseTOTPStep(user *User, step int64) (bool, error)
+	DelTOTP(user *User) error
+
+	// WebAuthn credentials (passkeys).
+	// GetWebAuthnCredential returns BadUserError if credID is unknown.
+	// UseWebAuthnCredential returns false if signCount is not after the
+	// stored count (replay or clone).
+	AddWebAuthnCredential(user *User, cred *WebAuthnCredential) error
+	ListWebAuthnCredentials(user *User) ([]WebAuthnCredential, error)
+	GetWebAuthnCredential(credID []byte) (*User, *WebAuthnCredential, error)
+	UseWebAuthnCredential(credID []byte, signCount int64) (bool, error)
+	DelWebAuthnCredential(user *User, credID []byte) error
+
+	// WebAuthn challenges, each good for one ceremony.
+	// TakeWebAuthnChallenge returns false if challenge was not put, was
+	// already taken or has expired.
+	PutWebAuthnChallenge(challenge []byte, expires int64) error
+	TakeWebAuthnChallenge(challenge []byte) (bool, error)
+
+	// Recovery codes, as bcrypt hashes.
+	// SetRecoveryCodes replaces any previous set.
+	// DelRecoveryCode returns false if hash was already used.
+	SetRecoveryCodes(user *User, hashes [][]byte) error
+	GetRecoveryCodes(user *User) ([][]byte, error)
+	DelRecoveryCode(user *User, hash []byte) (bool, error)
+
+	// Auth event log. GetAuthEvents returns newest first with
+	// start <= Time < end; guid 0 for all users, end 0 for no upper
+	// bound, limit 0 for no limit.
+	LogAuthEvent(ev *AuthEvent) error
+	GetAuthEvents(guid, start, end int64, limit int) ([]AuthEvent, error)
 }
 
 func strInStrs(they []string, it string) bool {
@@ -66,67 +149,151 @@ func baInBas(they [][]byte, it []byte) bool {
 	return false
 }
 
-// Used in GetUser, GetLocalUser, GetSocialUser which MUST have the
-// same result out of SELECT.
-// Processes SELECT username, password, password, prefs, email, emailmeta, id, socialkey, socialdata
-// LEFT JOIN of email and social tables may cause repetition!
-func readUserFromSelect(rows *sql.Rows) (*User, error) {
-	var email []byte
-	var emailmetablob []byte
-	var err error
-	var prefs []byte = nil
-	u := &User{}
-	u.Email = make([]EmailRecord, 0)
-	u.Social = make([]UserSocial, 0)
-	any := false
-	var socialkey []byte = nil
-	var socialdata []byte = nil
-	sokeys := make([][]byte, 0) // list of socialkeys found so far
+// Max ids in one IN (...), under every database's parameter limit
+const maxInIds = 500
+
+// "$1, $2, ..." and args for guids
+func inIds(guids []int64) (string, []interface{}) {
+	var sb strings.Builder
+	args := make([]interface{}, len(guids))
+	for i, guid := range guids {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "$%d", i+1)
+		args[i] = guid
+	}
+	return sb.String(), args
+}
 
+// Used in GetUser, GetLocalUser, GetSocialUser and GetUsers which MUST
+// have the same result.
+// Processes guser rows from userSelect(), then reads their emails and
+// social logins with one query each per maxInIds users, so a user with N
+// emails and M social logins is N+M rows, not N*M.
+func readUsers(ctx context.Context, db dialectDB, rows *sql.Rows) ([]*User, error) {
+	users := make([]*User, 0, 1)
 	for rows.Next() {
-		any = true
-		email = nil
-		emailmetablob = nil
-		socialkey = nil
-		socialdata = nil
 		var nilname sql.NullString
-		err = rows.Scan(&nilname, &u.Password, &prefs, &email, &emailmetablob, &u.Guid, &socialkey, &socialdata)
+		var prefs []byte
+		var created sql.NullInt64
+		u := &User{}
+		u.Email = make([]EmailRecord, 0)
+		u.Social = make([]UserSocial, 0)
+		err := rows.Scan(&u.Guid, &nilname, &u.Password, &prefs, &created)
 		if err != nil {
-			break
+			rows.Close()
+			return nil, err
 		}
-		if nilname.Valid {
-			u.Username = nilname.String
-		} else {
-			u.Username = ""
+		u.Username = nilname.String
+		u.Created = created.Int64
+		if len(prefs) > 0 {
+			unpackPrefsBlob(u, prefs)
 		}
-		if (email != nil) && (len(email) > 0) && !u.HasEmail(string(email)) {
-			ne := EmailRecord{Email: string(email)}
-			if len(emailmetablob) > 0 {
-				cbor.Loads(emailmetablob, &ne.EmailMetadata)
-			}
-			u.Email = append(u.Email, ne)
+		users = append(users, u)
+	}
+	err := rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	for start := 0; start < len(users); start += maxInIds {
+		end := start + maxInIds
+		if end > len(users) {
+			end = len(users)
 		}
-		if (socialkey != nil) && (len(socialkey) > 0) && !baInBas(sokeys, socialkey) {
-			sokeys = append(sokeys, socialkey)
-			service, sid := ParseSocialKey(socialkey)
-			if sid == "" {
-				log.Printf("failed to parse social key: %#v", socialkey)
-			} else {
-				u.Social = append(u.Social, UserSocial{
-					service,
-					sid,
-					socialdata,
-				})
-			}
+		err = readUserDetails(ctx, db, users[start:end])
+		if err != nil {
+			return nil, err
 		}
 	}
-	if !any {
-		return nil, BadUserError
+	return users, nil
+}
+
+// user_email and user_social rows for users
+func readUserDetails(ctx context.Context, db dialectDB, users []*User) error {
+	byGuid := make(map[int64]*User, len(users))
+	guids := make([]int64, len(users))
+	for i, u := range users {
+		byGuid[u.Guid] = u
+		guids[i] = u.Guid
 	}
-	if (prefs != nil) && (len(prefs) > 0) {
-		unpackPrefsBlob(u, prefs)
+	in, args := inIds(guids)
+
+	cmd := `SELECT id, email, data FROM user_email WHERE id IN (` + in + `)`
+	rows, err := dbQueryContext(ctx, db, cmd, args...)
+	if err != nil {
+		log.Printf("sql err on %#v: %s", cmd, err)
+		return err
 	}
-	return u, err
+	for rows.Next() {
+		var guid int64
+		var email string
+		var emailmetablob []byte
+		err = rows.Scan(&guid, &email, &emailmetablob)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		u := byGuid[guid]
+		if u == nil || len(email) == 0 {
+			continue
+		}
+		ne := EmailRecord{Email: email}
+		if len(emailmetablob) > 0 {
+			cbor.Loads(emailmetablob, &ne.EmailMetadata)
+		}
+		u.Email = append(u.Email, ne)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	cmd = `SELECT id, socialkey, socialdata FROM user_social WHERE id IN (` + in + `)`
+	rows, err = dbQueryContext(ctx, db, cmd, args...)
+	if err != nil {
+		log.Printf("sql err on %#v: %s", cmd, err)
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var guid int64
+		var socialkey []byte
+		var socialdata []byte
+		err = rows.Scan(&guid, &socialkey, &socialdata)
+		if err != nil {
+			return err
+		}
+		u := byGuid[guid]
+		if u == nil || len(socialkey) == 0 {
+			continue
+		}
+		service, sid := ParseSocialKey(socialkey)
+		if sid == "" {
+			log.Printf("failed to parse social key: %#v", socialkey)
+			continue
+		}
+		u.Social = append(u.Social, UserSocial{
+			service,
+			sid,
+			socialdata,
+		})
+	}
+	return rows.Err()
+}
+
+// First of readUsers(), BadUserError if none
+func readUser(ctx context.Context, db dialectDB, rows *sql.Rows) (*User, error) {
+	users, err := readUsers(ctx, db, rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, BadUserError
+	}
+	return users[0], nil
 }
 
 // sql commands for postgres.
@@ -138,7 +305,8 @@ username varchar(100), -- may be NULL
 password varchar(100), -- may be NULL
 prefs bytea -- cbor encoded UserSqlPrefs{}
 )`
-	createGuserNameIndex = `CREATE UNIQUE INDEX IF NOT EXISTS guser_name ON guser ( username )`
+	createGuserNameIndex    = `CREATE UNIQUE INDEX IF NOT EXISTS guser_name ON guser ( username )`
+	createGuserCreatedIndex = `CREATE INDEX IF NOT EXISTS guser_created ON guser ( created )`
 
 	createUserSocial = `CREATE TABLE IF NOT EXISTS user_social (
 id bigint, -- foreign key guser.id
@@ -157,67 +325,168 @@ PRIMARY KEY (id, email)
 	creaetUserEmailIndex = `CREATE INDEX IF NOT EXISTS user_email_email ON user_email ( email )`
 )
 
-func dbTxCmdList(db *sql.DB, cmds []string) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	defer tx.Rollback() // nop if committed
-	for _, cmd := range cmds {
-		_, err := tx.Exec(cmd)
-		if err != nil {
-			return fmt.Errorf("sql failed %#v, %v", cmd, err)
-		}
-	}
-	err = tx.Commit()
-	if err != nil {
-		return fmt.Errorf("commit of %d commands failed, %v", len(cmds), err)
-	}
-	return nil
-}
-
-func postgresCreateTables(db *sql.DB) error {
-	cmds := []string{
+// Schema versions for postgres, see migrate.go
+var postgresMigrations = [][]string{
+	// 1: baseline
+	{
 		createGuser,
 		createGuserNameIndex,
 		createUserSocial,
 		createUserSocialKeyIndex,
 		createUserEmail,
 		creaetUserEmailIndex,
+		createUserAPIKey,
+		createUserAPIKeyIdIndex,
+		createUserTOTP,
+		createUserWebAuthn,
+		createUserWebAuthnIdIndex,
+		createUserRecovery,
+		createLoginThrottle,
+		createAuthEvent,
+		createAuthEventIdIndex,
+		createAuthEventTimeIndex,
+		createWebhookOutbox,
+		createWebhookOutboxNextIndex,
+		createUserDisabled,
+	},
+	// 2: password bcrypt bytes as bytea, like sqlite3's BLOB.
+	// lib/pq wrote []byte into the varchar as "\x" hex text.
+	{
+		`ALTER TABLE guser ALTER COLUMN password TYPE bytea USING CASE WHEN substr(password, 1, 2) = '\x' THEN decode(substr(password, 3), 'hex') ELSE convert_to(password, 'UTF8') END`,
+	},
+	// 3: UserDB.Feedback's table
+	{
+		createFeedback,
+		createFeedbackGuidIndex,
+		createFeedbackTimeIndex,
+	},
+	// 4: guser.created for ListUsers, and username LIKE 'prefix%' needs
+	// pattern_ops unless the database collation is C
+	{
+		`ALTER TABLE guser ADD COLUMN created bigint`,
+		createGuserCreatedIndex,
+		`CREATE INDEX IF NOT EXISTS guser_name_pattern ON guser ( username varchar_pattern_ops )`,
+	},
+	// 5: single-use WebAuthn challenges
+	{
+		createWebAuthnChallenge,
+		createWebAuthnChallengeExpiresIndex,
+	},
+	// 6: lower case stored emails
+	lowerStoredEmails,
+	// 7: ListUsers matches and sorts usernames by LOWER(), in byte order
+	{
+		`CREATE INDEX IF NOT EXISTS guser_lower_name ON guser ( (LOWER(username)) COLLATE "C" )`,
+		`DROP INDEX IF EXISTS guser_name_pattern`,
+	},
+}
+
+// SELECT for readUsers, id is the guser primary key column
+func userSelect(id string) string {
+	return `SELECT g.` + id + `, g.username, g.password, g.prefs, g.created FROM guser g`
+}
+
+func getUser(ctx context.Context, db dialectDB, id string, guid int64) (*User, error) {
+	// user records are highly cacheable and frequently read, see CachedUserDB
+	cmd := userSelect(id) + ` WHERE g.` + id + ` = $1`
+	rows, err := dbQueryContext(ctx, db, cmd, guid)
+	if err != nil {
+		log.Printf("sql err on %#v: %s", cmd, err)
+		return nil, err
 	}
-	return dbTxCmdList(db, cmds)
+	return readUser(ctx, db, rows)
 }
 
-func postgresGetUser(db *sql.DB, guid int64) (*User, error) {
-	// TODO: user records are probably highly cacheable, and frequently read
-	cmd := `SELECT g.username, g.password, g.prefs, e.email, e.data, g.id, s.socialkey, s.socialdata FROM guser g LEFT JOIN user_email e ON g.id = e.id LEFT JOIN user_social s ON g.id = s.id WHERE g.id = $1`
-	rows, err := db.Query(cmd, guid)
+func getLocalUser(ctx context.Context, db dialectDB, id string, uid string) (*User, error) {
+	cmd := userSelect(id) + ` WHERE g.username = $1`
+	rows, err := dbQueryContext(ctx, db, cmd, uid)
 	if err != nil {
 		log.Printf("sql err on %#v: %s", cmd, err)
 		return nil, err
 	}
-	return readUserFromSelect(rows)
+	return readUser(ctx, db, rows)
 }
 
-func postgresGetLocalUser(db *sql.DB, uid string) (*User, error) {
-	cmd := `SELECT g.username, g.password, g.prefs, e.email, e.data, g.id, s.socialkey, s.socialdata FROM guser g LEFT JOIN user_email e ON g.id = e.id LEFT JOIN user_social s ON g.id = s.id WHERE g.username = $1`
-	rows, err := db.Query(cmd, uid)
+func getSocialUser(ctx context.Context, db dialectDB, id string, service, sid string) (*User, error) {
+	socialkey := SocialKey(service, sid)
+	cmd := userSelect(id) + ` JOIN user_social s ON g.` + id + ` = s.id WHERE s.socialkey = $1`
+	rows, err := dbQueryContext(ctx, db, cmd, socialkey)
 	if err != nil {
 		log.Printf("sql err on %#v: %s", cmd, err)
 		return nil, err
 	}
-	return readUserFromSelect(rows)
+	return readUser(ctx, db, rows)
 }
 
-func postgresGetSocialUser(db *sql.DB, service, id string) (*User, error) {
-	socialkey := SocialKey(service, id)
-	cmd := `WITH sq AS (SELECT sqs.id FROM user_social sqs WHERE sqs.socialkey = $1 LIMIT 1) SELECT g.username, g.password, g.prefs, e.email, e.data, g.id, s.socialkey, s.socialdata FROM guser g JOIN sq ON g.id = sq.id LEFT JOIN user_email e ON g.id = e.id LEFT JOIN user_social s ON g.id = s.id`
-	rows, err := db.Query(cmd, socialkey)
+// Also matches addresses stored before en's options were set
+func getEmailUser(ctx context.Context, db dialectDB, id string, en *EmailNormalization, email string, validatedOnly bool) (*User, error) {
+	forms := en.LookupForms(email)
+	cmd := `SELECT id, data FROM user_email WHERE email = $1 OR email = $2`
+	rows, err := dbQueryContext(ctx, db, cmd, forms[0], forms[len(forms)-1])
 	if err != nil {
 		log.Printf("sql err on %#v: %s", cmd, err)
 		return nil, err
 	}
-	return readUserFromSelect(rows)
+	choice := EmailUserChoice{ValidatedOnly: validatedOnly}
+	for rows.Next() {
+		var guid int64
+		var emailmetablob []byte
+		err = rows.Scan(&guid, &emailmetablob)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var meta EmailMetadata
+		if len(emailmetablob) > 0 {
+			cbor.Loads(emailmetablob, &meta)
+		}
+		choice.Offer(guid, meta.Validated)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+	guid, ok := choice.Chosen()
+	if !ok {
+		return nil, BadUserError
+	}
+	return getUser(ctx, db, id, guid)
+}
+
+// Three queries per maxInIds users
+func getUsers(ctx context.Context, db dialectDB, id string, guids []int64) ([]*User, error) {
+	found := make(map[int64]*User, len(guids))
+	for start := 0; start < len(guids); start += maxInIds {
+		end := start + maxInIds
+		if end > len(guids) {
+			end = len(guids)
+		}
+		in, args := inIds(guids[start:end])
+		cmd := userSelect(id) + ` WHERE g.` + id + ` IN (` + in + `)`
+		rows, err := dbQueryContext(ctx, db, cmd, args...)
+		if err != nil {
+			log.Printf("sql err on %#v: %s", cmd, err)
+			return nil, err
+		}
+		users, err := readUsers(ctx, db, rows)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			found[u.Guid] = u
+		}
+	}
+	return usersInOrder(guids, found), nil
+}
+
+// GetUsers result for guids from found
+func usersInOrder(guids []int64, found map[int64]*User) []*User {
+	out := make([]*User, len(guids))
+	for i, guid := range guids {
+		out[i] = found[guid]
+	}
+	return out
 }
 
 func SocialKey(service, uid string) string {
@@ -269,18 +538,19 @@ func unpackPrefsBlob(user *User, blob []byte) error {
 	return err
 }
 
-func commonPutNewUser(xd innerDriver, nu *User) (*User, error) {
+func commonPutNewUser(ctx context.Context, xd innerDriver, nu *User) (*User, error) {
 	db := xd.DB()
+	en := xd.EmailNormalization()
 	if len(nu.Username) > 0 {
-		ou, _ := xd.GetLocalUser(nu.Username)
+		ou, _ := xd.GetLocalUser(ctx, nu.Username)
 		if ou != nil {
-			return nil, fmt.Errorf("username \"%s\" already taken", nu.Username)
+			return nil, fmt.Errorf("%w: %#v", ErrUsernameTaken, nu.Username)
 		}
 		// no collision, moving on
 	}
 	if (nu.Social != nil) && (len(nu.Social) > 0) {
 		for _, si := range nu.Social {
-			ou, _ := xd.GetSocialUser(si.Service, si.Id)
+			ou, _ := xd.GetSocialUser(ctx, si.Service, si.Id)
 			if ou != nil {
 				// database race? Should have just tried
 				// to log in, but maybe found it not
@@ -288,37 +558,42 @@ func commonPutNewUser(xd innerDriver, nu *User) (*User, error) {
 				// created elsewhere, and now we're
 				// trying to create it here? Probably
 				// a page reload will fix everything.
-				return nil, fmt.Errorf("social login \"%s %s\" already taken", si.Service, si.Id)
+				return nil, fmt.Errorf("%w: \"%s %s\"", ErrSocialTaken, si.Service, si.Id)
 			}
 		}
 	}
 	if (nu.Email != nil) && (len(nu.Email) > 0) {
 		for _, em := range nu.Email {
-			emrows, err := db.Query(`SELECT id, data FROM user_email WHERE email = $1`, em.Email)
+			forms := en.LookupForms(em.Email)
+			emrows, err := dbQueryContext(ctx, db, `SELECT id, data FROM user_email WHERE email = $1 OR email = $2`, forms[0], forms[len(forms)-1])
 			if err != nil {
 				log.Printf("error getting emails in newuser: %s", err)
 				return nil, err
 			}
-			if emrows.Next() {
+			taken := emrows.Next()
+			emrows.Close()
+			if taken {
 				// TODO: check that other email is validated
-				return nil, fmt.Errorf("email %#v already taken when making new user", em)
+				return nil, fmt.Errorf("%w: %#v", ErrEmailTaken, forms[0])
 			}
 		}
 	}
+	en.NormalizeUserEmails(nu)
 
 	pblob, err := prefsBlob(nu)
 	if err != nil {
 		log.Print("nu prefs cbor fail", err)
 		return nil, err
 	}
-	tx, err := db.Begin()
+	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback() // nop if committed
-	newGuid, err := xd.PutGuser(tx, nu, pblob)
+	newGuid, err := xd.PutGuser(ctx, tx, nu, pblob)
 	if err != nil {
-		return nil, err
+		tx.Rollback()
+		return nil, putNewUserCollision(ctx, xd, nu, err)
 	}
 	nu.Guid = newGuid
 
@@ -327,21 +602,17 @@ func commonPutNewUser(xd innerDriver, nu *User) (*User, error) {
 
 		for _, si := range nu.Social {
 			skey := SocialKey(si.Service, si.Id)
-			_, err = tx.Exec(cmd, nu.Guid, skey, nil)
+			_, err = txExecContext(ctx, db, tx, cmd, nu.Guid, skey, nil)
 			if err != nil {
 				log.Printf("error putting user social: %s", err)
-				return nil, err
+				tx.Rollback()
+				nu.Guid = 0
+				return nil, putNewUserCollision(ctx, xd, nu, err)
 			}
 		}
 	}
 	if (nu.Email != nil) && (len(nu.Email) > 0) {
 		cmd := `INSERT INTO user_email (id, email, data) VALUES ($1, $2, $3)`
-		stmt, err := tx.Prepare(cmd)
-		if err != nil {
-			log.Printf("error preparing user_email statement %#v: %s", cmd, err)
-			tx.Rollback()
-			return nil, err
-		}
 
 		for _, em := range nu.Email {
 			edblob, err := cbor.Dumps(em.EmailMetadata)
@@ -349,13 +620,26 @@ func commonPutNewUser(xd innerDriver, nu *User) (*User, error) {
 				err = fmt.Errorf("could not cbor encode email metadata for %s, %v", em.Email, err)
 				return nil, err
 			}
-			_, err = stmt.Exec(nu.Guid, em.Email, edblob)
+			_, err = txExecContext(ctx, db, tx, cmd, nu.Guid, em.Email, edblob)
 			if err != nil {
 				err = fmt.Errorf("error putting user email: %s", err)
 				return nil, err
 			}
 		}
 	}
+	for _, si := range nu.Social {
+		err = txLogAuthEvent(ctx, db, tx, socialLinkedEvent(nu.Guid, si))
+		if err != nil {
+			nu.Guid = 0
+			return nil, err
+		}
+	}
+
+	err = xd.Hooks().FireUserCreatedTx(tx, nu)
+	if err != nil {
+		nu.Guid = 0
+		return nil, err
+	}
 
 	err = tx.Commit()
 	if err != nil {
@@ -363,227 +647,368 @@ func commonPutNewUser(xd innerDriver, nu *User) (*User, error) {
 		return nil, err
 	}
 
+	xd.Hooks().FireUserCreated(nu)
+	for _, si := range nu.Social {
+		xd.Hooks().FireSocialLinked(nu, si)
+	}
 	return nu, nil
 }
 
+// A PutNewUser that passed the checks can still lose a race to another
+// on the unique indexes. Returns the Err*Taken for that, or err.
+// Call after rolling back, GetLocalUser etc may need the connection.
+func putNewUserCollision(ctx context.Context, xd innerDriver, nu *User, err error) error {
+	if len(nu.Username) > 0 {
+		ou, _ := xd.GetLocalUser(ctx, nu.Username)
+		if ou != nil {
+			return fmt.Errorf("%w: %#v", ErrUsernameTaken, nu.Username)
+		}
+	}
+	for _, si := range nu.Social {
+		ou, _ := xd.GetSocialUser(ctx, si.Service, si.Id)
+		if ou != nil {
+			return fmt.Errorf("%w: \"%s %s\"", ErrSocialTaken, si.Service, si.Id)
+		}
+	}
+	return err
+}
+
 func SetUserPrefs(db *sql.DB, user *User) error {
+	return SetUserPrefsContext(context.Background(), db, user)
+}
+
+func SetUserPrefsContext(ctx context.Context, db *sql.DB, user *User) error {
+	return setUserPrefs(ctx, detectDB(db), user)
+}
+
+func setUserPrefs(ctx context.Context, db dialectDB, user *User) error {
 	pblob, err := prefsBlob(user)
 	if err != nil {
 		log.Print("set prefs cbor fail", err)
 		return err
 	}
-	_, err = db.Exec(`UPDATE guser SET prefs = $1 WHERE id = $2`, pblob, user.Guid)
+	_, err = dbExecContext(ctx, db, `UPDATE guser SET prefs = $1 WHERE `+db.dialect.GuserId()+` = $2`, pblob, user.Guid)
 	return err
 }
 
 func SetUserPassword(db *sql.DB, user *User) error {
-	_, err := db.Exec(`UPDATE guser SET password = $1 WHERE id = $2`, user.Password, user.Guid)
-	return err
+	return SetUserPasswordContext(context.Background(), db, user)
+}
+
+func SetUserPasswordContext(ctx context.Context, db *sql.DB, user *User) error {
+	return setUserPassword(ctx, detectDB(db), nil, user)
+}
+
+func setUserPassword(ctx context.Context, db dialectDB, hr *HookRegistry, user *User) error {
+	err := txChange(ctx, db, changeEvent(user.Guid, EventPasswordChanged, "password", ""), nil, `UPDATE guser SET password = $1 WHERE `+db.dialect.GuserId()+` = $2`, user.Password, user.Guid)
+	if err != nil {
+		return err
+	}
+	hr.FirePasswordChanged(user)
+	return nil
+}
+
+// Run cmd, record ev and run hook, which may be nil, in one transaction
+func txChange(ctx context.Context, db dialectDB, ev *AuthEvent, hook func(tx *sql.Tx) error, cmd string, args ...interface{}) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	_, err = txExecContext(ctx, db, tx, cmd, args...)
+	if err != nil {
+		return err
+	}
+	err = txLogAuthEvent(ctx, db, tx, ev)
+	if err != nil {
+		return err
+	}
+	if hook != nil {
+		err = hook(tx)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // Set local login for a social-login user
 func SetLogin(db *sql.DB, user *User, username, password string) error {
-	_, err := db.Exec(`UPDATE guser SET username = $1, password = $2 WHERE id = $3`, username, password, user.Guid)
-	return err
+	return SetLoginContext(context.Background(), db, user, username, password)
+}
+
+func SetLoginContext(ctx context.Context, db *sql.DB, user *User, username, password string) error {
+	return setLogin(ctx, detectDB(db), nil, user, username, password)
+}
+
+func setLogin(ctx context.Context, db dialectDB, hr *HookRegistry, user *User, username, password string) error {
+	err := txChange(ctx, db, changeEvent(user.Guid, EventPasswordChanged, "password", username), nil, `UPDATE guser SET username = $1, password = $2 WHERE `+db.dialect.GuserId()+` = $3`, username, password, user.Guid)
+	if err != nil {
+		return err
+	}
+	hr.FirePasswordChanged(user)
+	return nil
 }
 
 func AddEmail(db *sql.DB, user *User, email EmailRecord) error {
+	return AddEmailContext(context.Background(), db, user, email)
+}
+
+func AddEmailContext(ctx context.Context, db *sql.DB, user *User, email EmailRecord) error {
+	return addEmail(ctx, detectDB(db), nil, nil, user, email)
+}
+
+func addEmail(ctx context.Context, db dialectDB, hr *HookRegistry, en *EmailNormalization, user *User, email EmailRecord) error {
+	email.Email = en.Normalize(email.Email)
 	metablob, err := cbor.Dumps(email.EmailMetadata)
 	if err != nil {
 		log.Print("failed to encode email metadata cbor ", err)
 		metablob = make([]byte, 0)
 	}
-	_, err = db.Exec(`INSERT INTO user_email (id, email, data) VALUES ($1, $2, $3)`, user.Guid, email.Email, metablob)
-	return err
+	hook := func(tx *sql.Tx) error {
+		return hr.FireEmailAddedTx(tx, user, email.Email)
+	}
+	err = txChange(ctx, db, changeEvent(user.Guid, EventEmailAdded, "", email.Email), hook, `INSERT INTO user_email (id, email, data) VALUES ($1, $2, $3)`, user.Guid, email.Email, metablob)
+	if err != nil {
+		return err
+	}
+	hr.FireEmailAdded(user, email.Email)
+	return nil
 }
 
 func DelEmail(db *sql.DB, user *User, email string) error {
-	_, err := db.Exec(`DELETE FROM user_email WHERE id = $1 AND email = $2`, user.Guid, email)
-	return err
+	return DelEmailContext(context.Background(), db, user, email)
 }
 
-func Feedback(db *sql.DB, user *User, now int64, text string) error {
-	_, err := db.Exec(`INSERT INTO feedback (guid, millis, msg) VALUES ($1, $2, $3)`, user.Guid, now, text)
-	return err
+func DelEmailContext(ctx context.Context, db *sql.DB, user *User, email string) error {
+	return delEmail(ctx, detectDB(db), nil, nil, user, email)
 }
 
-func dbIsSqlite(db *sql.DB) bool {
-	driver := db.Driver()
-	t := reflect.TypeOf(driver)
-	return t.Kind() == reflect.Ptr && t.Elem().Name() == "SQLiteDriver"
+func delEmail(ctx context.Context, db dialectDB, hr *HookRegistry, en *EmailNormalization, user *User, email string) error {
+	forms := en.LookupForms(email)
+	norm := forms[0]
+	hook := func(tx *sql.Tx) error {
+		return hr.FireEmailDeletedTx(tx, user, norm)
+	}
+	err := txChange(ctx, db, changeEvent(user.Guid, EventEmailDeleted, "", norm), hook, `DELETE FROM user_email WHERE id = $1 AND (email = $2 OR email = $3)`, user.Guid, norm, forms[len(forms)-1])
+	if err != nil {
+		return err
+	}
+	hr.FireEmailDeleted(user, norm)
+	return nil
 }
 
 func NewSqlUserDB(db *sql.DB) UserDB {
-	if dbIsSqlite(db) {
-		return &sqlite3UserDB{db}
-	}
-	return &postgresUserDB{db}
+	return NewSqlUserDBWithDialect(db, DetectDialect(db))
+}
+
+func NewSqlUserDBContext(db *sql.DB) UserDBContext {
+	return ContextUserDB(NewSqlUserDB(db))
+}
+
+// For drivers DetectDialect doesn't know, or to override it. The
+// standalone functions taking db always use DetectDialect; see also
+// NewSqlThrottleStoreWithDialect and NewSqlWebhookOutboxWithDialect.
+func NewSqlUserDBWithDialect(db *sql.DB, dialect Dialect) UserDB {
+	return BackgroundUserDB(&sqlUserDB{db, dialect, &HookRegistry{}, &EmailNormalization{}})
 }
 
 type innerDriver interface {
-	PutGuser(tx *sql.Tx, nu *User, pblob []byte) (int64, error)
-	GetLocalUser(uid string) (*User, error)
-	GetSocialUser(service, id string) (*User, error)
-	DB() *sql.DB
+	PutGuser(ctx context.Context, tx *sql.Tx, nu *User, pblob []byte) (int64, error)
+	GetUser(ctx context.Context, guid int64) (*User, error)
+	GetLocalUser(ctx context.Context, uid string) (*User, error)
+	GetSocialUser(ctx context.Context, service, id string) (*User, error)
+	GetUsers(ctx context.Context, guids []int64) ([]*User, error)
+	GetEmailUser(ctx context.Context, email string, validatedOnly bool) (*User, error)
+	DB() dialectDB
+	Hooks() *HookRegistry
+	EmailNormalization() *EmailNormalization
 }
 
-type postgresUserDB struct {
-	db *sql.DB
+type sqlUserDB struct {
+	db      *sql.DB
+	dialect Dialect
+	hooks   *HookRegistry
+	en      *EmailNormalization
 }
 
 // implement innerDriver
-func (sdb *postgresUserDB) PutGuser(tx *sql.Tx, nu *User, pblob []byte) (int64, error) {
+func (sdb *sqlUserDB) PutGuser(ctx context.Context, tx *sql.Tx, nu *User, pblob []byte) (int64, error) {
 	username := sql.NullString{String: nu.Username, Valid: nu.Username != ""}
-	idrows, err := tx.Query(`INSERT INTO guser (username, password, prefs) VALUES ($1, $2, $3) RETURNING id`, username, nu.Password, pblob)
-	if err != nil {
-		err = fmt.Errorf("error inserting new user: %s", err)
-		return 0, err
+	if nu.Created == 0 {
+		nu.Created = time.Now().Unix()
 	}
-	var newGuid int64 = 0
-	if idrows.Next() {
-		err = idrows.Scan(&newGuid)
-		if err != nil {
-			err = fmt.Errorf("could not get new guid: %s", err)
-			return 0, err
-		}
-	}
-	// This call to Next which doesn't do anything but return
-	// false is necssary due to lib/pq driver oddities!
-	for idrows.Next() {
-		log.Print("bogus extra rows of return from INSERT!")
-	}
-	return newGuid, err
+	return sdb.dialect.InsertGuser(ctx, tx, username, nu.Password, pblob, nu.Created)
 }
 
 // implement innerDriver
-func (sdb *postgresUserDB) DB() *sql.DB {
-	return sdb.db
+func (sdb *sqlUserDB) Hooks() *HookRegistry {
+	return sdb.hooks
+}
+
+func (sdb *sqlUserDB) EmailNormalization() *EmailNormalization {
+	return sdb.en
+}
+
+func (sdb *sqlUserDB) DB() dialectDB {
+	return dialectDB{sdb.db, sdb.dialect}
 }
 
-func (sdb *postgresUserDB) PutNewUser(nu *User) (*User, error) {
-	return commonPutNewUser(sdb, nu)
+func (sdb *sqlUserDB) PutNewUser(ctx context.Context, nu *User) (*User, error) {
+	return commonPutNewUser(ctx, sdb, nu)
 }
 
-func (sdb *postgresUserDB) GetUser(guid int64) (*User, error) {
-	return postgresGetUser(sdb.db, guid)
+func (sdb *sqlUserDB) GetUser(ctx context.Context, guid int64) (*User, error) {
+	return getUser(ctx, sdb.DB(), sdb.dialect.GuserId(), guid)
+}
+func (sdb *sqlUserDB) GetLocalUser(ctx context.Context, uid string) (*User, error) {
+	return getLocalUser(ctx, sdb.DB(), sdb.dialect.GuserId(), uid)
 }
-func (sdb *postgresUserDB) GetLocalUser(uid string) (*User, error) {
-	return postgresGetLocalUser(sdb.db, uid)
+func (sdb *sqlUserDB) GetSocialUser(ctx context.Context, service, id string) (*User, error) {
+	return getSocialUser(ctx, sdb.DB(), sdb.dialect.GuserId(), service, id)
 }
-func (sdb *postgresUserDB) GetSocialUser(service, id string) (*User, error) {
-	return postgresGetSocialUser(sdb.db, service, id)
+func (sdb *sqlUserDB) GetUsers(ctx context.Context, guids []int64) ([]*User, error) {
+	return getUsers(ctx, sdb.DB(), sdb.dialect.GuserId(), guids)
+}
+func (sdb *sqlUserDB) GetEmailUser(ctx context.Context, email string, validatedOnly bool) (*User, error) {
+	return getEmailUser(ctx, sdb.DB(), sdb.dialect.GuserId(), sdb.en, email, validatedOnly)
+}
+func (sdb *sqlUserDB) ListUsers(ctx context.Context, q UserQuery) ([]*User, string, error) {
+	return listUsers(ctx, sdb.DB(), q)
+}
+
+func (sdb *sqlUserDB) DisableUser(ctx context.Context, user *User, reason string) error {
+	return disableUser(ctx, sdb.DB(), user, reason)
 }
 
-func (sdb *postgresUserDB) SetUserPrefs(xuser *User) error {
-	return SetUserPrefs(sdb.db, xuser)
+func (sdb *sqlUserDB) EnableUser(ctx context.Context, user *User) error {
+	return enableUser(ctx, sdb.DB(), user)
 }
-func (sdb *postgresUserDB) SetUserPassword(xuser *User) error {
-	return SetUserPassword(sdb.db, xuser)
+
+func (sdb *sqlUserDB) GetDisabled(ctx context.Context, user *User) (bool, string, error) {
+	return getDisabled(ctx, sdb.DB(), user)
+}
+
+func (sdb *sqlUserDB) DeleteUser(ctx context.Context, user *User) error {
+	return commonDeleteUser(ctx, sdb.DB(), sdb.dialect.GuserId(), sdb.hooks, user)
+}
+
+func (sdb *sqlUserDB) ExportUser(ctx context.Context, guid int64) (*UserExport, error) {
+	return ExportUserFrom(ctx, sdb, guid)
+}
+
+func (sdb *sqlUserDB) SetUserPrefs(ctx context.Context, xuser *User) error {
+	return setUserPrefs(ctx, sdb.DB(), xuser)
+}
+func (sdb *sqlUserDB) SetUserPassword(ctx context.Context, xuser *User) error {
+	return setUserPassword(ctx, sdb.DB(), sdb.hooks, xuser)
 }
 
 // Set local login for a social-login user
-func (sdb *postgresUserDB) SetLogin(user *User, username, password string) error {
-	return SetLogin(sdb.db, user, username, password)
+func (sdb *sqlUserDB) SetLogin(ctx context.Context, user *User, username, password string) error {
+	return setLogin(ctx, sdb.DB(), sdb.hooks, user, username, password)
 }
 
-func (sdb *postgresUserDB) AddEmail(user *User, email EmailRecord) error {
-	return AddEmail(sdb.db, user, email)
+func (sdb *sqlUserDB) AddEmail(ctx context.Context, user *User, email EmailRecord) error {
+	return addEmail(ctx, sdb.DB(), sdb.hooks, sdb.en, user, email)
 }
 
-func (sdb *postgresUserDB) DelEmail(user *User, email string) error {
-	return DelEmail(sdb.db, user, email)
+func (sdb *sqlUserDB) DelEmail(ctx context.Context, user *User, email string) error {
+	return delEmail(ctx, sdb.DB(), sdb.hooks, sdb.en, user, email)
 }
 
-func (sdb *postgresUserDB) Feedback(user *User, now int64, text string) error {
-	return Feedback(sdb.db, user, now, text)
+func (sdb *sqlUserDB) Feedback(ctx context.Context, user *User, now int64, text string) error {
+	return feedback(ctx, sdb.DB(), user, now, text)
 }
 
-func (sdb *postgresUserDB) Setup() error {
-	return postgresCreateTables(sdb.db)
+func (sdb *sqlUserDB) ListFeedback(ctx context.Context, guid, start, end int64, offset, limit int) ([]FeedbackRecord, error) {
+	return listFeedback(ctx, sdb.DB(), guid, start, end, offset, limit)
 }
 
-type sqlite3UserDB struct {
-	db *sql.DB
+func (sdb *sqlUserDB) LimitedFeedback(ctx context.Context, user *User, now int64, text string, start int64, max int) (bool, int64, error) {
+	return limitedFeedback(ctx, sdb.DB(), user, now, text, start, max)
 }
 
-// implement innerDriver
-func (sdb *sqlite3UserDB) PutGuser(tx *sql.Tx, nu *User, pblob []byte) (int64, error) {
-	username := sql.NullString{String: nu.Username, Valid: nu.Username != ""}
-	result, err := tx.Exec(`INSERT INTO guser (username, password, prefs) VALUES ($1, $2, $3)`, username, nu.Password, pblob)
-	if err != nil {
-		err = fmt.Errorf("error inserting new user: %s", err)
-		return 0, err
-	}
-	newGuid, err := result.LastInsertId()
-	if err != nil {
-		err = fmt.Errorf("could not get user insert rowid, %v", err)
-	}
-	return newGuid, err
+func (sdb *sqlUserDB) CreateAPIKey(ctx context.Context, user *User, name string, scopes []string) (string, *APIKey, error) {
+	return createAPIKey(ctx, sdb.DB(), user, name, scopes)
 }
 
-// implement innerDriver
-func (sdb *sqlite3UserDB) DB() *sql.DB {
-	return sdb.db
+func (sdb *sqlUserDB) ListAPIKeys(ctx context.Context, user *User) ([]APIKey, error) {
+	return listAPIKeys(ctx, sdb.DB(), user)
 }
 
-func (sdb *sqlite3UserDB) PutNewUser(nu *User) (*User, error) {
-	return commonPutNewUser(sdb, nu)
+func (sdb *sqlUserDB) RevokeAPIKey(ctx context.Context, user *User, prefix string) error {
+	return revokeAPIKey(ctx, sdb.DB(), user, prefix)
 }
 
-func (sdb *sqlite3UserDB) GetUser(guid int64) (*User, error) {
-	cmd := `SELECT g.username, g.password, g.prefs, e.email, e.data, g.ROWID, s.socialkey, s.socialdata FROM guser g LEFT JOIN user_email e ON g.ROWID = e.id LEFT JOIN user_social s ON g.ROWID = s.id WHERE g.ROWID = $1`
-	rows, err := sdb.db.Query(cmd, guid)
-	if err != nil {
-		log.Printf("sql err on %#v: %s", cmd, err)
-		return nil, err
-	}
-	return readUserFromSelect(rows)
+func (sdb *sqlUserDB) GetAPIKeyUser(ctx context.Context, key string) (*User, *APIKey, error) {
+	return commonGetAPIKeyUser(ctx, sdb, key)
 }
 
-func (sdb *sqlite3UserDB) GetLocalUser(uid string) (*User, error) {
-	cmd := `SELECT g.username, g.password, g.prefs, e.email, e.data, g.ROWID, s.socialkey, s.socialdata FROM guser g LEFT JOIN user_email e ON g.ROWID = e.id LEFT JOIN user_social s ON g.ROWID = s.id WHERE g.username = $1`
-	rows, err := sdb.db.Query(cmd, uid)
-	if err != nil {
-		log.Printf("sql err on %#v: %s", cmd, err)
-		return nil, err
-	}
-	return readUserFromSelect(rows)
+func (sdb *sqlUserDB) PutTOTP(ctx context.Context, user *User, rec *TOTPRecord) error {
+	return putTOTP(ctx, sdb.DB(), user, rec)
 }
-func (sdb *sqlite3UserDB) GetSocialUser(service, id string) (*User, error) {
-	socialkey := SocialKey(service, id)
-	cmd := `WITH sq AS (SELECT sqs.id FROM user_social sqs WHERE sqs.socialkey = $1 LIMIT 1) SELECT g.username, g.password, g.prefs, e.email, e.data, g.ROWID, s.socialkey, s.socialdata FROM guser g JOIN sq ON g.ROWID = sq.id LEFT JOIN user_email e ON g.ROWID = e.id LEFT JOIN user_social s ON g.ROWID = s.id`
-	rows, err := sdb.db.Query(cmd, socialkey)
-	if err != nil {
-		log.Printf("sql err on %#v: %s", cmd, err)
-		return nil, err
-	}
-	return readUserFromSelect(rows)
+
+func (sdb *sqlUserDB) GetTOTP(ctx context.Context, user *User) (*TOTPRecord, error) {
+	return getTOTP(ctx, sdb.DB(), user)
 }
 
-func (sdb *sqlite3UserDB) SetUserPrefs(xuser *User) error {
-	return SetUserPrefs(sdb.db, xuser)
+func (sdb *sqlUserDB) UseTOTPStep(ctx context.Context, user *User, step int64) (bool, error) {
+	return useTOTPStep(ctx, sdb.DB(), user, step)
 }
-func (sdb *sqlite3UserDB) SetUserPassword(xuser *User) error {
-	return SetUserPassword(sdb.db, xuser)
+
+func (sdb *sqlUserDB) DelTOTP(ctx context.Context, user *User) error {
+	return delTOTP(ctx, sdb.DB(), user)
 }
 
-// Set local login for a social-login user
-func (sdb *sqlite3UserDB) SetLogin(user *User, username, password string) error {
-	return SetLogin(sdb.db, user, username, password)
+func (sdb *sqlUserDB) AddWebAuthnCredential(ctx context.Context, user *User, cred *WebAuthnCredential) error {
+	return addWebAuthnCredential(ctx, sdb.DB(), user, cred)
+}
+
+func (sdb *sqlUserDB) ListWebAuthnCredentials(ctx context.Context, user *User) ([]WebAuthnCredential, error) {
+	return listWebAuthnCredentials(ctx, sdb.DB(), user)
+}
+
+func (sdb *sqlUserDB) GetWebAuthnCredential(ctx context.Context, credID []byte) (*User, *WebAuthnCredential, error) {
+	return commonGetWebAuthnCredential(ctx, sdb, credID)
+}
+
+func (sdb *sqlUserDB) UseWebAuthnCredential(ctx context.Context, credID []byte, signCount int64) (bool, error) {
+	return useWebAuthnCredential(ctx, sdb.DB(), credID, signCount)
+}
+
+func (sdb *sqlUserDB) DelWebAuthnCredential(ctx context.Context, user *User, credID []byte) error {
+	return delWebAuthnCredential(ctx, sdb.DB(), user, credID)
+}
+
+func (sdb *sqlUserDB) PutWebAuthnChallenge(ctx context.Context, challenge []byte, expires int64) error {
+	return putWebAuthnChallenge(ctx, sdb.DB(), challenge, expires)
+}
+
+func (sdb *sqlUserDB) TakeWebAuthnChallenge(ctx context.Context, challenge []byte) (bool, error) {
+	return takeWebAuthnChallenge(ctx, sdb.DB(), challenge)
+}
+
+func (sdb *sqlUserDB) SetRecoveryCodes(ctx context.Context, user *User, hashes [][]byte) error {
+	return setRecoveryCodes(ctx, sdb.DB(), user, hashes)
+}
+
+func (sdb *sqlUserDB) GetRecoveryCodes(ctx context.Context, user *User) ([][]byte, error) {
+	return getRecoveryCodes(ctx, sdb.DB(), user)
 }
 
-func (sdb *sqlite3UserDB) AddEmail(user *User, email EmailRecord) error {
-	return AddEmail(sdb.db, user, email)
+func (sdb *sqlUserDB) DelRecoveryCode(ctx context.Context, user *User, hash []byte) (bool, error) {
+	return delRecoveryCode(ctx, sdb.DB(), user, hash)
 }
 
-func (sdb *sqlite3UserDB) DelEmail(user *User, email string) error {
-	return DelEmail(sdb.db, user, email)
+func (sdb *sqlUserDB) LogAuthEvent(ctx context.Context, ev *AuthEvent) error {
+	return logAuthEvent(ctx, sdb.DB(), ev)
 }
 
-func (sdb *sqlite3UserDB) Feedback(user *User, now int64, text string) error {
-	return Feedback(sdb.db, user, now, text)
+func (sdb *sqlUserDB) GetAuthEvents(ctx context.Context, guid, start, end int64, limit int) ([]AuthEvent, error) {
+	return getAuthEvents(ctx, sdb.DB(), guid, start, end, limit)
 }
 
-func (sdb *sqlite3UserDB) Setup() error {
-	return sqlite3CreateTables(sdb.db)
+func (sdb *sqlUserDB) Setup(ctx context.Context) error {
+	return migrate(ctx, sdb.DB(), sdb.dialect.Migrations())
 }
@@ -1,9 +1,38 @@
 package sql
 
-import "database/sql"
+import (
+	"context"
+	"database/sql"
+)
 
-func sqlite3CreateTables(db *sql.DB) error {
-	cmds := []string{
+// serial id int is builtin ROWID
+type sqlite3Dialect struct{}
+
+func (sqlite3Dialect) Name() string {
+	return "sqlite3"
+}
+
+// sqlite3 takes $N as is
+func (sqlite3Dialect) Rebind(cmd string, args []interface{}) (string, []interface{}) {
+	return cmd, args
+}
+
+func (sqlite3Dialect) GuserId() string {
+	return "ROWID"
+}
+
+func (d sqlite3Dialect) InsertGuser(ctx context.Context, tx *sql.Tx, username sql.NullString, password, prefs []byte, created int64) (int64, error) {
+	return insertGuserLastId(ctx, d, tx, username, password, prefs, created)
+}
+
+func (sqlite3Dialect) Migrations() [][]string {
+	return sqlite3Migrations
+}
+
+// Schema versions for sqlite3, see migrate.go
+var sqlite3Migrations = [][]string{
+	// 1: baseline
+	{
 		//createGuser, -- override postgres:
 		// serial id int is builtin ROWID
 		`CREATE TABLE IF NOT EXISTS guser (
@@ -16,6 +45,42 @@ prefs BLOB -- cbor encoded UserSqlPrefs{}
 		createUserSocialKeyIndex,
 		createUserEmail,
 		creaetUserEmailIndex,
-	}
-	return dbTxCmdList(db, cmds)
+		createUserAPIKey,
+		createUserAPIKeyIdIndex,
+		createUserTOTP,
+		createUserWebAuthn,
+		createUserWebAuthnIdIndex,
+		createUserRecovery,
+		createLoginThrottle,
+		createAuthEvent,
+		createAuthEventIdIndex,
+		createAuthEventTimeIndex,
+		sqlite3CreateWebhookOutbox,
+		createWebhookOutboxNextIndex,
+		createUserDisabled,
+	},
+	// 2: postgres password to bytea, already a BLOB here
+	{},
+	// 3: UserDB.Feedback's table
+	{
+		createFeedback,
+		createFeedbackGuidIndex,
+		createFeedbackTimeIndex,
+	},
+	// 4: guser.created for ListUsers
+	{
+		`ALTER TABLE guser ADD COLUMN created INTEGER`,
+		createGuserCreatedIndex,
+	},
+	// 5: single-use WebAuthn challenges
+	{
+		createWebAuthnChallenge,
+		createWebAuthnChallengeExpiresIndex,
+	},
+	// 6: lower case stored emails
+	lowerStoredEmails,
+	// 7: ListUsers matches and sorts usernames by LOWER()
+	{
+		`CREATE INDEX IF NOT EXISTS guser_lower_name ON guser ( LOWER(username) )`,
+	},
 }
@@ -0,0 +1,1013 @@
+package testutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ls "github.com/brianolson/login/login/sql"
+)
+
+// RunUserDBConformance checks that a UserDB behaves like the SQL ones.
+// newUserDB is called for each subtest and may return a fresh UserDB or
+// the same one every time; names used are unique to each run, so an
+// existing database is fine.
+func RunUserDBConformance(t *testing.T, newUserDB func(t *testing.T) ls.UserDB) {
+	c := &conformance{run: time.Now().UnixNano() % 1000000000}
+	tests := []struct {
+		name string
+		f    func(t *testing.T, udb ls.UserDB)
+	}{
+		{"BasicUser", c.basicUser},
+		{"GetUsers", c.getUsers},
+		{"NotFound", c.notFound},
+		{"DuplicateUsername", c.duplicateUsername},
+		{"DuplicateSocial", c.duplicateSocial},
+		{"EmailCollision", c.emailCollision},
+		{"Prefs", c.prefs},
+		{"Password", c.password},
+		{"SetLogin", c.setLogin},
+		{"Email", c.email},
+		{"EmailUser", c.emailUser},
+		{"EmailNormalization", c.emailNormalization},
+		{"Disable", c.disable},
+		{"Delete", c.delete},
+		{"Export", c.export},
+		{"APIKeys", c.apiKeys},
+		{"TOTP", c.totp},
+		{"WebAuthn", c.webAuthn},
+		{"WebAuthnChallenge", c.webAuthnChallenge},
+		{"Recovery", c.recovery},
+		{"AuthEvents", c.authEvents},
+		{"ChangeEvents", c.changeEvents},
+		{"Feedback", c.feedback},
+		{"ConcurrentLimitedFeedback", c.concurrentLimitedFeedback},
+		{"ListUsers", c.listUsers},
+		{"ListUsersCase", c.listUsersCase},
+		{"ConcurrentPutNewUser", c.concurrentPutNewUser},
+	}
+	for _, tc := range tests {
+		f := tc.f
+		t.Run(tc.name, func(t *testing.T) {
+			f(t, newUserDB(t))
+		})
+	}
+}
+
+type conformance struct {
+	run int64
+	seq int64
+}
+
+// A name no other user in this or an earlier run has
+func (c *conformance) name(base string) string {
+	return fmt.Sprintf("%s-%d-%d", base, c.run, atomic.AddInt64(&c.seq, 1))
+}
+
+func (c *conformance) putUser(t *testing.T, udb ls.UserDB, nu *ls.User) *ls.User {
+	t.Helper()
+	_, err := udb.PutNewUser(nu)
+	if err != nil {
+		t.Fatalf("put user %#v, %v", nu.Username, err)
+	}
+	if nu.Guid == 0 {
+		t.Fatal("put user did not set Guid")
+	}
+	return nu
+}
+
+func (c *conformance) basicUser(t *testing.T, udb ls.UserDB) {
+	service := c.name("svc")
+	nu := ls.User{
+		Username: c.name("basic"),
+		Social: []ls.UserSocial{
+			{Service: service, Id: "alice"},
+			{Service: service, Id: "artemis"},
+		},
+		Email: []ls.EmailRecord{
+			{Email: c.name("z") + "@z.z", EmailMetadata: ls.EmailMetadata{Validated: true, Added: 31337}},
+			{Email: c.name("y") + "@y.y", EmailMetadata: ls.EmailMetadata{Validated: false, Added: 12345}},
+		},
+	}
+	err := nu.SetPassword("derp")
+	Mtfail(t, err, "set password, %v", err)
+	xu, err := udb.PutNewUser(&nu)
+	if err != nil {
+		t.Fatalf("put user, %v", err)
+	}
+	if xu.Guid == 0 {
+		t.Error("xu.Guid zero")
+	}
+
+	gets := map[string]func() (*ls.User, error){
+		"guid":   func() (*ls.User, error) { return udb.GetUser(nu.Guid) },
+		"local":  func() (*ls.User, error) { return udb.GetLocalUser(nu.Username) },
+		"social": func() (*ls.User, error) { return udb.GetSocialUser(service, "artemis") },
+	}
+	for how, get := range gets {
+		gu, err := get()
+		if err != nil {
+			t.Errorf("get user by %s, %v", how, err)
+			continue
+		}
+		if gu.Guid != nu.Guid {
+			t.Errorf("get user by %s got guid %d, wanted %d", how, gu.Guid, nu.Guid)
+		}
+		err = UserDeepEqual(nu, *gu)
+		Mtfail(t, err, "get user by %s neq, %v", how, err)
+		if !gu.GoodPassword("derp") {
+			t.Errorf("get user by %s: password did not round trip", how)
+		}
+	}
+
+	other := c.putUser(t, udb, &ls.User{Username: c.name("basic")})
+	if other.Guid == nu.Guid {
+		t.Errorf("two users got guid %d", nu.Guid)
+	}
+}
+
+func (c *conformance) getUsers(t *testing.T, udb ls.UserDB) {
+	service := c.name("svc")
+	var users []*ls.User
+	for i := 0; i < 3; i++ {
+		nu := &ls.User{Username: c.name("batch")}
+		for j := 0; j <= i; j++ {
+			nu.Email = append(nu.Email, ls.NewEmail(c.name("batch")+"@example.com"))
+			nu.Social = append(nu.Social, ls.UserSocial{Service: service, Id: c.name("batch")})
+		}
+		// and one more social login, N emails by N+1 social logins
+		nu.Social = append(nu.Social, ls.UserSocial{Service: service, Id: c.name("batch")})
+		users = append(users, c.putUser(t, udb, nu))
+	}
+
+	guids := []int64{users[1].Guid, 1 << 60, users[0].Guid, users[2].Guid, users[0].Guid}
+	got, err := udb.GetUsers(guids)
+	if err != nil {
+		t.Fatalf("get users, %v", err)
+	}
+	if len(got) != len(guids) {
+		t.Fatalf("got %d users for %d guids", len(got), len(guids))
+	}
+	for i, guid := range guids {
+		if guid == 1<<60 {
+			if got[i] != nil {
+				t.Errorf("got user %#v for missing guid", got[i])
+			}
+			continue
+		}
+		if got[i] == nil || got[i].Guid != guid {
+			t.Errorf("GetUsers[%d] = %#v, wanted guid %d", i, got[i], guid)
+			continue
+		}
+		for _, nu := range users {
+			if nu.Guid == guid {
+				err = UserDeepEqual(*nu, *got[i])
+				Mtfail(t, err, "GetUsers[%d] neq, %v", i, err)
+			}
+		}
+	}
+
+	got, err = udb.GetUsers(nil)
+	if err != nil || len(got) != 0 {
+		t.Errorf("GetUsers(nil) = %#v, %v", got, err)
+	}
+}
+
+func (c *conformance) notFound(t *testing.T, udb ls.UserDB) {
+	_, err := udb.GetUser(1 << 60)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetUser: expected BadUserError, got %v", err)
+	}
+	_, err = udb.GetLocalUser(c.name("nobody"))
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetLocalUser: expected BadUserError, got %v", err)
+	}
+	_, err = udb.GetSocialUser(c.name("svc"), "nobody")
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetSocialUser: expected BadUserError, got %v", err)
+	}
+	_, _, err = udb.GetAPIKeyUser(ls.APIKeyMarker + "nope_nope")
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetAPIKeyUser: expected BadUserError, got %v", err)
+	}
+	_, _, err = udb.GetWebAuthnCredential([]byte(c.name("cred")))
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetWebAuthnCredential: expected BadUserError, got %v", err)
+	}
+	err = udb.DeleteUser(&ls.User{Guid: 1 << 60})
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("DeleteUser: expected BadUserError, got %v", err)
+	}
+}
+
+func (c *conformance) duplicateUsername(t *testing.T, udb ls.UserDB) {
+	username := c.name("dup")
+	nu := c.putUser(t, udb, &ls.User{Username: username})
+	_, err := udb.PutNewUser(&ls.User{Username: username})
+	if !errors.Is(err, ls.ErrUsernameTaken) {
+		t.Errorf("expected ErrUsernameTaken, got %v", err)
+	}
+	xu, err := udb.GetLocalUser(username)
+	if err != nil || xu.Guid != nu.Guid {
+		t.Errorf("original user lost, %#v %v", xu, err)
+	}
+}
+
+func (c *conformance) duplicateSocial(t *testing.T, udb ls.UserDB) {
+	service := c.name("svc")
+	nu := c.putUser(t, udb, &ls.User{Social: []ls.UserSocial{{Service: service, Id: "alice"}}})
+	_, err := udb.PutNewUser(&ls.User{
+		Username: c.name("dupsocial"),
+		Social:   []ls.UserSocial{{Service: service, Id: "bob"}, {Service: service, Id: "alice"}},
+	})
+	if !errors.Is(err, ls.ErrSocialTaken) {
+		t.Errorf("expected ErrSocialTaken, got %v", err)
+	}
+	xu, err := udb.GetSocialUser(service, "alice")
+	if err != nil || xu.Guid != nu.Guid {
+		t.Errorf("original user lost, %#v %v", xu, err)
+	}
+	_, err = udb.GetSocialUser(service, "bob")
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("failed new user left social login, %v", err)
+	}
+}
+
+func (c *conformance) emailCollision(t *testing.T, udb ls.UserDB) {
+	email := c.name("taken") + "@example.com"
+	c.putUser(t, udb, &ls.User{Username: c.name("email"), Email: []ls.EmailRecord{ls.NewEmail(email)}})
+	username := c.name("email")
+	_, err := udb.PutNewUser(&ls.User{Username: username, Email: []ls.EmailRecord{ls.NewEmail(email)}})
+	if !errors.Is(err, ls.ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken, got %v", err)
+	}
+	_, err = udb.GetLocalUser(username)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("failed new user was stored, %v", err)
+	}
+}
+
+func (c *conformance) prefs(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{
+		Username:    c.name("prefs"),
+		DisplayName: "Before",
+		Data:        map[string]interface{}{"a": "b"},
+	})
+	xu, err := udb.GetUser(nu.Guid)
+	if err != nil {
+		t.Fatalf("get user, %v", err)
+	}
+	if xu.DisplayName != "Before" || xu.Data["a"] != "b" {
+		t.Errorf("new user prefs not stored %#v", xu)
+	}
+
+	nu.DisplayName = "After"
+	nu.Data = map[string]interface{}{"k": "v", "list": []interface{}{"x", "y"}}
+	err = udb.SetUserPrefs(nu)
+	Mtfail(t, err, "set prefs, %v", err)
+	xu, err = udb.GetUser(nu.Guid)
+	if err != nil {
+		t.Fatalf("get user, %v", err)
+	}
+	if xu.DisplayName != "After" || xu.Data["k"] != "v" || xu.Data["a"] != nil {
+		t.Errorf("prefs not replaced %#v", xu)
+	}
+	if list, ok := xu.Data["list"].([]interface{}); !ok || len(list) != 2 || list[1] != "y" {
+		t.Errorf("prefs list did not round trip %#v", xu.Data["list"])
+	}
+}
+
+func (c *conformance) password(t *testing.T, udb ls.UserDB) {
+	nu := &ls.User{Username: c.name("password")}
+	err := nu.SetPassword("old")
+	Mtfail(t, err, "set password, %v", err)
+	c.putUser(t, udb, nu)
+	err = nu.SetPassword("new")
+	Mtfail(t, err, "set password, %v", err)
+	err = udb.SetUserPassword(nu)
+	Mtfail(t, err, "set user password, %v", err)
+	xu, err := udb.GetLocalUser(nu.Username)
+	if err != nil {
+		t.Fatalf("get user, %v", err)
+	}
+	if !xu.GoodPassword("new") || xu.GoodPassword("old") {
+		t.Error("password not changed")
+	}
+}
+
+func (c *conformance) setLogin(t *testing.T, udb ls.UserDB) {
+	service := c.name("svc")
+	taken := c.putUser(t, udb, &ls.User{Username: c.name("login")})
+	su := c.putUser(t, udb, &ls.User{Social: []ls.UserSocial{{Service: service, Id: "carol"}}})
+	username := c.name("login")
+	err := udb.SetLogin(su, username, "")
+	Mtfail(t, err, "set login, %v", err)
+	xu, err := udb.GetLocalUser(username)
+	if err != nil || xu.Guid != su.Guid {
+		t.Errorf("set login not stored %#v %v", xu, err)
+	}
+	err = udb.SetLogin(su, taken.Username, "")
+	if err == nil {
+		t.Error("SetLogin to a taken username succeeded")
+	}
+	xu, err = udb.GetLocalUser(taken.Username)
+	if err != nil || xu.Guid != taken.Guid {
+		t.Errorf("SetLogin took username from %d, %#v %v", taken.Guid, xu, err)
+	}
+}
+
+func (c *conformance) email(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("email")})
+	email := c.name("added") + "@example.com"
+	err := udb.AddEmail(nu, ls.EmailRecord{Email: email, EmailMetadata: ls.EmailMetadata{Validated: true, Added: 1234}})
+	Mtfail(t, err, "add email, %v", err)
+	xu, err := udb.GetUser(nu.Guid)
+	if err != nil {
+		t.Fatalf("get user, %v", err)
+	}
+	if len(xu.Email) != 1 || xu.Email[0].Email != email || !xu.Email[0].Validated || xu.Email[0].Added != 1234 {
+		t.Errorf("email not added %#v", xu.Email)
+	}
+	err = udb.DelEmail(nu, email)
+	Mtfail(t, err, "del email, %v", err)
+	xu, err = udb.GetUser(nu.Guid)
+	if err != nil {
+		t.Fatalf("get user, %v", err)
+	}
+	if len(xu.Email) != 0 {
+		t.Errorf("email not deleted %#v", xu.Email)
+	}
+	// free for someone else now
+	c.putUser(t, udb, &ls.User{Username: c.name("email"), Email: []ls.EmailRecord{ls.NewEmail(email)}})
+}
+
+func (c *conformance) emailUser(t *testing.T, udb ls.UserDB) {
+	email := c.name("found") + "@example.com"
+	first := c.putUser(t, udb, &ls.User{Username: c.name("email"), Email: []ls.EmailRecord{ls.NewEmail(" " + strings.ToUpper(email))}})
+	xu, err := udb.GetEmailUser(email, false)
+	if err != nil || xu.Guid != first.Guid || !xu.HasEmail(email) {
+		t.Fatalf("get email user %#v, %v", xu, err)
+	}
+	_, err = udb.GetEmailUser(email, true)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("unvalidated email: expected BadUserError, got %v", err)
+	}
+	_, err = udb.GetEmailUser(c.name("nobody")+"@example.com", false)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("unknown email: expected BadUserError, got %v", err)
+	}
+
+	// a validated address beats an older unvalidated one
+	second := c.putUser(t, udb, &ls.User{Username: c.name("email")})
+	err = udb.AddEmail(second, ls.EmailRecord{Email: strings.ToUpper(email[:1]) + email[1:], EmailMetadata: ls.EmailMetadata{Validated: true}})
+	Mtfail(t, err, "add email, %v", err)
+	for _, validatedOnly := range []bool{false, true} {
+		xu, err = udb.GetEmailUser(strings.ToUpper(email), validatedOnly)
+		if err != nil || xu.Guid != second.Guid {
+			t.Errorf("get validated email user %v got %#v, %v", validatedOnly, xu, err)
+		}
+	}
+	err = udb.DelEmail(second, strings.ToUpper(email))
+	Mtfail(t, err, "del email, %v", err)
+	xu, err = udb.GetEmailUser(email, false)
+	if err != nil || xu.Guid != first.Guid {
+		t.Errorf("after del got %#v, %v", xu, err)
+	}
+}
+
+// Options set later apply to new addresses, and lookups still find the
+// ones stored before
+func (c *conformance) emailNormalization(t *testing.T, udb ls.UserDB) {
+	en := udb.EmailNormalization()
+	defer func(old ls.EmailNormalization) { *en = old }(*en)
+	*en = ls.EmailNormalization{}
+	email := c.name("Jo.Doe") + "@GMail.com"
+	old := c.putUser(t, udb, &ls.User{Username: c.name("dots"), Email: []ls.EmailRecord{ls.NewEmail(email)}})
+
+	*en = ls.EmailNormalization{GmailDots: true, PlusTags: true}
+	xu, err := udb.GetEmailUser(strings.ToUpper(email), false)
+	if err != nil || xu.Guid != old.Guid {
+		t.Errorf("address from before options got %#v, %v", xu, err)
+	}
+	_, err = udb.PutNewUser(&ls.User{Username: c.name("dots"), Email: []ls.EmailRecord{ls.NewEmail(email)}})
+	if !errors.Is(err, ls.ErrEmailTaken) {
+		t.Errorf("address from before options: expected ErrEmailTaken, got %v", err)
+	}
+
+	local := c.name("a.b")
+	err = udb.AddEmail(old, ls.NewEmail(local+"+tag@gmail.com"))
+	Mtfail(t, err, "add email, %v", err)
+	norm := strings.ReplaceAll(local, ".", "") + "@gmail.com"
+	xu, err = udb.GetUser(old.Guid)
+	if err != nil || !xu.HasEmail(norm) {
+		t.Errorf("expected %s stored, got %#v, %v", norm, xu, err)
+	}
+	xu, err = udb.GetEmailUser(local+"+other@googlemail.com", false)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("googlemail.com is another domain, got %#v, %v", xu, err)
+	}
+	xu, err = udb.GetEmailUser(strings.ToUpper(local)+"+other@gmail.com", false)
+	if err != nil || xu.Guid != old.Guid {
+		t.Errorf("normalized lookup got %#v, %v", xu, err)
+	}
+}
+
+func (c *conformance) disable(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("disable")})
+	disabled, _, err := udb.GetDisabled(nu)
+	if err != nil || disabled {
+		t.Errorf("new user disabled %v %v", disabled, err)
+	}
+	err = udb.DisableUser(nu, "first")
+	Mtfail(t, err, "disable, %v", err)
+	err = udb.DisableUser(nu, "second")
+	Mtfail(t, err, "disable again, %v", err)
+	disabled, reason, err := udb.GetDisabled(nu)
+	if err != nil || !disabled || reason != "second" {
+		t.Errorf("expected disabled for second, got %v %q %v", disabled, reason, err)
+	}
+	err = udb.EnableUser(nu)
+	Mtfail(t, err, "enable, %v", err)
+	disabled, _, err = udb.GetDisabled(nu)
+	if err != nil || disabled {
+		t.Errorf("enabled user still disabled %v %v", disabled, err)
+	}
+}
+
+func (c *conformance) delete(t *testing.T, udb ls.UserDB) {
+	service := c.name("svc")
+	email := c.name("deleted") + "@example.com"
+	nu := c.putUser(t, udb, &ls.User{
+		Username: c.name("delete"),
+		Social:   []ls.UserSocial{{Service: service, Id: "dave"}},
+		Email:    []ls.EmailRecord{ls.NewEmail(email)},
+	})
+	key, _, err := udb.CreateAPIKey(nu, "gone", nil)
+	Mtfail(t, err, "api key, %v", err)
+	err = udb.DisableUser(nu, "leaving")
+	Mtfail(t, err, "disable, %v", err)
+
+	err = udb.DeleteUser(nu)
+	if err != nil {
+		t.Fatalf("delete, %v", err)
+	}
+	_, err = udb.GetUser(nu.Guid)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetUser: expected BadUserError, got %v", err)
+	}
+	_, err = udb.GetLocalUser(nu.Username)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetLocalUser: expected BadUserError, got %v", err)
+	}
+	_, err = udb.GetSocialUser(service, "dave")
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetSocialUser: expected BadUserError, got %v", err)
+	}
+	_, _, err = udb.GetAPIKeyUser(key)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("GetAPIKeyUser: expected BadUserError, got %v", err)
+	}
+	disabled, _, err := udb.GetDisabled(nu)
+	if err != nil || disabled {
+		t.Errorf("deleted user still disabled %v %v", disabled, err)
+	}
+	err = udb.DeleteUser(nu)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("delete again: expected BadUserError, got %v", err)
+	}
+
+	// everything unique is free again
+	c.putUser(t, udb, &ls.User{
+		Username: nu.Username,
+		Social:   []ls.UserSocial{{Service: service, Id: "dave"}},
+		Email:    []ls.EmailRecord{ls.NewEmail(email)},
+	})
+}
+
+func (c *conformance) export(t *testing.T, udb ls.UserDB) {
+	service := c.name("svc")
+	email := c.name("export") + "@example.com"
+	nu := &ls.User{
+		Username:    c.name("export"),
+		DisplayName: "Exported",
+		Social:      []ls.UserSocial{{Service: service, Id: "erin"}},
+		Email:       []ls.EmailRecord{ls.NewEmail(email)},
+	}
+	err := nu.SetPassword("secret")
+	Mtfail(t, err, "set password, %v", err)
+	c.putUser(t, udb, nu)
+	_, _, err = udb.CreateAPIKey(nu, "exported key", []string{"read"})
+	Mtfail(t, err, "api key, %v", err)
+	err = udb.LogAuthEvent(&ls.AuthEvent{Time: 100, Guid: nu.Guid, Type: ls.EventLoginSuccess, Method: "password"})
+	Mtfail(t, err, "log event, %v", err)
+
+	ex, err := udb.ExportUser(nu.Guid)
+	if err != nil {
+		t.Fatalf("export, %v", err)
+	}
+	if ex.Guid != nu.Guid || ex.Username != nu.Username || ex.DisplayName != "Exported" || !ex.HasPassword {
+		t.Errorf("bad export %#v", ex)
+	}
+	if len(ex.Emails) != 1 || ex.Emails[0].Email != email {
+		t.Errorf("bad export emails %#v", ex.Emails)
+	}
+	if len(ex.Social) != 1 || ex.Social[0].Service != service || ex.Social[0].Id != "erin" {
+		t.Errorf("bad export social %#v", ex.Social)
+	}
+	if len(ex.Sessions.APIKeys) != 1 || ex.Sessions.APIKeys[0].Name != "exported key" {
+		t.Errorf("bad export api keys %#v", ex.Sessions.APIKeys)
+	}
+	// newest first, after the social_linked from PutNewUser
+	if len(ex.Events) != 2 || ex.Events[0].Type != ls.EventSocialLinked || ex.Events[1].Type != ls.EventLoginSuccess {
+		t.Errorf("bad export events %#v", ex.Events)
+	}
+	_, err = udb.ExportUser(1 << 60)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("export unknown user: expected BadUserError, got %v", err)
+	}
+}
+
+func (c *conformance) apiKeys(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("apikey")})
+	keys, err := udb.ListAPIKeys(nu)
+	if err != nil || len(keys) != 0 {
+		t.Errorf("new user has api keys %#v %v", keys, err)
+	}
+	key, ak, err := udb.CreateAPIKey(nu, "laptop", []string{"read", "write"})
+	if err != nil {
+		t.Fatalf("create api key, %v", err)
+	}
+	if !ls.IsAPIKey(key) || ak.Name != "laptop" || !ak.HasScope("write") {
+		t.Errorf("bad api key %q %#v", key, ak)
+	}
+	_, _, err = udb.CreateAPIKey(nu, "phone", nil)
+	Mtfail(t, err, "create second api key, %v", err)
+
+	ku, gak, err := udb.GetAPIKeyUser(key)
+	if err != nil {
+		t.Fatalf("api key user, %v", err)
+	}
+	if ku.Guid != nu.Guid || gak.Prefix != ak.Prefix || !gak.HasScope("read") || gak.LastUsed == 0 {
+		t.Errorf("bad api key user %#v %#v", ku, gak)
+	}
+	keys, err = udb.ListAPIKeys(nu)
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("expected 2 api keys, got %#v %v", keys, err)
+	}
+
+	err = udb.RevokeAPIKey(nu, ak.Prefix)
+	Mtfail(t, err, "revoke, %v", err)
+	_, _, err = udb.GetAPIKeyUser(key)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("revoked key: expected BadUserError, got %v", err)
+	}
+	keys, err = udb.ListAPIKeys(nu)
+	if err != nil || len(keys) != 1 || keys[0].Name != "phone" {
+		t.Errorf("expected phone key left, got %#v %v", keys, err)
+	}
+	_, _, err = udb.GetAPIKeyUser("not a key")
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("bogus key: expected BadUserError, got %v", err)
+	}
+}
+
+func (c *conformance) totp(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("totp")})
+	rec, err := udb.GetTOTP(nu)
+	if err != nil || rec != nil {
+		t.Errorf("new user has totp %#v %v", rec, err)
+	}
+	ok, err := udb.UseTOTPStep(nu, 1)
+	if err != nil || ok {
+		t.Errorf("step accepted without totp %v %v", ok, err)
+	}
+	err = udb.PutTOTP(nu, &ls.TOTPRecord{Secret: []byte("pending"), Enabled: false})
+	Mtfail(t, err, "put totp, %v", err)
+	err = udb.PutTOTP(nu, &ls.TOTPRecord{Secret: []byte("sealed"), Enabled: true, LastStep: 10})
+	Mtfail(t, err, "replace totp, %v", err)
+	ok, err = udb.UseTOTPStep(nu, 10)
+	if err != nil || ok {
+		t.Errorf("replayed step accepted %v %v", ok, err)
+	}
+	ok, err = udb.UseTOTPStep(nu, 11)
+	if err != nil || !ok {
+		t.Errorf("new step rejected %v %v", ok, err)
+	}
+	rec, err = udb.GetTOTP(nu)
+	if err != nil || rec == nil || !rec.Enabled || rec.LastStep != 11 || !bytes.Equal(rec.Secret, []byte("sealed")) {
+		t.Errorf("bad totp %#v %v", rec, err)
+	}
+	err = udb.DelTOTP(nu)
+	Mtfail(t, err, "del totp, %v", err)
+	rec, err = udb.GetTOTP(nu)
+	if err != nil || rec != nil {
+		t.Errorf("totp not deleted %#v %v", rec, err)
+	}
+}
+
+func (c *conformance) webAuthn(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("webauthn")})
+	id1 := []byte(c.name("cred"))
+	id2 := []byte(c.name("cred"))
+	err := udb.AddWebAuthnCredential(nu, &ls.WebAuthnCredential{ID: id1, PublicKey: []byte("cose1"), Name: "first", Created: 1})
+	Mtfail(t, err, "add webauthn, %v", err)
+	err = udb.AddWebAuthnCredential(nu, &ls.WebAuthnCredential{ID: id2, PublicKey: []byte("cose2"), Name: "second", Created: 2})
+	Mtfail(t, err, "add webauthn, %v", err)
+	creds, err := udb.ListWebAuthnCredentials(nu)
+	if err != nil || len(creds) != 2 || creds[0].Name != "first" || creds[1].Name != "second" {
+		t.Errorf("bad credential list %#v %v", creds, err)
+	}
+
+	ok, err := udb.UseWebAuthnCredential(id1, 5)
+	if err != nil || !ok {
+		t.Errorf("use webauthn %v %v", ok, err)
+	}
+	ok, err = udb.UseWebAuthnCredential(id1, 5)
+	if err != nil || ok {
+		t.Errorf("sign count replay accepted %v %v", ok, err)
+	}
+	// no counter, always 0
+	for i := 0; i < 2; i++ {
+		ok, err = udb.UseWebAuthnCredential(id2, 0)
+		if err != nil || !ok {
+			t.Errorf("counterless use %d rejected %v %v", i, ok, err)
+		}
+	}
+	cu, cred, err := udb.GetWebAuthnCredential(id1)
+	if err != nil {
+		t.Fatalf("get webauthn, %v", err)
+	}
+	if cu.Guid != nu.Guid || !bytes.Equal(cred.PublicKey, []byte("cose1")) || cred.SignCount != 5 || cred.LastUsed == 0 {
+		t.Errorf("bad webauthn credential %#v %#v", cu, cred)
+	}
+
+	err = udb.DelWebAuthnCredential(nu, id1)
+	Mtfail(t, err, "del webauthn, %v", err)
+	_, _, err = udb.GetWebAuthnCredential(id1)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("deleted credential: expected BadUserError, got %v", err)
+	}
+	creds, err = udb.ListWebAuthnCredentials(nu)
+	if err != nil || len(creds) != 1 || !bytes.Equal(creds[0].ID, id2) {
+		t.Errorf("expected second credential left, got %#v %v", creds, err)
+	}
+}
+
+func (c *conformance) webAuthnChallenge(t *testing.T, udb ls.UserDB) {
+	now := time.Now().Unix()
+	fresh := []byte(c.name("challenge"))
+	stale := []byte(c.name("challenge"))
+	err := udb.PutWebAuthnChallenge(fresh, now+300)
+	Mtfail(t, err, "put challenge, %v", err)
+	err = udb.PutWebAuthnChallenge(stale, now-1)
+	Mtfail(t, err, "put challenge, %v", err)
+	ok, err := udb.TakeWebAuthnChallenge(fresh)
+	if err != nil || !ok {
+		t.Errorf("challenge not taken %v %v", ok, err)
+	}
+	ok, err = udb.TakeWebAuthnChallenge(fresh)
+	if err != nil || ok {
+		t.Errorf("challenge taken twice %v %v", ok, err)
+	}
+	ok, err = udb.TakeWebAuthnChallenge(stale)
+	if err != nil || ok {
+		t.Errorf("expired challenge taken %v %v", ok, err)
+	}
+	ok, err = udb.TakeWebAuthnChallenge([]byte(c.name("challenge")))
+	if err != nil || ok {
+		t.Errorf("unknown challenge taken %v %v", ok, err)
+	}
+}
+
+func (c *conformance) recovery(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("recovery")})
+	codes, err := udb.GetRecoveryCodes(nu)
+	if err != nil || len(codes) != 0 {
+		t.Errorf("new user has recovery codes %#v %v", codes, err)
+	}
+	err = udb.SetRecoveryCodes(nu, [][]byte{[]byte("old")})
+	Mtfail(t, err, "set recovery, %v", err)
+	err = udb.SetRecoveryCodes(nu, [][]byte{[]byte("a"), []byte("b")})
+	Mtfail(t, err, "replace recovery, %v", err)
+	ok, err := udb.DelRecoveryCode(nu, []byte("old"))
+	if err != nil || ok {
+		t.Errorf("replaced code still usable %v %v", ok, err)
+	}
+	ok, err = udb.DelRecoveryCode(nu, []byte("a"))
+	if err != nil || !ok {
+		t.Errorf("code not found %v %v", ok, err)
+	}
+	ok, err = udb.DelRecoveryCode(nu, []byte("a"))
+	if err != nil || ok {
+		t.Errorf("code used twice %v %v", ok, err)
+	}
+	codes, err = udb.GetRecoveryCodes(nu)
+	if err != nil || len(codes) != 1 || !bytes.Equal(codes[0], []byte("b")) {
+		t.Errorf("expected code b left, got %#v %v", codes, err)
+	}
+}
+
+func (c *conformance) authEvents(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("events")})
+	for i, etype := range []string{ls.EventLoginSuccess, ls.EventPasswordChanged, ls.EventLogout} {
+		err := udb.LogAuthEvent(&ls.AuthEvent{Time: 100 + int64(i), Guid: nu.Guid, Type: etype, Method: "password", IP: "127.0.0.1", UserAgent: "test", Detail: nu.Username})
+		Mtfail(t, err, "log event, %v", err)
+	}
+	events, err := udb.GetAuthEvents(nu.Guid, 0, 0, 0)
+	if err != nil || len(events) != 3 {
+		t.Fatalf("expected 3 events, got %#v %v", events, err)
+	}
+	if events[0].Type != ls.EventLogout || events[2].Type != ls.EventLoginSuccess {
+		t.Errorf("events not newest first %#v", events)
+	}
+	if ev := events[0]; ev.Guid != nu.Guid || ev.Time != 102 || ev.Method != "password" || ev.IP != "127.0.0.1" || ev.UserAgent != "test" || ev.Detail != nu.Username {
+		t.Errorf("event did not round trip %#v", ev)
+	}
+	events, err = udb.GetAuthEvents(nu.Guid, 101, 102, 0)
+	if err != nil || len(events) != 1 || events[0].Type != ls.EventPasswordChanged {
+		t.Errorf("bad time range %#v %v", events, err)
+	}
+	events, err = udb.GetAuthEvents(nu.Guid, 0, 0, 2)
+	if err != nil || len(events) != 2 || events[0].Type != ls.EventLogout {
+		t.Errorf("bad limit %#v %v", events, err)
+	}
+}
+
+// Changes to logins and emails are in the event log without anyone
+// calling LogAuthEvent
+func (c *conformance) changeEvents(t *testing.T, udb ls.UserDB) {
+	service := c.name("svc")
+	nu := c.putUser(t, udb, &ls.User{Social: []ls.UserSocial{{Service: service, Id: "alice"}}})
+	username := c.name("changes")
+	err := udb.SetLogin(nu, username, "pw")
+	Mtfail(t, err, "set login, %v", err)
+	err = nu.SetPassword("pw2")
+	Mtfail(t, err, "set password, %v", err)
+	err = udb.SetUserPassword(nu)
+	Mtfail(t, err, "set user password, %v", err)
+	email := c.name("changes") + "@example.com"
+	err = udb.AddEmail(nu, ls.EmailRecord{Email: email})
+	Mtfail(t, err, "add email, %v", err)
+	err = udb.DelEmail(nu, email)
+	Mtfail(t, err, "del email, %v", err)
+
+	events, err := udb.GetAuthEvents(nu.Guid, 0, 0, 0)
+	Mtfail(t, err, "get events, %v", err)
+	counts := make(map[string]int)
+	for _, ev := range events {
+		counts[ev.Type]++
+		switch ev.Type {
+		case ls.EventSocialLinked:
+			if ev.Method != service || ev.Detail != "alice" {
+				t.Errorf("bad social event %#v", ev)
+			}
+		case ls.EventEmailAdded, ls.EventEmailDeleted:
+			if ev.Detail != email {
+				t.Errorf("bad email event %#v", ev)
+			}
+		}
+		if ev.Time == 0 || ev.Guid != nu.Guid {
+			t.Errorf("bad event %#v", ev)
+		}
+	}
+	want := map[string]int{
+		ls.EventSocialLinked:    1,
+		ls.EventPasswordChanged: 2,
+		ls.EventEmailAdded:      1,
+		ls.EventEmailDeleted:    1,
+	}
+	for etype, n := range want {
+		if counts[etype] != n {
+			t.Errorf("%d %s events, wanted %d: %#v", counts[etype], etype, n, events)
+		}
+	}
+}
+
+func (c *conformance) feedback(t *testing.T, udb ls.UserDB) {
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("feedback")})
+	for i, msg := range []string{"one", "two", "three"} {
+		err := udb.Feedback(nu, 1000+int64(i), msg)
+		Mtfail(t, err, "feedback, %v", err)
+	}
+	fb, err := udb.ListFeedback(nu.Guid, 0, 0, 0, 0)
+	if err != nil || len(fb) != 3 || fb[0].Msg != "three" || fb[0].Guid != nu.Guid || fb[0].Millis != 1002 {
+		t.Errorf("bad feedback %#v %v", fb, err)
+	}
+	fb, err = udb.ListFeedback(nu.Guid, 0, 0, 1, 1)
+	if err != nil || len(fb) != 1 || fb[0].Msg != "two" {
+		t.Errorf("bad feedback page %#v %v", fb, err)
+	}
+	fb, err = udb.ListFeedback(nu.Guid, 0, 0, 2, 0)
+	if err != nil || len(fb) != 1 || fb[0].Msg != "one" {
+		t.Errorf("bad feedback offset %#v %v", fb, err)
+	}
+	fb, err = udb.ListFeedback(nu.Guid, 1001, 1002, 0, 0)
+	if err != nil || len(fb) != 1 || fb[0].Msg != "two" {
+		t.Errorf("bad feedback range %#v %v", fb, err)
+	}
+
+	stored, oldest, err := udb.LimitedFeedback(nu, 1003, "four", 1000, 4)
+	if err != nil || !stored {
+		t.Errorf("fourth of four not stored, %v", err)
+	}
+	stored, oldest, err = udb.LimitedFeedback(nu, 1004, "five", 1000, 4)
+	if err != nil || stored || oldest != 1000 {
+		t.Errorf("fifth of four: stored %v, oldest %d, %v", stored, oldest, err)
+	}
+	stored, oldest, err = udb.LimitedFeedback(nu, 1004, "five", 1001, 4)
+	if err != nil || !stored {
+		t.Errorf("four since 1001 not stored, %v", err)
+	}
+}
+
+// Racing LimitedFeedback for one user stores exactly max
+func (c *conformance) concurrentLimitedFeedback(t *testing.T, udb ls.UserDB) {
+	const racers, max = 10, 3
+	nu := c.putUser(t, udb, &ls.User{Username: c.name("feedbackrace")})
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	stored := 0
+	for i := 0; i < racers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, _, err := udb.LimitedFeedback(nu, 2000+int64(i), "race", 2000, max)
+			if err != nil {
+				t.Errorf("limited feedback, %v", err)
+			}
+			if ok {
+				l.Lock()
+				stored++
+				l.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	fb, err := udb.ListFeedback(nu.Guid, 0, 0, 0, 0)
+	if err != nil || stored != max || len(fb) != max {
+		t.Errorf("%d racers stored %d, %d in db, wanted %d, %v", racers, stored, len(fb), max, err)
+	}
+}
+
+// Usernames of every page of q, checking each is at most q.Limit
+func listUsernames(t *testing.T, udb ls.UserDB, q ls.UserQuery) []string {
+	t.Helper()
+	var names []string
+	for pages := 0; pages < 20; pages++ {
+		users, next, err := udb.ListUsers(q)
+		if err != nil {
+			t.Fatalf("list users %#v, %v", q, err)
+		}
+		if q.Limit > 0 && len(users) > q.Limit {
+			t.Errorf("page of %d users, limit %d", len(users), q.Limit)
+		}
+		for _, u := range users {
+			names = append(names, u.Username)
+		}
+		if next == "" {
+			return names
+		}
+		q.Cursor = next
+	}
+	t.Fatalf("list users %#v never ended", q)
+	return nil
+}
+
+func (c *conformance) listUsers(t *testing.T, udb ls.UserDB) {
+	prefix := c.name("list") + "-"
+	service := c.name("svc")
+	var users []*ls.User
+	for i, letter := range []string{"c", "a", "e", "b", "d"} {
+		nu := &ls.User{Username: prefix + letter, Created: int64(5000 - 1000*i)}
+		if i%2 == 0 {
+			nu.Social = []ls.UserSocial{{Service: service, Id: nu.Username}}
+		}
+		if letter == "b" {
+			nu.Email = []ls.EmailRecord{ls.NewEmail(prefix + "list_b@example.com")}
+		}
+		users = append(users, c.putUser(t, udb, nu))
+	}
+	err := udb.DisableUser(users[1], "listed")
+	Mtfail(t, err, "disable user, %v", err)
+	xu, err := udb.GetUser(users[0].Guid)
+	if err != nil || xu.Created != 5000 {
+		t.Errorf("created not stored %#v, %v", xu, err)
+	}
+	other := c.putUser(t, udb, &ls.User{Username: c.name("other")})
+	if other.Created == 0 {
+		t.Errorf("PutNewUser did not set Created")
+	}
+
+	expect := func(q ls.UserQuery, want ...string) {
+		t.Helper()
+		q.UsernamePrefix = prefix
+		got := listUsernames(t, udb, q)
+		for i := range want {
+			want[i] = prefix + want[i]
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("list users %#v got %v, wanted %v", q, got, want)
+		}
+	}
+	// guid order is creation order
+	expect(ls.UserQuery{Limit: 2}, "c", "a", "e", "b", "d")
+	expect(ls.UserQuery{Descending: true}, "d", "b", "e", "a", "c")
+	expect(ls.UserQuery{Sort: ls.SortByUsername, Limit: 2}, "a", "b", "c", "d", "e")
+	expect(ls.UserQuery{Sort: ls.SortByUsername, Descending: true, Limit: 3}, "e", "d", "c", "b", "a")
+	expect(ls.UserQuery{Sort: ls.SortByCreated, Limit: 1}, "d", "b", "e", "a", "c")
+	expect(ls.UserQuery{Email: "LIST_B@"}, "b")
+	expect(ls.UserQuery{Email: "list%b"})
+	expect(ls.UserQuery{Service: service, Sort: ls.SortByUsername}, "c", "d", "e")
+	expect(ls.UserQuery{Disabled: ls.DisabledOnly}, "a")
+	expect(ls.UserQuery{Disabled: ls.EnabledOnly, Sort: ls.SortByUsername}, "b", "c", "d", "e")
+	expect(ls.UserQuery{CreatedStart: 2000, CreatedEnd: 4000, Sort: ls.SortByCreated}, "b", "e")
+
+	_, _, err = udb.ListUsers(ls.UserQuery{Cursor: "nope"})
+	if !errors.Is(err, ls.ErrBadCursor) {
+		t.Errorf("expected ErrBadCursor, got %v", err)
+	}
+	_, next, err := udb.ListUsers(ls.UserQuery{UsernamePrefix: prefix, Limit: 1})
+	if err != nil || next == "" {
+		t.Fatalf("first page, next %q, %v", next, err)
+	}
+	_, _, err = udb.ListUsers(ls.UserQuery{UsernamePrefix: prefix, Limit: 1, Sort: ls.SortByCreated, Cursor: next})
+	if !errors.Is(err, ls.ErrBadCursor) {
+		t.Errorf("cursor from another sort: expected ErrBadCursor, got %v", err)
+	}
+}
+
+// UsernamePrefix and SortByUsername ignore case the same everywhere
+func (c *conformance) listUsersCase(t *testing.T, udb ls.UserDB) {
+	prefix := c.name("case") + "-"
+	for _, letter := range []string{"B", "a", "c", "D"} {
+		c.putUser(t, udb, &ls.User{Username: prefix + letter})
+	}
+	upper := strings.ToUpper(prefix)
+	c.putUser(t, udb, &ls.User{Username: upper + "e"})
+
+	expect := func(q ls.UserQuery, want string) {
+		t.Helper()
+		got := strings.Join(listUsernames(t, udb, q), " ")
+		want = strings.Replace(strings.Replace(want, "p-", prefix, -1), "P-", upper, -1)
+		if got != want {
+			t.Errorf("list users %#v got %v, wanted %v", q, got, want)
+		}
+	}
+	expect(ls.UserQuery{UsernamePrefix: prefix, Sort: ls.SortByUsername, Limit: 2}, "p-a p-B p-c p-D P-e")
+	expect(ls.UserQuery{UsernamePrefix: upper, Sort: ls.SortByUsername, Descending: true, Limit: 3}, "P-e p-D p-c p-B p-a")
+	expect(ls.UserQuery{UsernamePrefix: upper + "b"}, "p-B")
+}
+
+// Racing PutNewUser for one username: one wins, the rest get
+// ErrUsernameTaken. Different usernames all get their own guid.
+func (c *conformance) concurrentPutNewUser(t *testing.T, udb ls.UserDB) {
+	const racers = 10
+	username := c.name("racer")
+	var wg sync.WaitGroup
+	var l sync.Mutex
+	won := 0
+	guids := make(map[int64]bool)
+	errs := make(chan error, 2*racers)
+	for i := 0; i < racers; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := udb.PutNewUser(&ls.User{Username: username})
+			if err == nil {
+				l.Lock()
+				won++
+				l.Unlock()
+			} else if !errors.Is(err, ls.ErrUsernameTaken) {
+				errs <- fmt.Errorf("racer: expected ErrUsernameTaken, got %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			nu := &ls.User{Username: c.name("runner")}
+			_, err := udb.PutNewUser(nu)
+			if err != nil {
+				errs <- fmt.Errorf("put %s, %v", nu.Username, err)
+				return
+			}
+			l.Lock()
+			guids[nu.Guid] = true
+			l.Unlock()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if won != 1 {
+		t.Errorf("%d racers created %s", won, username)
+	}
+	if len(guids) != racers {
+		t.Errorf("expected %d distinct guids, got %d", racers, len(guids))
+	}
+}
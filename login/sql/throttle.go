@@ -0,0 +1,73 @@
+package sql
+
+import (
+	"database/sql"
+)
+
+// Login failure counters for login.Throttle, shared by all servers
+// using the database.
+const createLoginThrottle = `CREATE TABLE IF NOT EXISTS login_throttle (
+k varchar(300) PRIMARY KEY, -- "u:username" or "ip:addr"
+failures int,
+last bigint -- unix timestamp
+)`
+
+// Implements login.ThrottleStore. Table is created by UserDB.Setup()
+type SqlThrottleStore struct {
+	db dialectDB
+}
+
+func NewSqlThrottleStore(db *sql.DB) *SqlThrottleStore {
+	return &SqlThrottleStore{detectDB(db)}
+}
+
+// As NewSqlUserDBWithDialect
+func NewSqlThrottleStoreWithDialect(db *sql.DB, dialect Dialect) *SqlThrottleStore {
+	return &SqlThrottleStore{dialectDB{db, dialect}}
+}
+
+func (ts *SqlThrottleStore) Get(key string) (failures int, last int64, err error) {
+	rows, err := dbQuery(ts.db, `SELECT failures, last FROM login_throttle WHERE k = $1`, key)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		err = rows.Scan(&failures, &last)
+	}
+	return
+}
+
+func (ts *SqlThrottleStore) Fail(key string, now, forgetBefore int64) (int, error) {
+	for try := 0; try < 2; try++ {
+		result, err := dbExec(ts.db, `UPDATE login_throttle SET failures = CASE WHEN last < $1 THEN 1 ELSE failures + 1 END, last = $2 WHERE k = $3`, forgetBefore, now, key)
+		if err != nil {
+			return 0, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			_, err = dbExec(ts.db, `INSERT INTO login_throttle (k, failures, last) VALUES ($1, 1, $2)`, key, now)
+			if err != nil {
+				// probably a concurrent insert, go around again to UPDATE
+				continue
+			}
+		}
+		failures, _, err := ts.Get(key)
+		return failures, err
+	}
+	failures, _, err := ts.Get(key)
+	return failures, err
+}
+
+func (ts *SqlThrottleStore) Refund(key string) error {
+	_, err := dbExec(ts.db, `UPDATE login_throttle SET failures = failures - 1 WHERE k = $1 AND failures > 0`, key)
+	return err
+}
+
+func (ts *SqlThrottleStore) Reset(key string) error {
+	_, err := dbExec(ts.db, `DELETE FROM login_throttle WHERE k = $1`, key)
+	return err
+}
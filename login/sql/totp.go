@@ -0,0 +1,113 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+)
+
+// TOTP second factor state for a user.
+// Secret is sealed by the caller (crypto.SealSecret); this package
+// never sees the plain secret.
+type TOTPRecord struct {
+	Secret []byte
+
+	// false from enrollment until the first code is confirmed
+	Enabled bool
+
+	// highest time step accepted, codes at or before it are replays
+	LastStep int64
+}
+
+const createUserTOTP = `CREATE TABLE IF NOT EXISTS user_totp (
+id bigint PRIMARY KEY, -- foreign key guser.id
+secret bytea, -- sealed
+enabled boolean,
+laststep bigint
+)`
+
+// Replace any TOTP state for user
+func PutTOTP(db *sql.DB, user *User, rec *TOTPRecord) error {
+	return PutTOTPContext(context.Background(), db, user, rec)
+}
+
+func PutTOTPContext(ctx context.Context, db *sql.DB, user *User, rec *TOTPRecord) error {
+	return putTOTP(ctx, detectDB(db), user, rec)
+}
+
+func putTOTP(ctx context.Context, db dialectDB, user *User, rec *TOTPRecord) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nop if committed
+	_, err = txExecContext(ctx, db, tx, `DELETE FROM user_totp WHERE id = $1`, user.Guid)
+	if err != nil {
+		return err
+	}
+	_, err = txExecContext(ctx, db, tx, `INSERT INTO user_totp (id, secret, enabled, laststep) VALUES ($1, $2, $3, $4)`, user.Guid, rec.Secret, rec.Enabled, rec.LastStep)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns nil, nil if the user has no TOTP
+func GetTOTP(db *sql.DB, user *User) (*TOTPRecord, error) {
+	return GetTOTPContext(context.Background(), db, user)
+}
+
+func GetTOTPContext(ctx context.Context, db *sql.DB, user *User) (*TOTPRecord, error) {
+	return getTOTP(ctx, detectDB(db), user)
+}
+
+func getTOTP(ctx context.Context, db dialectDB, user *User) (*TOTPRecord, error) {
+	rows, err := dbQueryContext(ctx, db, `SELECT secret, enabled, laststep FROM user_totp WHERE id = $1`, user.Guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var rec TOTPRecord
+	err = rows.Scan(&rec.Secret, &rec.Enabled, &rec.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Atomically record step as used. false if step was not after the last
+// used step (a replay or a stale code).
+func UseTOTPStep(db *sql.DB, user *User, step int64) (bool, error) {
+	return UseTOTPStepContext(context.Background(), db, user, step)
+}
+
+func UseTOTPStepContext(ctx context.Context, db *sql.DB, user *User, step int64) (bool, error) {
+	return useTOTPStep(ctx, detectDB(db), user, step)
+}
+
+func useTOTPStep(ctx context.Context, db dialectDB, user *User, step int64) (bool, error) {
+	result, err := dbExecContext(ctx, db, `UPDATE user_totp SET laststep = $1 WHERE id = $2 AND laststep < $1`, step, user.Guid)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func DelTOTP(db *sql.DB, user *User) error {
+	return DelTOTPContext(context.Background(), db, user)
+}
+
+func DelTOTPContext(ctx context.Context, db *sql.DB, user *User) error {
+	return delTOTP(ctx, detectDB(db), user)
+}
+
+func delTOTP(ctx context.Context, db dialectDB, user *User) error {
+	_, err := dbExecContext(ctx, db, `DELETE FROM user_totp WHERE id = $1`, user.Guid)
+	return err
+}
@@ -10,6 +10,12 @@ import (
 
 var BadUserError = errors.New("bad user name & password")
 
+// PutNewUser errors wrap one of these when a unique field collides
+// with an existing user. Test with errors.Is()
+var ErrUsernameTaken = errors.New("username already taken")
+var ErrSocialTaken = errors.New("social login already taken")
+var ErrEmailTaken = errors.New("email already taken")
+
 type User struct {
 	// primary key
 	Guid int64
@@ -30,6 +36,10 @@ type User struct {
 
 	// Serialized by encoding/json or similar
 	Data map[string]interface{}
+
+	// unix timestamp, set by PutNewUser if 0. 0 for users from before
+	// schema version 4.
+	Created int64
 }
 
 type UserSocial struct {
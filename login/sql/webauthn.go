@@ -0,0 +1,198 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// A WebAuthn public key credential (passkey, security key)
+type WebAuthnCredential struct {
+	ID []byte
+
+	// COSE_Key as sent by the authenticator at registration
+	PublicKey []byte
+
+	// last signature counter seen, for clone detection
+	SignCount int64
+
+	Name     string
+	Created  int64 // unix timestamp
+	LastUsed int64 // unix timestamp, 0 if never
+}
+
+const (
+	createUserWebAuthn = `CREATE TABLE IF NOT EXISTS user_webauthn (
+credid bytea PRIMARY KEY,
+id bigint, -- foreign key guser.id
+pubkey bytea, -- COSE_Key
+signcount bigint,
+name varchar(100),
+created bigint, -- unix timestamp
+lastused bigint -- unix timestamp
+)`
+	createUserWebAuthnIdIndex = `CREATE INDEX IF NOT EXISTS user_webauthn_id ON user_webauthn ( id )`
+
+	createWebAuthnChallenge = `CREATE TABLE IF NOT EXISTS webauthn_challenge (
+challenge bytea PRIMARY KEY, -- sha256(challenge)
+expires bigint -- unix timestamp
+)`
+	createWebAuthnChallengeExpiresIndex = `CREATE INDEX IF NOT EXISTS webauthn_challenge_expires ON webauthn_challenge ( expires )`
+)
+
+func AddWebAuthnCredential(db *sql.DB, user *User, cred *WebAuthnCredential) error {
+	return AddWebAuthnCredentialContext(context.Background(), db, user, cred)
+}
+
+func AddWebAuthnCredentialContext(ctx context.Context, db *sql.DB, user *User, cred *WebAuthnCredential) error {
+	return addWebAuthnCredential(ctx, detectDB(db), user, cred)
+}
+
+func addWebAuthnCredential(ctx context.Context, db dialectDB, user *User, cred *WebAuthnCredential) error {
+	_, err := dbExecContext(ctx, db, `INSERT INTO user_webauthn (credid, id, pubkey, signcount, name, created, lastused) VALUES ($1, $2, $3, $4, $5, $6, $7)`, cred.ID, user.Guid, cred.PublicKey, cred.SignCount, cred.Name, cred.Created, cred.LastUsed)
+	return err
+}
+
+func ListWebAuthnCredentials(db *sql.DB, user *User) ([]WebAuthnCredential, error) {
+	return ListWebAuthnCredentialsContext(context.Background(), db, user)
+}
+
+func ListWebAuthnCredentialsContext(ctx context.Context, db *sql.DB, user *User) ([]WebAuthnCredential, error) {
+	return listWebAuthnCredentials(ctx, detectDB(db), user)
+}
+
+func listWebAuthnCredentials(ctx context.Context, db dialectDB, user *User) ([]WebAuthnCredential, error) {
+	rows, err := dbQueryContext(ctx, db, `SELECT credid, pubkey, signcount, name, created, lastused FROM user_webauthn WHERE id = $1 ORDER BY created`, user.Guid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]WebAuthnCredential, 0)
+	for rows.Next() {
+		var cred WebAuthnCredential
+		err = rows.Scan(&cred.ID, &cred.PublicKey, &cred.SignCount, &cred.Name, &cred.Created, &cred.LastUsed)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, cred)
+	}
+	return out, rows.Err()
+}
+
+// Returns BadUserError if credID isn't known
+func commonGetWebAuthnCredential(ctx context.Context, xd innerDriver, credID []byte) (*User, *WebAuthnCredential, error) {
+	rows, err := dbQueryContext(ctx, xd.DB(), `SELECT credid, pubkey, signcount, name, created, lastused, id FROM user_webauthn WHERE credid = $1`, credID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var cred WebAuthnCredential
+	var guid int64
+	found := rows.Next()
+	if found {
+		err = rows.Scan(&cred.ID, &cred.PublicKey, &cred.SignCount, &cred.Name, &cred.Created, &cred.LastUsed, &guid)
+	}
+	rows.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !found {
+		return nil, nil, BadUserError
+	}
+	user, err := xd.GetUser(ctx, guid)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &cred, nil
+}
+
+// Atomically record a successful assertion. false if signCount is not
+// after the stored count (a replay or a cloned authenticator), except
+// that authenticators without a counter always send 0.
+func UseWebAuthnCredential(db *sql.DB, credID []byte, signCount int64) (bool, error) {
+	return UseWebAuthnCredentialContext(context.Background(), db, credID, signCount)
+}
+
+func UseWebAuthnCredentialContext(ctx context.Context, db *sql.DB, credID []byte, signCount int64) (bool, error) {
+	return useWebAuthnCredential(ctx, detectDB(db), credID, signCount)
+}
+
+func useWebAuthnCredential(ctx context.Context, db dialectDB, credID []byte, signCount int64) (bool, error) {
+	now := time.Now().Unix()
+	if signCount == 0 {
+		// Nothing to race on. mysql counts an UPDATE that changes
+		// nothing (used twice in a second) as no rows, so look instead.
+		_, err := dbExecContext(ctx, db, `UPDATE user_webauthn SET lastused = $1 WHERE credid = $2 AND signcount = 0`, now, credID)
+		if err != nil {
+			return false, err
+		}
+		rows, err := dbQueryContext(ctx, db, `SELECT 1 FROM user_webauthn WHERE credid = $1 AND signcount = 0`, credID)
+		if err != nil {
+			return false, err
+		}
+		defer rows.Close()
+		return rows.Next(), rows.Err()
+	}
+	result, err := dbExecContext(ctx, db, `UPDATE user_webauthn SET signcount = $1, lastused = $2 WHERE credid = $3 AND signcount < $4`, signCount, now, credID, signCount)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func DelWebAuthnCredential(db *sql.DB, user *User, credID []byte) error {
+	return DelWebAuthnCredentialContext(context.Background(), db, user, credID)
+}
+
+func DelWebAuthnCredentialContext(ctx context.Context, db *sql.DB, user *User, credID []byte) error {
+	return delWebAuthnCredential(ctx, detectDB(db), user, credID)
+}
+
+func delWebAuthnCredential(ctx context.Context, db dialectDB, user *User, credID []byte) error {
+	_, err := dbExecContext(ctx, db, `DELETE FROM user_webauthn WHERE id = $1 AND credid = $2`, user.Guid, credID)
+	return err
+}
+
+// Remember a challenge (or its hash) handed out for a ceremony, until
+// expires. Also forgets expired ones.
+func PutWebAuthnChallenge(db *sql.DB, challenge []byte, expires int64) error {
+	return PutWebAuthnChallengeContext(context.Background(), db, challenge, expires)
+}
+
+func PutWebAuthnChallengeContext(ctx context.Context, db *sql.DB, challenge []byte, expires int64) error {
+	return putWebAuthnChallenge(ctx, detectDB(db), challenge, expires)
+}
+
+func putWebAuthnChallenge(ctx context.Context, db dialectDB, challenge []byte, expires int64) error {
+	_, err := dbExecContext(ctx, db, `DELETE FROM webauthn_challenge WHERE expires < $1`, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	_, err = dbExecContext(ctx, db, `INSERT INTO webauthn_challenge (challenge, expires) VALUES ($1, $2)`, challenge, expires)
+	return err
+}
+
+// Atomically forget challenge. false if it was never put, was already
+// taken or has expired.
+func TakeWebAuthnChallenge(db *sql.DB, challenge []byte) (bool, error) {
+	return TakeWebAuthnChallengeContext(context.Background(), db, challenge)
+}
+
+func TakeWebAuthnChallengeContext(ctx context.Context, db *sql.DB, challenge []byte) (bool, error) {
+	return takeWebAuthnChallenge(ctx, detectDB(db), challenge)
+}
+
+func takeWebAuthnChallenge(ctx context.Context, db dialectDB, challenge []byte) (bool, error) {
+	result, err := dbExecContext(ctx, db, `DELETE FROM webauthn_challenge WHERE challenge = $1 AND expires >= $2`, challenge, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,143 @@
+package sql
+
+import (
+	"database/sql"
+)
+
+// One webhook POST waiting in the outbox
+type WebhookDelivery struct {
+	Id    int64
+	URL   string
+	Event string
+	Body  []byte // JSON
+
+	Attempts    int
+	NextAttempt int64 // unix timestamp, -1 after giving up
+	Created     int64 // unix timestamp
+	LastError   string
+}
+
+// Durable queue of webhook deliveries. Rows are deleted once delivered.
+const (
+	createWebhookOutbox = `CREATE TABLE IF NOT EXISTS webhook_outbox (
+id bigserial PRIMARY KEY,
+url varchar(500),
+event varchar(100),
+body bytea, -- JSON
+attempts int,
+nextattempt bigint, -- unix timestamp, -1 when given up
+created bigint, -- unix timestamp
+lasterror varchar(300)
+)`
+	// INTEGER PRIMARY KEY is the autoincrement ROWID
+	sqlite3CreateWebhookOutbox = `CREATE TABLE IF NOT EXISTS webhook_outbox (
+id INTEGER PRIMARY KEY,
+url varchar(500),
+event varchar(100),
+body BLOB, -- JSON
+attempts int,
+nextattempt bigint, -- unix timestamp, -1 when given up
+created bigint, -- unix timestamp
+lasterror varchar(300)
+)`
+	createWebhookOutboxNextIndex = `CREATE INDEX IF NOT EXISTS webhook_outbox_next ON webhook_outbox ( nextattempt )`
+)
+
+// Implements login.WebhookOutbox. Table is created by UserDB.Setup()
+type SqlWebhookOutbox struct {
+	db dialectDB
+}
+
+func NewSqlWebhookOutbox(db *sql.DB) *SqlWebhookOutbox {
+	return &SqlWebhookOutbox{detectDB(db)}
+}
+
+// As NewSqlUserDBWithDialect
+func NewSqlWebhookOutboxWithDialect(db *sql.DB, dialect Dialect) *SqlWebhookOutbox {
+	return &SqlWebhookOutbox{dialectDB{db, dialect}}
+}
+
+// Add d to the outbox. If tx is not nil the delivery commits or rolls
+// back with it.
+func (wo *SqlWebhookOutbox) Enqueue(tx *sql.Tx, d *WebhookDelivery) error {
+	cmd := `INSERT INTO webhook_outbox (url, event, body, attempts, nextattempt, created, lasterror) VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	args := []interface{}{d.URL, d.Event, d.Body, d.Attempts, d.NextAttempt, d.Created, d.LastError}
+	var err error
+	if tx != nil {
+		_, err = txExec(wo.db, tx, cmd, args...)
+	} else {
+		_, err = dbExec(wo.db, cmd, args...)
+	}
+	return err
+}
+
+// Deliveries due at now, claimed by pushing their next attempt out to
+// leaseUntil so that other dispatchers sharing the database skip them.
+func (wo *SqlWebhookOutbox) ClaimDue(now, leaseUntil int64, limit int) ([]WebhookDelivery, error) {
+	rows, err := dbQuery(wo.db, `SELECT id, url, event, body, attempts, nextattempt, created, lasterror FROM webhook_outbox WHERE nextattempt >= 0 AND nextattempt <= $1 ORDER BY nextattempt LIMIT $2`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	due := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		err = rows.Scan(&d.Id, &d.URL, &d.Event, &d.Body, &d.Attempts, &d.NextAttempt, &d.Created, &d.LastError)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]WebhookDelivery, 0, len(due))
+	for _, d := range due {
+		result, err := dbExec(wo.db, `UPDATE webhook_outbox SET nextattempt = $1 WHERE id = $2 AND nextattempt = $3`, leaseUntil, d.Id, d.NextAttempt)
+		if err != nil {
+			return out, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return out, err
+		}
+		if n == 1 {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+func (wo *SqlWebhookOutbox) Delivered(id int64) error {
+	_, err := dbExec(wo.db, `DELETE FROM webhook_outbox WHERE id = $1`, id)
+	return err
+}
+
+// Record a failed attempt. next is when to retry, -1 to give up.
+func (wo *SqlWebhookOutbox) Failed(id int64, attempts int, next int64, errmsg string) error {
+	if len(errmsg) > 300 {
+		errmsg = errmsg[:300]
+	}
+	_, err := dbExec(wo.db, `UPDATE webhook_outbox SET attempts = $1, nextattempt = $2, lasterror = $3 WHERE id = $4`, attempts, next, errmsg, id)
+	return err
+}
+
+// Deliveries that were given up on, for inspection
+func (wo *SqlWebhookOutbox) Dead(limit int) ([]WebhookDelivery, error) {
+	rows, err := dbQuery(wo.db, `SELECT id, url, event, body, attempts, nextattempt, created, lasterror FROM webhook_outbox WHERE nextattempt < 0 ORDER BY created LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := make([]WebhookDelivery, 0)
+	for rows.Next() {
+		var d WebhookDelivery
+		err = rows.Scan(&d.Id, &d.URL, &d.Event, &d.Body, &d.Attempts, &d.NextAttempt, &d.Created, &d.LastError)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
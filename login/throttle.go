@@ -0,0 +1,370 @@
+package login
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Brute force protection for local password and second factor login.
+// Failures are counted per username and per client IP. After a few free
+// failures each further attempt must wait exponentially longer, and
+// after LockoutFailures the account is locked for LockoutDuration.
+//
+// Every attempt is counted as a failure before it is checked, and
+// refunded if it wasn't one, so concurrent attempts can't all get in
+// under the limit.
+
+var ErrThrottled = errors.New("too many login attempts")
+
+// Returned instead of BadUserError when a login attempt isn't even
+// checked. errors.Is(err, ErrThrottled) is true.
+type ThrottledError struct {
+	RetryAfter time.Duration
+
+	// Account is locked out, not just backing off
+	Locked bool
+}
+
+func (te *ThrottledError) Error() string {
+	what := "too many login attempts"
+	if te.Locked {
+		what = "account temporarily locked"
+	}
+	return fmt.Sprintf("%s, try again in %s", what, te.RetryAfter.Round(time.Second))
+}
+
+func (te *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+// Counter storage. Times are unix seconds.
+// See NewMemoryThrottleStore and sql.NewSqlThrottleStore
+type ThrottleStore interface {
+	// failures counted for key and time of the latest
+	Get(key string) (failures int, last int64, err error)
+
+	// Count a failure at now. If the previous failure was before
+	// forgetBefore the count starts over. Returns the new count.
+	Fail(key string, now, forgetBefore int64) (int, error)
+
+	// Take back one Fail
+	Refund(key string) error
+
+	Reset(key string) error
+}
+
+type ThrottleLimits struct {
+	// failures allowed before any delay
+	FreeFailures int
+	// delay after the first non-free failure, doubling each time
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// lock after this many failures, 0 for never
+	LockoutFailures int
+}
+
+type Throttle struct {
+	Store ThrottleStore
+
+	User ThrottleLimits
+	IP   ThrottleLimits
+
+	// Lockout length, and how long failures are remembered
+	LockoutDuration time.Duration
+
+	// nil uses the host of request.RemoteAddr.
+	// Set this if behind a proxy that sets X-Forwarded-For.
+	ClientIP func(request *http.Request) string
+}
+
+func NewThrottle(store ThrottleStore) *Throttle {
+	return &Throttle{
+		Store: store,
+		User: ThrottleLimits{
+			FreeFailures:    3,
+			BaseDelay:       time.Second,
+			MaxDelay:        5 * time.Minute,
+			LockoutFailures: 10,
+		},
+		IP: ThrottleLimits{
+			FreeFailures:    20,
+			BaseDelay:       time.Second,
+			MaxDelay:        5 * time.Minute,
+			LockoutFailures: 0,
+		},
+		LockoutDuration: 15 * time.Minute,
+	}
+}
+
+// Used by GetHttpUser, JSONLoginHandler, TokenHandler and
+// SecondFactorHandler if not nil. Set at startup.
+var LoginThrottle *Throttle
+
+func (th *Throttle) clientIP(request *http.Request) string {
+	if th.ClientIP != nil {
+		return th.ClientIP(request)
+	}
+	return remoteHost(request)
+}
+
+// host part of request.RemoteAddr
+func remoteHost(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// Social login users may not have a username
+func throttleName(user *User) string {
+	if len(user.Username) > 0 {
+		return user.Username
+	}
+	return fmt.Sprintf("#%d", user.Guid)
+}
+
+// Set Retry-After if err is a *ThrottledError, returns the seconds
+func setRetryAfter(out http.ResponseWriter, err error) int64 {
+	var te *ThrottledError
+	if !errors.As(err, &te) {
+		return 0
+	}
+	secs := int64((te.RetryAfter + time.Second - 1) / time.Second)
+	out.Header().Set("Retry-After", fmt.Sprintf("%d", secs))
+	return secs
+}
+
+func userThrottleKey(username string) string {
+	return "u:" + strings.ToLower(username)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// How long after the last of failures the next attempt must wait, and
+// whether that is a lockout
+func (th *Throttle) delay(limits *ThrottleLimits, failures int) (time.Duration, bool) {
+	if limits.LockoutFailures > 0 && failures >= limits.LockoutFailures {
+		return th.LockoutDuration, true
+	}
+	over := failures - limits.FreeFailures
+	if over < 0 {
+		return 0, false
+	}
+	delay := limits.BaseDelay
+	for i := 0; i < over && delay < limits.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > limits.MaxDelay {
+		delay = limits.MaxDelay
+	}
+	return delay, false
+}
+
+// How long until key may try again, nil if now. Also returns the
+// failures still remembered.
+func (th *Throttle) wait(key string, limits *ThrottleLimits, now time.Time) (int, *ThrottledError, error) {
+	failures, last, err := th.Store.Get(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	lastt := time.Unix(last, 0)
+	if failures == 0 || now.Sub(lastt) > th.LockoutDuration {
+		return 0, nil, nil
+	}
+	delay, locked := th.delay(limits, failures)
+	until := lastt.Add(delay)
+	if now.Before(until) {
+		return failures, &ThrottledError{RetryAfter: until.Sub(now), Locked: locked}, nil
+	}
+	return failures, nil, nil
+}
+
+func (th *Throttle) keys(request *http.Request, username string) []string {
+	return []string{userThrottleKey(username), ipThrottleKey(th.clientIP(request))}
+}
+
+func (th *Throttle) limits() []*ThrottleLimits {
+	return []*ThrottleLimits{&th.User, &th.IP}
+}
+
+// Check returns a *ThrottledError if username or the client may not
+// try to log in right now.
+func (th *Throttle) Check(request *http.Request, username string) error {
+	_, err := th.check(th.keys(request, username), time.Now())
+	return err
+}
+
+// failures remembered for each key
+func (th *Throttle) check(keys []string, now time.Time) ([]int, error) {
+	seen := make([]int, len(keys))
+	for i, limits := range th.limits() {
+		failures, te, err := th.wait(keys[i], limits, now)
+		if err != nil || te != nil {
+			return nil, errOrThrottled(err, te)
+		}
+		seen[i] = failures
+	}
+	return seen, nil
+}
+
+// Check, then count the attempt as a failure before it is made. Follow
+// with Success or Refund if it doesn't fail.
+func (th *Throttle) Reserve(request *http.Request, username string) error {
+	keys := th.keys(request, username)
+	now := time.Now()
+	seen, err := th.check(keys, now)
+	if err != nil {
+		return err
+	}
+	forget := now.Unix() - int64(th.LockoutDuration/time.Second)
+	for i, limits := range th.limits() {
+		n, err := th.Store.Fail(keys[i], now.Unix(), forget)
+		if err != nil {
+			th.refund(keys[:i])
+			return err
+		}
+		if n-1 <= seen[i] {
+			continue
+		}
+		// Other attempts were counted since check(), just now
+		delay, locked := th.delay(limits, n-1)
+		if delay > 0 {
+			th.refund(keys[:i+1])
+			return &ThrottledError{RetryAfter: delay, Locked: locked}
+		}
+	}
+	return nil
+}
+
+func (th *Throttle) refund(keys []string) {
+	for _, key := range keys {
+		err := th.Store.Refund(key)
+		if err != nil {
+			log.Print("throttle refund ", err)
+		}
+	}
+}
+
+func errOrThrottled(err error, te *ThrottledError) error {
+	if err != nil {
+		return err
+	}
+	if te != nil {
+		return te
+	}
+	return nil
+}
+
+// Take back a Reserve for an attempt that neither failed nor succeeded
+func (th *Throttle) Refund(request *http.Request, username string) {
+	th.refund(th.keys(request, username))
+}
+
+// After a Reserve: clear username's failures, and take back the client
+// IP's reservation. The client IP's earlier failures are left to expire
+// so that logging in to one account doesn't reset guessing at others.
+func (th *Throttle) Success(request *http.Request, username string) {
+	keys := th.keys(request, username)
+	err := th.Store.Reset(keys[0])
+	if err != nil {
+		log.Print("throttle reset ", err)
+	}
+	th.refund(keys[1:])
+}
+
+// Wrap a login check with LoginThrottle, if set.
+// Wrong passwords and codes count as failures, other errors don't.
+func throttled(request *http.Request, username string, check func() error) error {
+	th := LoginThrottle
+	if th == nil {
+		return check()
+	}
+	err := th.Reserve(request, username)
+	if err != nil {
+		return err
+	}
+	err = check()
+	switch {
+	case err == nil:
+		th.Success(request, username)
+	case errors.Is(err, BadUserError) || errors.Is(err, ErrBadSecondFactor):
+		// counted by Reserve
+	default:
+		th.Refund(request, username)
+	}
+	return err
+}
+
+type memThrottleEntry struct {
+	failures int
+	last     int64
+}
+
+// In-process ThrottleStore. Counters are lost on restart and not shared
+// between servers.
+type MemoryThrottleStore struct {
+	l       sync.Mutex
+	entries map[string]memThrottleEntry
+	fails   int
+}
+
+func NewMemoryThrottleStore() *MemoryThrottleStore {
+	return &MemoryThrottleStore{entries: make(map[string]memThrottleEntry)}
+}
+
+func (ms *MemoryThrottleStore) Get(key string) (int, int64, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	e := ms.entries[key]
+	return e.failures, e.last, nil
+}
+
+// prune old entries every this many failures
+const memThrottlePruneInterval = 1000
+
+func (ms *MemoryThrottleStore) Fail(key string, now, forgetBefore int64) (int, error) {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	e := ms.entries[key]
+	if e.last < forgetBefore {
+		e.failures = 0
+	}
+	e.failures++
+	e.last = now
+	ms.entries[key] = e
+	ms.fails++
+	if ms.fails%memThrottlePruneInterval == 0 {
+		for k, v := range ms.entries {
+			if v.last < forgetBefore {
+				delete(ms.entries, k)
+			}
+		}
+	}
+	return e.failures, nil
+}
+
+func (ms *MemoryThrottleStore) Refund(key string) error {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	if e, ok := ms.entries[key]; ok && e.failures > 0 {
+		e.failures--
+		ms.entries[key] = e
+	}
+	return nil
+}
+
+func (ms *MemoryThrottleStore) Reset(key string) error {
+	ms.l.Lock()
+	defer ms.l.Unlock()
+	delete(ms.entries, key)
+	return nil
+}
@@ -0,0 +1,87 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/brianolson/login/login/crypto"
+)
+
+const DefaultTokenTTL = 14 * 24 * time.Hour
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"` // seconds
+	Guid        int64  `json:"guid"`
+}
+
+// Issues bearer tokens for "Authorization: Bearer <token>".
+// POST with a logged in "u" cookie (e.g. after oauth login), or with
+// username, password and totp (if enrolled) as a JSON object or form fields.
+// A token resolves to the same *User in GetHttpUser as the cookie does.
+type TokenHandler struct {
+	Udb UserDB
+
+	// zero uses DefaultTokenTTL
+	TTL time.Duration
+}
+
+func (th *TokenHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, th.Udb)
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "POST only", nil)
+		return
+	}
+	user, err := cookieGetUser(request, udb)
+	if errors.Is(err, ErrUserDisabled) {
+		writeLoginError(out, err, nil)
+		return
+	}
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("token cookie err ", err)
+	}
+	if user == nil {
+		var lr jsonLoginRequest
+		if isJSONRequest(request) {
+			err = json.NewDecoder(request.Body).Decode(&lr)
+			if err != nil {
+				writeJSONError(out, http.StatusBadRequest, "bad_request", "could not parse JSON body", nil)
+				return
+			}
+		} else {
+			lr.Username = request.PostFormValue("username")
+			lr.Password = request.PostFormValue("password")
+			lr.TOTP = request.PostFormValue("totp")
+		}
+		if len(lr.Username) == 0 {
+			writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "need login cookie or username and password", nil)
+			return
+		}
+		user, err = localLogin(request, udb, lr.Username, lr.Password, lr.TOTP)
+		if err != nil {
+			writeLoginError(out, err, nil)
+			return
+		}
+	}
+	ttl := th.TTL
+	if ttl == 0 {
+		ttl = DefaultTokenTTL
+	}
+	token, err := crypto.MakeBearerToken(user.Guid, ttl)
+	if err != nil {
+		log.Print("error making bearer token ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error making token", nil)
+		return
+	}
+	writeJSON(out, http.StatusOK, TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ttl / time.Second),
+		Guid:        user.Guid,
+	})
+}
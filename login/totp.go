@@ -0,0 +1,152 @@
+package login
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/brianolson/login/login/crypto"
+)
+
+type totpEnrollRequest struct {
+	Action string `json:"action"`
+	Code   string `json:"code"`
+}
+
+type TOTPEnrollResponse struct {
+	// otpauth:// URI, usually shown as a QR code
+	URI string `json:"uri"`
+	// base32 secret for typing in by hand
+	Secret string `json:"secret"`
+}
+
+type TOTPConfirmResponse struct {
+	Ok bool `json:"ok"`
+	// generated if this is the user's first second factor
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+// Manage TOTP for the logged in user. JSON responses.
+// POST action=begin: new unconfirmed secret, responds TOTPEnrollResponse
+// POST action=confirm&code=123456: turn it on, responds TOTPConfirmResponse
+// POST action=disable&code=123456: turn it off (a recovery code also works)
+// Fields may be form encoded or a JSON object.
+type TOTPEnrollHandler struct {
+	Udb UserDB
+
+	// Shown in the authenticator app, e.g. your site name
+	Issuer string
+}
+
+func (th *TOTPEnrollHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	udb := requestUserDB(request, th.Udb)
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "POST only", nil)
+		return
+	}
+	user, err := requestGetUser(request, udb)
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("totp enroll user ", err)
+	}
+	if user == nil {
+		writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "not logged in", nil)
+		return
+	}
+	var er totpEnrollRequest
+	if isJSONRequest(request) {
+		err = json.NewDecoder(request.Body).Decode(&er)
+		if err != nil {
+			writeJSONError(out, http.StatusBadRequest, "bad_request", "could not parse JSON body", nil)
+			return
+		}
+	} else {
+		er.Action = request.PostFormValue("action")
+		er.Code = request.PostFormValue("code")
+	}
+	er.Code = strings.TrimSpace(er.Code)
+	rec, err := udb.GetTOTP(user)
+	if err != nil {
+		log.Print("get totp ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error reading totp", nil)
+		return
+	}
+
+	switch er.Action {
+	case "begin":
+		if rec != nil && rec.Enabled {
+			writeJSONError(out, http.StatusConflict, "already_enrolled", "disable the current authenticator first", nil)
+			return
+		}
+		secret, err := crypto.GenerateTOTPSecret()
+		if err == nil {
+			rec = &TOTPRecord{}
+			rec.Secret, err = crypto.SealSecret(secret)
+		}
+		if err == nil {
+			err = udb.PutTOTP(user, rec)
+		}
+		if err != nil {
+			log.Print("totp begin ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error starting totp", nil)
+			return
+		}
+		writeJSON(out, http.StatusOK, TOTPEnrollResponse{
+			URI:    crypto.TOTPURI(th.Issuer, user.BestDisplayName(), secret),
+			Secret: crypto.TOTPSecretString(secret),
+		})
+	case "confirm":
+		if rec == nil || rec.Enabled {
+			writeJSONError(out, http.StatusConflict, "bad_request", "no totp enrollment in progress", nil)
+			return
+		}
+		secret, err := crypto.OpenSecret(rec.Secret)
+		if err != nil {
+			log.Print("totp open secret ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error reading totp", nil)
+			return
+		}
+		step, ok := crypto.CheckTOTP(secret, er.Code, time.Now())
+		if !ok {
+			writeJSONError(out, http.StatusUnauthorized, "bad_second_factor", ErrBadSecondFactor.Error(), FieldErrors{"code": "wrong code"})
+			return
+		}
+		rec.Enabled = true
+		rec.LastStep = step
+		err = udb.PutTOTP(user, rec)
+		var codes []string
+		if err == nil {
+			codes, err = ensureRecoveryCodes(udb, user)
+		}
+		if err != nil {
+			log.Print("totp confirm ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error saving totp", nil)
+			return
+		}
+		writeJSON(out, http.StatusOK, TOTPConfirmResponse{true, codes})
+	case "disable":
+		if rec == nil {
+			writeJSON(out, http.StatusOK, map[string]bool{"ok": true})
+			return
+		}
+		if rec.Enabled {
+			err = checkSecondFactor(udb, user, er.Code)
+			if err != nil {
+				writeLoginError(out, err, FieldErrors{"code": "wrong code"})
+				return
+			}
+		}
+		err = udb.DelTOTP(user)
+		if err != nil {
+			log.Print("totp disable ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error removing totp", nil)
+			return
+		}
+		writeJSON(out, http.StatusOK, map[string]bool{"ok": true})
+	default:
+		writeJSONError(out, http.StatusBadRequest, "bad_request", "action must be begin, confirm, or disable", nil)
+	}
+}
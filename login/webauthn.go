@@ -0,0 +1,636 @@
+package login
+
+import (
+	"bytes"
+	gocrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+
+	"github.com/brianolson/login/login/crypto"
+)
+
+// WebAuthn (passkey) registration and login.
+//
+// Attestation statements are not verified; we trust the browser about
+// what kind of authenticator it is, as with attestation "none".
+// Supported algorithms are ES256, EdDSA and RS256.
+
+var ErrWebAuthn = errors.New("webauthn verification failed")
+
+const (
+	webauthnRegisterPurpose = "webauthn.create"
+	webauthnLoginPurpose    = "webauthn.get"
+
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+
+	authDataUP = 0x01 // user present
+	authDataUV = 0x04 // user verified
+	authDataAT = 0x40 // attested credential data included
+	authDataED = 0x80 // extension data included
+)
+
+var b64url = base64.RawURLEncoding
+
+// browsers send unpadded, some libraries pad
+func b64urlDecode(s string) ([]byte, error) {
+	return b64url.DecodeString(strings.TrimRight(s, "="))
+}
+
+// Serves the WebAuthn ceremonies as JSON POSTs with an "action":
+//
+//	register_begin   (logged in) creation options for navigator.credentials.create()
+//	register_finish  (logged in) {"credential":{...}, "name":"my phone"}
+//	login_begin      request options for navigator.credentials.get();
+//	                 with a "u2" cookie this is the second factor step,
+//	                 otherwise it is a passwordless login
+//	login_finish     {"credential":{...}}, sets the "u" cookie, responds UserInfo
+//	list             (logged in) the user's credentials
+//	remove           (logged in) {"id":"base64url credential id"}
+//
+// Binary fields are base64url in both directions.
+type WebAuthnHandler struct {
+	Udb UserDB
+
+	// Relying party id, usually the site's domain, e.g. "example.com"
+	RPID   string
+	RPName string
+
+	// Expected origin of the browser page, e.g. "https://example.com"
+	Origin string
+}
+
+type webauthnRequest struct {
+	Action     string              `json:"action"`
+	Name       string              `json:"name"`
+	Id         string              `json:"id"`
+	Credential *webauthnCredential `json:"credential"`
+}
+
+// PublicKeyCredential as JSON from the browser
+type webauthnCredential struct {
+	Id       string `json:"id"`
+	RawId    string `json:"rawId"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+type webauthnCredDesc struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+type WebAuthnCredentialInfo struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Created  int64  `json:"created"`
+	LastUsed int64  `json:"lastused"`
+}
+
+type WebAuthnRegisterResponse struct {
+	WebAuthnCredentialInfo
+	// generated if this is the user's first second factor
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+func (wh *WebAuthnHandler) ServeHTTP(out http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		out.Header().Set("Allow", http.MethodPost)
+		writeJSONError(out, http.StatusMethodNotAllowed, "bad_request", "POST only", nil)
+		return
+	}
+	var wr webauthnRequest
+	err := json.NewDecoder(request.Body).Decode(&wr)
+	if err != nil {
+		writeJSONError(out, http.StatusBadRequest, "bad_request", "could not parse JSON body", nil)
+		return
+	}
+	// this request's queries all go through bound.Udb
+	bound := *wh
+	bound.Udb = requestUserDB(request, wh.Udb)
+	wh = &bound
+	switch wr.Action {
+	case "login_begin":
+		wh.loginBegin(out, request)
+		return
+	case "login_finish":
+		wh.loginFinish(out, request, &wr)
+		return
+	}
+
+	user, err := requestGetUser(request, wh.Udb)
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("webauthn user ", err)
+	}
+	if user == nil {
+		writeJSONError(out, http.StatusUnauthorized, "not_logged_in", "not logged in", nil)
+		return
+	}
+	switch wr.Action {
+	case "register_begin":
+		wh.registerBegin(out, user)
+	case "register_finish":
+		wh.registerFinish(out, user, &wr)
+	case "list":
+		creds, err := wh.Udb.ListWebAuthnCredentials(user)
+		if err != nil {
+			log.Print("webauthn list ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error listing credentials", nil)
+			return
+		}
+		infos := make([]WebAuthnCredentialInfo, len(creds))
+		for i, cred := range creds {
+			infos[i] = WebAuthnCredentialInfo{b64url.EncodeToString(cred.ID), cred.Name, cred.Created, cred.LastUsed}
+		}
+		writeJSON(out, http.StatusOK, infos)
+	case "remove":
+		credID, err := b64urlDecode(wr.Id)
+		if err != nil || len(credID) == 0 {
+			writeJSONError(out, http.StatusBadRequest, "bad_request", "bad credential id", nil)
+			return
+		}
+		err = wh.Udb.DelWebAuthnCredential(user, credID)
+		if err != nil {
+			log.Print("webauthn remove ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error removing credential", nil)
+			return
+		}
+		writeJSON(out, http.StatusOK, map[string]bool{"ok": true})
+	default:
+		writeJSONError(out, http.StatusBadRequest, "bad_request", "unknown action", nil)
+	}
+}
+
+func userHandle(guid int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(guid))
+	return b[:]
+}
+
+func (wh *WebAuthnHandler) credDescs(user *User) ([]webauthnCredDesc, error) {
+	creds, err := wh.Udb.ListWebAuthnCredentials(user)
+	if err != nil {
+		return nil, err
+	}
+	descs := make([]webauthnCredDesc, len(creds))
+	for i, cred := range creds {
+		descs[i] = webauthnCredDesc{"public-key", b64url.EncodeToString(cred.ID)}
+	}
+	return descs, nil
+}
+
+// Challenges are remembered by hash until used once or expired
+func challengeHash(token []byte) []byte {
+	h := sha256.Sum256(token)
+	return h[:]
+}
+
+// The challenge is a MACed token under the token key, so the browser never
+// sees anything that would pass as a login cookie.
+func (wh *WebAuthnHandler) challengeString(purpose string, uid int64) (string, error) {
+	token, err := crypto.MakeChallenge(purpose, uid)
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(crypto.SecondFactorTTL).Unix()
+	err = wh.Udb.PutWebAuthnChallenge(challengeHash([]byte(token)), expires)
+	if err != nil {
+		return "", err
+	}
+	return b64url.EncodeToString([]byte(token)), nil
+}
+
+func (wh *WebAuthnHandler) registerBegin(out http.ResponseWriter, user *User) {
+	challenge, err := wh.challengeString(webauthnRegisterPurpose, user.Guid)
+	var exclude []webauthnCredDesc
+	if err == nil {
+		exclude, err = wh.credDescs(user)
+	}
+	if err != nil {
+		log.Print("webauthn register begin ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error starting registration", nil)
+		return
+	}
+	name := user.Username
+	if name == "" {
+		name = user.BestDisplayName()
+	}
+	writeJSON(out, http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge": challenge,
+			"rp":        map[string]string{"id": wh.RPID, "name": wh.RPName},
+			"user": map[string]string{
+				"id":          b64url.EncodeToString(userHandle(user.Guid)),
+				"name":        name,
+				"displayName": user.BestDisplayName(),
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": coseAlgES256},
+				{"type": "public-key", "alg": coseAlgEdDSA},
+				{"type": "public-key", "alg": coseAlgRS256},
+			},
+			"timeout":            int64(crypto.SecondFactorTTL / time.Millisecond),
+			"attestation":        "none",
+			"excludeCredentials": exclude,
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+		},
+	})
+}
+
+func (wh *WebAuthnHandler) registerFinish(out http.ResponseWriter, user *User, wr *webauthnRequest) {
+	cred, err := wh.verifyRegistration(user, wr.Credential)
+	if err != nil {
+		log.Print("webauthn register ", err)
+		writeJSONError(out, http.StatusBadRequest, "bad_credential", err.Error(), nil)
+		return
+	}
+	cred.Name = wr.Name
+	err = wh.Udb.AddWebAuthnCredential(user, cred)
+	var codes []string
+	if err == nil {
+		codes, err = ensureRecoveryCodes(wh.Udb, user)
+	}
+	if err != nil {
+		log.Print("webauthn register store ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error saving credential", nil)
+		return
+	}
+	writeJSON(out, http.StatusOK, WebAuthnRegisterResponse{
+		WebAuthnCredentialInfo{b64url.EncodeToString(cred.ID), cred.Name, cred.Created, cred.LastUsed},
+		codes,
+	})
+}
+
+func (wh *WebAuthnHandler) loginBegin(out http.ResponseWriter, request *http.Request) {
+	pending, err := pendingGetUser(request, wh.Udb)
+	if err != nil && !errors.Is(err, BadUserError) {
+		log.Print("webauthn pending user ", err)
+	}
+	var uid int64
+	allow := []webauthnCredDesc{}
+	uv := "required"
+	if pending != nil {
+		uid = pending.Guid
+		allow, err = wh.credDescs(pending)
+		uv = "discouraged"
+	}
+	var challenge string
+	if err == nil {
+		challenge, err = wh.challengeString(webauthnLoginPurpose, uid)
+	}
+	if err != nil {
+		log.Print("webauthn login begin ", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error starting login", nil)
+		return
+	}
+	writeJSON(out, http.StatusOK, map[string]interface{}{
+		"publicKey": map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             wh.RPID,
+			"timeout":          int64(crypto.SecondFactorTTL / time.Millisecond),
+			"allowCredentials": allow,
+			"userVerification": uv,
+		},
+	})
+}
+
+func (wh *WebAuthnHandler) loginFinish(out http.ResponseWriter, request *http.Request, wr *webauthnRequest) {
+	user, err := wh.verifyAssertion(wr.Credential)
+	if err != nil {
+		if !errors.Is(err, ErrWebAuthn) && !errors.Is(err, BadUserError) {
+			log.Print("webauthn login ", err)
+			writeJSONError(out, http.StatusInternalServerError, "internal", "error checking credential", nil)
+			return
+		}
+		recordLoginFailure(wh.Udb, request, 0, "webauthn", err.Error(), err)
+		writeJSONError(out, http.StatusUnauthorized, "bad_credentials", err.Error(), nil)
+		return
+	}
+	err = loginSucceeded(wh.Udb, request, user, "webauthn")
+	if err != nil {
+		writeLoginError(out, err, nil)
+		return
+	}
+	clearPendingCookie(out)
+	err = setLoginCookie(out, user)
+	if err != nil {
+		log.Printf("error making cookie: %s", err)
+		writeJSONError(out, http.StatusInternalServerError, "internal", "error logging in", nil)
+		return
+	}
+	writeJSON(out, http.StatusOK, NewUserInfo(user))
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// Check clientDataJSON and use up its challenge; returns the uid the
+// challenge was issued for
+func (wh *WebAuthnHandler) checkClientData(raw []byte, ceremony string) (int64, error) {
+	var cd clientData
+	err := json.Unmarshal(raw, &cd)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad clientDataJSON, %v", ErrWebAuthn, err)
+	}
+	if cd.Type != ceremony {
+		return 0, fmt.Errorf("%w: clientData type %#v", ErrWebAuthn, cd.Type)
+	}
+	if cd.Origin != wh.Origin {
+		return 0, fmt.Errorf("%w: origin %#v", ErrWebAuthn, cd.Origin)
+	}
+	token, err := b64urlDecode(cd.Challenge)
+	if err != nil {
+		return 0, fmt.Errorf("%w: bad challenge", ErrWebAuthn)
+	}
+	uid, err := crypto.ParseChallenge(ceremony, string(token))
+	if err != nil {
+		return 0, fmt.Errorf("%w: challenge %v", ErrWebAuthn, err)
+	}
+	fresh, err := wh.Udb.TakeWebAuthnChallenge(challengeHash(token))
+	if err != nil {
+		return 0, err
+	}
+	if !fresh {
+		return 0, fmt.Errorf("%w: challenge already used", ErrWebAuthn)
+	}
+	return uid, nil
+}
+
+type authData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	// only with authDataAT
+	CredID    []byte
+	PublicKey []byte
+}
+
+func parseAuthData(b []byte) (*authData, error) {
+	if len(b) < 37 {
+		return nil, fmt.Errorf("%w: authenticator data too short", ErrWebAuthn)
+	}
+	ad := &authData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.Flags&authDataAT == 0 {
+		return ad, nil
+	}
+	rest := b[37:]
+	// aaguid[16] credIdLen[2] credId[credIdLen] COSE_Key
+	if len(rest) < 18 {
+		return nil, fmt.Errorf("%w: attested credential data too short", ErrWebAuthn)
+	}
+	idlen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idlen {
+		return nil, fmt.Errorf("%w: credential id too short", ErrWebAuthn)
+	}
+	ad.CredID = rest[:idlen]
+	rest = rest[idlen:]
+	// the key is the next CBOR item; extensions may follow it
+	rd := bytes.NewReader(rest)
+	var key map[int64]interface{}
+	err := cbor.NewDecoder(rd).Decode(&key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad credential public key, %v", ErrWebAuthn, err)
+	}
+	ad.PublicKey = rest[:len(rest)-rd.Len()]
+	return ad, nil
+}
+
+func (wh *WebAuthnHandler) checkAuthData(ad *authData, needUV bool) error {
+	want := sha256.Sum256([]byte(wh.RPID))
+	if !bytes.Equal(ad.RPIDHash, want[:]) {
+		return fmt.Errorf("%w: wrong rp id", ErrWebAuthn)
+	}
+	if ad.Flags&authDataUP == 0 {
+		return fmt.Errorf("%w: user not present", ErrWebAuthn)
+	}
+	if needUV && ad.Flags&authDataUV == 0 {
+		return fmt.Errorf("%w: user not verified", ErrWebAuthn)
+	}
+	return nil
+}
+
+type attestationObject struct {
+	Fmt      string      `cbor:"fmt"`
+	AttStmt  interface{} `cbor:"attStmt"`
+	AuthData []byte      `cbor:"authData"`
+}
+
+func (wh *WebAuthnHandler) verifyRegistration(user *User, wc *webauthnCredential) (*WebAuthnCredential, error) {
+	if wc == nil {
+		return nil, fmt.Errorf("%w: missing credential", ErrWebAuthn)
+	}
+	cdj, err := b64urlDecode(wc.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad clientDataJSON", ErrWebAuthn)
+	}
+	uid, err := wh.checkClientData(cdj, webauthnRegisterPurpose)
+	if err != nil {
+		return nil, err
+	}
+	if uid != user.Guid {
+		return nil, fmt.Errorf("%w: challenge for another user", ErrWebAuthn)
+	}
+	aob, err := b64urlDecode(wc.Response.AttestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad attestationObject", ErrWebAuthn)
+	}
+	var ao attestationObject
+	err = cbor.Loads(aob, &ao)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad attestationObject, %v", ErrWebAuthn, err)
+	}
+	ad, err := parseAuthData(ao.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	err = wh.checkAuthData(ad, false)
+	if err != nil {
+		return nil, err
+	}
+	if ad.CredID == nil {
+		return nil, fmt.Errorf("%w: no attested credential", ErrWebAuthn)
+	}
+	_, _, err = parseCOSEKey(ad.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnCredential{
+		ID:        ad.CredID,
+		PublicKey: ad.PublicKey,
+		SignCount: int64(ad.SignCount),
+		Created:   time.Now().Unix(),
+	}, nil
+}
+
+// Returns the user the assertion logs in
+func (wh *WebAuthnHandler) verifyAssertion(wc *webauthnCredential) (*User, error) {
+	if wc == nil {
+		return nil, fmt.Errorf("%w: missing credential", ErrWebAuthn)
+	}
+	credID, err := b64urlDecode(wc.RawId)
+	if err != nil || len(credID) == 0 {
+		return nil, fmt.Errorf("%w: bad credential id", ErrWebAuthn)
+	}
+	cdj, err := b64urlDecode(wc.Response.ClientDataJSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad clientDataJSON", ErrWebAuthn)
+	}
+	uid, err := wh.checkClientData(cdj, webauthnLoginPurpose)
+	if err != nil {
+		return nil, err
+	}
+	user, cred, err := wh.Udb.GetWebAuthnCredential(credID)
+	if err != nil {
+		return nil, err
+	}
+	// uid 0 is passwordless, otherwise the challenge was for a
+	// second factor and must be answered by that user's credential
+	if uid != 0 && uid != user.Guid {
+		return nil, fmt.Errorf("%w: credential belongs to another user", ErrWebAuthn)
+	}
+	adb, err := b64urlDecode(wc.Response.AuthenticatorData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad authenticatorData", ErrWebAuthn)
+	}
+	ad, err := parseAuthData(adb)
+	if err != nil {
+		return nil, err
+	}
+	err = wh.checkAuthData(ad, uid == 0)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := b64urlDecode(wc.Response.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature encoding", ErrWebAuthn)
+	}
+	cdhash := sha256.Sum256(cdj)
+	signed := append(append([]byte{}, adb...), cdhash[:]...)
+	err = verifyCOSESignature(cred.PublicKey, signed, sig)
+	if err != nil {
+		return nil, err
+	}
+	newCount := int64(ad.SignCount)
+	ok, err := wh.Udb.UseWebAuthnCredential(cred.ID, newCount)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: signature counter went from %d to %d, cloned authenticator?", ErrWebAuthn, cred.SignCount, newCount)
+	}
+	return user, nil
+}
+
+// COSE integers come out of cbor as uint64 or int64
+func coseInt(v interface{}) (int64, bool) {
+	switch iv := v.(type) {
+	case int64:
+		return iv, true
+	case uint64:
+		return int64(iv), true
+	}
+	return 0, false
+}
+
+func coseBytes(key map[int64]interface{}, k int64) []byte {
+	b, _ := key[k].([]byte)
+	return b
+}
+
+// Returns alg and public key
+func parseCOSEKey(raw []byte) (int64, interface{}, error) {
+	var key map[int64]interface{}
+	err := cbor.Loads(raw, &key)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: bad COSE key, %v", ErrWebAuthn, err)
+	}
+	alg, _ := coseInt(key[3])
+	switch alg {
+	case coseAlgES256:
+		crv, _ := coseInt(key[-1])
+		x := coseBytes(key, -2)
+		y := coseBytes(key, -3)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return 0, nil, fmt.Errorf("%w: bad ES256 key", ErrWebAuthn)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return 0, nil, fmt.Errorf("%w: ES256 point not on curve", ErrWebAuthn)
+		}
+		return alg, pub, nil
+	case coseAlgEdDSA:
+		x := coseBytes(key, -2)
+		if len(x) != ed25519.PublicKeySize {
+			return 0, nil, fmt.Errorf("%w: bad EdDSA key", ErrWebAuthn)
+		}
+		return alg, ed25519.PublicKey(x), nil
+	case coseAlgRS256:
+		n := coseBytes(key, -1)
+		e := coseBytes(key, -2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return 0, nil, fmt.Errorf("%w: bad RS256 key", ErrWebAuthn)
+		}
+		ei := 0
+		for _, eb := range e {
+			ei = (ei << 8) | int(eb)
+		}
+		return alg, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: ei}, nil
+	}
+	return 0, nil, fmt.Errorf("%w: unsupported COSE alg %d", ErrWebAuthn, alg)
+}
+
+func verifyCOSESignature(rawKey, signed, sig []byte) error {
+	_, pub, err := parseCOSEKey(rawKey)
+	if err != nil {
+		return err
+	}
+	ok := false
+	switch pk := pub.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(signed)
+		ok = ecdsa.VerifyASN1(pk, h[:], sig)
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(pk, signed, sig)
+	case *rsa.PublicKey:
+		h := sha256.Sum256(signed)
+		ok = rsa.VerifyPKCS1v15(pk, gocrypto.SHA256, h[:], sig) == nil
+	}
+	if !ok {
+		return fmt.Errorf("%w: bad signature", ErrWebAuthn)
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package login
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	dsql "database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brianolson/login/login/sql"
+)
+
+// Outbound webhooks for account events. Events are written to a durable
+// outbox in the same transaction as the change, and a
+// WebhookDispatcher POSTs them with retries.
+//
+// Each POST body is a WebhookEvent. The X-Login-Signature header is
+// "t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>" with the secret>",
+// check it with VerifyWebhookSignature.
+
+const (
+	WebhookUserCreated  = "user.created"
+	WebhookUserDeleted  = "user.deleted"
+	WebhookEmailAdded   = "email.added"
+	WebhookEmailDeleted = "email.deleted"
+)
+
+const webhookSignatureHeader = "X-Login-Signature"
+
+type WebhookDelivery = sql.WebhookDelivery
+
+type WebhookEvent struct {
+	Type string `json:"type"`
+	Time int64  `json:"time"`
+	Guid int64  `json:"guid"`
+
+	// user.created
+	User *UserInfo `json:"user,omitempty"`
+	// email.added, email.deleted
+	Email string `json:"email,omitempty"`
+}
+
+// See sql.NewSqlWebhookOutbox
+type WebhookOutbox interface {
+	// tx may be nil
+	Enqueue(tx *dsql.Tx, d *WebhookDelivery) error
+	ClaimDue(now, leaseUntil int64, limit int) ([]WebhookDelivery, error)
+	Delivered(id int64) error
+	// next is when to retry, -1 to give up
+	Failed(id int64, attempts int, next int64, errmsg string) error
+}
+
+type WebhookEndpoint struct {
+	URL    string
+	Secret []byte
+
+	// Event types to send, nil for all
+	Events []string
+}
+
+func (we *WebhookEndpoint) wants(event string) bool {
+	if we.Events == nil {
+		return true
+	}
+	for _, e := range we.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDispatcher struct {
+	Outbox    WebhookOutbox
+	Endpoints []WebhookEndpoint
+
+	Client *http.Client
+
+	// Give up after this many failed attempts
+	MaxAttempts int
+	// Retry delay after the first failure, doubling each time
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// How often Run checks the outbox
+	PollInterval time.Duration
+	// How long a claimed delivery is hidden from other dispatchers
+	Lease time.Duration
+
+	hl     sync.Mutex
+	hooked map[*HookRegistry]bool
+}
+
+func NewWebhookDispatcher(outbox WebhookOutbox, endpoints []WebhookEndpoint) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Outbox:       outbox,
+		Endpoints:    endpoints,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts:  10,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     6 * time.Hour,
+		PollInterval: 10 * time.Second,
+		Lease:        time.Minute,
+	}
+}
+
+// Register on hr, usually udb.Hooks(), to enqueue account events.
+// An enqueue error rolls back the change. Registering on the same hr
+// again does nothing.
+func (wd *WebhookDispatcher) RegisterHooks(hr *HookRegistry) {
+	wd.hl.Lock()
+	defer wd.hl.Unlock()
+	if wd.hooked[hr] {
+		return
+	}
+	if wd.hooked == nil {
+		wd.hooked = make(map[*HookRegistry]bool)
+	}
+	wd.hooked[hr] = true
+	hr.OnUserCreatedTx(func(tx *dsql.Tx, user *User) error {
+		ui := NewUserInfo(user)
+		return wd.enqueue(tx, &WebhookEvent{Type: WebhookUserCreated, Guid: user.Guid, User: &ui})
+	})
+	hr.OnUserDeletedTx(func(tx *dsql.Tx, user *User) error {
+		return wd.enqueue(tx, &WebhookEvent{Type: WebhookUserDeleted, Guid: user.Guid})
+	})
+	hr.OnEmailAddedTx(func(tx *dsql.Tx, user *User, email string) error {
+		return wd.enqueue(tx, &WebhookEvent{Type: WebhookEmailAdded, Guid: user.Guid, Email: email})
+	})
+	hr.OnEmailDeletedTx(func(tx *dsql.Tx, user *User, email string) error {
+		return wd.enqueue(tx, &WebhookEvent{Type: WebhookEmailDeleted, Guid: user.Guid, Email: email})
+	})
+}
+
+// Queue ev for every endpoint that wants it
+func (wd *WebhookDispatcher) Send(ev *WebhookEvent) error {
+	return wd.enqueue(nil, ev)
+}
+
+func (wd *WebhookDispatcher) enqueue(tx *dsql.Tx, ev *WebhookEvent) error {
+	now := time.Now().Unix()
+	if ev.Time == 0 {
+		ev.Time = now
+	}
+	var body []byte
+	for _, ep := range wd.Endpoints {
+		if !ep.wants(ev.Type) {
+			continue
+		}
+		if body == nil {
+			var err error
+			body, err = json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+		}
+		err := wd.Outbox.Enqueue(tx, &WebhookDelivery{
+			URL:         ep.URL,
+			Event:       ev.Type,
+			Body:        body,
+			NextAttempt: now,
+			Created:     now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (wd *WebhookDispatcher) endpoint(url string) *WebhookEndpoint {
+	for i := range wd.Endpoints {
+		if wd.Endpoints[i].URL == url {
+			return &wd.Endpoints[i]
+		}
+	}
+	return nil
+}
+
+// Try everything due now once. Returns the number delivered.
+func (wd *WebhookDispatcher) DeliverDue() (int, error) {
+	now := time.Now()
+	due, err := wd.Outbox.ClaimDue(now.Unix(), now.Add(wd.Lease).Unix(), 100)
+	if err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, d := range due {
+		err = wd.deliver(&d)
+		if err == nil {
+			delivered++
+			err = wd.Outbox.Delivered(d.Id)
+		} else {
+			err = wd.Outbox.Failed(d.Id, d.Attempts+1, wd.nextAttempt(d.Attempts+1), err.Error())
+		}
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+// unix time to retry after attempts failures, -1 to give up
+func (wd *WebhookDispatcher) nextAttempt(attempts int) int64 {
+	if attempts >= wd.MaxAttempts {
+		return -1
+	}
+	delay := wd.BaseDelay
+	for i := 1; i < attempts && delay < wd.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > wd.MaxDelay {
+		delay = wd.MaxDelay
+	}
+	return time.Now().Add(delay).Unix()
+}
+
+var errWebhookNoEndpoint = errors.New("endpoint no longer configured")
+
+func (wd *WebhookDispatcher) deliver(d *WebhookDelivery) error {
+	ep := wd.endpoint(d.URL)
+	if ep == nil {
+		return errWebhookNoEndpoint
+	}
+	req, err := http.NewRequest("POST", d.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Login-Event", d.Event)
+	req.Header.Set("X-Login-Delivery", strconv.FormatInt(d.Id, 10))
+	req.Header.Set(webhookSignatureHeader, SignWebhook(ep.Secret, time.Now().Unix(), d.Body))
+	resp, err := wd.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Deliver until ctx is done
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(wd.PollInterval)
+	defer ticker.Stop()
+	for {
+		_, err := wd.DeliverDue()
+		if err != nil {
+			log.Print("webhook deliver ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func webhookMAC(secret []byte, t int64, body []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", t)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Value for the X-Login-Signature header
+func SignWebhook(secret []byte, t int64, body []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", t, hex.EncodeToString(webhookMAC(secret, t, body)))
+}
+
+var ErrBadWebhookSignature = errors.New("bad webhook signature")
+
+// For receivers. Checks the X-Login-Signature header value against body,
+// and that it was made within tolerance of now.
+func VerifyWebhookSignature(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	var t int64
+	var sig []byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			t, _ = strconv.ParseInt(kv[1], 10, 64)
+		case "v1":
+			sig, _ = hex.DecodeString(kv[1])
+		}
+	}
+	if t == 0 || sig == nil {
+		return ErrBadWebhookSignature
+	}
+	age := time.Since(time.Unix(t, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrBadWebhookSignature
+	}
+	if !hmac.Equal(sig, webhookMAC(secret, t, body)) {
+		return ErrBadWebhookSignature
+	}
+	return nil
+}
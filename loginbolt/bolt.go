@@ -0,0 +1,1130 @@
+package loginbolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+	bolt "go.etcd.io/bbolt"
+
+	ls "github.com/brianolson/login/login/sql"
+)
+
+// UserDB on a bbolt file, for a single binary with no database server.
+// A module of its own so the login module doesn't depend on bbolt.
+// Buckets are named after the SQL tables. Values are cbor, keys are
+// big-endian ids or the indexed value:
+//
+//	guser         guid -> storedUser
+//	guser_name    username -> guid
+//	user_social   SocialKey() -> guid
+//	user_email    email\0guid -> nothing, emails need not be unique
+//	user_apikey   ls.APIKeyHash() -> storedAPIKey
+//	user_totp     guid -> TOTPRecord
+//	user_webauthn credential id -> storedWebAuthn
+//	user_recovery guid -> [][]byte
+//	user_disabled guid -> reason
+//	auth_event    time, seq -> AuthEvent
+//	feedback      millis, seq -> FeedbackRecord
+//	webauthn_challenge  challenge -> big-endian expiry
+//
+// Hooks run after the change commits, with a nil tx, so they may use
+// the UserDB. A veto from OnUserCreatedTx deletes the new user again.
+
+var (
+	boltGuser        = []byte("guser")
+	boltGuserName    = []byte("guser_name")
+	boltUserSocial   = []byte("user_social")
+	boltUserEmail    = []byte("user_email")
+	boltUserAPIKey   = []byte("user_apikey")
+	boltUserTOTP     = []byte("user_totp")
+	boltUserWebAuthn = []byte("user_webauthn")
+	boltUserRecovery = []byte("user_recovery")
+	boltUserDisabled = []byte("user_disabled")
+	boltAuthEvent    = []byte("auth_event")
+	boltFeedback     = []byte("feedback")
+
+	boltWebAuthnChallenge = []byte("webauthn_challenge")
+)
+
+var boltBuckets = [][]byte{
+	boltGuser,
+	boltGuserName,
+	boltUserSocial,
+	boltUserEmail,
+	boltUserAPIKey,
+	boltUserTOTP,
+	boltUserWebAuthn,
+	boltUserRecovery,
+	boltUserDisabled,
+	boltAuthEvent,
+	boltFeedback,
+	boltWebAuthnChallenge,
+}
+
+// Setup() creates the buckets and lower cases old addresses
+func NewBoltUserDB(db *bolt.DB) ls.UserDB {
+	return &boltUserDB{db, &ls.HookRegistry{}, &ls.EmailNormalization{}}
+}
+
+type boltUserDB struct {
+	db    *bolt.DB
+	hooks *ls.HookRegistry
+	en    *ls.EmailNormalization
+}
+
+func (bdb *boltUserDB) EmailNormalization() *ls.EmailNormalization {
+	return bdb.en
+}
+
+func (bdb *boltUserDB) Hooks() *ls.HookRegistry {
+	return bdb.hooks
+}
+
+func boltId(id int64) []byte {
+	out := make([]byte, 8)
+	binary.BigEndian.PutUint64(out, uint64(id))
+	return out
+}
+
+func boltParseId(b []byte) int64 {
+	if len(b) < 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// Log keys sort by time, seq keeps entries at the same time apart
+func boltTimeKey(b *bolt.Bucket, t int64) ([]byte, error) {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	return append(boltId(t), boltId(int64(seq))...), nil
+}
+
+func boltEmailKey(email string, guid int64) []byte {
+	return append([]byte(email+"\x00"), boltId(guid)...)
+}
+
+func boltPut(b *bolt.Bucket, key []byte, v interface{}) error {
+	blob, err := cbor.Dumps(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, blob)
+}
+
+func boltGetUser(tx *bolt.Tx, guid int64) (*storedUser, error) {
+	blob := tx.Bucket(boltGuser).Get(boltId(guid))
+	if blob == nil {
+		return nil, ls.BadUserError
+	}
+	var su storedUser
+	err := cbor.Loads(blob, &su)
+	if err != nil {
+		return nil, fmt.Errorf("bad guser record %d, %v", guid, err)
+	}
+	return &su, nil
+}
+
+// nil if there's no such user, as SQL UPDATE would do nothing
+func boltUpdateUser(tx *bolt.Tx, guid int64, f func(su *storedUser) error) error {
+	su, err := boltGetUser(tx, guid)
+	if errors.Is(err, ls.BadUserError) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = f(su)
+	if err != nil {
+		return err
+	}
+	return boltPut(tx.Bucket(boltGuser), boltId(guid), su)
+}
+
+// Any of ls.EmailNormalization.LookupForms
+func boltEmailTaken(tx *bolt.Tx, forms []string) bool {
+	c := tx.Bucket(boltUserEmail).Cursor()
+	for _, email := range forms {
+		prefix := []byte(email + "\x00")
+		k, _ := c.Seek(prefix)
+		if k != nil && bytes.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lower case addresses stored by older code, as SQL migration 6
+func boltLowerEmails(tx *bolt.Tx) error {
+	b := tx.Bucket(boltUserEmail)
+	guids := make(map[int64]bool)
+	err := b.ForEach(func(k, v []byte) error {
+		if len(k) < 9 {
+			return nil
+		}
+		email := string(k[:len(k)-9])
+		if email != ls.NormalizeEmail(email) {
+			guids[boltParseId(k[len(k)-8:])] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for guid := range guids {
+		err = boltUpdateUser(tx, guid, func(su *storedUser) error {
+			for _, em := range su.Email {
+				err := b.Delete(boltEmailKey(em.Email, guid))
+				if err != nil {
+					return err
+				}
+			}
+			su.Email = lowerEmails(su.Email)
+			for _, em := range su.Email {
+				err := b.Put(boltEmailKey(em.Email, guid), nil)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Values from a bucket keyed by boltTimeKey with start <= t < end,
+// newest first, until f returns false. end 0 for no upper bound.
+func boltNewestFirst(b *bolt.Bucket, start, end int64, f func(v []byte) (bool, error)) error {
+	c := b.Cursor()
+	var k, v []byte
+	if end != 0 {
+		k, _ = c.Seek(boltId(end))
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	} else {
+		k, v = c.Last()
+	}
+	for ; k != nil; k, v = c.Prev() {
+		if boltParseId(k) < start {
+			break
+		}
+		more, err := f(v)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bdb *boltUserDB) Setup() error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return boltLowerEmails(tx)
+	})
+}
+
+func (bdb *boltUserDB) PutNewUser(nu *ls.User) (*ls.User, error) {
+	forms := make([][]string, len(nu.Email))
+	for i, em := range nu.Email {
+		forms[i] = bdb.en.LookupForms(em.Email)
+	}
+	bdb.en.NormalizeUserEmails(nu)
+	pblob, err := prefsBlob(nu)
+	if err != nil {
+		log.Print("nu prefs cbor fail", err)
+		return nil, err
+	}
+	if nu.Created == 0 {
+		nu.Created = time.Now().Unix()
+	}
+	su := &storedUser{
+		Username: nu.Username,
+		Password: nu.Password,
+		Prefs:    pblob,
+		Created:  nu.Created,
+	}
+	for _, si := range nu.Social {
+		su.Social = append(su.Social, ls.SocialKey(si.Service, si.Id))
+	}
+	for _, em := range nu.Email {
+		edblob, err := cbor.Dumps(em.EmailMetadata)
+		if err != nil {
+			err = fmt.Errorf("could not cbor encode email metadata for %s, %v", em.Email, err)
+			return nil, err
+		}
+		su.Email = append(su.Email, storedEmail{em.Email, edblob})
+	}
+
+	err = bdb.db.Update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(boltGuserName)
+		socials := tx.Bucket(boltUserSocial)
+		emails := tx.Bucket(boltUserEmail)
+		if su.Username != "" && names.Get([]byte(su.Username)) != nil {
+			return fmt.Errorf("%w: %#v", ls.ErrUsernameTaken, nu.Username)
+		}
+		for i, skey := range su.Social {
+			if socials.Get([]byte(skey)) != nil {
+				si := nu.Social[i]
+				return fmt.Errorf("%w: \"%s %s\"", ls.ErrSocialTaken, si.Service, si.Id)
+			}
+		}
+		for _, ef := range forms {
+			if boltEmailTaken(tx, ef) {
+				// TODO: check that other email is validated
+				return fmt.Errorf("%w: %#v", ls.ErrEmailTaken, ef[0])
+			}
+		}
+
+		users := tx.Bucket(boltGuser)
+		seq, err := users.NextSequence()
+		if err != nil {
+			return err
+		}
+		su.Guid = int64(seq)
+		guidKey := boltId(su.Guid)
+		err = boltPut(users, guidKey, su)
+		if err != nil {
+			return err
+		}
+		if su.Username != "" {
+			err = names.Put([]byte(su.Username), guidKey)
+			if err != nil {
+				return err
+			}
+		}
+		for _, skey := range su.Social {
+			err = socials.Put([]byte(skey), guidKey)
+			if err != nil {
+				return err
+			}
+		}
+		for _, em := range su.Email {
+			err = emails.Put(boltEmailKey(em.Email, su.Guid), nil)
+			if err != nil {
+				return err
+			}
+		}
+		for _, si := range nu.Social {
+			err = boltLogAuthEvent(tx, socialLinkedEvent(su.Guid, si))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// After commit, bolt allows one writer and hooks may use the UserDB
+	nu.Guid = su.Guid
+	err = bdb.hooks.FireUserCreatedTx(nil, nu)
+	if err != nil {
+		derr := bdb.db.Update(func(tx *bolt.Tx) error {
+			return boltDeleteUser(tx, su.Guid)
+		})
+		if derr != nil {
+			log.Print("bolt delete vetoed user ", derr)
+		}
+		nu.Guid = 0
+		return nil, err
+	}
+
+	bdb.hooks.FireUserCreated(nu)
+	for _, si := range nu.Social {
+		bdb.hooks.FireSocialLinked(nu, si)
+	}
+	return nu, nil
+}
+
+func (bdb *boltUserDB) GetUser(guid int64) (*ls.User, error) {
+	var user *ls.User
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		su, err := boltGetUser(tx, guid)
+		if err == nil {
+			user = su.user()
+		}
+		return err
+	})
+	return user, err
+}
+
+// guid from an index bucket, then the user
+func (bdb *boltUserDB) getIndexedUser(bucket []byte, key string) (*ls.User, error) {
+	var user *ls.User
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		guidKey := tx.Bucket(bucket).Get([]byte(key))
+		if guidKey == nil {
+			return ls.BadUserError
+		}
+		su, err := boltGetUser(tx, boltParseId(guidKey))
+		if err == nil {
+			user = su.user()
+		}
+		return err
+	})
+	return user, err
+}
+
+func (bdb *boltUserDB) GetLocalUser(username string) (*ls.User, error) {
+	return bdb.getIndexedUser(boltGuserName, username)
+}
+
+func (bdb *boltUserDB) GetSocialUser(service, id string) (*ls.User, error) {
+	return bdb.getIndexedUser(boltUserSocial, ls.SocialKey(service, id))
+}
+
+func (bdb *boltUserDB) GetUsers(guids []int64) ([]*ls.User, error) {
+	out := make([]*ls.User, len(guids))
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		for i, guid := range guids {
+			su, err := boltGetUser(tx, guid)
+			if errors.Is(err, ls.BadUserError) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			out[i] = su.user()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (bdb *boltUserDB) GetEmailUser(email string, validatedOnly bool) (*ls.User, error) {
+	forms := bdb.en.LookupForms(email)
+	var user *ls.User
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		choice := ls.EmailUserChoice{ValidatedOnly: validatedOnly}
+		c := tx.Bucket(boltUserEmail).Cursor()
+		for _, addr := range forms {
+			prefix := []byte(addr + "\x00")
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				su, err := boltGetUser(tx, boltParseId(k[len(prefix):]))
+				if err != nil {
+					return err
+				}
+				for _, em := range su.Email {
+					if em.Email == addr {
+						var meta ls.EmailMetadata
+						if len(em.Data) > 0 {
+							cbor.Loads(em.Data, &meta)
+						}
+						choice.Offer(su.Guid, meta.Validated)
+					}
+				}
+			}
+		}
+		guid, ok := choice.Chosen()
+		if !ok {
+			return ls.BadUserError
+		}
+		su, err := boltGetUser(tx, guid)
+		if err == nil {
+			user = su.user()
+		}
+		return err
+	})
+	return user, err
+}
+
+func (bdb *boltUserDB) ListUsers(q ls.UserQuery) (users []*ls.User, next string, err error) {
+	err = bdb.db.View(func(tx *bolt.Tx) error {
+		var all []*ls.User
+		err := tx.Bucket(boltGuser).ForEach(func(k, v []byte) error {
+			var su storedUser
+			err := cbor.Loads(v, &su)
+			if err != nil {
+				return fmt.Errorf("bad guser record %d, %v", boltParseId(k), err)
+			}
+			all = append(all, su.user())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		disabled := tx.Bucket(boltUserDisabled)
+		users, next, err = ls.ListUsersFrom(q, all, func(guid int64) bool {
+			return disabled.Get(boltId(guid)) != nil
+		})
+		return err
+	})
+	return
+}
+
+func (bdb *boltUserDB) DisableUser(user *ls.User, reason string) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserDisabled).Put(boltId(user.Guid), []byte(reason))
+	})
+}
+
+func (bdb *boltUserDB) EnableUser(user *ls.User) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserDisabled).Delete(boltId(user.Guid))
+	})
+}
+
+func (bdb *boltUserDB) GetDisabled(user *ls.User) (disabled bool, reason string, err error) {
+	err = bdb.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltUserDisabled).Get(boltId(user.Guid))
+		disabled = v != nil
+		reason = string(v)
+		return nil
+	})
+	return
+}
+
+// Delete the keys of b for which match(value) is true
+func boltDeleteMatching(b *bolt.Bucket, match func(v []byte) bool) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if match(v) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The auth event log and feedback are kept, as in SQL
+func (bdb *boltUserDB) DeleteUser(user *ls.User) error {
+	err := bdb.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteUser(tx, user.Guid)
+	})
+	if err != nil {
+		return err
+	}
+	err = bdb.hooks.FireUserDeletedTx(nil, user)
+	if err != nil {
+		log.Print("user deleted hook ", err)
+	}
+	bdb.hooks.FireUserDeleted(user)
+	return nil
+}
+
+func (bdb *boltUserDB) ExportUser(guid int64) (*ls.UserExport, error) {
+	return ls.ExportUserFrom(context.Background(), ls.ContextUserDB(bdb), guid)
+}
+
+func (bdb *boltUserDB) SetUserPrefs(user *ls.User) error {
+	pblob, err := prefsBlob(user)
+	if err != nil {
+		log.Print("set prefs cbor fail", err)
+		return err
+	}
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return boltUpdateUser(tx, user.Guid, func(su *storedUser) error {
+			su.Prefs = pblob
+			return nil
+		})
+	})
+}
+
+func (bdb *boltUserDB) SetUserPassword(user *ls.User) error {
+	err := bdb.db.Update(func(tx *bolt.Tx) error {
+		err := boltUpdateUser(tx, user.Guid, func(su *storedUser) error {
+			su.Password = user.Password
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return boltLogAuthEvent(tx, changeEvent(user.Guid, ls.EventPasswordChanged, "password", ""))
+	})
+	if err != nil {
+		return err
+	}
+	bdb.hooks.FirePasswordChanged(user)
+	return nil
+}
+
+// Set local login for a social-login user
+func (bdb *boltUserDB) SetLogin(user *ls.User, username, password string) error {
+	err := bdb.db.Update(func(tx *bolt.Tx) error {
+		names := tx.Bucket(boltGuserName)
+		guidKey := names.Get([]byte(username))
+		if guidKey != nil && boltParseId(guidKey) != user.Guid {
+			return fmt.Errorf("%w: %#v", ls.ErrUsernameTaken, username)
+		}
+		err := boltUpdateUser(tx, user.Guid, func(su *storedUser) error {
+			if su.Username != "" {
+				err := names.Delete([]byte(su.Username))
+				if err != nil {
+					return err
+				}
+			}
+			su.Username = username
+			su.Password = []byte(password)
+			if username == "" {
+				return nil
+			}
+			return names.Put([]byte(username), boltId(su.Guid))
+		})
+		if err != nil {
+			return err
+		}
+		return boltLogAuthEvent(tx, changeEvent(user.Guid, ls.EventPasswordChanged, "password", username))
+	})
+	if err != nil {
+		return err
+	}
+	bdb.hooks.FirePasswordChanged(user)
+	return nil
+}
+
+func (bdb *boltUserDB) AddEmail(user *ls.User, email ls.EmailRecord) error {
+	email.Email = bdb.en.Normalize(email.Email)
+	metablob, err := cbor.Dumps(email.EmailMetadata)
+	if err != nil {
+		log.Print("failed to encode email metadata cbor ", err)
+		metablob = make([]byte, 0)
+	}
+	err = bdb.db.Update(func(tx *bolt.Tx) error {
+		err := boltUpdateUser(tx, user.Guid, func(su *storedUser) error {
+			if su.hasEmail(email.Email) {
+				return fmt.Errorf("email %#v already added", email.Email)
+			}
+			su.Email = append(su.Email, storedEmail{email.Email, metablob})
+			return tx.Bucket(boltUserEmail).Put(boltEmailKey(email.Email, su.Guid), nil)
+		})
+		if err != nil {
+			return err
+		}
+		return boltLogAuthEvent(tx, changeEvent(user.Guid, ls.EventEmailAdded, "", email.Email))
+	})
+	if err != nil {
+		return err
+	}
+	err = bdb.hooks.FireEmailAddedTx(nil, user, email.Email)
+	if err != nil {
+		log.Print("email added hook ", err)
+	}
+	bdb.hooks.FireEmailAdded(user, email.Email)
+	return nil
+}
+
+func (bdb *boltUserDB) DelEmail(user *ls.User, email string) error {
+	forms := bdb.en.LookupForms(email)
+	norm := forms[0]
+	err := bdb.db.Update(func(tx *bolt.Tx) error {
+		err := boltUpdateUser(tx, user.Guid, func(su *storedUser) error {
+			emails := su.Email[:0]
+			for _, em := range su.Email {
+				if !strInStrs(forms, em.Email) {
+					emails = append(emails, em)
+				}
+			}
+			su.Email = emails
+			b := tx.Bucket(boltUserEmail)
+			for _, addr := range forms {
+				err := b.Delete(boltEmailKey(addr, su.Guid))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return boltLogAuthEvent(tx, changeEvent(user.Guid, ls.EventEmailDeleted, "", norm))
+	})
+	if err != nil {
+		return err
+	}
+	err = bdb.hooks.FireEmailDeletedTx(nil, user, norm)
+	if err != nil {
+		log.Print("email deleted hook ", err)
+	}
+	bdb.hooks.FireEmailDeleted(user, norm)
+	return nil
+}
+
+func (bdb *boltUserDB) Feedback(user *ls.User, now int64, text string) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltFeedback)
+		key, err := boltTimeKey(b, now)
+		if err != nil {
+			return err
+		}
+		return boltPut(b, key, ls.FeedbackRecord{Guid: user.Guid, Millis: now, Msg: text})
+	})
+}
+
+func (bdb *boltUserDB) ListFeedback(guid, start, end int64, offset, limit int) ([]ls.FeedbackRecord, error) {
+	out := make([]ls.FeedbackRecord, 0)
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		return boltNewestFirst(tx.Bucket(boltFeedback), start, end, func(v []byte) (bool, error) {
+			var fr ls.FeedbackRecord
+			err := cbor.Loads(v, &fr)
+			if err != nil {
+				return false, err
+			}
+			if guid != 0 && fr.Guid != guid {
+				return true, nil
+			}
+			if offset > 0 {
+				offset--
+				return true, nil
+			}
+			out = append(out, fr)
+			return limit <= 0 || len(out) < limit, nil
+		})
+	})
+	return out, err
+}
+
+func (bdb *boltUserDB) LimitedFeedback(user *ls.User, now int64, text string, start int64, max int) (bool, int64, error) {
+	stored := false
+	var oldest int64
+	err := bdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltFeedback)
+		count := 0
+		err := boltNewestFirst(b, start, 0, func(v []byte) (bool, error) {
+			var fr ls.FeedbackRecord
+			err := cbor.Loads(v, &fr)
+			if err != nil {
+				return false, err
+			}
+			if fr.Guid == user.Guid {
+				count++
+				oldest = fr.Millis
+			}
+			return count < max, nil
+		})
+		if err != nil || count >= max {
+			return err
+		}
+		key, err := boltTimeKey(b, now)
+		if err != nil {
+			return err
+		}
+		stored = true
+		return boltPut(b, key, ls.FeedbackRecord{Guid: user.Guid, Millis: now, Msg: text})
+	})
+	if err != nil {
+		return false, 0, err
+	}
+	if stored {
+		oldest = 0
+	}
+	return stored, oldest, nil
+}
+
+func (bdb *boltUserDB) CreateAPIKey(user *ls.User, name string, scopes []string) (string, *ls.APIKey, error) {
+	key, ak, err := ls.NewAPIKey(name, scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	keyhash := ls.APIKeyHash(key)
+	err = bdb.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltUserAPIKey), keyhash, storedAPIKey{keyhash, user.Guid, *ak})
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return key, ak, nil
+}
+
+func (bdb *boltUserDB) ListAPIKeys(user *ls.User) ([]ls.APIKey, error) {
+	out := make([]ls.APIKey, 0)
+	// scanning all keys, there are few in a small deployment
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserAPIKey).ForEach(func(_, v []byte) error {
+			var sk storedAPIKey
+			err := cbor.Loads(v, &sk)
+			if err == nil && sk.Guid == user.Guid {
+				out = append(out, sk.Key)
+			}
+			return err
+		})
+	})
+	sortAPIKeys(out)
+	return out, err
+}
+
+func (bdb *boltUserDB) RevokeAPIKey(user *ls.User, prefix string) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteMatching(tx.Bucket(boltUserAPIKey), func(v []byte) bool {
+			var sk storedAPIKey
+			return cbor.Loads(v, &sk) == nil && sk.Guid == user.Guid && sk.Key.Prefix == prefix
+		})
+	})
+}
+
+func (bdb *boltUserDB) GetAPIKeyUser(key string) (*ls.User, *ls.APIKey, error) {
+	if !ls.IsAPIKey(key) {
+		return nil, nil, ls.BadUserError
+	}
+	keyhash := ls.APIKeyHash(key)
+	var sk storedAPIKey
+	var user *ls.User
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		blob := tx.Bucket(boltUserAPIKey).Get(keyhash)
+		if blob == nil {
+			return ls.BadUserError
+		}
+		err := cbor.Loads(blob, &sk)
+		if err != nil {
+			return err
+		}
+		su, err := boltGetUser(tx, sk.Guid)
+		if err == nil {
+			user = su.user()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now().Unix()
+	if now-sk.Key.LastUsed > ls.APIKeyLastUsedResolution {
+		sk.Key.LastUsed = now
+		err = bdb.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(boltUserAPIKey)
+			if b.Get(keyhash) == nil {
+				// revoked meanwhile
+				return nil
+			}
+			return boltPut(b, keyhash, sk)
+		})
+		if err != nil {
+			log.Print("apikey lastused update ", err)
+		}
+	}
+	return user, &sk.Key, nil
+}
+
+func (bdb *boltUserDB) getTOTP(tx *bolt.Tx, guid int64) (*ls.TOTPRecord, error) {
+	blob := tx.Bucket(boltUserTOTP).Get(boltId(guid))
+	if blob == nil {
+		return nil, nil
+	}
+	var rec ls.TOTPRecord
+	err := cbor.Loads(blob, &rec)
+	if err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// Replace any TOTP state for user
+func (bdb *boltUserDB) PutTOTP(user *ls.User, rec *ls.TOTPRecord) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltUserTOTP), boltId(user.Guid), rec)
+	})
+}
+
+func (bdb *boltUserDB) GetTOTP(user *ls.User) (rec *ls.TOTPRecord, err error) {
+	err = bdb.db.View(func(tx *bolt.Tx) error {
+		rec, err = bdb.getTOTP(tx, user.Guid)
+		return err
+	})
+	return
+}
+
+func (bdb *boltUserDB) UseTOTPStep(user *ls.User, step int64) (ok bool, err error) {
+	err = bdb.db.Update(func(tx *bolt.Tx) error {
+		rec, err := bdb.getTOTP(tx, user.Guid)
+		if err != nil || rec == nil || rec.LastStep >= step {
+			return err
+		}
+		rec.LastStep = step
+		ok = true
+		return boltPut(tx.Bucket(boltUserTOTP), boltId(user.Guid), rec)
+	})
+	return ok && err == nil, err
+}
+
+func (bdb *boltUserDB) DelTOTP(user *ls.User) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserTOTP).Delete(boltId(user.Guid))
+	})
+}
+
+func (bdb *boltUserDB) AddWebAuthnCredential(user *ls.User, cred *ls.WebAuthnCredential) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUserWebAuthn)
+		if b.Get(cred.ID) != nil {
+			return fmt.Errorf("webauthn credential %x already added", cred.ID)
+		}
+		return boltPut(b, cred.ID, storedWebAuthn{user.Guid, *cred})
+	})
+}
+
+func (bdb *boltUserDB) ListWebAuthnCredentials(user *ls.User) ([]ls.WebAuthnCredential, error) {
+	out := make([]ls.WebAuthnCredential, 0)
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUserWebAuthn).ForEach(func(_, v []byte) error {
+			var sw storedWebAuthn
+			err := cbor.Loads(v, &sw)
+			if err == nil && sw.Guid == user.Guid {
+				out = append(out, sw.Cred)
+			}
+			return err
+		})
+	})
+	sortWebAuthnCredentials(out)
+	return out, err
+}
+
+func (bdb *boltUserDB) GetWebAuthnCredential(credID []byte) (*ls.User, *ls.WebAuthnCredential, error) {
+	var sw storedWebAuthn
+	var user *ls.User
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		blob := tx.Bucket(boltUserWebAuthn).Get(credID)
+		if blob == nil {
+			return ls.BadUserError
+		}
+		err := cbor.Loads(blob, &sw)
+		if err != nil {
+			return err
+		}
+		su, err := boltGetUser(tx, sw.Guid)
+		if err == nil {
+			user = su.user()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, &sw.Cred, nil
+}
+
+// Record a successful assertion
+func (bdb *boltUserDB) UseWebAuthnCredential(credID []byte, signCount int64) (ok bool, err error) {
+	err = bdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUserWebAuthn)
+		blob := b.Get(credID)
+		if blob == nil {
+			return nil
+		}
+		var sw storedWebAuthn
+		err := cbor.Loads(blob, &sw)
+		if err != nil || !signCountAfter(sw.Cred.SignCount, signCount) {
+			return err
+		}
+		sw.Cred.SignCount = signCount
+		sw.Cred.LastUsed = time.Now().Unix()
+		ok = true
+		return boltPut(b, credID, sw)
+	})
+	return ok && err == nil, err
+}
+
+func (bdb *boltUserDB) DelWebAuthnCredential(user *ls.User, credID []byte) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUserWebAuthn)
+		blob := b.Get(credID)
+		if blob == nil {
+			return nil
+		}
+		var sw storedWebAuthn
+		err := cbor.Loads(blob, &sw)
+		if err != nil || sw.Guid != user.Guid {
+			return err
+		}
+		return b.Delete(credID)
+	})
+}
+
+func (bdb *boltUserDB) PutWebAuthnChallenge(challenge []byte, expires int64) error {
+	now := time.Now().Unix()
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltWebAuthnChallenge)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if len(v) == 8 && int64(binary.BigEndian.Uint64(v)) < now {
+				expired = append(expired, copyBytes(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		return b.Put(challenge, boltId(expires))
+	})
+}
+
+func (bdb *boltUserDB) TakeWebAuthnChallenge(challenge []byte) (ok bool, err error) {
+	err = bdb.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltWebAuthnChallenge)
+		v := b.Get(challenge)
+		if v == nil {
+			return nil
+		}
+		ok = len(v) == 8 && int64(binary.BigEndian.Uint64(v)) >= time.Now().Unix()
+		return b.Delete(challenge)
+	})
+	return ok && err == nil, err
+}
+
+func (bdb *boltUserDB) getRecoveryCodes(tx *bolt.Tx, guid int64) ([][]byte, error) {
+	out := make([][]byte, 0)
+	blob := tx.Bucket(boltUserRecovery).Get(boltId(guid))
+	if blob == nil {
+		return out, nil
+	}
+	err := cbor.Loads(blob, &out)
+	return out, err
+}
+
+// Replace all of user's recovery codes
+func (bdb *boltUserDB) SetRecoveryCodes(user *ls.User, hashes [][]byte) error {
+	codes := make([][]byte, 0, len(hashes))
+	for _, hash := range hashes {
+		if !baInBas(codes, hash) {
+			codes = append(codes, hash)
+		}
+	}
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltUserRecovery), boltId(user.Guid), codes)
+	})
+}
+
+func (bdb *boltUserDB) GetRecoveryCodes(user *ls.User) (codes [][]byte, err error) {
+	err = bdb.db.View(func(tx *bolt.Tx) error {
+		codes, err = bdb.getRecoveryCodes(tx, user.Guid)
+		return err
+	})
+	return
+}
+
+// Use up a code. false if it was already used.
+func (bdb *boltUserDB) DelRecoveryCode(user *ls.User, hash []byte) (ok bool, err error) {
+	err = bdb.db.Update(func(tx *bolt.Tx) error {
+		codes, err := bdb.getRecoveryCodes(tx, user.Guid)
+		if err != nil {
+			return err
+		}
+		for i, code := range codes {
+			if bytes.Equal(code, hash) {
+				ok = true
+				codes = append(codes[:i], codes[i+1:]...)
+				return boltPut(tx.Bucket(boltUserRecovery), boltId(user.Guid), codes)
+			}
+		}
+		return nil
+	})
+	return ok && err == nil, err
+}
+
+func (bdb *boltUserDB) LogAuthEvent(ev *ls.AuthEvent) error {
+	return bdb.db.Update(func(tx *bolt.Tx) error {
+		return boltLogAuthEvent(tx, ev)
+	})
+}
+
+func boltLogAuthEvent(tx *bolt.Tx, ev *ls.AuthEvent) error {
+	b := tx.Bucket(boltAuthEvent)
+	key, err := boltTimeKey(b, ev.Time)
+	if err != nil {
+		return err
+	}
+	return boltPut(b, key, ev)
+}
+
+func (bdb *boltUserDB) GetAuthEvents(guid, start, end int64, limit int) ([]ls.AuthEvent, error) {
+	out := make([]ls.AuthEvent, 0)
+	err := bdb.db.View(func(tx *bolt.Tx) error {
+		return boltNewestFirst(tx.Bucket(boltAuthEvent), start, end, func(v []byte) (bool, error) {
+			var ev ls.AuthEvent
+			err := cbor.Loads(v, &ev)
+			if err != nil {
+				return false, err
+			}
+			if guid == 0 || ev.Guid == guid {
+				out = append(out, ev)
+			}
+			return limit <= 0 || len(out) < limit, nil
+		})
+	})
+	return out, err
+}
+
+// Delete a user's records and indexes
+func boltDeleteUser(tx *bolt.Tx, guid int64) error {
+	su, err := boltGetUser(tx, guid)
+	if err != nil {
+		return err
+	}
+	guidKey := boltId(guid)
+	err = tx.Bucket(boltGuser).Delete(guidKey)
+	if err != nil {
+		return err
+	}
+	if su.Username != "" {
+		err = tx.Bucket(boltGuserName).Delete([]byte(su.Username))
+		if err != nil {
+			return err
+		}
+	}
+	for _, skey := range su.Social {
+		err = tx.Bucket(boltUserSocial).Delete([]byte(skey))
+		if err != nil {
+			return err
+		}
+	}
+	for _, em := range su.Email {
+		err = tx.Bucket(boltUserEmail).Delete(boltEmailKey(em.Email, guid))
+		if err != nil {
+			return err
+		}
+	}
+	for _, name := range [][]byte{boltUserTOTP, boltUserRecovery, boltUserDisabled} {
+		err = tx.Bucket(name).Delete(guidKey)
+		if err != nil {
+			return err
+		}
+	}
+	err = boltDeleteMatching(tx.Bucket(boltUserAPIKey), func(v []byte) bool {
+		var sk storedAPIKey
+		return cbor.Loads(v, &sk) == nil && sk.Guid == guid
+	})
+	if err != nil {
+		return err
+	}
+	return boltDeleteMatching(tx.Bucket(boltUserWebAuthn), func(v []byte) bool {
+		var sw storedWebAuthn
+		return cbor.Loads(v, &sw) == nil && sw.Guid == guid
+	})
+}
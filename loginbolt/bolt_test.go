@@ -0,0 +1,163 @@
+package loginbolt_test
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	cbor "github.com/brianolson/cbor_go"
+	bolt "go.etcd.io/bbolt"
+
+	ls "github.com/brianolson/login/login/sql"
+	tu "github.com/brianolson/login/login/sql/testutil"
+	"github.com/brianolson/login/loginbolt"
+)
+
+func openBolt(t *testing.T, path string) ls.UserDB {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("bolt open %s, %v", path, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	udb := loginbolt.NewBoltUserDB(db)
+	err = udb.Setup()
+	if err != nil {
+		t.Fatalf("bolt setup, %v", err)
+	}
+	return udb
+}
+
+func TestBoltUserDBConformance(t *testing.T) {
+	tu.RunUserDBConformance(t, func(t *testing.T) ls.UserDB {
+		return openBolt(t, filepath.Join(t.TempDir(), "users.db"))
+	})
+}
+
+func TestBoltUserDBReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udb := loginbolt.NewBoltUserDB(db)
+	err = udb.Setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nu := &ls.User{Username: "kept", DisplayName: "Kept", Email: []ls.EmailRecord{ls.NewEmail("kept@example.com")}}
+	_, err = udb.PutNewUser(nu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	udb = openBolt(t, path)
+	xu, err := udb.GetLocalUser("kept")
+	if err != nil || xu.Guid != nu.Guid || xu.DisplayName != "Kept" || !xu.HasEmail("kept@example.com") {
+		t.Errorf("bad reopened user %#v %v", xu, err)
+	}
+	next := &ls.User{Username: "next"}
+	_, err = udb.PutNewUser(next)
+	if err != nil || next.Guid <= nu.Guid {
+		t.Errorf("reopened guid sequence gave %d after %d, %v", next.Guid, nu.Guid, err)
+	}
+}
+
+// Hooks run after commit, so they can use the UserDB without deadlock
+func TestBoltUserCreatedHook(t *testing.T) {
+	udb := openBolt(t, filepath.Join(t.TempDir(), "users.db"))
+	udb.Hooks().OnUserCreatedTx(func(tx *sql.Tx, user *ls.User) error {
+		xu, err := udb.GetUser(user.Guid)
+		if err != nil {
+			return err
+		}
+		if xu.Username == "vetoed" {
+			return errors.New("no")
+		}
+		return nil
+	})
+	var created []string
+	udb.Hooks().OnUserCreated(func(user *ls.User) {
+		created = append(created, user.Username)
+	})
+	_, err := udb.PutNewUser(&ls.User{Username: "kept"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = udb.PutNewUser(&ls.User{Username: "vetoed"})
+	if !errors.Is(err, ls.ErrVetoed) {
+		t.Errorf("expected veto, got %v", err)
+	}
+	_, err = udb.GetLocalUser("vetoed")
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("vetoed user still there, %v", err)
+	}
+	_, err = udb.PutNewUser(&ls.User{Username: "vetoed"})
+	if !errors.Is(err, ls.ErrVetoed) {
+		t.Errorf("username should be free again after veto, got %v", err)
+	}
+	if len(created) != 1 || created[0] != "kept" {
+		t.Errorf("created hook should only see kept, got %v", created)
+	}
+}
+
+// Addresses stored as given by older code are lower cased by Setup
+func TestBoltLowerStoredEmails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type oldEmail struct {
+		Email string
+		Data  []byte
+	}
+	type oldUser struct {
+		Guid     int64
+		Username string
+		Email    []oldEmail
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		users, err := tx.CreateBucketIfNotExists([]byte("guser"))
+		if err != nil {
+			return err
+		}
+		emails, err := tx.CreateBucketIfNotExists([]byte("user_email"))
+		if err != nil {
+			return err
+		}
+		guidKey := []byte{0, 0, 0, 0, 0, 0, 0, 1}
+		ou := oldUser{Guid: 1, Username: "oldtimer"}
+		for _, email := range []string{"Old@Example.com", "Two@Example.com", "two@example.com"} {
+			ou.Email = append(ou.Email, oldEmail{Email: email})
+			err = emails.Put(append([]byte(email+"\x00"), guidKey...), nil)
+			if err != nil {
+				return err
+			}
+		}
+		blob, err := cbor.Dumps(ou)
+		if err != nil {
+			return err
+		}
+		err = users.SetSequence(1)
+		if err != nil {
+			return err
+		}
+		return users.Put(guidKey, blob)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	udb := openBolt(t, path)
+	xu, err := udb.GetEmailUser("OLD@example.com", false)
+	if err != nil || xu.Guid != 1 || len(xu.Email) != 2 || !xu.HasEmail("old@example.com") || !xu.HasEmail("two@example.com") {
+		t.Errorf("old email user %#v, %v", xu, err)
+	}
+	_, err = udb.PutNewUser(&ls.User{Username: "newcomer", Email: []ls.EmailRecord{ls.NewEmail("Two@example.com")}})
+	if !errors.Is(err, ls.ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken for old address, got %v", err)
+	}
+}
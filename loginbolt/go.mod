@@ -0,0 +1,11 @@
+module github.com/brianolson/login/loginbolt
+
+go 1.16
+
+require (
+	github.com/brianolson/cbor_go v1.0.0
+	github.com/brianolson/login/login v0.0.0
+	go.etcd.io/bbolt v1.3.5
+)
+
+replace github.com/brianolson/login/login => ../login
@@ -0,0 +1,161 @@
+package loginbolt
+
+import (
+	"bytes"
+	"log"
+	"sort"
+	"time"
+
+	cbor "github.com/brianolson/cbor_go"
+
+	ls "github.com/brianolson/login/login/sql"
+)
+
+// A guser row with its user_social and user_email rows. Prefs and email
+// data are cbor as in the SQL tables, so every User read out is a fresh
+// copy.
+type storedUser struct {
+	Guid     int64
+	Username string
+	Password []byte
+	Prefs    []byte   // ls.PrefsBlob
+	Social   []string // ls.SocialKey()
+	Email    []storedEmail
+	Created  int64
+}
+
+type storedEmail struct {
+	Email string
+	Data  []byte // ls.EmailMetadata
+}
+
+type storedAPIKey struct {
+	Hash []byte // ls.APIKeyHash()
+	Guid int64
+	Key  ls.APIKey
+}
+
+type storedWebAuthn struct {
+	Guid int64
+	Cred ls.WebAuthnCredential
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+func prefsBlob(user *ls.User) ([]byte, error) {
+	return cbor.Dumps(ls.PrefsBlob{DisplayName: user.DisplayName, Data: user.Data})
+}
+
+func (su *storedUser) user() *ls.User {
+	u := &ls.User{
+		Guid:     su.Guid,
+		Username: su.Username,
+		Password: copyBytes(su.Password),
+		Created:  su.Created,
+		Email:    make([]ls.EmailRecord, 0, len(su.Email)),
+		Social:   make([]ls.UserSocial, 0, len(su.Social)),
+	}
+	for _, em := range su.Email {
+		ne := ls.EmailRecord{Email: em.Email}
+		if len(em.Data) > 0 {
+			cbor.Loads(em.Data, &ne.EmailMetadata)
+		}
+		u.Email = append(u.Email, ne)
+	}
+	for _, skey := range su.Social {
+		service, sid := ls.ParseSocialKey([]byte(skey))
+		u.Social = append(u.Social, ls.UserSocial{Service: service, Id: sid})
+	}
+	if len(su.Prefs) > 0 {
+		var uprefs ls.PrefsBlob
+		err := cbor.Loads(su.Prefs, &uprefs)
+		if err == nil {
+			u.DisplayName = uprefs.DisplayName
+			u.Data = uprefs.Data
+		} else {
+			log.Print("bad prefs cbor", err)
+		}
+	}
+	return u
+}
+
+func (su *storedUser) hasEmail(email string) bool {
+	for _, em := range su.Email {
+		if em.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+func changeEvent(guid int64, etype, method, detail string) *ls.AuthEvent {
+	return &ls.AuthEvent{Time: time.Now().Unix(), Guid: guid, Type: etype, Method: method, Detail: detail}
+}
+
+func socialLinkedEvent(guid int64, si ls.UserSocial) *ls.AuthEvent {
+	return changeEvent(guid, ls.EventSocialLinked, si.Service, si.Id)
+}
+
+// As UseWebAuthnCredential's SQL: counters go up, or stay 0 on
+// authenticators without one
+func signCountAfter(old, next int64) bool {
+	return old < next || (old == 0 && next == 0)
+}
+
+// ORDER BY created
+func sortAPIKeys(keys []ls.APIKey) {
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+}
+
+func sortWebAuthnCredentials(creds []ls.WebAuthnCredential) {
+	sort.SliceStable(creds, func(i, j int) bool { return creds[i].Created < creds[j].Created })
+}
+
+func strInStrs(they []string, it string) bool {
+	for _, xs := range they {
+		if xs == it {
+			return true
+		}
+	}
+	return false
+}
+
+// ls.NormalizeEmail each address. Of those that become the same the one
+// already lower case is kept, else the first by byte order, as SQL
+// migration 6.
+func lowerEmails(emails []storedEmail) []storedEmail {
+	out := make([]storedEmail, 0, len(emails))
+	orig := make([]string, 0, len(emails))
+	for _, em := range emails {
+		norm := ls.NormalizeEmail(em.Email)
+		i := 0
+		for i < len(out) && out[i].Email != norm {
+			i++
+		}
+		if i == len(out) {
+			orig = append(orig, em.Email)
+			em.Email = norm
+			out = append(out, em)
+			continue
+		}
+		if orig[i] != norm && (em.Email == norm || em.Email < orig[i]) {
+			orig[i] = em.Email
+			out[i] = storedEmail{norm, em.Data}
+		}
+	}
+	return out
+}
+
+func baInBas(they [][]byte, it []byte) bool {
+	for _, xs := range they {
+		if bytes.Equal(xs, it) {
+			return true
+		}
+	}
+	return false
+}
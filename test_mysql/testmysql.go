@@ -0,0 +1,30 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"reflect"
+
+	_ "github.com/go-sql-driver/mysql"
+
+	tu "github.com/brianolson/login/login/sql/testutil"
+)
+
+var maybefail = tu.Maybefail
+
+func main() {
+	var mysqlConnectString string
+	flag.StringVar(&mysqlConnectString, "mysql", "", "connection string for mysql")
+	flag.Parse()
+	db, err := sql.Open("mysql", mysqlConnectString)
+	maybefail(err, "error opening mysql db, %v", err)
+	driver := db.Driver()
+	fmt.Printf("driver\nT %T\nv %v\nv# %#v\n", driver, driver, driver)
+	t := reflect.TypeOf(driver)
+	fmt.Printf("TypeOf(driver).Name() = %#v\n", t.Name())
+	fmt.Printf("TypeOf(driver).String() = %#v\n", t.String())
+	if t.Kind() == reflect.Ptr {
+		fmt.Printf("Elem.Name %#v\n", t.Elem().Name())
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gms "github.com/dolthub/go-mysql-server"
+	"github.com/dolthub/go-mysql-server/memory"
+	"github.com/dolthub/go-mysql-server/server"
+	gmssql "github.com/dolthub/go-mysql-server/sql"
+	_ "github.com/go-sql-driver/mysql"
+
+	ls "github.com/brianolson/login/login/sql"
+	tu "github.com/brianolson/login/login/sql/testutil"
+)
+
+var tdb *sql.DB
+var udb ls.UserDB
+var tdbLock sync.Mutex
+
+// tests are running against embeddedMysql()
+var embedded bool
+
+var mtfail = tu.Mtfail
+var userDeepEqual = tu.UserDeepEqual
+
+// Start an in-process go-mysql-server, returns its connection string
+func embeddedMysql() string {
+	mdb := memory.NewDatabase("logintest")
+	mdb.EnablePrimaryKeyIndexes()
+	provider := memory.NewDBProvider(mdb)
+	engine := gms.NewDefault(provider)
+	config := server.Config{Protocol: "tcp", Address: "127.0.0.1:0"}
+	srv, err := server.NewServer(config, engine, gmssql.NewContext, memory.NewSessionBuilder(provider), nil)
+	maybefail(err, "error starting embedded mysql, %v", err)
+	go srv.Start()
+	return "root@tcp(" + srv.Listener.Addr().String() + ")/logintest"
+}
+
+func TestMain(m *testing.M) {
+	var mysqlConnectString string
+	flag.StringVar(&mysqlConnectString, "mysql", "", "connection string for mysql, default in-process go-mysql-server")
+	flag.Parse()
+	if mysqlConnectString == "" {
+		mysqlConnectString = embeddedMysql()
+		embedded = true
+	}
+	db, err := sql.Open("mysql", mysqlConnectString)
+	maybefail(err, "error opening mysql db, %v", err)
+
+	udb = ls.NewSqlUserDB(db)
+
+	err = udb.Setup()
+	maybefail(err, "error creating tables, %v", err)
+
+	tdb = db
+
+	os.Exit(m.Run())
+}
+
+func TestBasicUser(t *testing.T) {
+	newUser := ls.User{
+		Username: "wat",
+
+		Social: []ls.UserSocial{
+			ls.UserSocial{Service: "z", Id: "alice"},
+			ls.UserSocial{Service: "y", Id: "artemis"},
+		},
+
+		Email: []ls.EmailRecord{
+			ls.EmailRecord{Email: "z@z.z", EmailMetadata: ls.EmailMetadata{Validated: true, Added: 31337}},
+			ls.EmailRecord{Email: "y@y.y", EmailMetadata: ls.EmailMetadata{Validated: false, Added: 12345}},
+		},
+	}
+	err := newUser.SetPassword("derp")
+	mtfail(t, err, "set password, %v", err)
+	tdbLock.Lock()
+	defer tdbLock.Unlock()
+	xu, err := udb.PutNewUser(&newUser)
+	mtfail(t, err, "put user, %v", err)
+	if xu.Guid == 0 {
+		t.Error("xu.Guid zero")
+	}
+	tu, err := udb.GetUser(xu.Guid)
+	mtfail(t, err, "get user %d, %v", xu.Guid, err)
+	err = userDeepEqual(newUser, *tu)
+	mtfail(t, err, "get user guid neq, %v", err)
+
+	tu, err = udb.GetLocalUser("wat")
+	mtfail(t, err, "get user name=%s, %v", "wat", err)
+	err = userDeepEqual(newUser, *tu)
+	mtfail(t, err, "get user wat neq, %v", err)
+
+	tu, err = udb.GetSocialUser("z", "alice")
+	mtfail(t, err, "get user z:alice, %v", err)
+	err = userDeepEqual(newUser, *tu)
+	mtfail(t, err, "get user z:alice neq, %v", err)
+
+	if !tu.GoodPassword("derp") {
+		t.Error("password did not round trip")
+	}
+	_, err = udb.PutNewUser(&ls.User{Username: "wat"})
+	if !errors.Is(err, ls.ErrUsernameTaken) {
+		t.Errorf("expected ErrUsernameTaken, got %v", err)
+	}
+	_, err = udb.PutNewUser(&ls.User{Social: []ls.UserSocial{{Service: "z", Id: "alice"}}})
+	if !errors.Is(err, ls.ErrSocialTaken) {
+		t.Errorf("expected ErrSocialTaken, got %v", err)
+	}
+	_, err = udb.PutNewUser(&ls.User{Username: "other", Email: []ls.EmailRecord{ls.NewEmail("z@z.z")}})
+	if !errors.Is(err, ls.ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken, got %v", err)
+	}
+	_, err = udb.GetUser(xu.Guid + 1000)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("expected BadUserError, got %v", err)
+	}
+}
+
+func TestUserUpdates(t *testing.T) {
+	nu := &ls.User{Username: "changer", DisplayName: "Before"}
+	_, err := udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	nu.DisplayName = "After"
+	nu.Data = map[string]interface{}{"k": "v"}
+	err = udb.SetUserPrefs(nu)
+	mtfail(t, err, "set prefs, %v", err)
+	err = nu.SetPassword("new-password")
+	mtfail(t, err, "set password, %v", err)
+	err = udb.SetUserPassword(nu)
+	mtfail(t, err, "set user password, %v", err)
+	err = udb.AddEmail(nu, ls.NewEmail("changer@example.com"))
+	mtfail(t, err, "add email, %v", err)
+	xu, err := udb.GetUser(nu.Guid)
+	mtfail(t, err, "get user, %v", err)
+	if xu.DisplayName != "After" || xu.Data["k"] != "v" || !xu.HasEmail("changer@example.com") {
+		t.Errorf("updates not stored %#v", xu)
+	}
+	if !xu.GoodPassword("new-password") {
+		t.Error("new password not stored")
+	}
+	err = udb.DelEmail(nu, "changer@example.com")
+	mtfail(t, err, "del email, %v", err)
+	xu, err = udb.GetUser(nu.Guid)
+	mtfail(t, err, "get user, %v", err)
+	if len(xu.Email) != 0 {
+		t.Errorf("email not deleted %#v", xu.Email)
+	}
+
+	err = udb.DisableUser(nu, "testing")
+	mtfail(t, err, "disable, %v", err)
+	disabled, reason, err := udb.GetDisabled(nu)
+	mtfail(t, err, "get disabled, %v", err)
+	if !disabled || reason != "testing" {
+		t.Errorf("expected disabled for testing, got %v %q", disabled, reason)
+	}
+	err = udb.DeleteUser(nu)
+	mtfail(t, err, "delete, %v", err)
+	_, err = udb.GetUser(nu.Guid)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("deleted user: expected BadUserError, got %v", err)
+	}
+	err = udb.DeleteUser(nu)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("delete again: expected BadUserError, got %v", err)
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	nu := &ls.User{Username: "creds"}
+	_, err := udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	key, _, err := udb.CreateAPIKey(nu, "laptop", []string{"read"})
+	mtfail(t, err, "api key, %v", err)
+	ku, ak, err := udb.GetAPIKeyUser(key)
+	mtfail(t, err, "api key user, %v", err)
+	if ku == nil || ku.Guid != nu.Guid || ak.Name != "laptop" {
+		t.Errorf("bad api key user %#v %#v", ku, ak)
+	}
+
+	err = udb.PutTOTP(nu, &ls.TOTPRecord{Secret: []byte("sealed"), Enabled: true, LastStep: 10})
+	mtfail(t, err, "put totp, %v", err)
+	ok, err := udb.UseTOTPStep(nu, 10)
+	mtfail(t, err, "use step, %v", err)
+	if ok {
+		t.Error("replayed TOTP step accepted")
+	}
+	ok, err = udb.UseTOTPStep(nu, 11)
+	mtfail(t, err, "use step, %v", err)
+	if !ok {
+		t.Error("new TOTP step rejected")
+	}
+	rec, err := udb.GetTOTP(nu)
+	mtfail(t, err, "get totp, %v", err)
+	if rec == nil || !rec.Enabled || rec.LastStep != 11 {
+		t.Errorf("bad totp %#v", rec)
+	}
+
+	credID := []byte{1, 2, 3, 4}
+	err = udb.AddWebAuthnCredential(nu, &ls.WebAuthnCredential{ID: credID, PublicKey: []byte("cose"), Name: "key", Created: 1})
+	mtfail(t, err, "add webauthn, %v", err)
+	cu, cred, err := udb.GetWebAuthnCredential(credID)
+	mtfail(t, err, "get webauthn, %v", err)
+	if cu == nil || cu.Guid != nu.Guid || !bytes.Equal(cred.PublicKey, []byte("cose")) {
+		t.Errorf("bad webauthn credential %#v %#v", cu, cred)
+	}
+
+	err = udb.SetRecoveryCodes(nu, [][]byte{[]byte("a"), []byte("b")})
+	mtfail(t, err, "set recovery, %v", err)
+	ok, err = udb.DelRecoveryCode(nu, []byte("a"))
+	mtfail(t, err, "del recovery, %v", err)
+	if !ok {
+		t.Error("recovery code not found")
+	}
+	codes, err := udb.GetRecoveryCodes(nu)
+	mtfail(t, err, "get recovery, %v", err)
+	if len(codes) != 1 {
+		t.Errorf("expected 1 recovery code, got %d", len(codes))
+	}
+}
+
+func TestLogs(t *testing.T) {
+	nu := &ls.User{Username: "logger"}
+	_, err := udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	for i, etype := range []string{ls.EventLoginSuccess, ls.EventLogout} {
+		err = udb.LogAuthEvent(&ls.AuthEvent{Time: 100 + int64(i), Guid: nu.Guid, Type: etype})
+		mtfail(t, err, "log event, %v", err)
+	}
+	events, err := udb.GetAuthEvents(nu.Guid, 0, 0, 1)
+	mtfail(t, err, "get events, %v", err)
+	if len(events) != 1 || events[0].Type != ls.EventLogout {
+		t.Errorf("bad events %#v", events)
+	}
+
+	for i, msg := range []string{"one", "two", "three"} {
+		err = udb.Feedback(nu, 1000+int64(i), msg)
+		mtfail(t, err, "feedback, %v", err)
+	}
+	fb, err := udb.ListFeedback(nu.Guid, 0, 0, 1, 1)
+	mtfail(t, err, "list feedback, %v", err)
+	if len(fb) != 1 || fb[0].Msg != "two" {
+		t.Errorf("bad feedback page %#v", fb)
+	}
+
+	ts := ls.NewSqlThrottleStore(tdb)
+	now := time.Now().Unix()
+	for i := 1; i <= 2; i++ {
+		n, err := ts.Fail("u:logger", now, now-60)
+		mtfail(t, err, "throttle fail, %v", err)
+		if n != i {
+			t.Errorf("throttle count %d, wanted %d", n, i)
+		}
+	}
+	err = ts.Reset("u:logger")
+	mtfail(t, err, "throttle reset, %v", err)
+
+	wo := ls.NewSqlWebhookOutbox(tdb)
+	err = wo.Enqueue(nil, &ls.WebhookDelivery{URL: "http://example.com/", Event: "user.created", Body: []byte("{}"), Created: now})
+	mtfail(t, err, "enqueue, %v", err)
+	due, err := wo.ClaimDue(now, now+60, 10)
+	mtfail(t, err, "claim, %v", err)
+	if len(due) != 1 || due[0].Event != "user.created" {
+		t.Fatalf("bad claimed deliveries %#v", due)
+	}
+	err = wo.Delivered(due[0].Id)
+	mtfail(t, err, "delivered, %v", err)
+}
+
+func TestDialect(t *testing.T) {
+	if name := ls.DetectDialect(tdb).Name(); name != "mysql" {
+		t.Errorf("go-sql-driver/mysql detected as %s", name)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	tu.RunUserDBConformance(t, func(t *testing.T) ls.UserDB {
+		if embedded && strings.Contains(t.Name(), "/Concurrent") {
+			t.Skip("go-mysql-server memory tables don't isolate concurrent transactions, use -mysql")
+		}
+		return udb
+	})
+}
+
+// As if step 4 failed after its ALTER committed: Setup runs it again
+func TestMigrateRepeatsPartialStep(t *testing.T) {
+	version, err := ls.SchemaVersion(tdb)
+	mtfail(t, err, "version, %v", err)
+	_, err = tdb.Exec(`DELETE FROM schema_version WHERE version >= 4`)
+	mtfail(t, err, "delete versions, %v", err)
+	err = udb.Setup()
+	mtfail(t, err, "migrate again, %v", err)
+	again, err := ls.SchemaVersion(tdb)
+	if err != nil || again != version {
+		t.Errorf("version %d after repeating steps, wanted %d, %v", again, version, err)
+	}
+}
+
+// Migration 6 on addresses stored as given by older code
+func TestLowerStoredEmails(t *testing.T) {
+	const guid = 990001
+	defer tdb.Exec(`DELETE FROM user_email WHERE id = ?`, guid)
+	for _, email := range []string{"Old@Example.com", "Two@Example.com", "two@example.com", "THREE@example.com", "Three@Example.com"} {
+		// a case insensitive collation refuses the second of a pair
+		tdb.Exec(`INSERT INTO user_email (id, email) VALUES (?, ?)`, guid, email)
+	}
+	_, err := tdb.Exec(`DELETE FROM schema_version WHERE version >= 6`)
+	mtfail(t, err, "delete version, %v", err)
+	err = udb.Setup()
+	mtfail(t, err, "migrate, %v", err)
+
+	rows, err := tdb.Query(`SELECT email FROM user_email WHERE id = ? ORDER BY email`, guid)
+	mtfail(t, err, "emails, %v", err)
+	var emails []string
+	for rows.Next() {
+		var email string
+		err = rows.Scan(&email)
+		mtfail(t, err, "scan, %v", err)
+		emails = append(emails, email)
+	}
+	rows.Close()
+	if strings.Join(emails, " ") != "old@example.com three@example.com two@example.com" {
+		t.Errorf("emails not lower cased: %v", emails)
+	}
+}
@@ -77,3 +77,9 @@ func TestBasicUser(t *testing.T) {
 	err = userDeepEqual(newUser, *tu)
 	mtfail(t, err, "get user z:alice neq, %v", err)
 }
+
+func TestConformance(t *testing.T) {
+	tu.RunUserDBConformance(t, func(t *testing.T) ls.UserDB {
+		return udb
+	})
+}
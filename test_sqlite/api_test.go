@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestJSONLoginMe(t *testing.T) {
+	name := uniqueName("jason")
+	nu := &ls.User{
+		Username: name,
+		Social:   []ls.UserSocial{{Service: "x", Id: name}},
+		Email:    []ls.EmailRecord{ls.NewEmail(name + "@example.com")},
+	}
+	err := nu.SetPassword("argonauts")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	req := httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"`+name+`","password":"nope"}`))
+	rec := httptest.NewRecorder()
+	lh.ServeHTTP(rec, req)
+	var je login.JSONError
+	json.Unmarshal(rec.Body.Bytes(), &je)
+	if rec.Code != 401 || je.Code != "bad_credentials" {
+		t.Errorf("bad password: expected 401 bad_credentials, got %d %#v", rec.Code, je)
+	}
+
+	req = httptest.NewRequest("POST", "/api/login", strings.NewReader(`{"username":"`+name+`","password":"argonauts"}`))
+	rec = httptest.NewRecorder()
+	lh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	mh := &login.JSONMeHandler{Udb: udb}
+	req = httptest.NewRequest("GET", "/api/me", nil)
+	rec = httptest.NewRecorder()
+	mh.ServeHTTP(rec, req)
+	if rec.Code != 401 {
+		t.Errorf("me without cookie expected 401, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/api/me", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	mh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("me status %d: %s", rec.Code, rec.Body.String())
+	}
+	var ui login.UserInfo
+	err = json.Unmarshal(rec.Body.Bytes(), &ui)
+	mtfail(t, err, "me json, %v", err)
+	if ui.Guid != nu.Guid || len(ui.Emails) != 1 || len(ui.Services) != 1 || ui.Services[0].Service != "x" {
+		t.Errorf("unexpected me %#v", ui)
+	}
+	if strings.Contains(rec.Body.String(), "assword") {
+		t.Errorf("me leaks password: %s", rec.Body.String())
+	}
+
+	req = httptest.NewRequest("POST", "/api/logout", nil)
+	rec = httptest.NewRecorder()
+	login.JSONLogoutHandler(rec, req)
+	cleared := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "u" && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("logout did not clear cookie")
+	}
+}
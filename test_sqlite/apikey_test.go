@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestAPIKey(t *testing.T) {
+	name := uniqueName("robot")
+	nu := &ls.User{Username: name}
+	_, err := udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	key, ak, err := udb.CreateAPIKey(nu, "ci", []string{"read"})
+	mtfail(t, err, "create key, %v", err)
+	if !ls.IsAPIKey(key) || ak.Prefix == "" || key[:len(ak.Prefix)] != ak.Prefix {
+		t.Errorf("bad key %#v %#v", key, ak)
+	}
+
+	keys, err := udb.ListAPIKeys(nu)
+	mtfail(t, err, "list keys, %v", err)
+	if len(keys) != 1 || keys[0].Name != "ci" || !keys[0].HasScope("read") {
+		t.Errorf("bad key list %#v", keys)
+	}
+
+	var seen *login.User
+	var canWrite bool
+	h := login.APIKeyMiddleware(udb, http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		seen = login.UserFromContext(request.Context())
+		canWrite = login.HasScope(request.Context(), "write")
+	}))
+	req := httptest.NewRequest("GET", "/api/thing", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen == nil || seen.Guid != nu.Guid || canWrite {
+		t.Errorf("middleware user %#v write=%v", seen, canWrite)
+	}
+
+	// the lookup runs in the request's context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	seen = nil
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req.WithContext(ctx))
+	if seen != nil || rec.Code != 500 {
+		t.Errorf("canceled request: code %d user %#v", rec.Code, seen)
+	}
+
+	// raw key must not work as a full login
+	xu, _ := login.GetHttpUser(rec, req, udb)
+	if xu != nil {
+		t.Error("api key accepted by GetHttpUser")
+	}
+
+	err = udb.RevokeAPIKey(nu, ak.Prefix)
+	mtfail(t, err, "revoke, %v", err)
+	seen = nil
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen != nil || rec.Code != 401 {
+		t.Errorf("revoked key: code %d user %#v", rec.Code, seen)
+	}
+}
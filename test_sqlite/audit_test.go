@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestAuthEvents(t *testing.T) {
+	name := uniqueName("auditee")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("watched")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	start := time.Now().Unix()
+	lh := &login.JSONLoginHandler{Udb: udb}
+	rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"wrong"}`, nil)
+	if rec.Code != 401 {
+		t.Fatalf("bad login status %d", rec.Code)
+	}
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"watched"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	login.LogoutUdb = udb
+	defer func() { login.LogoutUdb = nil }()
+	req := httptest.NewRequest("POST", "/api/logout", nil)
+	req.Header.Set("User-Agent", "audit-test")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	login.JSONLogoutHandler(rec, req)
+
+	events, err := udb.GetAuthEvents(nu.Guid, start, 0, 0)
+	mtfail(t, err, "get events, %v", err)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %#v", events)
+	}
+	// newest first
+	expected := []string{login.EventLogout, login.EventLoginSuccess, login.EventLoginFailure}
+	for i, ev := range events {
+		if ev.Type != expected[i] {
+			t.Errorf("event %d type %s, wanted %s", i, ev.Type, expected[i])
+		}
+	}
+	if events[0].UserAgent != "audit-test" || events[0].IP != "192.0.2.1" {
+		t.Errorf("unexpected logout event %#v", events[0])
+	}
+	if events[2].Method != "password" || events[2].Detail != name {
+		t.Errorf("unexpected failure event %#v", events[2])
+	}
+
+	events, err = udb.GetAuthEvents(nu.Guid, start, start+3600, 1)
+	mtfail(t, err, "get events, %v", err)
+	if len(events) != 1 || events[0].Type != login.EventLogout {
+		t.Errorf("limit 1: %#v", events)
+	}
+	events, err = udb.GetAuthEvents(nu.Guid, 0, start, 0)
+	mtfail(t, err, "get events, %v", err)
+	if len(events) != 0 {
+		t.Errorf("expected no events before start, got %#v", events)
+	}
+
+	ah := &login.AuthEventsHandler{Udb: udb}
+	req = httptest.NewRequest("GET", "/api/activity?limit=2", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	ah.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("activity status %d: %s", rec.Code, rec.Body.String())
+	}
+	var infos []login.AuthEventInfo
+	err = json.Unmarshal(rec.Body.Bytes(), &infos)
+	mtfail(t, err, "activity json, %v", err)
+	if len(infos) != 2 || infos[1].Type != login.EventLoginSuccess {
+		t.Errorf("unexpected activity %#v", infos)
+	}
+}
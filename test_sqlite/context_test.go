@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+	tu "github.com/brianolson/login/login/sql/testutil"
+)
+
+func TestUserDBContext(t *testing.T) {
+	name := uniqueName("contextual")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("deadline")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	cdb := ls.NewSqlUserDBContext(tdb)
+	xu, err := cdb.GetUser(context.Background(), nu.Guid)
+	if err != nil || xu == nil || xu.Username != name {
+		t.Errorf("context get user %#v %v", xu, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	xu, err = cdb.GetLocalUser(ctx, name)
+	if !errors.Is(err, context.Canceled) || xu != nil {
+		t.Errorf("canceled get user %#v %v", xu, err)
+	}
+	err = cdb.SetUserPrefs(ctx, nu)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled set prefs %v", err)
+	}
+	_, err = ls.BindUserDB(ctx, cdb).GetUser(nu.Guid)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled bound get user %v", err)
+	}
+
+	// a client that has gone away gets no user
+	req := httptest.NewRequest("POST", "/login", nil)
+	req.Form = map[string][]string{"username": {name}, "password": {"deadline"}}
+	req = req.WithContext(ctx)
+	xu, err = login.GetHttpUser(httptest.NewRecorder(), req, udb)
+	if xu != nil || !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled request got user %#v %v", xu, err)
+	}
+}
+
+func TestConformanceContext(t *testing.T) {
+	// the plain UserDB methods through both adapters
+	tu.RunUserDBConformance(t, func(t *testing.T) ls.UserDB {
+		cdb := ls.BackgroundUserDB(ls.NewSqlUserDBContext(conformanceDB(t)))
+		err := cdb.Setup()
+		mtfail(t, err, "error creating tables, %v", err)
+		return cdb
+	})
+}
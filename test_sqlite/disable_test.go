@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestDisableDeleteUser(t *testing.T) {
+	name := uniqueName("badactor")
+	nu := &ls.User{
+		Username: name,
+		Social:   []ls.UserSocial{{Service: "x", Id: name}},
+		Email:    []ls.EmailRecord{ls.NewEmail(name + "@example.com")},
+	}
+	err := nu.SetPassword("misdeeds")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	key, _, err := udb.CreateAPIKey(nu, "k", []string{"read"})
+	mtfail(t, err, "api key, %v", err)
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"misdeeds"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+	rec = postJSON(&login.TokenHandler{Udb: udb}, "/api/token", `{"username":"`+name+`","password":"misdeeds"}`, nil)
+	var tr login.TokenResponse
+	json.Unmarshal(rec.Body.Bytes(), &tr)
+
+	err = udb.DisableUser(nu, "spam")
+	mtfail(t, err, "disable, %v", err)
+	disabled, reason, err := udb.GetDisabled(nu)
+	mtfail(t, err, "get disabled, %v", err)
+	if !disabled || reason != "spam" {
+		t.Errorf("expected disabled for spam, got %v %#v", disabled, reason)
+	}
+
+	// cookie
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	xu, err := login.GetHttpUser(httptest.NewRecorder(), req, udb)
+	if xu != nil || !errors.Is(err, login.ErrUserDisabled) {
+		t.Errorf("cookie: expected ErrUserDisabled, got %v %v", xu, err)
+	}
+	// bearer token
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+	xu, err = login.GetHttpUser(httptest.NewRecorder(), req, udb)
+	if xu != nil || !errors.Is(err, login.ErrUserDisabled) {
+		t.Errorf("bearer: expected ErrUserDisabled, got %v %v", xu, err)
+	}
+	// password
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"misdeeds"}`, nil)
+	if rec.Code != 403 || jsonErrorCode(rec) != "disabled" {
+		t.Errorf("login: expected 403 disabled, got %d %s", rec.Code, rec.Body.String())
+	}
+	// api key
+	called := false
+	mw := login.APIKeyMiddleware(udb, http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		called = true
+	}))
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec = httptest.NewRecorder()
+	mw.ServeHTTP(rec, req)
+	if called || rec.Code != 403 {
+		t.Errorf("api key: expected 403, got %d", rec.Code)
+	}
+
+	err = udb.EnableUser(nu)
+	mtfail(t, err, "enable, %v", err)
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"misdeeds"}`, nil)
+	if rec.Code != 200 {
+		t.Errorf("login after enable: %d %s", rec.Code, rec.Body.String())
+	}
+
+	err = udb.DeleteUser(nu)
+	mtfail(t, err, "delete, %v", err)
+	_, err = udb.GetUser(nu.Guid)
+	if err != ls.BadUserError {
+		t.Errorf("deleted user GetUser: %v", err)
+	}
+	ou, _ := udb.GetSocialUser("x", name)
+	if ou != nil {
+		t.Error("deleted user social login remains")
+	}
+	_, _, err = udb.GetAPIKeyUser(key)
+	if !errors.Is(err, ls.BadUserError) {
+		t.Errorf("deleted user api key: %v", err)
+	}
+	err = udb.DeleteUser(nu)
+	if err != ls.BadUserError {
+		t.Errorf("second delete: expected BadUserError, got %v", err)
+	}
+
+	// email is free for a new user
+	nu2 := &ls.User{Username: uniqueName("goodactor"), Email: []ls.EmailRecord{ls.NewEmail(name + "@example.com")}}
+	_, err = udb.PutNewUser(nu2)
+	mtfail(t, err, "reuse email, %v", err)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestExportUser(t *testing.T) {
+	name := uniqueName("exporter")
+	nu := &ls.User{
+		Username:    name,
+		DisplayName: "Ex Porter",
+		Social:      []ls.UserSocial{{Service: "x", Id: name}},
+		Email:       []ls.EmailRecord{ls.NewEmail(name + "@example.com")},
+		Data:        map[string]interface{}{"theme": "dark", "nested": map[string]interface{}{"a": 1}},
+	}
+	err := nu.SetPassword("sekrit-password")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	_, _, err = udb.CreateAPIKey(nu, "laptop", []string{"read"})
+	mtfail(t, err, "api key, %v", err)
+
+	rec := postJSON(&login.JSONLoginHandler{Udb: udb}, "/api/login", `{"username":"`+name+`","password":"sekrit-password"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	eh := &login.ExportHandler{Udb: udb}
+	req := httptest.NewRequest("GET", "/api/export", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	eh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("export status %d: %s", rec.Code, rec.Body.String())
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Disposition"), "attachment") {
+		t.Error("export not an attachment")
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "sekrit") || strings.Contains(body, "$2a$") {
+		t.Errorf("export leaks password: %s", body)
+	}
+	var ex login.UserExport
+	err = json.Unmarshal(rec.Body.Bytes(), &ex)
+	mtfail(t, err, "export json, %v", err)
+	if ex.Guid != nu.Guid || ex.Username != name || ex.DisplayName != "Ex Porter" || !ex.HasPassword {
+		t.Errorf("bad export user %#v", ex)
+	}
+	if ex.Data["theme"] != "dark" {
+		t.Errorf("bad export data %#v", ex.Data)
+	}
+	if len(ex.Emails) != 1 || ex.Emails[0].Email != name+"@example.com" || len(ex.Social) != 1 || ex.Social[0].Id != name {
+		t.Errorf("bad export emails/social %#v %#v", ex.Emails, ex.Social)
+	}
+	if len(ex.Sessions.APIKeys) != 1 || ex.Sessions.APIKeys[0].Name != "laptop" {
+		t.Errorf("bad export api keys %#v", ex.Sessions)
+	}
+	if len(ex.Events) == 0 || ex.Events[0].Type != login.EventLoginSuccess {
+		t.Errorf("bad export events %#v", ex.Events)
+	}
+
+	rec = httptest.NewRecorder()
+	eh.ServeHTTP(rec, httptest.NewRequest("GET", "/api/export", nil))
+	if rec.Code != 401 {
+		t.Errorf("export without login: expected 401, got %d", rec.Code)
+	}
+
+	// disabled users can't log in but can still take their data
+	err = udb.DisableUser(nu, "leaving")
+	mtfail(t, err, "disable, %v", err)
+	rec = httptest.NewRecorder()
+	eh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("disabled export status %d: %s", rec.Code, rec.Body.String())
+	}
+	ex = login.UserExport{}
+	err = json.Unmarshal(rec.Body.Bytes(), &ex)
+	mtfail(t, err, "export json, %v", err)
+	if ex.Guid != nu.Guid {
+		t.Errorf("disabled export got user %d, wanted %d", ex.Guid, nu.Guid)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestFeedback(t *testing.T) {
+	name := uniqueName("critic")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("constructive")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	other := &ls.User{Username: uniqueName("bystander")}
+	_, err = udb.PutNewUser(other)
+	mtfail(t, err, "put user, %v", err)
+
+	// times of our own, feedback from other tests' runs is still there
+	base := nu.Guid * 1000
+	for i, msg := range []string{"first", "second", "third"} {
+		err = udb.Feedback(nu, base+int64(i), msg)
+		mtfail(t, err, "feedback, %v", err)
+	}
+	err = udb.Feedback(other, base+1, "elsewhere")
+	mtfail(t, err, "feedback, %v", err)
+
+	fb, err := udb.ListFeedback(nu.Guid, 0, 0, 0, 0)
+	mtfail(t, err, "list, %v", err)
+	if len(fb) != 3 || fb[0].Msg != "third" || fb[2].Msg != "first" || fb[0].Guid != nu.Guid {
+		t.Errorf("bad feedback list %#v", fb)
+	}
+	fb, err = udb.ListFeedback(nu.Guid, 0, 0, 1, 1)
+	mtfail(t, err, "list page, %v", err)
+	if len(fb) != 1 || fb[0].Msg != "second" {
+		t.Errorf("bad feedback page %#v", fb)
+	}
+	fb, err = udb.ListFeedback(nu.Guid, 0, 0, 2, 0)
+	mtfail(t, err, "list offset, %v", err)
+	if len(fb) != 1 || fb[0].Msg != "first" {
+		t.Errorf("bad feedback offset %#v", fb)
+	}
+	fb, err = udb.ListFeedback(0, base+1, base+2, 0, 0)
+	mtfail(t, err, "list time, %v", err)
+	if len(fb) != 2 {
+		t.Errorf("expected 2 feedback at %d, got %#v", base+1, fb)
+	}
+}
+
+func TestFeedbackHandler(t *testing.T) {
+	name := uniqueName("talker")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("talkative-password")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	rec := postJSON(&login.JSONLoginHandler{Udb: udb}, "/api/login", `{"username":"`+name+`","password":"talkative-password"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	fh := &login.FeedbackHandler{Udb: udb, MaxLength: 20, PerUser: 2, Window: time.Hour}
+	rec = postJSON(fh, "/api/feedback", `{"text":"hello"}`, nil)
+	if rec.Code != 401 {
+		t.Errorf("anonymous feedback: expected 401, got %d", rec.Code)
+	}
+	rec = postJSON(fh, "/api/feedback", `{"text":"  "}`, cookies)
+	if rec.Code != 400 || jsonErrorCode(rec) != "invalid_fields" {
+		t.Errorf("empty feedback: got %d %s", rec.Code, rec.Body.String())
+	}
+	rec = postJSON(fh, "/api/feedback", `{"text":"`+strings.Repeat("x", 21)+`"}`, cookies)
+	if rec.Code != 400 || jsonErrorCode(rec) != "invalid_fields" {
+		t.Errorf("long feedback: got %d %s", rec.Code, rec.Body.String())
+	}
+	for i := 0; i < 2; i++ {
+		rec = postJSON(fh, "/api/feedback", `{"text":"great site"}`, cookies)
+		if rec.Code != 200 {
+			t.Fatalf("feedback %d: got %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	rec = postJSON(fh, "/api/feedback", `{"text":"one more"}`, cookies)
+	if rec.Code != 429 || jsonErrorCode(rec) != "throttled" || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("feedback over limit: got %d %s", rec.Code, rec.Body.String())
+	}
+	fb, err := udb.ListFeedback(nu.Guid, 0, 0, 0, 0)
+	mtfail(t, err, "list, %v", err)
+	if len(fb) != 2 || fb[0].Msg != "great site" {
+		t.Errorf("bad stored feedback %#v", fb)
+	}
+}
@@ -3,8 +3,11 @@ module github.com/brianolson/login/test_sqlite
 go 1.16
 
 require (
+	github.com/brianolson/cbor_go v1.0.0
 	github.com/brianolson/login/login v0.0.0
 	github.com/mattn/go-sqlite3 v1.14.9
+	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	modernc.org/sqlite v1.11.2
 )
 
 replace github.com/brianolson/login/login => ../login
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestHooks(t *testing.T) {
+	// Hooks only on this UserDB, the other tests' udb has none.
+	// TestMain runs everything once per driver.
+	udb := ls.NewSqlUserDB(tdb)
+	login.LogoutUdb = udb
+	defer func() { login.LogoutUdb = nil }()
+	name := uniqueName("hooked")
+	blockedName := uniqueName("hookblocked")
+	email := name + "@example.com"
+	created := 0
+	logins := 0
+	failed := 0
+	var loggedOut int64
+	emails := 0
+	suspended := false
+	blocked := 0
+	udb.Hooks().OnUserCreatedTx(func(tx *sql.Tx, user *ls.User) error {
+		if user.Username == blockedName {
+			return errors.New("no thanks")
+		}
+		return nil
+	})
+	udb.Hooks().OnUserCreated(func(user *ls.User) {
+		if user.Username == blockedName {
+			blocked++
+		}
+		if user.Username != name {
+			return
+		}
+		// after commit, the user is readable on the UserDB
+		xu, err := udb.GetUser(user.Guid)
+		if err != nil || xu.Username != name {
+			t.Errorf("created hook could not read user, %v", err)
+		}
+		created++
+		// registering from inside a hook must not deadlock
+		udb.Hooks().OnEmailAdded(func(user *ls.User, added string) {
+			if added == email {
+				emails++
+			}
+		})
+	})
+	udb.Hooks().OnLogin(func(user *ls.User, method string) error {
+		if user.Username != name {
+			return nil
+		}
+		logins++
+		if suspended {
+			return errors.New("account suspended")
+		}
+		return nil
+	})
+	udb.Hooks().OnLoginFailed(func(guid int64, method, detail string, err error) {
+		if detail == name || errors.Is(err, login.ErrVetoed) {
+			failed++
+		}
+	})
+	udb.Hooks().OnLogout(func(guid int64) {
+		loggedOut = guid
+	})
+
+	nu := &ls.User{Username: blockedName}
+	_, err := udb.PutNewUser(nu)
+	if !errors.Is(err, login.ErrVetoed) {
+		t.Fatalf("expected veto, got %v", err)
+	}
+	ou, _ := udb.GetLocalUser(blockedName)
+	if ou != nil {
+		t.Fatal("vetoed user was created")
+	}
+	if blocked != 0 {
+		t.Error("created hook ran for vetoed user")
+	}
+
+	nu = &ls.User{Username: name}
+	err = nu.SetPassword("fishing")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	if created != 1 {
+		t.Errorf("expected 1 created, got %d", created)
+	}
+
+	err = udb.AddEmail(nu, ls.NewEmail(email))
+	mtfail(t, err, "add email, %v", err)
+	if emails != 1 {
+		t.Errorf("expected 1 email hook, got %d", emails)
+	}
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"wrong"}`, nil)
+	if rec.Code != 401 || failed != 1 {
+		t.Errorf("bad password: %d, %d failed hooks", rec.Code, failed)
+	}
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"fishing"}`, nil)
+	if rec.Code != 200 || logins != 1 {
+		t.Fatalf("login: %d, %d login hooks: %s", rec.Code, logins, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	req := httptest.NewRequest("GET", "/logout", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	login.LogoutHandler(rec, req)
+	if loggedOut != nu.Guid {
+		t.Errorf("logout hook got %d, wanted %d", loggedOut, nu.Guid)
+	}
+
+	suspended = true
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"fishing"}`, nil)
+	if rec.Code != 403 || jsonErrorCode(rec) != "vetoed" {
+		t.Errorf("expected 403 vetoed, got %d %s", rec.Code, rec.Body.String())
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "u" && c.MaxAge > 0 {
+			t.Error("vetoed login set cookie")
+		}
+	}
+	if failed != 2 {
+		t.Errorf("veto should count as failed login, got %d", failed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestMigrate(t *testing.T) {
+	version, err := ls.SchemaVersion(tdb)
+	mtfail(t, err, "schema version, %v", err)
+	if version < 2 {
+		t.Errorf("expected migrated schema, got version %d", version)
+	}
+	err = udb.Setup()
+	mtfail(t, err, "second Setup, %v", err)
+	again, err := ls.SchemaVersion(tdb)
+	mtfail(t, err, "schema version, %v", err)
+	if again != version {
+		t.Errorf("second Setup changed version %d -> %d", version, again)
+	}
+
+	// a database from newer code
+	_, err = tdb.Exec(`INSERT INTO schema_version (version, applied) VALUES ($1, 0)`, version+1)
+	mtfail(t, err, "insert version, %v", err)
+	err = udb.Setup()
+	if !errors.Is(err, ls.ErrSchemaTooNew) {
+		t.Errorf("expected ErrSchemaTooNew, got %v", err)
+	}
+	_, err = tdb.Exec(`DELETE FROM schema_version WHERE version = $1`, version+1)
+	mtfail(t, err, "delete version, %v", err)
+}
+
+func TestMigrateAdoptsOldSchema(t *testing.T) {
+	db, err := sql.Open(sqliteDriver, filepath.Join(t.TempDir(), "old.db"))
+	mtfail(t, err, "open, %v", err)
+	defer db.Close()
+	// as created by Setup() before migrations
+	for _, cmd := range []string{
+		`CREATE TABLE IF NOT EXISTS guser (username varchar(100), password BLOB, prefs BLOB)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS guser_name ON guser ( username )`,
+		`CREATE TABLE IF NOT EXISTS user_social (id bigint, socialkey bytea, socialdata bytea, PRIMARY KEY (id, socialkey))`,
+		`CREATE TABLE IF NOT EXISTS user_email (id bigint, email varchar(100), data bytea, PRIMARY KEY (id, email))`,
+		`INSERT INTO guser (username) VALUES ('oldtimer')`,
+		// addresses as given, before normalization
+		`INSERT INTO user_email (id, email) VALUES (1, 'Old@Example.com')`,
+		`INSERT INTO user_email (id, email) VALUES (1, 'Two@Example.com')`,
+		`INSERT INTO user_email (id, email) VALUES (1, 'two@example.com')`,
+		`INSERT INTO user_email (id, email) VALUES (1, 'THREE@example.com')`,
+		`INSERT INTO user_email (id, email) VALUES (1, 'Three@Example.com')`,
+	} {
+		_, err = db.Exec(cmd)
+		mtfail(t, err, "old schema %s, %v", cmd, err)
+	}
+	oldudb := ls.NewSqlUserDB(db)
+	err = oldudb.Setup()
+	mtfail(t, err, "migrate old db, %v", err)
+	version, err := ls.SchemaVersion(db)
+	mtfail(t, err, "schema version, %v", err)
+	expected, _ := ls.SchemaVersion(tdb)
+	if version != expected {
+		t.Errorf("old db at version %d, wanted %d", version, expected)
+	}
+	ou, err := oldudb.GetLocalUser("oldtimer")
+	mtfail(t, err, "old user, %v", err)
+	_, _, err = oldudb.CreateAPIKey(ou, "new table", nil)
+	mtfail(t, err, "new table on old db, %v", err)
+
+	var emails []string
+	for _, em := range ou.Email {
+		emails = append(emails, em.Email)
+	}
+	sort.Strings(emails)
+	if strings.Join(emails, " ") != "old@example.com three@example.com two@example.com" {
+		t.Errorf("old emails not lower cased: %v", emails)
+	}
+	eu, err := oldudb.GetEmailUser("OLD@example.com", false)
+	if err != nil || eu.Guid != ou.Guid {
+		t.Errorf("old email user %#v, %v", eu, err)
+	}
+	_, err = oldudb.PutNewUser(&ls.User{Username: "newcomer", Email: []ls.EmailRecord{ls.NewEmail("old@EXAMPLE.com")}})
+	if !errors.Is(err, ls.ErrEmailTaken) {
+		t.Errorf("expected ErrEmailTaken for old address, got %v", err)
+	}
+}
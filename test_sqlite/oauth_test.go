@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	oauth "golang.org/x/oauth2"
+
+	"github.com/brianolson/login/login"
+	"github.com/brianolson/login/login/crypto"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+// Stands in for the oauth token endpoint and the facebook graph API
+type fakeFacebook struct {
+	id string
+}
+
+func (ff *fakeFacebook) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body interface{}
+	if req.URL.Path == "/token" {
+		body = map[string]string{"access_token": "fbtoken", "token_type": "bearer"}
+	} else {
+		body = map[string]string{"id": ff.id, "name": "Face Book"}
+	}
+	bb, _ := json.Marshal(body)
+	return &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(string(bb))),
+		Request:    req,
+	}, nil
+}
+
+func facebookLogin(t *testing.T, cb *login.OauthCallbackHandler, ff *fakeFacebook) *httptest.ResponseRecorder {
+	start, err := url.Parse(cb.StartUrl())
+	mtfail(t, err, "start url, %v", err)
+	q := url.Values{"state": {start.Query().Get("state")}, "code": {"fbcode"}}
+	req := httptest.NewRequest("GET", "/login/facebook/callback?"+q.Encode(), nil)
+	ctx := context.WithValue(req.Context(), oauth.HTTPClient, &http.Client{Transport: ff})
+	rec := httptest.NewRecorder()
+	cb.ServeHTTP(rec, req.WithContext(ctx))
+	return rec
+}
+
+func TestSocialLoginSecondFactor(t *testing.T) {
+	configs := map[string]login.OauthConfig{"facebook": {
+		ClientID:    "app",
+		Endpoint:    oauth.Endpoint{AuthURL: "https://fb.example.com/auth", TokenURL: "https://fb.example.com/token"},
+		RedirectURL: "https://example.com/login/facebook/callback",
+	}}
+	mods, err := login.BuildOauthMods(configs, udb, "/home", "/error", "/login/2fa")
+	mtfail(t, err, "build oauth mods, %v", err)
+	cb := mods[0]
+	ff := &fakeFacebook{id: uniqueName("fb")}
+
+	// first login makes the user
+	rec := facebookLogin(t, cb, ff)
+	if rec.Code != 303 || rec.Header().Get("Location") != "/home" {
+		t.Fatalf("social login %d to %s", rec.Code, rec.Header().Get("Location"))
+	}
+	xu, err := udb.GetSocialUser("facebook", ff.id)
+	mtfail(t, err, "get social user, %v", err)
+
+	secret, _ := crypto.GenerateTOTPSecret()
+	sealed, err := crypto.SealSecret(secret)
+	mtfail(t, err, "seal, %v", err)
+	err = udb.PutTOTP(xu, &ls.TOTPRecord{Secret: sealed, Enabled: true})
+	mtfail(t, err, "put totp, %v", err)
+
+	rec = facebookLogin(t, cb, ff)
+	if rec.Code != 303 || rec.Header().Get("Location") != "/login/2fa" {
+		t.Fatalf("social login with totp %d to %s", rec.Code, rec.Header().Get("Location"))
+	}
+	var pending []*http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "u" && c.MaxAge >= 0 {
+			t.Error("got full login cookie without second factor")
+		}
+		if c.Name == "u2" {
+			pending = append(pending, c)
+		}
+	}
+	if len(pending) != 1 {
+		t.Fatal("no pending cookie")
+	}
+
+	sh := &login.SecondFactorHandler{Udb: udb}
+	rec = postJSON(sh, "/login/2fa", `{"code":"`+crypto.TOTPCode(secret, time.Now())+`"}`, pending)
+	if rec.Code != 200 {
+		t.Fatalf("second factor status %d: %s", rec.Code, rec.Body.String())
+	}
+}
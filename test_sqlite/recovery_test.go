@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	"github.com/brianolson/login/login/crypto"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	name := uniqueName("lostphone")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("whereisit")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	secret, _ := crypto.GenerateTOTPSecret()
+	sealed, err := crypto.SealSecret(secret)
+	mtfail(t, err, "seal, %v", err)
+	err = udb.PutTOTP(nu, &ls.TOTPRecord{Secret: sealed, Enabled: true})
+	mtfail(t, err, "put totp, %v", err)
+
+	codes, err := login.GenerateRecoveryCodes(udb, nu)
+	mtfail(t, err, "generate, %v", err)
+	if len(codes) != login.RecoveryCodeCount {
+		t.Fatalf("got %d codes", len(codes))
+	}
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"whereisit","totp":"`+codes[3]+`"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("recovery code login status %d: %s", rec.Code, rec.Body.String())
+	}
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"whereisit","totp":"`+codes[3]+`"}`, nil)
+	if rec.Code != 401 || jsonErrorCode(rec) != "bad_second_factor" {
+		t.Errorf("reused recovery code: %d %s", rec.Code, rec.Body.String())
+	}
+	n, err := login.RecoveryCodesRemaining(udb, nu)
+	mtfail(t, err, "remaining, %v", err)
+	if n != login.RecoveryCodeCount-1 {
+		t.Errorf("expected %d remaining, got %d", login.RecoveryCodeCount-1, n)
+	}
+
+	// regenerate through the handler, old codes stop working
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"whereisit","totp":"`+codes[4]+`"}`, nil)
+	cookies := rec.Result().Cookies()
+	rh := &login.RecoveryCodesHandler{Udb: udb}
+	// the login cookie alone is not enough, nor is a used code
+	for _, body := range []string{`{}`, `{"code":"` + codes[3] + `"}`} {
+		rec = postJSON(rh, "/recovery", body, cookies)
+		if rec.Code != 401 || jsonErrorCode(rec) != "bad_second_factor" {
+			t.Errorf("regenerate with %s: %d %s", body, rec.Code, rec.Body.String())
+		}
+	}
+	n, err = login.RecoveryCodesRemaining(udb, nu)
+	mtfail(t, err, "remaining, %v", err)
+	if n != login.RecoveryCodeCount-2 {
+		t.Errorf("rejected regenerate changed codes, %d remaining", n)
+	}
+	rec = postJSON(rh, "/recovery", `{"code":"`+codes[6]+`"}`, cookies)
+	if rec.Code != 200 {
+		t.Fatalf("regenerate status %d: %s", rec.Code, rec.Body.String())
+	}
+	sh := &login.SecondFactorHandler{Udb: udb}
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"whereisit"}`, nil)
+	pending := []*http.Cookie{}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "u2" {
+			pending = append(pending, c)
+		}
+	}
+	rec = postJSON(sh, "/login/2fa", `{"code":"`+codes[5]+`"}`, pending)
+	if rec.Code != 401 {
+		t.Errorf("old recovery code after regenerate: %d %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestRegisterJSON(t *testing.T) {
+	rh := &login.RegisterHandler{Udb: udb, HomePath: "/"}
+
+	name := uniqueName("reggie")
+	body := `{"username":"` + name + `","password":"hunter22","email":"` + name + `@example.com"}`
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	rh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("register status %d: %s", rec.Code, rec.Body.String())
+	}
+	gotCookie := false
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "u" && c.Value != "" {
+			gotCookie = true
+		}
+	}
+	if !gotCookie {
+		t.Error("no login cookie after register")
+	}
+	xu, err := udb.GetLocalUser(name)
+	mtfail(t, err, "get registered user, %v", err)
+	if !xu.GoodPassword("hunter22") {
+		t.Error("registered password doesn't check")
+	}
+	if !xu.HasEmail(name + "@example.com") {
+		t.Error("registered email missing")
+	}
+
+	// again, should collide
+	req = httptest.NewRequest("POST", "/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec = httptest.NewRecorder()
+	rh.ServeHTTP(rec, req)
+	if rec.Code != 400 {
+		t.Fatalf("duplicate register status %d: %s", rec.Code, rec.Body.String())
+	}
+	var je login.JSONError
+	err = json.Unmarshal(rec.Body.Bytes(), &je)
+	mtfail(t, err, "bad json error, %v", err)
+	if je.Fields["username"] == "" {
+		t.Errorf("expected username field error, got %#v", je)
+	}
+}
+
+func TestRegisterForm(t *testing.T) {
+	policy := login.DefaultRegistrationPolicy
+	policy.RequireEmail = true
+	var formErrs login.FieldErrors
+	rh := &login.RegisterHandler{
+		Udb:      udb,
+		Policy:   &policy,
+		HomePath: "/home",
+		FormError: func(out http.ResponseWriter, request *http.Request, errs login.FieldErrors) {
+			formErrs = errs
+			out.WriteHeader(400)
+		},
+	}
+	name := uniqueName("formy")
+
+	form := url.Values{"username": {name}, "password": {"short"}}
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	rh.ServeHTTP(rec, req)
+	if formErrs["password"] == "" || formErrs["email"] == "" {
+		t.Errorf("expected password and email errors, got %#v", formErrs)
+	}
+
+	form = url.Values{"username": {name}, "password": {"long enough"}, "email": {name + "@example.com"}}
+	req = httptest.NewRequest("POST", "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	rh.ServeHTTP(rec, req)
+	if rec.Code != 303 || rec.Header().Get("Location") != "/home" {
+		t.Errorf("expected redirect home, got %d %v", rec.Code, rec.Header())
+	}
+}
+
+// A vetoed or disabled new user isn't logged in, as for JSONLoginHandler
+func TestRegisterVetoed(t *testing.T) {
+	udb := ls.NewSqlUserDB(tdb)
+	udb.Hooks().OnLogin(func(user *ls.User, method string) error {
+		if method == "register" {
+			return errors.New("invite only")
+		}
+		return nil
+	})
+	rh := &login.RegisterHandler{Udb: udb, HomePath: "/home"}
+	name := uniqueName("uninvited")
+	rec := postJSON(rh, "/register", `{"username":"`+name+`","password":"long enough"}`, nil)
+	if rec.Code != 403 || jsonErrorCode(rec) != "vetoed" {
+		t.Errorf("expected 403 vetoed, got %d %s", rec.Code, rec.Body.String())
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "u" && c.MaxAge >= 0 {
+			t.Error("vetoed registration set cookie")
+		}
+	}
+
+	form := url.Values{"username": {uniqueName("uninvited-form")}, "password": {"long enough"}}
+	req := httptest.NewRequest("POST", "/register", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	rh.ServeHTTP(rec, req)
+	if rec.Code != 403 {
+		t.Errorf("expected form 403, got %d %v", rec.Code, rec.Header())
+	}
+}
@@ -1,53 +1,83 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
+	_ "modernc.org/sqlite"
 
 	ls "github.com/brianolson/login/login/sql"
 	tu "github.com/brianolson/login/login/sql/testutil"
 )
 
-// go get github.com/mattn/go-sqlite3
+// go get github.com/mattn/go-sqlite3 modernc.org/sqlite
 
 var tdb *sql.DB
 var udb ls.UserDB
 var tdbLock sync.Mutex
 
+// driver of the current run, tests run once with each
+var sqliteDriver string
+
 var mtfail = tu.Mtfail
 var userDeepEqual = tu.UserDeepEqual
 
-func TestMain(m *testing.M) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	maybefail(err, "error opening test sqlite3 :memory: db, %v", err)
-
-	udb = ls.NewSqlUserDB(db)
-
-	err = udb.Setup()
-	maybefail(err, "error creating tables, %v", err)
+var nameSeq int64
 
-	tdb = db
+// Distinct on every call. Tests rerun by -count share the db, so new
+// users need names that don't collide with the last run's.
+func uniqueName(base string) string {
+	return fmt.Sprintf("%s-%s-%d", base, sqliteDriver, atomic.AddInt64(&nameSeq, 1))
+}
 
-	result := m.Run()
+func TestMain(m *testing.M) {
+	result := 0
+	// mattn/go-sqlite3 (CGo) and modernc.org/sqlite (pure Go)
+	for _, driver := range []string{"sqlite3", "sqlite"} {
+		sqliteDriver = driver
+		db, err := sql.Open(driver, ":memory:")
+		maybefail(err, "error opening test %s :memory: db, %v", driver, err)
+		// another connection would be another, empty, database
+		db.SetMaxOpenConns(1)
+
+		udb = ls.NewSqlUserDB(db)
+
+		err = udb.Setup()
+		maybefail(err, "error creating tables, %v", err)
+
+		tdb = db
+
+		code := m.Run()
+		if code != 0 {
+			result = code
+		}
+		db.Close()
+	}
 	os.Exit(result)
 }
 
 func TestBasicUser(t *testing.T) {
+	name := uniqueName("wat")
 	newUser := ls.User{
-		Username: "wat",
+		Username: name,
 
 		Social: []ls.UserSocial{
-			ls.UserSocial{Service: "z", Id: "alice"},
-			ls.UserSocial{Service: "y", Id: "artemis"},
+			ls.UserSocial{Service: "z", Id: name},
+			ls.UserSocial{Service: "y", Id: name},
 		},
 
 		Email: []ls.EmailRecord{
-			ls.EmailRecord{Email: "z@z.z", EmailMetadata: ls.EmailMetadata{Validated: true, Added: 31337}},
-			ls.EmailRecord{Email: "y@y.y", EmailMetadata: ls.EmailMetadata{Validated: false, Added: 12345}},
+			ls.EmailRecord{Email: name + "@z.z", EmailMetadata: ls.EmailMetadata{Validated: true, Added: 31337}},
+			ls.EmailRecord{Email: name + "@y.y", EmailMetadata: ls.EmailMetadata{Validated: false, Added: 12345}},
 		},
 	}
 	err := newUser.SetPassword("derp")
@@ -55,7 +85,9 @@ func TestBasicUser(t *testing.T) {
 	tdbLock.Lock()
 	defer tdbLock.Unlock()
 	xu, err := udb.PutNewUser(&newUser)
-	mtfail(t, err, "put user, %v", err)
+	if err != nil {
+		t.Fatalf("put user, %v", err)
+	}
 	if xu.Guid == 0 {
 		t.Error("xu.Guid zero")
 	}
@@ -64,13 +96,101 @@ func TestBasicUser(t *testing.T) {
 	err = userDeepEqual(newUser, *tu)
 	mtfail(t, err, "get user guid neq, %v", err)
 
-	tu, err = udb.GetLocalUser("wat")
-	mtfail(t, err, "get user name=%s, %v", "wat", err)
+	tu, err = udb.GetLocalUser(name)
+	mtfail(t, err, "get user name=%s, %v", name, err)
 	err = userDeepEqual(newUser, *tu)
-	mtfail(t, err, "get user wat neq, %v", err)
+	mtfail(t, err, "get user %s neq, %v", name, err)
 
-	tu, err = udb.GetSocialUser("z", "alice")
-	mtfail(t, err, "get user z:alice, %v", err)
+	tu, err = udb.GetSocialUser("z", name)
+	mtfail(t, err, "get user z:%s, %v", name, err)
 	err = userDeepEqual(newUser, *tu)
-	mtfail(t, err, "get user z:alice neq, %v", err)
+	mtfail(t, err, "get user z:%s neq, %v", name, err)
+}
+
+func TestDialect(t *testing.T) {
+	if name := ls.DetectDialect(tdb).Name(); name != "sqlite3" {
+		t.Errorf("%s detected as %s", sqliteDriver, name)
+	}
+	// guser id is ROWID here, not id
+	nu := &ls.User{Username: uniqueName("updater")}
+	_, err := udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	nu.DisplayName = "Up Dater"
+	err = udb.SetUserPrefs(nu)
+	mtfail(t, err, "set prefs, %v", err)
+	err = nu.SetPassword("updated")
+	mtfail(t, err, "set password, %v", err)
+	err = udb.SetUserPassword(nu)
+	mtfail(t, err, "set user password, %v", err)
+	xu, err := udb.GetUser(nu.Guid)
+	mtfail(t, err, "get user, %v", err)
+	if xu.DisplayName != "Up Dater" || !xu.GoodPassword("updated") {
+		t.Errorf("updates not stored %#v", xu)
+	}
+
+	name := uniqueName("dialect")
+	su := &ls.User{Social: []ls.UserSocial{{Service: "x", Id: name}}}
+	_, err = udb.PutNewUser(su)
+	mtfail(t, err, "put social user, %v", err)
+	err = udb.SetLogin(su, name, "")
+	mtfail(t, err, "set login, %v", err)
+	xu, err = udb.GetLocalUser(name)
+	mtfail(t, err, "get local user, %v", err)
+	if xu == nil || xu.Guid != su.Guid {
+		t.Errorf("set login not stored %#v", xu)
+	}
+}
+
+// Opens each connection to name with a busy timeout, so writers wait
+// for each other instead of failing with SQLITE_BUSY. Neither driver
+// takes that in the DSN the same way.
+type busyConnector struct {
+	drv  driver.Driver
+	name string
+}
+
+func (bc *busyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := bc.drv.Open(bc.name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.(driver.ExecerContext).ExecContext(ctx, `PRAGMA busy_timeout = 10000`, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (bc *busyConnector) Driver() driver.Driver {
+	return bc.drv
+}
+
+// A new database for a conformance subtest. :memory: is one connection,
+// since each would be a new database. The Concurrent subtests get a WAL
+// file with a pool of connections, so they really race.
+func conformanceDB(t *testing.T) *sql.DB {
+	db, err := sql.Open(sqliteDriver, ":memory:")
+	mtfail(t, err, "error opening %s :memory: db, %v", sqliteDriver, err)
+	if !strings.Contains(t.Name(), "/Concurrent") {
+		db.SetMaxOpenConns(1)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	drv := db.Driver()
+	db.Close()
+	db = sql.OpenDB(&busyConnector{drv, filepath.Join(t.TempDir(), "race.db")})
+	t.Cleanup(func() { db.Close() })
+	_, err = db.Exec(`PRAGMA journal_mode = WAL`)
+	mtfail(t, err, "wal, %v", err)
+	return db
+}
+
+func TestConformance(t *testing.T) {
+	tu.RunUserDBConformance(t, func(t *testing.T) ls.UserDB {
+		cdb := ls.NewSqlUserDB(conformanceDB(t))
+		err := cdb.Setup()
+		mtfail(t, err, "error creating tables, %v", err)
+		return cdb
+	})
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	name := uniqueName("hammer")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("rightpassword")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	th := login.NewThrottle(ls.NewSqlThrottleStore(tdb))
+	th.User = login.ThrottleLimits{FreeFailures: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, LockoutFailures: 4}
+	// httptest's client address, failures from earlier runs are still stored
+	err = th.Store.Reset("ip:192.0.2.1")
+	mtfail(t, err, "store reset, %v", err)
+	login.LoginThrottle = th
+	defer func() { login.LoginThrottle = nil }()
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	for i := 0; i < 2; i++ {
+		rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"wrong"}`, nil)
+		if rec.Code != 401 {
+			t.Fatalf("free failure %d: expected 401, got %d %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	// even the right password has to wait now
+	rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"rightpassword"}`, nil)
+	if rec.Code != 429 || jsonErrorCode(rec) != "throttled" {
+		t.Fatalf("expected 429 throttled, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("missing Retry-After")
+	}
+	var je login.JSONError
+	json.Unmarshal(rec.Body.Bytes(), &je)
+	if je.RetryAfter <= 0 || je.RetryAfter > 120 {
+		t.Errorf("unexpected retry_after %d", je.RetryAfter)
+	}
+
+	// a different user from the same client is still allowed
+	rec = postJSON(lh, "/api/login", `{"username":"`+uniqueName("nobody")+`","password":"wrong"}`, nil)
+	if rec.Code != 401 {
+		t.Errorf("other user: expected 401, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// lockout
+	store := th.Store
+	for i := 0; i < 2; i++ {
+		_, err = store.Fail("u:"+name, time.Now().Unix(), 0)
+		mtfail(t, err, "store fail, %v", err)
+	}
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"rightpassword"}`, nil)
+	if rec.Code != 429 || jsonErrorCode(rec) != "locked" {
+		t.Fatalf("expected 429 locked, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// success clears the user's counter
+	err = store.Reset("u:" + name)
+	mtfail(t, err, "store reset, %v", err)
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"wrong"}`, nil)
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"rightpassword"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("login after reset: %d %s", rec.Code, rec.Body.String())
+	}
+	failures, _, err := store.Get("u:" + name)
+	mtfail(t, err, "store get, %v", err)
+	if failures != 0 {
+		t.Errorf("expected failures reset after login, got %d", failures)
+	}
+}
+
+// Concurrent guesses can't all get in before any is counted
+func TestLoginThrottleConcurrent(t *testing.T) {
+	name := uniqueName("rush")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("rightpassword")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	th := login.NewThrottle(ls.NewSqlThrottleStore(tdb))
+	th.User = login.ThrottleLimits{FreeFailures: 2, BaseDelay: time.Minute, MaxDelay: time.Hour}
+	th.IP = login.ThrottleLimits{FreeFailures: 1000, BaseDelay: time.Second, MaxDelay: time.Second}
+	login.LoginThrottle = th
+	defer func() { login.LoginThrottle = nil }()
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	const tries = 10
+	codes := make([]int, tries)
+	var wg sync.WaitGroup
+	for i := 0; i < tries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"wrong"}`, nil).Code
+		}(i)
+	}
+	wg.Wait()
+	checked := 0
+	for _, code := range codes {
+		switch code {
+		case 401:
+			checked++
+		case 429:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if checked > 2 {
+		t.Errorf("%d of %d concurrent guesses checked, wanted at most 2", checked, tries)
+	}
+	failures, _, err := th.Store.Get("u:" + name)
+	mtfail(t, err, "store get, %v", err)
+	if failures != checked {
+		t.Errorf("%d failures counted for %d checked guesses", failures, checked)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestBearerToken(t *testing.T) {
+	name := uniqueName("tokey")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("tokentoken")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	th := &login.TokenHandler{Udb: udb}
+	req := httptest.NewRequest("POST", "/api/token", strings.NewReader(`{"username":"`+name+`","password":"tokentoken"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	th.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("token status %d: %s", rec.Code, rec.Body.String())
+	}
+	var tr login.TokenResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &tr)
+	mtfail(t, err, "token json, %v", err)
+	if tr.AccessToken == "" || tr.Guid != nu.Guid {
+		t.Fatalf("bad token response %#v", tr)
+	}
+
+	req = httptest.NewRequest("GET", "/stuff", nil)
+	req.Header.Set("Authorization", "Bearer "+tr.AccessToken)
+	rec = httptest.NewRecorder()
+	xu, err := login.GetHttpUser(rec, req, udb)
+	mtfail(t, err, "bearer GetHttpUser, %v", err)
+	if xu == nil || xu.Guid != nu.Guid {
+		t.Errorf("bearer token got user %#v", xu)
+	}
+
+	req = httptest.NewRequest("GET", "/stuff", nil)
+	req.Header.Set("Authorization", "Bearer "+tr.AccessToken+"x")
+	rec = httptest.NewRecorder()
+	xu, _ = login.GetHttpUser(rec, req, udb)
+	if xu != nil {
+		t.Errorf("bad bearer token got user %#v", xu)
+	}
+}
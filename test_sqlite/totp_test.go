@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+	"github.com/brianolson/login/login/crypto"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func postJSON(h http.Handler, path, body string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func jsonErrorCode(rec *httptest.ResponseRecorder) string {
+	var je login.JSONError
+	json.Unmarshal(rec.Body.Bytes(), &je)
+	return je.Code
+}
+
+func TestTOTPLogin(t *testing.T) {
+	name := uniqueName("totty")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("secondfactor")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"secondfactor"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	eh := &login.TOTPEnrollHandler{Udb: udb, Issuer: "Test"}
+	rec = postJSON(eh, "/totp", `{"action":"begin"}`, cookies)
+	if rec.Code != 200 {
+		t.Fatalf("totp begin status %d: %s", rec.Code, rec.Body.String())
+	}
+	var er login.TOTPEnrollResponse
+	json.Unmarshal(rec.Body.Bytes(), &er)
+	if !strings.HasPrefix(er.URI, "otpauth://totp/Test:"+name+"?") {
+		t.Errorf("bad otpauth uri %s", er.URI)
+	}
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(er.Secret)
+	mtfail(t, err, "bad secret, %v", err)
+
+	now := time.Now()
+	rec = postJSON(eh, "/totp", `{"action":"confirm","code":"`+crypto.TOTPCode(secret, now)+`"}`, cookies)
+	if rec.Code != 200 {
+		t.Fatalf("totp confirm status %d: %s", rec.Code, rec.Body.String())
+	}
+	var cr login.TOTPConfirmResponse
+	json.Unmarshal(rec.Body.Bytes(), &cr)
+	if len(cr.RecoveryCodes) != login.RecoveryCodeCount {
+		t.Errorf("expected recovery codes at enrollment, got %#v", cr)
+	}
+
+	// password alone is no longer enough
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"secondfactor"}`, nil)
+	if rec.Code != 401 || jsonErrorCode(rec) != "second_factor_required" {
+		t.Fatalf("expected second_factor_required, got %d %s", rec.Code, rec.Body.String())
+	}
+	var pending []*http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "u" {
+			t.Error("got full login cookie without second factor")
+		}
+		if c.Name == "u2" {
+			pending = append(pending, c)
+		}
+	}
+	if len(pending) != 1 {
+		t.Fatal("no pending cookie")
+	}
+	// pending cookie is not a login
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "u", Value: pending[0].Value})
+	xu, _ := login.GetHttpUser(httptest.NewRecorder(), req, udb)
+	if xu != nil {
+		t.Error("pending token accepted as login")
+	}
+	// nor is it with the MAC stripped off
+	body := strings.SplitN(pending[0].Value, ".", 2)[0]
+	rec = postJSON(eh, "/totp", `{"action":"begin"}`, []*http.Cookie{{Name: "u", Value: body}})
+	if rec.Code != 401 {
+		t.Errorf("pending token body accepted as login, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	sh := &login.SecondFactorHandler{Udb: udb}
+	code := crypto.TOTPCode(secret, now.Add(crypto.TOTPPeriod*time.Second))
+	rec = postJSON(sh, "/login/2fa", `{"code":"`+code+`"}`, pending)
+	if rec.Code != 200 {
+		t.Fatalf("second factor status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// same code again is a replay
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"secondfactor","totp":"`+code+`"}`, nil)
+	if rec.Code != 401 || jsonErrorCode(rec) != "bad_second_factor" {
+		t.Errorf("expected replay rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+}
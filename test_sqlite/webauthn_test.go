@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cbor "github.com/brianolson/cbor_go"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+const testRPID = "example.com"
+const testOrigin = "https://example.com"
+
+var b64u = base64.RawURLEncoding
+
+// Minimal software authenticator, ES256, no attestation
+type softAuthenticator struct {
+	key       *ecdsa.PrivateKey
+	credID    []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credID := make([]byte, 16)
+	rand.Read(credID)
+	return &softAuthenticator{key: key, credID: credID}
+}
+
+func (sa *softAuthenticator) authData(flags byte, attested bool) []byte {
+	rpHash := sha256.Sum256([]byte(testRPID))
+	ad := append([]byte{}, rpHash[:]...)
+	if attested {
+		flags |= 0x40
+	}
+	ad = append(ad, flags)
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], sa.signCount)
+	ad = append(ad, count[:]...)
+	if attested {
+		ad = append(ad, make([]byte, 16)...) // aaguid
+		var idlen [2]byte
+		binary.BigEndian.PutUint16(idlen[:], uint16(len(sa.credID)))
+		ad = append(ad, idlen[:]...)
+		ad = append(ad, sa.credID...)
+		x := make([]byte, 32)
+		y := make([]byte, 32)
+		sa.key.X.FillBytes(x)
+		sa.key.Y.FillBytes(y)
+		cose, _ := cbor.Dumps(map[int64]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: y})
+		ad = append(ad, cose...)
+	}
+	return ad
+}
+
+func clientDataJSON(ceremony, challenge string) []byte {
+	cd, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	return cd
+}
+
+func (sa *softAuthenticator) create(challenge string) map[string]interface{} {
+	ao, _ := cbor.Dumps(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": sa.authData(0x05, true),
+	})
+	return map[string]interface{}{
+		"id":    b64u.EncodeToString(sa.credID),
+		"rawId": b64u.EncodeToString(sa.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64u.EncodeToString(clientDataJSON("webauthn.create", challenge)),
+			"attestationObject": b64u.EncodeToString(ao),
+		},
+	}
+}
+
+func (sa *softAuthenticator) get(challenge string, flags byte) map[string]interface{} {
+	sa.signCount++
+	ad := sa.authData(flags, false)
+	cdj := clientDataJSON("webauthn.get", challenge)
+	cdhash := sha256.Sum256(cdj)
+	h := sha256.Sum256(append(append([]byte{}, ad...), cdhash[:]...))
+	sig, _ := ecdsa.SignASN1(rand.Reader, sa.key, h[:])
+	return map[string]interface{}{
+		"id":    b64u.EncodeToString(sa.credID),
+		"rawId": b64u.EncodeToString(sa.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64u.EncodeToString(cdj),
+			"authenticatorData": b64u.EncodeToString(ad),
+			"signature":         b64u.EncodeToString(sig),
+		},
+	}
+}
+
+func webauthnPost(t *testing.T, h http.Handler, body map[string]interface{}, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	bb, _ := json.Marshal(body)
+	return postJSON(h, "/webauthn", string(bb), cookies)
+}
+
+func beginChallenge(t *testing.T, rec *httptest.ResponseRecorder) string {
+	var opts struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &opts)
+	if rec.Code != 200 || opts.PublicKey.Challenge == "" {
+		t.Fatalf("begin status %d: %s", rec.Code, rec.Body.String())
+	}
+	return opts.PublicKey.Challenge
+}
+
+func TestWebAuthn(t *testing.T) {
+	name := uniqueName("passkey")
+	nu := &ls.User{Username: name}
+	err := nu.SetPassword("notreallyused")
+	mtfail(t, err, "set password, %v", err)
+	_, err = udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+
+	lh := &login.JSONLoginHandler{Udb: udb}
+	rec := postJSON(lh, "/api/login", `{"username":"`+name+`","password":"notreallyused"}`, nil)
+	if rec.Code != 200 {
+		t.Fatalf("login status %d: %s", rec.Code, rec.Body.String())
+	}
+	cookies := rec.Result().Cookies()
+
+	wh := &login.WebAuthnHandler{Udb: udb, RPID: testRPID, RPName: "Test", Origin: testOrigin}
+	sa := newSoftAuthenticator(t)
+
+	challenge := beginChallenge(t, webauthnPost(t, wh, map[string]interface{}{"action": "register_begin"}, cookies))
+	// the challenge names the user but is not a login
+	raw, err := b64u.DecodeString(challenge)
+	mtfail(t, err, "challenge not base64url, %v", err)
+	for _, v := range strings.SplitN(string(raw), ".", 2) {
+		eh := &login.TOTPEnrollHandler{Udb: udb, Issuer: "Test"}
+		rec = postJSON(eh, "/totp", `{"action":"begin"}`, []*http.Cookie{{Name: "u", Value: v}})
+		if rec.Code != 401 {
+			t.Errorf("challenge %q accepted as login, got %d %s", v, rec.Code, rec.Body.String())
+		}
+	}
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "register_finish", "name": "soft", "credential": sa.create(challenge)}, cookies)
+	if rec.Code != 200 {
+		t.Fatalf("register finish status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// password now needs the passkey as second factor
+	rec = postJSON(lh, "/api/login", `{"username":"`+name+`","password":"notreallyused"}`, nil)
+	if rec.Code != 401 || jsonErrorCode(rec) != "second_factor_required" {
+		t.Fatalf("expected second_factor_required, got %d %s", rec.Code, rec.Body.String())
+	}
+	pending := rec.Result().Cookies()
+	challenge = beginChallenge(t, webauthnPost(t, wh, map[string]interface{}{"action": "login_begin"}, pending))
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "login_finish", "credential": sa.get(challenge, 0x01)}, pending)
+	if rec.Code != 200 {
+		t.Fatalf("second factor login status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// passwordless, needs user verification
+	challenge = beginChallenge(t, webauthnPost(t, wh, map[string]interface{}{"action": "login_begin"}, nil))
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "login_finish", "credential": sa.get(challenge, 0x01)}, nil)
+	if rec.Code != 401 {
+		t.Errorf("passwordless without UV expected 401, got %d", rec.Code)
+	}
+	// that used up the challenge
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "login_finish", "credential": sa.get(challenge, 0x05)}, nil)
+	if rec.Code != 401 {
+		t.Errorf("reused challenge expected 401, got %d", rec.Code)
+	}
+	challenge = beginChallenge(t, webauthnPost(t, wh, map[string]interface{}{"action": "login_begin"}, nil))
+	assertion := sa.get(challenge, 0x05)
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "login_finish", "credential": assertion}, nil)
+	if rec.Code != 200 {
+		t.Fatalf("passwordless login status %d: %s", rec.Code, rec.Body.String())
+	}
+	var ui login.UserInfo
+	json.Unmarshal(rec.Body.Bytes(), &ui)
+	if ui.Guid != nu.Guid {
+		t.Errorf("passwordless logged in as %d, wanted %d", ui.Guid, nu.Guid)
+	}
+
+	// replayed assertion has a used challenge
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "login_finish", "credential": assertion}, nil)
+	if rec.Code != 401 {
+		t.Errorf("replay expected 401, got %d", rec.Code)
+	}
+	// a fresh challenge signed with a stale sign count, as by a clone
+	sa.signCount--
+	challenge = beginChallenge(t, webauthnPost(t, wh, map[string]interface{}{"action": "login_begin"}, nil))
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "login_finish", "credential": sa.get(challenge, 0x05)}, nil)
+	if rec.Code != 401 || !strings.Contains(rec.Body.String(), "counter") {
+		t.Errorf("stale sign count expected 401, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "list"}, cookies)
+	var infos []login.WebAuthnCredentialInfo
+	json.Unmarshal(rec.Body.Bytes(), &infos)
+	if len(infos) != 1 || infos[0].Name != "soft" || infos[0].LastUsed == 0 {
+		t.Fatalf("bad list %d %s", rec.Code, rec.Body.String())
+	}
+	rec = webauthnPost(t, wh, map[string]interface{}{"action": "remove", "id": infos[0].Id}, cookies)
+	if rec.Code != 200 {
+		t.Errorf("remove status %d", rec.Code)
+	}
+	creds, err := udb.ListWebAuthnCredentials(nu)
+	mtfail(t, err, "list creds, %v", err)
+	if len(creds) != 0 {
+		t.Errorf("credential not removed")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brianolson/login/login"
+	ls "github.com/brianolson/login/login/sql"
+)
+
+func TestWebhooks(t *testing.T) {
+	name := uniqueName("hooky")
+	secret := []byte("shh")
+	var l sync.Mutex
+	var got []login.WebhookEvent
+	status := 500
+	rx := httptest.NewServer(http.HandlerFunc(func(out http.ResponseWriter, request *http.Request) {
+		body, _ := ioutil.ReadAll(request.Body)
+		err := login.VerifyWebhookSignature(secret, request.Header.Get("X-Login-Signature"), body, time.Minute)
+		if err != nil {
+			t.Errorf("webhook signature: %v", err)
+		}
+		l.Lock()
+		defer l.Unlock()
+		if status == 200 {
+			var ev login.WebhookEvent
+			json.Unmarshal(body, &ev)
+			got = append(got, ev)
+		}
+		out.WriteHeader(status)
+	}))
+	defer rx.Close()
+
+	outbox := ls.NewSqlWebhookOutbox(tdb)
+	wd := login.NewWebhookDispatcher(outbox, []login.WebhookEndpoint{{URL: rx.URL, Secret: secret}})
+	wd.BaseDelay = 0
+	wd.MaxAttempts = 3
+	// hooks only on this UserDB, not the other tests' udb
+	udb := ls.NewSqlUserDB(tdb)
+	wd.RegisterHooks(udb.Hooks())
+	wd.RegisterHooks(udb.Hooks()) // no duplicate events
+
+	nu := &ls.User{Username: name}
+	_, err := udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	err = udb.AddEmail(nu, ls.NewEmail(name+"@example.com"))
+	mtfail(t, err, "add email, %v", err)
+
+	// receiver failing, retry is scheduled
+	n, err := wd.DeliverDue()
+	mtfail(t, err, "deliver, %v", err)
+	if n != 0 {
+		t.Errorf("expected 0 delivered while failing, got %d", n)
+	}
+
+	l.Lock()
+	status = 200
+	l.Unlock()
+	n, err = wd.DeliverDue()
+	mtfail(t, err, "deliver, %v", err)
+	if n != 2 {
+		t.Fatalf("expected 2 delivered, got %d", n)
+	}
+	if got[0].Type != login.WebhookUserCreated || got[0].User == nil || got[0].User.Username != name {
+		t.Errorf("bad user event %#v", got[0])
+	}
+	if got[1].Type != login.WebhookEmailAdded || got[1].Email != name+"@example.com" || got[1].Guid != nu.Guid {
+		t.Errorf("bad email event %#v", got[1])
+	}
+	n, err = wd.DeliverDue()
+	mtfail(t, err, "deliver, %v", err)
+	if n != 0 {
+		t.Errorf("delivered rows should be gone, got %d more", n)
+	}
+
+	err = udb.DelEmail(nu, name+"@example.com")
+	mtfail(t, err, "del email, %v", err)
+	err = udb.DeleteUser(nu)
+	mtfail(t, err, "delete user, %v", err)
+	n, err = wd.DeliverDue()
+	mtfail(t, err, "deliver, %v", err)
+	if n != 2 || got[2].Type != login.WebhookEmailDeleted || got[3].Type != login.WebhookUserDeleted || got[3].Guid != nu.Guid {
+		t.Errorf("expected email.deleted, user.deleted, got %d %#v", n, got[2:])
+	}
+
+	// give up after MaxAttempts
+	l.Lock()
+	status = 503
+	l.Unlock()
+	err = wd.Send(&login.WebhookEvent{Type: "test.event", Guid: nu.Guid})
+	mtfail(t, err, "send, %v", err)
+	for i := 0; i < 4; i++ {
+		_, err = wd.DeliverDue()
+		mtfail(t, err, "deliver, %v", err)
+	}
+	all, err := outbox.Dead(10)
+	mtfail(t, err, "dead, %v", err)
+	// earlier runs' receivers are dead too
+	var dead []ls.WebhookDelivery
+	for _, d := range all {
+		if d.URL == rx.URL {
+			dead = append(dead, d)
+		}
+	}
+	if len(dead) != 1 || dead[0].Attempts != 3 || dead[0].LastError != "webhook status 503" {
+		t.Errorf("expected one dead delivery, got %#v", dead)
+	}
+
+	if login.VerifyWebhookSignature(secret, login.SignWebhook([]byte("other"), time.Now().Unix(), []byte("{}")), []byte("{}"), time.Minute) == nil {
+		t.Error("wrong secret verified")
+	}
+}
+
+// A failed enqueue rolls back the change with it
+func TestWebhookEnqueueRollback(t *testing.T) {
+	udb := ls.NewSqlUserDB(tdb)
+	name := uniqueName("unhooky")
+	nu := &ls.User{Username: name}
+	_, err := udb.PutNewUser(nu)
+	mtfail(t, err, "put user, %v", err)
+	udb.Hooks().OnEmailAddedTx(func(tx *sql.Tx, user *ls.User, email string) error {
+		return errors.New("outbox down")
+	})
+	udb.Hooks().OnUserDeletedTx(func(tx *sql.Tx, user *ls.User) error {
+		return errors.New("outbox down")
+	})
+	err = udb.AddEmail(nu, ls.NewEmail(name+"@example.com"))
+	if !errors.Is(err, ls.ErrVetoed) {
+		t.Errorf("expected veto, got %v", err)
+	}
+	xu, err := udb.GetUser(nu.Guid)
+	mtfail(t, err, "get user, %v", err)
+	if len(xu.Email) != 0 {
+		t.Errorf("email added despite failed hook: %#v", xu.Email)
+	}
+	err = udb.DeleteUser(nu)
+	if !errors.Is(err, ls.ErrVetoed) {
+		t.Errorf("expected veto, got %v", err)
+	}
+	_, err = udb.GetUser(nu.Guid)
+	mtfail(t, err, "user deleted despite failed hook, %v", err)
+}